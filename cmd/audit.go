@@ -0,0 +1,84 @@
+// Copyright © 2018 Optum
+
+package cmd
+
+import (
+	"context"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/audit"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+var (
+	auditCmd       *cobra.Command
+	auditVerifyCmd *cobra.Command
+)
+
+func initAudit() {
+	auditCmd = &cobra.Command{
+		Use:   "audit",
+		Short: "Manage the audit events recorded for FHIR interactions",
+	}
+	auditVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Check the audit events and their anchors against the hashes sent to the chain",
+		Long: `Recomputes the hash of every audit event and anchor, and compares the hash of each anchor with the data of
+the transaction in which the account of the server sent it to itself. Anchoring must have been enabled with
+audit_anchor_interval, and chain_id must be the one the anchors were signed for.`,
+		RunE:         auditVerifyRun,
+		SilenceUsage: true,
+	}
+	auditCmd.AddCommand(auditVerifyCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+func auditVerifyRun(cmd *cobra.Command, args []string) error {
+	config.BindFlags(auditVerifyCmd)
+
+	var problems []string
+	app := fx.New(
+		fx.Provide(
+			logging.NewLogger,
+			config.NewConfig,
+			ethereum.NewConnection,
+			ethereum.NewTransactOpts,
+			database.NewConnection,
+			signer.NewAccount,
+		),
+		fx.Logger(logging.NewLogger()),
+		fx.Invoke(func(log *logging.Logger, appConfig *config.Config, db *database.DB, conn ethereum.Backend, opts *bind.TransactOpts) error {
+			if opts == nil {
+				return errors.New("anchors are sent by the signer of the top level organization, which is not configured")
+			}
+			if appConfig.ChainID <= 0 {
+				return errors.New("verifying anchors requires the chain_id of the network")
+			}
+			txns, ok := conn.(audit.TransactionReader)
+			if !ok {
+				return errors.New("the connection to the chain cannot look up transactions")
+			}
+			var err error
+			problems, err = audit.Verify(context.Background(), db, audit.LookupSentToSelf(txns, appConfig.ChainID, opts.From))
+			return err
+		}),
+	)
+	if err := app.Err(); err != nil {
+		return errors.Wrap(err, "audit verification failed")
+	}
+	for _, problem := range problems {
+		log.Warn(problem)
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("audit events do not match their anchors (%d problems)", len(problems))
+	}
+	log.Info("audit events match their anchors")
+	return nil
+}
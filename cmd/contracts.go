@@ -0,0 +1,173 @@
+// Copyright © 2018 Optum
+
+package cmd
+
+import (
+	"context"
+	"sort"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+var (
+	contractsCmd       *cobra.Command
+	contractsDeployCmd *cobra.Command
+	contractsVerifyCmd *cobra.Command
+)
+
+func initContracts() {
+	contractsCmd = &cobra.Command{
+		Use:   "contracts",
+		Short: "Deploy and verify the contracts of the organization",
+	}
+	contractsDeployCmd = &cobra.Command{
+		Use:   "deploy",
+		Short: "Deploy the Organization, ObjectCollection and ObjectIndex contracts that have no address in the config file",
+		Long: `Deploy the Organization contract, and an ObjectCollection contract with an ObjectIndex contract for each of its
+indexes for every collection in the contracts section of the config file that has no address, and write a copy
+of the config file with the addresses of the deployed contracts filled in. The copy is only readable by its owner,
+and the secrets of the config file are not copied. When a deployment fails, the addresses of the contracts
+deployed before it are written.`,
+		Run: contractsDeployRun,
+	}
+	contractsDeployCmd.Flags().StringP("output", "o", "", "file to write the config with the deployed addresses to (required)")
+	contractsDeployCmd.Flags().String("tenant", "", "deploy the contracts of a tenant rather than of the top level organization")
+	contractsVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Check that every configured contract has code and implements the expected ABI",
+		Run:   contractsVerifyRun,
+	}
+	contractsCmd.AddCommand(contractsDeployCmd, contractsVerifyCmd)
+	rootCmd.AddCommand(contractsCmd)
+}
+
+// ethereumCollections returns the collections of a configuration that are stored in collection contracts, by name
+func ethereumCollections(c *config.Config) []*config.ObjectCollectionContract {
+	collections := []*config.ObjectCollectionContract{}
+	for name, coll := range c.ObjectCollectionContracts {
+		if c.Storage[name] != storage.BackendSQL {
+			collections = append(collections, coll)
+		}
+	}
+	sort.Slice(collections, func(i, j int) bool { return collections[i].Name < collections[j].Name })
+	return collections
+}
+
+func contractsDeployRun(cmd *cobra.Command, args []string) {
+	config.BindFlags(contractsDeployCmd)
+	output, _ := contractsDeployCmd.Flags().GetString("output")
+	tenant, _ := contractsDeployCmd.Flags().GetString("tenant")
+	if output == "" {
+		log.Fatal("an output file is required")
+	}
+
+	app := fx.New(
+		fx.Provide(
+			logging.NewLogger,
+			config.NewConfig,
+			ethereum.NewConnection,
+		),
+		fx.Logger(logging.NewLogger()),
+		fx.Invoke(func(lc fx.Lifecycle, log *logging.Logger, appConfig *config.Config, conn ethereum.Backend) error {
+			c := appConfig
+			if tenant != "" {
+				c = nil
+				for _, t := range appConfig.Tenants {
+					if t.Name == tenant {
+						c = appConfig.ForTenant(t)
+					}
+				}
+				if c == nil {
+					return errors.Errorf("unknown tenant %q", tenant)
+				}
+			}
+			account, err := signer.NewAccount(c)
+			if err != nil {
+				return err
+			}
+			opts, err := ethereum.NewTransactOpts(lc, log, c, account)
+			if err != nil {
+				return err
+			}
+			if opts == nil {
+				return errors.New("a signer is required to deploy contracts")
+			}
+			transactions, err := ethereum.NewTransactionManager(log, c, conn, opts)
+			if err != nil {
+				return err
+			}
+			name := c.OrganizationName
+			if name == "" {
+				name = c.Tenant
+			}
+			organization, err := ethereum.NewDeployer(log, conn, transactions).Deploy(context.Background(), name, c.OrganizationContract, ethereumCollections(c))
+			// the contracts deployed before a failure are written too, so that they are not deployed again
+			if writeErr := config.WriteContractsFile(output, tenant, organization, c.ObjectCollectionContracts); writeErr != nil {
+				if err != nil {
+					log.WithError(writeErr).Error("failed to write the addresses of the contracts deployed before the failure")
+					return err
+				}
+				return writeErr
+			}
+			if err != nil {
+				return errors.Wrapf(err, "wrote the addresses of the contracts deployed before the failure to %s", output)
+			}
+			return nil
+		}),
+	)
+	if err := app.Err(); err != nil {
+		log.WithError(err).Fatal("contract deployment failed")
+	}
+	log.Infof("wrote config with the deployed contracts to %s", output)
+}
+
+func contractsVerifyRun(cmd *cobra.Command, args []string) {
+	config.BindFlags(contractsVerifyCmd)
+
+	problems := 0
+	app := fx.New(
+		fx.Provide(
+			logging.NewLogger,
+			config.NewConfig,
+			ethereum.NewConnection,
+		),
+		fx.Logger(logging.NewLogger()),
+		fx.Invoke(func(log *logging.Logger, appConfig *config.Config, conn ethereum.Backend) error {
+			configs := []*config.Config{}
+			if appConfig.HasOrganization() {
+				configs = append(configs, appConfig)
+			}
+			for _, t := range appConfig.Tenants {
+				configs = append(configs, appConfig.ForTenant(t))
+			}
+			for _, c := range configs {
+				found, err := ethereum.VerifyContracts(context.Background(), conn, c.OrganizationContract, ethereumCollections(c))
+				if err != nil {
+					return err
+				}
+				for _, problem := range found {
+					if c.Tenant != "" {
+						problem = "tenant " + c.Tenant + ": " + problem
+					}
+					log.Warn(problem)
+				}
+				problems += len(found)
+			}
+			return nil
+		}),
+	)
+	if err := app.Err(); err != nil {
+		log.WithError(err).Fatal("contract verification failed")
+	}
+	if problems > 0 {
+		log.Fatalf("contracts do not match the configuration (%d problems)", problems)
+	}
+	log.Info("contracts match the configuration")
+}
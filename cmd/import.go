@@ -0,0 +1,149 @@
+// Copyright © 2018 Optum
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers/resources"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/mirror"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+var importCmd *cobra.Command
+
+func initImport() {
+	importCmd = &cobra.Command{
+		Use:   "import <file>...",
+		Short: "Create the resources of NDJSON and Bundle files",
+		Long: `Create the resources of NDJSON files, and of the entries of files holding a single Bundle.
+
+Every resource is validated before anything is written, and references between the resources of the files are
+rewritten to the IDs assigned to the created resources. Created resources are recorded in the progress file by
+their id and a hash of their content, so that running the same import again resumes it. Resources whose transaction
+was not mined within txn_wait are recorded as pending with the hash of the transaction, and are not submitted again.
+Resources that could not be created are written to the error report with an OperationOutcome describing the problem.`,
+		Args: cobra.MinimumNArgs(1),
+		Run:  importRun,
+	}
+	rootCmd.AddCommand(importCmd)
+	importCmd.Flags().Int("concurrency", 8, "number of resources created at the same time")
+	importCmd.Flags().String("progress", "import-progress.ndjson", "file in which created resources are recorded, to resume an interrupted import")
+	importCmd.Flags().String("errors", "import-errors.ndjson", "file to which resources that could not be created are reported")
+	importCmd.Flags().String("tenant", "", "import the resources of a tenant rather than of the top level organization")
+	importCmd.Flags().Duration("txn_wait", 10*time.Minute, "time to wait for the receipt of the transaction of each resource")
+	importCmd.Flags().Duration("txn_timeout", 10*time.Minute, "time after which a transaction that has not been mined is reported as failed")
+	importCmd.Flags().Duration("txn_resubmit_after", 2*time.Minute, "time after which a transaction that has not been mined is resubmitted with a higher gas price (0 disables resubmission)")
+}
+
+func importRun(cmd *cobra.Command, args []string) {
+	config.BindFlags(importCmd)
+	concurrency, _ := importCmd.Flags().GetInt("concurrency")
+	progressPath, _ := importCmd.Flags().GetString("progress")
+	errorsPath, _ := importCmd.Flags().GetString("errors")
+	tenant, _ := importCmd.Flags().GetString("tenant")
+
+	var registry *resources.Registry
+	app := fx.New(
+		fx.Provide(
+			logging.NewLogger,
+			config.NewConfig,
+			resources.NewRegistry,
+			resources.NewTenants,
+			newRenderer,
+			ethereum.NewConnection,
+			ethereum.NewTransactOpts,
+			ethereum.NewTransactionManager,
+			ethereum.NewTransactionsChannel,
+			ethereum.NewTransactionsListener,
+			database.NewConnection,
+			ipfs.NewClient,
+			fetcher.NewRegistry,
+			signer.NewAccount,
+			envelope.NewKeyring,
+			mirror.NewMirror,
+			static.NewStaticFilesBox,
+			subscriptions.NewEngine,
+		),
+		fx.Logger(logging.NewLogger()),
+		fx.Invoke(
+			ethereum.StartTransactionsListener,
+			func(r *resources.Registry, tenants *resources.Tenants) error {
+				registry = r
+				if tenant == "" {
+					return nil
+				}
+				for _, t := range tenants.Tenants {
+					if t.Name == tenant {
+						registry = t.Registry
+						return nil
+					}
+				}
+				return errors.Errorf("unknown tenant %q", tenant)
+			},
+		),
+	)
+	if err := app.Start(context.Background()); err != nil {
+		log.WithError(err).Fatal("unable to start import")
+	}
+	defer app.Stop(context.Background())
+
+	summary, err := runImport(registry, concurrency, progressPath, errorsPath, args)
+	if err != nil {
+		log.WithError(err).Error("import failed")
+	}
+	if summary != nil {
+		log.Infof("created %d resources, %d pending (see %s), skipped %d imported by previous runs, %d failed (see %s)",
+			summary.Created, summary.Pending, progressPath, summary.Skipped, summary.Failed, errorsPath)
+	}
+}
+
+// runImport imports files, resuming from the progress file, until they are imported or the process is interrupted
+func runImport(registry *resources.Registry, concurrency int, progressPath string, errorsPath string, paths []string) (*resources.ImportSummary, error) {
+	progress, err := os.OpenFile(progressPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open progress file")
+	}
+	defer progress.Close()
+	errs, err := os.Create(errorsPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create error report")
+	}
+	defer errs.Close()
+
+	// the progress file is read from its start, and records are appended to it
+	importer, err := resources.NewImporter(registry, concurrency, progress, progress, errs)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	defer signal.Stop(interrupt)
+	go func() {
+		select {
+		case <-interrupt:
+			log.Warn("interrupted, waiting for the resources being created")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return importer.Run(ctx, paths...)
+}
@@ -0,0 +1,163 @@
+// Copyright © 2018 Optum
+
+package cmd
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/mirror"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/fx"
+)
+
+var (
+	mirrorCmd      *cobra.Command
+	mirrorCheckCmd *cobra.Command
+)
+
+func initMirror() {
+	mirrorCmd = &cobra.Command{
+		Use:   "mirror",
+		Short: "Manage the database mirror of collection contracts",
+	}
+	mirrorCheckCmd = &cobra.Command{
+		Use:          "check",
+		Short:        "Compare the mirror with the collection contracts at the last synced block",
+		RunE:         mirrorCheckRun,
+		SilenceUsage: true,
+	}
+	mirrorCmd.AddCommand(mirrorCheckCmd)
+	rootCmd.AddCommand(mirrorCmd)
+}
+
+func mirrorCheckRun(cmd *cobra.Command, args []string) error {
+	config.BindFlags(mirrorCheckCmd)
+
+	mismatches := 0
+	app := fx.New(
+		fx.Provide(
+			logging.NewLogger,
+			config.NewConfig,
+			ethereum.NewConnection,
+			database.NewConnection,
+			ipfs.NewClient,
+			fetcher.NewRegistry,
+			signer.NewAccount,
+			envelope.NewKeyring,
+			mirror.NewMirror,
+		),
+		fx.Logger(logging.NewLogger()),
+		fx.Invoke(func(log *logging.Logger, appConfig *config.Config, db *database.DB, conn ethereum.Backend, ipfsClient *ipfs.Client, fetchers *fetcher.Registry, keyring *envelope.Keyring, m *mirror.Mirror) error {
+			configs := []*config.Config{}
+			if appConfig.HasOrganization() {
+				configs = append(configs, appConfig)
+			}
+			for _, t := range appConfig.Tenants {
+				configs = append(configs, appConfig.ForTenant(t))
+			}
+			for _, c := range configs {
+				tenantKeyring := keyring
+				if c.Tenant != "" {
+					account, err := signer.NewAccount(c)
+					if err != nil {
+						return errors.Wrapf(err, "failed to read signer of tenant %q", c.Tenant)
+					}
+					if tenantKeyring, err = envelope.NewKeyring(log, c, account); err != nil {
+						return errors.Wrapf(err, "failed to create keyring of tenant %q", c.Tenant)
+					}
+				}
+				for _, coll := range c.ObjectCollectionContracts {
+					adapter, err := ethereum.NewAdapter(conn, nil, c.OrganizationContract, coll, nil, ipfsClient, fetchers, tenantKeyring, db, log)
+					if err != nil {
+						return errors.Wrapf(err, "failed to create adapter for collection %q", coll.StorageName())
+					}
+					n, err := checkMirror(context.Background(), log, m, adapter)
+					if err != nil {
+						return errors.Wrapf(err, "failed to check collection %q", coll.StorageName())
+					}
+					mismatches += n
+				}
+			}
+			return nil
+		}),
+	)
+	if err := app.Err(); err != nil {
+		return errors.Wrap(err, "mirror check failed")
+	}
+	if mismatches > 0 {
+		return errors.Errorf("mirror does not match the chain (%d differences)", mismatches)
+	}
+	log.Info("mirror matches the chain")
+	return nil
+}
+
+// checkMirror logs every object whose state in the mirror differs from the collection contract and returns the number of differences
+func checkMirror(ctx context.Context, log *logging.Logger, m *mirror.Mirror, adapter *ethereum.Adapter) (int, error) {
+	name := adapter.Collection().StorageName()
+	cursor, err := m.Cursor(name)
+	if err != nil {
+		return 0, err
+	}
+	objects, err := m.Objects(name)
+	if err != nil {
+		return 0, err
+	}
+	events, err := adapter.ObjectEvents(ctx, 0, &cursor, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	mirrored := map[string]*mirror.Object{}
+	for _, object := range objects {
+		mirrored[object.ObjectID] = object
+	}
+	onChain := map[string]bool{}
+	for _, event := range events {
+		if !event.Removed {
+			onChain[event.ID.String()] = true
+		}
+	}
+
+	mismatches := 0
+	report := func(id string, problem string) {
+		mismatches++
+		log.WithFields(logging.Fields{"collection": name, "object": id, "block": cursor}).Warn(problem)
+	}
+	block := new(big.Int).SetUint64(cursor)
+	for id := range onChain {
+		object, ok := mirrored[id]
+		element, err := adapter.ReadAt(ctx, uuid.Parse(id), block)
+		switch {
+		case errors.Cause(err) == ethereum.ErrObjectNotFound:
+			if ok && !object.Removed {
+				report(id, "object is removed on chain but not in the mirror")
+			}
+		case err != nil:
+			return mismatches, err
+		case !ok:
+			report(id, "object is missing from the mirror")
+		case object.Removed:
+			report(id, "object is removed in the mirror but not on chain")
+		case object.URI != element.Data.URI():
+			report(id, "object data differs between the mirror and the chain")
+		}
+	}
+	for id := range mirrored {
+		if !onChain[id] {
+			report(id, "object in the mirror has no events on chain")
+		}
+	}
+	log.WithField("collection", name).Infof("checked %d objects at block %d", len(onChain), cursor)
+	return mismatches, nil
+}
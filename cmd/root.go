@@ -34,10 +34,15 @@ func init() {
 	rootCmd.PersistentFlags().String("db_type", "sqlite3", "database dialect to use (sqlite3 or postgresql)")
 	rootCmd.PersistentFlags().String("db_conn_str", "data.sqlite", "database dialect-specific connection string")
 
-	rootCmd.PersistentFlags().Int64P("gas_price", "g", 0, "gas price to use for transactions")
-	rootCmd.PersistentFlags().Uint64P("gas_limit", "L", 0, "gas limit to use for transactions")
-	rootCmd.PersistentFlags().StringP("private_key", "k", "", "private key for signing transactions")
+	rootCmd.PersistentFlags().Int64P("gas_price", "g", 0, "gas price to use for transactions with the fixed gas price strategy")
+	rootCmd.PersistentFlags().String("gas_price_strategy", "node", "how the gas price of transactions is chosen (fixed, node or percentile of the prices paid in recent blocks)")
+	rootCmd.PersistentFlags().Int("gas_price_percentile", 60, "percentile of the gas prices paid in recent blocks used by the percentile gas price strategy")
+	rootCmd.PersistentFlags().Int("gas_price_blocks", 20, "number of recent blocks whose gas prices are used by the percentile gas price strategy")
+	rootCmd.PersistentFlags().Uint64P("gas_limit", "L", 0, "highest gas limit of a transaction (0 is limited only by the block gas limit)")
+	rootCmd.PersistentFlags().Float64("gas_limit_multiplier", 1.2, "factor by which the estimated gas of a transaction is raised to set its gas limit")
+	rootCmd.PersistentFlags().StringP("private_key", "k", "", "hex encoded private key for signing transactions, in dev mode only (configure a keystore or external signer in the signer section otherwise)")
 	rootCmd.PersistentFlags().StringP("rpc_url", "u", "http://localhost:8545", "ethereum node RPC URL")
+	rootCmd.PersistentFlags().Int64("chain_id", 0, "chain id of the network, to which the transactions signed by an external signer must be bound")
 	rootCmd.PersistentFlags().StringP("org_name", "n", "", "name of your Organization, to be attached to Organization contract")
 	rootCmd.PersistentFlags().StringP("org_contract_addr", "O", "", "address of this Organization's smart contract")
 
@@ -45,6 +50,10 @@ func init() {
 	rootCmd.PersistentFlags().Uint("txns_buffer", 2048, "")
 
 	initServe()
+	initMirror()
+	initContracts()
+	initImport()
+	initAudit()
 }
 
 func initConfig() {
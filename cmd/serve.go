@@ -4,22 +4,34 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/audit"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/format"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers/resources"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/metadata"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/mirror"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/tlsconfig"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/utils"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 	nLog "github.com/meatballhat/negroni-logrus"
 	"github.com/phyber/negroni-gzip/gzip"
 	"github.com/rs/cors"
@@ -46,7 +58,41 @@ func initServe() {
 	serveCmd.Flags().StringArray("cors_exposed_headers", []string{}, "")
 	serveCmd.Flags().Bool("cors_allow_credentials", false, "")
 	serveCmd.Flags().Int("cors_max_age", 0, "")
+	serveCmd.Flags().String("tls_cert_file", "", "PEM encoded certificate with which HTTPS is served, reloaded when the file changes (empty serves plain HTTP)")
+	serveCmd.Flags().String("tls_key_file", "", "PEM encoded private key of the certificate with which HTTPS is served")
+	serveCmd.Flags().String("tls_client_ca_file", "", "PEM encoded CA bundle against which the certificates presented by clients are verified")
+	serveCmd.Flags().Bool("tls_client_cert_required", false, "reject clients that do not present a certificate signed by the client CA bundle")
 	serveCmd.Flags().Bool("pprof", false, "enable pprof runtime profiling")
+	serveCmd.Flags().Duration("txn_wait", 0, "time to wait for the receipt of a transaction before responding to a write (0 responds as soon as the transaction is submitted)")
+	serveCmd.Flags().Duration("txn_timeout", 10*time.Minute, "time after which a transaction that has not been mined is reported as failed")
+	serveCmd.Flags().Duration("txn_drop_after", 24*time.Hour, "time after which a transaction that has still not been mined is reported as dropped (0 keeps checking it)")
+	serveCmd.Flags().Duration("txn_resubmit_after", 2*time.Minute, "time after which a transaction that has not been mined is resubmitted with a higher gas price (0 disables resubmission)")
+	serveCmd.Flags().Int64("txn_gas_price_bump", 10, "percentage by which the gas price of a resubmitted transaction is raised (at least 10)")
+	serveCmd.Flags().Int64("txn_max_gas_price", 0, "highest gas price of a transaction, including resubmitted ones (0 is unlimited)")
+	serveCmd.Flags().Duration("subscription_poll_interval", time.Minute, "interval at which requested subscriptions are activated")
+	serveCmd.Flags().Int("subscription_retries", 5, "number of times a failed subscription notification is retried")
+	serveCmd.Flags().Duration("subscription_retry_delay", time.Second, "delay before the first retry of a subscription notification, doubled on each retry")
+	serveCmd.Flags().Duration("subscription_timeout", 10*time.Second, "timeout of each subscription notification request")
+	serveCmd.Flags().Int("subscription_workers", 4, "number of subscription notifications delivered concurrently")
+	serveCmd.Flags().Bool("mirror", false, "copy resources stored in collection contracts to the database")
+	serveCmd.Flags().Uint64("mirror_start_block", 0, "first block copied to the mirror")
+	serveCmd.Flags().Uint64("mirror_reorg_depth", 12, "number of blocks copied to the mirror again on each sync, to discard changes lost in chain reorganizations")
+	serveCmd.Flags().Duration("mirror_poll_interval", 15*time.Second, "interval at which the mirror is synced")
+	serveCmd.Flags().String("ipfs_url", "", "URL of the HTTP API of an IPFS node in which large resources are stored (e.g. http://localhost:5001)")
+	serveCmd.Flags().Int("ipfs_threshold", 0, "size in bytes above which resources are stored in IPFS rather than on chain, when an IPFS node is configured")
+	serveCmd.Flags().Duration("ipfs_timeout", 30*time.Second, "timeout of each IPFS API request")
+	serveCmd.Flags().Int64("ipfs_max_size", ipfs.MaxPayloadSize, "size in bytes of the largest payload fetched from IPFS")
+	serveCmd.Flags().StringArray("fetch_allowed_hosts", []string{}, "hosts from which resources stored at http and https URIs are fetched, which may start with a *. wildcard (empty disables http and https URIs)")
+	serveCmd.Flags().Duration("fetch_timeout", 30*time.Second, "timeout of requests for resources stored at http and https URIs")
+	serveCmd.Flags().Int64("fetch_max_size", 10<<20, "size in bytes of the largest resource fetched from a URI")
+	serveCmd.Flags().String("fetch_file_root", "", "directory from which resources stored at file URIs are read, for development (empty disables file URIs)")
+	serveCmd.Flags().StringArray("encryption_keys", []string{}, "organization keys (<id>:<hex encoded 32 byte key>) with which resources are encrypted; the first key encrypts new versions, the others are kept to read versions written before a key rotation")
+	serveCmd.Flags().StringArray("encryption_recipients", []string{}, "public keys of the Ethereum accounts of organizations that can read the resources written by this server")
+	serveCmd.Flags().String("tenant_header", "X-Tenant-ID", "header that selects the tenant of requests sent to /fhir, as an alternative to /fhir/{tenant}")
+	serveCmd.Flags().String("export_dir", "exports", "directory to which the NDJSON files of bulk data exports are written")
+	serveCmd.Flags().Duration("audit_anchor_interval", 0, "interval at which the hash of the audit events recorded since the previous anchor is sent to the chain (0 disables anchoring, requires chain_id)")
+	serveCmd.Flags().StringArray("trusted_proxies", []string{}, "addresses or CIDR ranges of the proxies whose X-Forwarded-For header identifies the client recorded in audit events")
+	serveCmd.Flags().String("read_from", "chain", "source of reads, searches and history (chain or mirror); the mirror may lag behind recent writes")
 }
 
 func serveRun(cmd *cobra.Command, args []string) {
@@ -61,19 +107,35 @@ func serveRun(cmd *cobra.Command, args []string) {
 			NewRouter,
 			resources.NewCapabilityConfig,
 			resources.NewRegistry,
+			resources.NewTenants,
 			newRenderer,
 			newCORSMiddleware,
+			auth.NewAuthorizer,
+			format.NewNegotiator,
+			audit.NewAnchorer,
+			tlsconfig.NewTLSConfig,
 			ethereum.NewConnection,
 			ethereum.NewTransactOpts,
+			ethereum.NewTransactionManager,
 			ethereum.NewTransactionsChannel,
 			ethereum.NewTransactionsListener,
 			database.NewConnection,
+			ipfs.NewClient,
+			fetcher.NewRegistry,
+			signer.NewAccount,
+			envelope.NewKeyring,
+			mirror.NewMirror,
 			static.NewStaticFilesBox,
+			subscriptions.NewEngine,
+			subscriptions.NewWebsocketChannel,
 		),
 		fx.Logger(logging.NewLogger()),
 		fx.Invoke(
 			configureRouter,
 			ethereum.StartTransactionsListener,
+			subscriptions.StartEngine,
+			mirror.StartMirror,
+			audit.StartAnchorer,
 		),
 	)
 
@@ -103,7 +165,7 @@ func newRenderer(config *config.Config) *render.Render {
 }
 
 // NewRouter ...
-func NewRouter(lc fx.Lifecycle, log *logging.Logger, config *config.Config, corsMW *cors.Cors) *mux.Router {
+func NewRouter(lc fx.Lifecycle, log *logging.Logger, config *config.Config, corsMW *cors.Cors, authz *auth.Authorizer, negotiator *format.Negotiator, tlsConfig *tls.Config, registry *resources.Registry) (*mux.Router, error) {
 	log.Debug("executing NewRouter")
 
 	r := mux.NewRouter()
@@ -120,23 +182,45 @@ func NewRouter(lc fx.Lifecycle, log *logging.Logger, config *config.Config, cors
 	// request logging
 	n.Use(nLog.NewMiddlewareFromLogger(log, "web"))
 
-	// response gzip
-	n.Use(gzip.Gzip(gzip.DefaultCompression))
+	// audit events for the requests refused by the token validation, which never reach the recorders of the routes
+	n.Use(registry.AuditRejections())
 
-	n.UseHandler(r)
+	// response gzip, except for websocket upgrades, whose connection is hijacked from the response writer
+	n.Use(skipWebsockets(gzip.Gzip(gzip.DefaultCompression)))
 
+	// FHIR XML conversion of request bodies and responses, including the outcomes of rejected tokens
+	n.Use(negotiator)
+
+	// bearer token validation of FHIR requests, whose scopes are enforced by the resource routes
+	n.Use(authz)
+
+	n.UseHandler(limitResponseTime(r))
+
+	// reads are bounded by limitResponseTime rather than by a write timeout, which would cut the downloads of large
+	// export files and writes waiting for their transactions short
 	server := &http.Server{
-		Handler:      n,
-		Addr:         config.Address,
-		WriteTimeout: 15 * time.Second,
-		ReadTimeout:  15 * time.Second,
+		Handler:     n,
+		Addr:        config.Address,
+		ReadTimeout: 15 * time.Second,
+	}
+	if tlsConfig != nil {
+		if err := tlsconfig.ConfigureServer(server, tlsConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	lc.Append(fx.Hook{
 		OnStart: func(context.Context) error {
-			log.Info("starting server")
+			log.WithField("tls", tlsConfig != nil).Info("starting server")
 			go func() {
-				if err := server.ListenAndServe(); err != nil {
+				var err error
+				if tlsConfig != nil {
+					// the certificate is served by the TLS configuration, which reloads it when its files change
+					err = server.ListenAndServeTLS("", "")
+				} else {
+					err = server.ListenAndServe()
+				}
+				if err != nil {
 					log.WithError(err).Error("server failed")
 				}
 			}()
@@ -148,7 +232,39 @@ func NewRouter(lc fx.Lifecycle, log *logging.Logger, config *config.Config, cors
 		},
 	})
 
-	return r
+	return r, nil
+}
+
+// skipWebsockets bypasses a middleware for websocket upgrade requests
+func skipWebsockets(h negroni.Handler) negroni.Handler {
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if websocket.IsWebSocketUpgrade(req) {
+			next(rw, req)
+			return
+		}
+		h.ServeHTTP(rw, req, next)
+	})
+}
+
+// responseTimeout is the time after which the context of a read is cancelled
+const responseTimeout = 15 * time.Second
+
+// limitResponseTime cancels the context of the reads that take longer than responseTimeout, so that the queries of
+// the stores are abandoned without buffering the response
+// writes, including bundles, are not limited, since they wait up to txn_wait for their transactions and must not be
+// cut off once part of them has been submitted; neither are the downloads of export files and websocket connections,
+// which last as long as the client needs
+func limitResponseTime(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		read := req.Method == http.MethodGet || req.Method == http.MethodHead
+		if !read || websocket.IsWebSocketUpgrade(req) || strings.Contains(req.URL.Path, "/$export-file/") {
+			h.ServeHTTP(rw, req)
+			return
+		}
+		ctx, cancel := context.WithTimeout(req.Context(), responseTimeout)
+		defer cancel()
+		h.ServeHTTP(rw, req.WithContext(ctx))
+	})
 }
 
 func configureRouter(
@@ -157,13 +273,20 @@ func configureRouter(
 	cConfig *resources.CapabilityConfig,
 	rndr *render.Render,
 	registry *resources.Registry,
+	tenants *resources.Tenants,
 	config *config.Config,
+	ws *subscriptions.WebsocketChannel,
+	authz *auth.Authorizer,
 ) {
 	log.Debug("executing configureRouter")
 
+	// tenant routes must be matched before the routes of the top level organization
+	handlers.RegisterFHIRTenantRoutes(r, log, rndr, tenants, func(tenantRouter *mux.Router, t *resources.Tenant) {
+		registerFHIRRoutes(tenantRouter, log, t.Capability, rndr, t.Registry, ws, authz)
+	})
 	fhirRouter := r.PathPrefix("/fhir").Subrouter()
-	handlers.RegisterFHIRCapabilityStatementRoutes(fhirRouter, log, cConfig, rndr)
-	handlers.RegisterAllFHIRResourceRoutes(fhirRouter, log, rndr, registry)
+	fhirRouter.Use(auth.RequireTenant(""))
+	registerFHIRRoutes(fhirRouter, log, cConfig, rndr, registry, ws, authz)
 
 	handlers.RegisterHealthCheckRoutes(r, log)
 
@@ -174,6 +297,26 @@ func configureRouter(
 	debugRouter(r, log)
 }
 
+// registerFHIRRoutes mounts the routes of the FHIR base URL of an organization
+func registerFHIRRoutes(
+	fhirRouter *mux.Router,
+	log *logging.Logger,
+	cConfig *resources.CapabilityConfig,
+	rndr *render.Render,
+	registry *resources.Registry,
+	ws *subscriptions.WebsocketChannel,
+	authz *auth.Authorizer,
+) {
+	handlers.RegisterFHIRCapabilityStatementRoutes(fhirRouter, log, cConfig, rndr)
+	handlers.RegisterFHIRSmartConfigurationRoutes(fhirRouter, log, authz, rndr)
+	// must be registered before the resource routes, which would otherwise match "$export" as a resource ID
+	handlers.RegisterFHIRExportRoutes(fhirRouter, log, registry)
+	handlers.RegisterAllFHIRResourceRoutes(fhirRouter, log, rndr, registry)
+	handlers.RegisterFHIRBundleRoutes(fhirRouter, log, registry)
+	handlers.RegisterFHIRSubscriptionWebsocketRoutes(fhirRouter, log, registry, ws)
+	handlers.RegisterFHIRTransactionStatusRoutes(fhirRouter, log, registry)
+}
+
 func debugRouter(r *mux.Router, log *logging.Logger) {
 	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
 		f := logging.Fields{}
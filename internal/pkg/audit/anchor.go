@@ -0,0 +1,256 @@
+package audit
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	goethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+	"go.uber.org/fx"
+)
+
+// anchorUpdateBatch is the number of records assigned to an anchor by a single statement
+const anchorUpdateBatch = 500
+
+// SendFunc records the hash of an anchor, returning the ID of the transaction that holds it
+type SendFunc func(ctx context.Context, hash []byte) (string, error)
+
+// LookupFunc returns the hash recorded by the transaction of an anchor, or nil when no mined transaction of the
+// account of the server holds it
+type LookupFunc func(ctx context.Context, transaction string) ([]byte, error)
+
+// TransactionReader looks up the transactions of a chain
+type TransactionReader interface {
+	TransactionByHash(ctx context.Context, hash common.Hash) (*types.Transaction, bool, error)
+}
+
+// Anchorer periodically sends a hash of the audit events that no anchor covers yet to the chain
+// each anchor covers the previous one, so that a record cannot be changed or removed without breaking the chain
+type Anchorer struct {
+	context       context.Context
+	contextCancel context.CancelFunc
+	db            *database.DB
+	interval      time.Duration
+	log           logging.FieldLogger
+	send          SendFunc
+}
+
+// Anchor sends the hash of the records that no anchor covers yet, and assigns them to the new anchor
+// records committed after others with a higher ID are covered by the next anchor, rather than skipped
+// nil is returned when there are no new records
+func (a *Anchorer) Anchor(ctx context.Context) (*Anchor, error) {
+	previous := &Anchor{}
+	query := a.db.Order("id desc").First(previous)
+	if err := query.Error; err != nil && !query.RecordNotFound() {
+		return nil, errors.Wrap(err, "failed to read previous anchor")
+	}
+	records := []*Record{}
+	if err := a.db.Select("id, hash").Where("anchor_id = ?", 0).Order("id").Find(&records).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to read audit events")
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	anchor := &Anchor{
+		CreatedAt: time.Now().UTC(),
+		Records:   len(records),
+		Hash:      anchorHash(previous.Hash, records),
+		Previous:  previous.Hash,
+	}
+	hash, _ := hex.DecodeString(anchor.Hash)
+	txHash, err := a.send(ctx, hash)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to send anchor")
+	}
+	anchor.TransactionHash = txHash
+	if err := a.save(anchor, records); err != nil {
+		return nil, err
+	}
+	a.log.WithFields(logging.Fields{
+		"records":     len(records),
+		"hash":        anchor.Hash,
+		"transaction": txHash,
+	}).Info("anchored audit events")
+	return anchor, nil
+}
+
+// save stores an anchor and assigns its records to it
+func (a *Anchorer) save(anchor *Anchor, records []*Record) error {
+	tx := a.db.Begin()
+	if err := tx.Create(anchor).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to save anchor")
+	}
+	// the IDs are updated in batches, which keeps below the limit of parameters of a statement
+	for start := 0; start < len(records); start += anchorUpdateBatch {
+		end := start + anchorUpdateBatch
+		if end > len(records) {
+			end = len(records)
+		}
+		ids := []uint{}
+		for _, r := range records[start:end] {
+			ids = append(ids, r.ID)
+		}
+		if err := tx.Model(&Record{}).Where("id IN (?)", ids).Update("anchor_id", anchor.ID).Error; err != nil {
+			tx.Rollback()
+			return errors.Wrap(err, "failed to assign audit events to anchor")
+		}
+	}
+	return errors.Wrap(tx.Commit().Error, "failed to save anchor")
+}
+
+// Start anchors the audit events at the configured interval, until the application stops
+func (a *Anchorer) Start() {
+	if a.interval <= 0 {
+		return
+	}
+	a.log.Info("started")
+	go func() {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if _, err := a.Anchor(a.context); err != nil && a.context.Err() == nil {
+					a.log.WithError(err).Error("failed to anchor audit events")
+				}
+			case <-a.context.Done():
+				a.log.Info("stopped")
+				return
+			}
+		}
+	}()
+}
+
+// Verify recomputes the hashes of the stored records and anchors, compares the hash of each anchor with the one its
+// transaction recorded on chain, and describes the ones that do not match
+// the records of an anchor are those assigned to it, so gaps between their IDs are not reported; the chain is what
+// makes changes evident, since whoever can rewrite the records can also rewrite the anchors stored with them
+func Verify(ctx context.Context, db *database.DB, lookup LookupFunc) ([]string, error) {
+	anchors := []*Anchor{}
+	if err := db.Order("id").Find(&anchors).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to read anchors")
+	}
+	problems := []string{}
+	previous := ""
+	for _, anchor := range anchors {
+		if anchor.Previous != previous {
+			problems = append(problems, fmt.Sprintf("anchor %d does not follow the previous anchor", anchor.ID))
+		}
+		previous = anchor.Hash
+		recorded, err := lookup(ctx, anchor.TransactionHash)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to look up transaction of anchor %d", anchor.ID)
+		}
+		if recorded == nil {
+			problems = append(problems, fmt.Sprintf("anchor %d was not found on chain in transaction %s", anchor.ID, anchor.TransactionHash))
+		} else if hex.EncodeToString(recorded) != anchor.Hash {
+			problems = append(problems, fmt.Sprintf("anchor %d does not match the hash recorded on chain", anchor.ID))
+		}
+		records := []*Record{}
+		if err := db.Where("anchor_id = ?", anchor.ID).Order("id").Find(&records).Error; err != nil {
+			return nil, errors.Wrap(err, "failed to read audit events")
+		}
+		if len(records) != anchor.Records {
+			problems = append(problems, fmt.Sprintf("anchor %d covers %d audit events, %d were found", anchor.ID, anchor.Records, len(records)))
+		}
+		for _, r := range records {
+			if hashData(r.Data) != r.Hash {
+				problems = append(problems, fmt.Sprintf("audit event %s has been modified", r.UUID))
+			}
+		}
+		if anchorHash(anchor.Previous, records) != anchor.Hash {
+			problems = append(problems, fmt.Sprintf("anchor %d does not match its audit events", anchor.ID))
+		}
+	}
+	return problems, nil
+}
+
+// LookupSentToSelf returns the data of the mined transactions that an account sent to itself on a chain, which is
+// how sendToSelf records anchors
+func LookupSentToSelf(conn TransactionReader, chainID int64, account common.Address) LookupFunc {
+	signer := types.NewEIP155Signer(big.NewInt(chainID))
+	return func(ctx context.Context, transaction string) ([]byte, error) {
+		txn, pending, err := conn.TransactionByHash(ctx, common.HexToHash(transaction))
+		if err == goethereum.NotFound {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if pending || txn.To() == nil || *txn.To() != account {
+			return nil, nil
+		}
+		if from, err := types.Sender(signer, txn); err != nil || from != account {
+			return nil, nil
+		}
+		return txn.Data(), nil
+	}
+}
+
+// sendToSelf records a hash in the data of a transaction sent by the account of the server to itself
+// the transaction is signed for the chain, so that it cannot be replayed on another network
+func sendToSelf(conn ethereum.Backend, transactions *ethereum.TransactionManager, chainID int64) SendFunc {
+	signer := types.NewEIP155Signer(big.NewInt(chainID))
+	return func(ctx context.Context, hash []byte) (string, error) {
+		txn, err := transactions.Transact(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+			raw := types.NewTransaction(opts.Nonce.Uint64(), opts.From, new(big.Int), opts.GasLimit, opts.GasPrice, hash)
+			signed, err := opts.Signer(signer, opts.From, raw)
+			if err != nil {
+				return nil, err
+			}
+			if err := conn.SendTransaction(opts.Context, signed); err != nil {
+				return nil, err
+			}
+			return signed, nil
+		})
+		if err != nil {
+			return "", err
+		}
+		return txn.Hash().Hex(), nil
+	}
+}
+
+// NewAnchorer creates the anchorer of the audit events, which sends transactions with the account of the server
+func NewAnchorer(lc fx.Lifecycle, log *logging.Logger, config *config.Config, db *database.DB, conn ethereum.Backend, transactions *ethereum.TransactionManager) (*Anchorer, error) {
+	if config.AuditAnchorInterval > 0 && transactions == nil {
+		return nil, errors.New("anchoring audit events requires the account of the server")
+	}
+	if config.AuditAnchorInterval > 0 && config.ChainID <= 0 {
+		return nil, errors.New("anchoring audit events requires the chain_id of the network")
+	}
+	return newAnchorer(lc, log, config, db, sendToSelf(conn, transactions, config.ChainID)), nil
+}
+
+func newAnchorer(lc fx.Lifecycle, log *logging.Logger, config *config.Config, db *database.DB, send SendFunc) *Anchorer {
+	ctx, cancel := context.WithCancel(context.Background())
+	lc.Append(fx.Hook{
+		OnStop: func(context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+	return &Anchorer{
+		context:       ctx,
+		contextCancel: cancel,
+		db:            db,
+		interval:      config.AuditAnchorInterval,
+		log:           log.WithField("component", "audit-anchor"),
+		send:          send,
+	}
+}
+
+// StartAnchorer ...
+func StartAnchorer(a *Anchorer) {
+	a.Start()
+}
@@ -0,0 +1,148 @@
+package audit
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"go.uber.org/fx/fxtest"
+)
+
+func TestAnchor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := logging.NewLogger()
+	appConfig := &config.Config{DatabaseType: "sqlite3", DatabaseConnectionString: filepath.Join(dir, "test.db"), AuditAnchorInterval: time.Hour}
+	db, err := database.NewConnection(log, appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+	recorder, err := NewRecorder(log, appConfig, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sent := []string{}
+	chain := map[string][]byte{}
+	lc := fxtest.NewLifecycle(t)
+	anchorer := newAnchorer(lc, log, appConfig, db, func(ctx context.Context, hash []byte) (string, error) {
+		sent = append(sent, hex.EncodeToString(hash))
+		txn := fmt.Sprintf("0x%d", len(sent))
+		chain[txn] = hash
+		return txn, nil
+	})
+	lookup := func(ctx context.Context, transaction string) ([]byte, error) {
+		return chain[transaction], nil
+	}
+	record := func(n int) {
+		h := recorder.Handler("", "Practitioner", Read, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {}))
+		for i := 0; i < n; i++ {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/fhir/Practitioner", nil))
+		}
+	}
+
+	record(3)
+	first, err := anchorer.Anchor(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == nil || first.Records != 3 || first.Previous != "" {
+		t.Fatalf("expected the first anchor to cover 3 records, got %+v", first)
+	}
+	if none, err := anchorer.Anchor(context.Background()); err != nil || none != nil {
+		t.Fatalf("expected no anchor without new records, got %+v, %v", none, err)
+	}
+	record(2)
+	second, err := anchorer.Anchor(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Records != 2 || second.Previous != first.Hash {
+		t.Fatalf("expected the second anchor to follow the first, got %+v", second)
+	}
+	if len(sent) != 2 || sent[0] != first.Hash || sent[1] != second.Hash {
+		t.Fatalf("expected the hashes of the anchors to be sent, got %v", sent)
+	}
+
+	// a record committed after a record with a higher ID is covered by the next anchor, and gaps between IDs are
+	// not taken for removed records
+	if err := db.Create(&Record{ID: 10, UUID: "late-10", Data: []byte(`{}`), Hash: hashData([]byte(`{}`))}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := anchorer.Anchor(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&Record{ID: 8, UUID: "late-8", Data: []byte(`{}`), Hash: hashData([]byte(`{}`))}).Error; err != nil {
+		t.Fatal(err)
+	}
+	late, err := anchorer.Anchor(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if late == nil || late.Records != 1 {
+		t.Fatalf("expected the record committed late to be anchored, got %+v", late)
+	}
+
+	problems, err := Verify(context.Background(), db, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected untouched records to verify, got %v", problems)
+	}
+
+	// rewriting a record along with the hashes of its anchor is only evident from the chain
+	firstHash := first.Hash
+	forged := []byte(`{"forged":true}`)
+	if err := db.Model(&Record{}).Where("id = ?", 1).Updates(map[string]interface{}{"data": forged, "hash": hashData(forged)}).Error; err != nil {
+		t.Fatal(err)
+	}
+	records := []*Record{}
+	if err := db.Where("anchor_id = ?", first.ID).Order("id").Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(first).Update("hash", anchorHash("", records)).Error; err != nil {
+		t.Fatal(err)
+	}
+	problems, err = Verify(context.Background(), db, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first anchor no longer matches the chain, and the second no longer follows it
+	if len(problems) != 2 {
+		t.Fatalf("expected the rewritten anchor to be reported, got %v", problems)
+	}
+	if err := db.Model(first).Update("hash", firstHash).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&Record{}).Where("id = ?", 2).Update("data", []byte(`{}`)).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete(&Record{}, "id = ?", 5).Error; err != nil {
+		t.Fatal(err)
+	}
+	problems, err = Verify(context.Background(), db, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first anchor no longer matches its rewritten record, the modified record no longer matches its hash, and
+	// the second anchor no longer matches its records
+	if len(problems) != 4 {
+		t.Fatalf("expected the modified and removed records to be reported, got %v", problems)
+	}
+}
@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// Record is a stored AuditEvent, whose ID orders the records of an anchor
+type Record struct {
+	ID       uint      `gorm:"primary_key"`
+	UUID     string    `gorm:"unique_index"`
+	Recorded time.Time `gorm:"index"`
+	Action   string
+	// Agent is the client or certificate subject that sent the request
+	Agent string `gorm:"index"`
+	// Entity is the reference of the resource the request was sent for, e.g. Practitioner/<id>
+	Entity  string `gorm:"index"`
+	Outcome string
+	Subtype string
+	Data    []byte
+	// Hash is the hex encoded SHA-256 hash of Data
+	Hash string
+	// Tenant is the organization the request was sent to, empty for the top level organization
+	Tenant string `gorm:"not null;default:''"`
+	// AnchorID is the anchor that covers the record, 0 until it has been anchored
+	AnchorID uint `gorm:"index;not null;default:0"`
+}
+
+// TableName ...
+func (Record) TableName() string {
+	return "audit_events"
+}
+
+// Anchor is a hash of the records that were not covered by the previous anchors, which is sent to the chain
+// records are assigned to an anchor rather than ranged by ID, since IDs are neither committed in order nor gapless
+type Anchor struct {
+	ID        uint `gorm:"primary_key"`
+	CreatedAt time.Time
+	// Records is the number of records covered by the anchor
+	Records int
+	// Hash covers the hash of the previous anchor and the hashes of the records, hex encoded
+	Hash            string
+	Previous        string
+	TransactionHash string
+}
+
+// TableName ...
+func (Anchor) TableName() string {
+	return "audit_anchors"
+}
+
+func hashData(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// anchorHash chains the hashes of records to the hash of the previous anchor
+func anchorHash(previous string, records []*Record) string {
+	h := sha256.New()
+	h.Write([]byte(previous))
+	for _, r := range records {
+		h.Write([]byte(r.Hash))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,334 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/metadata"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/urfave/negroni"
+)
+
+// Interaction is a FHIR RESTful interaction, as coded in http://hl7.org/fhir/restful-interaction
+type Interaction string
+
+// Interaction values
+const (
+	Create          Interaction = "create"
+	Delete          Interaction = "delete"
+	HistoryInstance Interaction = "history-instance"
+	HistoryType     Interaction = "history-type"
+	Operation       Interaction = "operation"
+	Patch           Interaction = "patch"
+	Read            Interaction = "read"
+	SearchType      Interaction = "search-type"
+	Update          Interaction = "update"
+	VRead           Interaction = "vread"
+)
+
+// action returns the AuditEvent action of an interaction
+func (i Interaction) action() models.AuditEventAction {
+	switch i {
+	case Create:
+		return models.AuditEventActionC
+	case Update, Patch:
+		return models.AuditEventActionU
+	case Delete:
+		return models.AuditEventActionD
+	case SearchType, Operation:
+		return models.AuditEventActionE
+	}
+	return models.AuditEventActionR
+}
+
+// anonymous is the agent of requests without a token or client certificate, when authorization is disabled
+const anonymous = "anonymous"
+
+type contextKey string
+
+// auditedKey marks the requests whose route has recorded an AuditEvent
+const auditedKey contextKey = "audited"
+
+// Recorder stores an AuditEvent for each FHIR interaction
+type Recorder struct {
+	db  *database.DB
+	log logging.FieldLogger
+	// trustedProxies are the networks of the proxies whose X-Forwarded-For header is believed
+	trustedProxies []*net.IPNet
+}
+
+// statusWriter captures the status of a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Handler records an AuditEvent for each request handled by next, once its response has been written
+func (r *Recorder) Handler(tenant string, resourceType string, interaction Interaction, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if audited, ok := req.Context().Value(auditedKey).(*bool); ok {
+			*audited = true
+		}
+		sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+
+		event := newEvent(req, r.clientAddress(req), rw.Header(), sw.status, tenant, resourceType, interaction)
+		if err := r.save(tenant, event); err != nil {
+			r.log.WithError(err).WithField("path", req.URL.Path).Error("failed to record audit event")
+		}
+	})
+}
+
+// Rejections records an AuditEvent for the requests that are refused before a route records one, such as those
+// without a valid bearer token or with the token of another organization
+func (r *Recorder) Rejections() negroni.Handler {
+	return negroni.HandlerFunc(func(rw http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		audited := false
+		next(rw, req.WithContext(context.WithValue(req.Context(), auditedKey, &audited)))
+
+		nrw, ok := rw.(negroni.ResponseWriter)
+		if audited || !ok || (nrw.Status() != http.StatusUnauthorized && nrw.Status() != http.StatusForbidden) {
+			return
+		}
+		event := newEvent(req, r.clientAddress(req), rw.Header(), nrw.Status(), "", "", methodInteraction(req.Method))
+		// the resource is not known before routing, so the path stands for it
+		event.Entity[0].What = &models.Reference{Display: req.URL.Path}
+		if err := r.save("", event); err != nil {
+			r.log.WithError(err).WithField("path", req.URL.Path).Error("failed to record audit event")
+		}
+	})
+}
+
+// methodInteraction returns the interaction most likely requested with an HTTP method
+func methodInteraction(method string) Interaction {
+	switch method {
+	case http.MethodPost:
+		return Create
+	case http.MethodPut:
+		return Update
+	case http.MethodPatch:
+		return Patch
+	case http.MethodDelete:
+		return Delete
+	}
+	return Read
+}
+
+func (r *Recorder) save(tenant string, event *models.AuditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal audit event")
+	}
+	recorded, _ := time.Parse(time.RFC3339Nano, event.Recorded)
+	rec := &Record{
+		UUID:     event.ID,
+		Recorded: recorded,
+		Action:   string(event.Action),
+		Agent:    agentName(event.Agent[0]),
+		Outcome:  string(event.Outcome),
+		Subtype:  event.Subtype[0].Code,
+		Data:     data,
+		Hash:     hashData(data),
+		Tenant:   tenant,
+	}
+	if what := event.Entity[0].What; what != nil {
+		rec.Entity = strings.SplitN(what.Reference, "/_history/", 2)[0]
+	}
+	return errors.Wrap(r.db.Create(rec).Error, "failed to save audit event")
+}
+
+func agentName(agent *models.AuditEventAgent) string {
+	if agent.Who != nil && agent.Who.Identifier != nil {
+		return agent.Who.Identifier.Value
+	}
+	return agent.Name
+}
+
+// clientAddress returns the address of the client of a request
+// the X-Forwarded-For header is read from its end for as long as the address is that of a trusted proxy, so that
+// clients cannot choose the address recorded for them by sending the header themselves
+func (r *Recorder) clientAddress(req *http.Request) string {
+	address := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	forwarded := []string{}
+	for _, header := range req.Header["X-Forwarded-For"] {
+		for _, a := range strings.Split(header, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				forwarded = append(forwarded, a)
+			}
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0 && r.isTrustedProxy(address); i-- {
+		address = forwarded[i]
+	}
+	return address
+}
+
+func (r *Recorder) isTrustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range r.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newEvent describes a request from a client address and its outcome
+func newEvent(req *http.Request, address string, header http.Header, status int, tenant string, resourceType string, interaction Interaction) *models.AuditEvent {
+	now := time.Now().UTC()
+	event := &models.AuditEvent{
+		ID:     uuid.NewUUID().String(),
+		Meta:   &models.Meta{LastUpdated: now.Format(time.RFC3339)},
+		Type:   &models.Coding{System: "http://terminology.hl7.org/CodeSystem/audit-event-type", Code: "rest", Display: "RESTful Operation"},
+		Action: interaction.action(),
+		Subtype: []*models.Coding{
+			{System: "http://hl7.org/fhir/restful-interaction", Code: string(interaction)},
+		},
+		Recorded: now.Format(time.RFC3339Nano),
+		Agent:    []*models.AuditEventAgent{newAgent(req, address)},
+		Source: &models.AuditEventSource{
+			Site:     tenant,
+			Observer: &models.Reference{Display: metadata.Data.AppName},
+			Type: []*models.Coding{
+				{System: "http://terminology.hl7.org/CodeSystem/security-source-type", Code: "4", Display: "Application Server"},
+			},
+		},
+		Entity: []*models.AuditEventEntity{newEntity(req, header, resourceType)},
+	}
+	switch {
+	case status >= http.StatusInternalServerError:
+		event.Outcome = models.AuditEventOutcome8
+	case status >= http.StatusBadRequest:
+		event.Outcome = models.AuditEventOutcome4
+	default:
+		event.Outcome = models.AuditEventOutcome0
+	}
+	if event.Outcome != models.AuditEventOutcome0 {
+		event.OutcomeDesc = http.StatusText(status)
+	}
+	return event
+}
+
+// newAgent identifies the client by its token, or by the subject of its certificate
+func newAgent(req *http.Request, address string) *models.AuditEventAgent {
+	agent := &models.AuditEventAgent{Requestor: true}
+	if token := auth.FromContext(req.Context()); token != nil {
+		agent.Who = &models.Reference{Identifier: &models.Identifier{Value: token.ClientID}}
+		agent.Name = token.ClientID
+		agent.AltID = token.Subject
+	} else if cert := auth.ClientCertificate(req); cert != nil {
+		identity := auth.CertificateIdentity(cert)
+		agent.Who = &models.Reference{Identifier: &models.Identifier{Value: identity}}
+		agent.Name = identity
+		agent.AltID = cert.Subject.String()
+	} else {
+		agent.Name = anonymous
+	}
+
+	if address != "" {
+		agent.Network = &models.AuditEventNetwork{Address: address, Type: models.AuditEventNetworkType2}
+	}
+	return agent
+}
+
+// newEntity references the resource of a request, at the version that was read or written when it is known
+// the ID of a created resource is read from the Location header of the response
+func newEntity(req *http.Request, header http.Header, resourceType string) *models.AuditEventEntity {
+	entity := &models.AuditEventEntity{
+		Type: &models.Coding{System: "http://terminology.hl7.org/CodeSystem/audit-entity-type", Code: "2", Display: "System Object"},
+	}
+	vars := mux.Vars(req)
+	id, version := vars["resourceID"], vars["versionID"]
+	if id == "" {
+		location := header.Get("Location")
+		if i := strings.Index(location, "/"+resourceType+"/"); i >= 0 {
+			parts := strings.Split(location[i+len(resourceType)+2:], "/")
+			id = parts[0]
+			if len(parts) == 3 && parts[1] == "_history" {
+				version = parts[2]
+			}
+		}
+	}
+	if version == "" {
+		if etag := header.Get("Etag"); strings.HasPrefix(etag, `W/"`) {
+			version = strings.TrimSuffix(strings.TrimPrefix(etag, `W/"`), `"`)
+		}
+	}
+
+	if id == "" {
+		entity.What = &models.Reference{Type: resourceType}
+	} else {
+		reference := resourceType + "/" + id
+		if version != "" {
+			reference += "/_history/" + version
+		}
+		entity.What = &models.Reference{Reference: reference}
+	}
+	if req.URL.RawQuery != "" {
+		entity.Detail = []*models.AuditEventDetail{{Type: "query", ValueString: req.URL.RawQuery}}
+	}
+	return entity
+}
+
+// NewRecorder ...
+func NewRecorder(log *logging.Logger, config *config.Config, db *database.DB) (*Recorder, error) {
+	trustedProxies, err := parseNetworks(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.AutoMigrate(&Record{}, &Anchor{}).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to migrate audit tables")
+	}
+	return &Recorder{
+		db:             db,
+		log:            log.WithField("component", "audit"),
+		trustedProxies: trustedProxies,
+	}, nil
+}
+
+// parseNetworks reads a list of CIDR ranges, in which single addresses stand for themselves
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy range %q", s)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
@@ -0,0 +1,98 @@
+package audit
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/urfave/negroni"
+)
+
+func TestClientAddress(t *testing.T) {
+	trustedProxies, err := parseNetworks([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Recorder{trustedProxies: trustedProxies}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		address   string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "203.0.113.5"},
+		{"client forging the header", "203.0.113.5:4000", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:4000", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "192.0.2.1:4000", []string{"198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"address forged before the proxy", "10.1.2.3:4000", []string{"192.0.2.99, 198.51.100.7"}, "198.51.100.7"},
+		{"repeated headers", "10.1.2.3:4000", []string{"198.51.100.7", "10.4.5.6"}, "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/fhir/Practitioner", nil)
+		req.RemoteAddr = tt.remote
+		for _, f := range tt.forwarded {
+			req.Header.Add("X-Forwarded-For", f)
+		}
+		if address := r.clientAddress(req); address != tt.address {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.address, address)
+		}
+	}
+
+	if _, err := parseNetworks([]string{"proxy.example.org"}); err == nil {
+		t.Error("expected a host name to be rejected")
+	}
+}
+
+func TestRejections(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := logging.NewLogger()
+	appConfig := &config.Config{DatabaseType: "sqlite3", DatabaseConnectionString: filepath.Join(dir, "test.db")}
+	db, err := database.NewConnection(log, appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+	recorder, err := NewRecorder(log, appConfig, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the token validation refuses the requests without a token, and the route those of the wrong scope
+	n := negroni.New(recorder.Rejections(), negroni.HandlerFunc(func(rw http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+		if req.Header.Get("Authorization") == "" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(rw, req)
+	}))
+	n.UseHandler(recorder.Handler("", "Practitioner", Create, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+	})))
+
+	n.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/fhir/Practitioner", nil))
+	req := httptest.NewRequest(http.MethodPost, "/fhir/Practitioner", nil)
+	req.Header.Set("Authorization", "Bearer read-only")
+	n.ServeHTTP(httptest.NewRecorder(), req)
+
+	records := []*Record{}
+	if err := db.Order("id").Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("expected each refused request to be recorded once, got %d records", len(records))
+	}
+	if records[0].Agent != anonymous || records[0].Outcome != "4" || records[0].Subtype != string(Create) {
+		t.Errorf("expected a failed create by an anonymous client, got %+v", records[0])
+	}
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"github.com/unrolled/render"
+)
+
+const (
+	// fhirPrefix is the path under which requests require a token
+	fhirPrefix = "/fhir"
+
+	// SmartConfigurationPath is the path, relative to a FHIR base URL, of the SMART configuration
+	SmartConfigurationPath = "/.well-known/smart-configuration"
+
+	// tenantClaim names the organization a token was issued for, on a server with tenants
+	tenantClaim = "tenant"
+)
+
+// Authorizer validates the bearer tokens of FHIR requests
+type Authorizer struct {
+	config config.AuthConfig
+	keys   *keySet
+	log    logging.FieldLogger
+	// public holds the paths of the capability statements and SMART configurations of every FHIR base URL
+	public map[string]bool
+}
+
+// Enabled reports whether bearer tokens are required
+func (a *Authorizer) Enabled() bool {
+	return a.config.Enabled()
+}
+
+// ServeHTTP rejects FHIR requests without a valid bearer token, and adds the token of the others to their context
+// requests without a bearer token are granted the scopes of client certificates, when their client was authenticated by one
+// the capability statement and SMART configuration are public, so that clients can discover how to authorize
+func (a *Authorizer) ServeHTTP(rw http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if !a.Enabled() {
+		next(rw, req)
+		return
+	}
+	req = req.WithContext(withEnforcement(req.Context()))
+	if !a.requiresToken(req) {
+		next(rw, req)
+		return
+	}
+
+	header := req.Header.Get("Authorization")
+	if header == "" && a.config.ClientCertScopes != "" {
+		if cert := ClientCertificate(req); cert != nil {
+			next(rw, req.WithContext(WithToken(req.Context(), certificateToken(cert, a.config.ClientCertScopes))))
+			return
+		}
+	}
+	if header == "" {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="fhir"`)
+		writeOutcome(rw, http.StatusUnauthorized, models.OperationOutcomeIssueCodeLogin, "a bearer token is required")
+		return
+	}
+	if len(header) < 7 || !strings.EqualFold(header[:7], "bearer ") {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="fhir", error="invalid_request"`)
+		writeOutcome(rw, http.StatusUnauthorized, models.OperationOutcomeIssueCodeLogin, "the Authorization header must hold a bearer token")
+		return
+	}
+	token, err := a.validate(req, strings.TrimSpace(header[7:]))
+	if err != nil {
+		a.log.WithError(err).WithField("path", req.URL.Path).Info("rejected bearer token")
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="fhir", error="invalid_token", error_description=%q`, err.Error()))
+		writeOutcome(rw, http.StatusUnauthorized, models.OperationOutcomeIssueCodeLogin, fmt.Sprintf("invalid bearer token: %s", err.Error()))
+		return
+	}
+	next(rw, req.WithContext(WithToken(req.Context(), token)))
+}
+
+// requiresToken reports whether a request is sent to a FHIR route that is not public
+func (a *Authorizer) requiresToken(req *http.Request) bool {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if path != fhirPrefix && !strings.HasPrefix(path, fhirPrefix+"/") {
+		return false
+	}
+	return req.Method != http.MethodGet || !a.public[path]
+}
+
+// publicPaths lists the paths of the capability statement and SMART configuration of the FHIR base URL of the top
+// level organization and of each tenant, which are the only FHIR routes served without a token
+func publicPaths(appConfig *config.Config) map[string]bool {
+	bases := []string{fhirPrefix}
+	for _, tenant := range appConfig.Tenants {
+		bases = append(bases, fhirPrefix+"/"+tenant.Name)
+	}
+	paths := map[string]bool{}
+	for _, base := range bases {
+		paths[base+"/metadata"] = true
+		paths[base+SmartConfigurationPath] = true
+	}
+	return paths
+}
+
+// validate checks the signature, lifetime, issuer and audience of a token, and reads its scopes and tenant
+func (a *Authorizer) validate(req *http.Request, raw string) (*Token, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, errors.Errorf("unsupported signing method %q", t.Method.Alg())
+		}
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.key(req.Context(), kid)
+	})
+	if err != nil {
+		if vErr, ok := err.(*jwt.ValidationError); ok && vErr.Inner != nil {
+			return nil, vErr.Inner
+		}
+		return nil, err
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("token has no expiry")
+	}
+	if a.config.Issuer != "" && !claims.VerifyIssuer(a.config.Issuer, true) {
+		return nil, errors.New("token was issued by another issuer")
+	}
+	if a.config.Audience != "" && !hasAudience(claims["aud"], a.config.Audience) {
+		return nil, errors.New("token was issued for another audience")
+	}
+
+	token := &Token{}
+	token.Subject, _ = claims["sub"].(string)
+	if token.ClientID, _ = claims["client_id"].(string); token.ClientID == "" {
+		token.ClientID = token.Subject
+	}
+	token.Tenant, _ = claims[tenantClaim].(string)
+	switch scope := claims["scope"].(type) {
+	case string:
+		token.Scopes = ParseScopes(scope)
+	case []interface{}:
+		list := []string{}
+		for _, s := range scope {
+			if str, ok := s.(string); ok {
+				list = append(list, str)
+			}
+		}
+		token.Scopes = ParseScopes(strings.Join(list, " "))
+	default:
+		token.Scopes = Scopes{}
+	}
+	return token, nil
+}
+
+// hasAudience reports whether an aud claim, which is a string or a list of strings, holds an audience
+func hasAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SmartConfiguration publishes the endpoints and capabilities of the authorization server, as required by SMART on FHIR
+func (a *Authorizer) SmartConfiguration(rndr *render.Render) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		doc := map[string]interface{}{
+			"grant_types_supported":    []string{"authorization_code", "client_credentials"},
+			"response_types_supported": []string{"code"},
+			"scopes_supported": []string{
+				"system/*.read", "system/*.write", "system/*.*",
+				"user/*.read", "user/*.write", "user/*.*",
+			},
+			"capabilities": []string{"launch-standalone", "client-public", "client-confidential-symmetric", "permission-user"},
+		}
+		if a.config.AuthorizeURL != "" {
+			doc["authorization_endpoint"] = a.config.AuthorizeURL
+		}
+		if a.config.TokenURL != "" {
+			doc["token_endpoint"] = a.config.TokenURL
+		}
+		if a.config.Issuer != "" {
+			doc["issuer"] = a.config.Issuer
+		}
+		if a.config.JWKSURL != "" {
+			doc["jwks_uri"] = a.config.JWKSURL
+		}
+		rndr.JSON(rw, http.StatusOK, doc)
+	})
+}
+
+// NewAuthorizer ...
+func NewAuthorizer(log *logging.Logger, appConfig *config.Config) (*Authorizer, error) {
+	aLog := log.WithField("component", "auth")
+	c := appConfig.Auth
+	if !c.Enabled() {
+		aLog.Warn("no token issuer or keys are configured, FHIR requests are not authorized")
+		return &Authorizer{config: c, log: aLog, public: publicPaths(appConfig)}, nil
+	}
+	bearer := c.Issuer != "" || c.JWKSURL != "" || len(c.Keys) > 0
+	if bearer && (c.AuthorizeURL == "" || c.TokenURL == "") {
+		aLog.Warn("the authorize_url and token_url of the authorization server are not configured, clients cannot discover them")
+	}
+	static, err := readStaticKeys(c.Keys)
+	if err != nil {
+		return nil, err
+	}
+	refresh := c.JWKSRefresh
+	if refresh <= 0 {
+		refresh = defaultJWKSRefresh
+	}
+	return &Authorizer{
+		config: c,
+		keys: &keySet{
+			client:  &http.Client{Timeout: 10 * time.Second},
+			issuer:  c.Issuer,
+			jwksURL: c.JWKSURL,
+			log:     aLog,
+			refresh: refresh,
+			static:  static,
+		},
+		log:    aLog,
+		public: publicPaths(appConfig),
+	}, nil
+}
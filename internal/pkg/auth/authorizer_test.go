@@ -0,0 +1,186 @@
+package auth_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/urfave/negroni"
+)
+
+func TestParseScopes(t *testing.T) {
+	scopes := auth.ParseScopes("openid launch system/Practitioner.write user/*.read patient/*.* fhirUser")
+	if len(scopes) != 3 {
+		t.Fatalf("expected 3 resource scopes, got %v", scopes)
+	}
+	tests := []struct {
+		resourceType string
+		access       auth.Access
+		allowed      bool
+	}{
+		{"Practitioner", auth.Write, true},
+		{"Practitioner", auth.Read, true},
+		{"Location", auth.Read, true},
+		{"Location", auth.Write, false},
+		{"*", auth.Read, true},
+		{"*", auth.Write, false},
+	}
+	for _, test := range tests {
+		if allowed := scopes.Allows(test.resourceType, test.access); allowed != test.allowed {
+			t.Errorf("%s access to %s: expected %t, got %t", test.access, test.resourceType, test.allowed, allowed)
+		}
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-auth-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "test.pem")
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	appConfig := &config.Config{
+		Auth:    config.AuthConfig{Audience: "https://fhir.example.org", Keys: []string{keyPath}},
+		Tenants: []*config.TenantConfig{{Name: "alpha"}},
+	}
+	authz, err := auth.NewAuthorizer(logging.NewLogger(), appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	router := mux.NewRouter()
+	router.Handle("/fhir/metadata", ok).Methods("GET")
+	router.Handle("/fhir/alpha/metadata", ok).Methods("GET")
+	router.Handle("/fhir/Practitioner/{id}", auth.Require("Practitioner", auth.Read, ok)).Methods("GET")
+	router.Handle("/fhir/.well-known/smart-configuration", auth.Require("Practitioner", auth.Read, ok)).Methods("GET")
+	router.Handle("/fhir/Practitioner", auth.RequireTenant("")(auth.Require("Practitioner", auth.Write, ok))).Methods("POST")
+	router.Handle("/fhir/alpha/Practitioner", auth.RequireTenant("alpha")(auth.Require("Practitioner", auth.Write, ok))).Methods("POST")
+	n := negroni.New(authz)
+	n.UseHandler(router)
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	claims := func(scope string) jwt.MapClaims {
+		return jwt.MapClaims{
+			"aud":       []string{"https://fhir.example.org"},
+			"client_id": "payer",
+			"exp":       time.Now().Add(time.Hour).Unix(),
+			"scope":     scope,
+		}
+	}
+	expired := claims("system/*.*")
+	expired["exp"] = time.Now().Add(-time.Minute).Unix()
+	otherAudience := claims("system/*.*")
+	otherAudience["aud"] = "https://other.example.org"
+	tenant := claims("system/*.*")
+	tenant["tenant"] = "alpha"
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"public capability statement", http.MethodGet, "/fhir/metadata", "", http.StatusOK},
+		{"public capability statement of a tenant", http.MethodGet, "/fhir/alpha/metadata", "", http.StatusOK},
+		{"resource named like a public path", http.MethodGet, "/fhir/Practitioner/metadata", "", http.StatusUnauthorized},
+		{"protected route at a public path", http.MethodGet, "/fhir/.well-known/smart-configuration", "", http.StatusUnauthorized},
+		{"missing token", http.MethodPost, "/fhir/Practitioner", "", http.StatusUnauthorized},
+		{"write scope", http.MethodPost, "/fhir/Practitioner", sign(jwt.SigningMethodRS256, key, claims("system/Practitioner.write")), http.StatusOK},
+		{"read scope", http.MethodPost, "/fhir/Practitioner", sign(jwt.SigningMethodRS256, key, claims("user/*.read")), http.StatusForbidden},
+		{"expired token", http.MethodPost, "/fhir/Practitioner", sign(jwt.SigningMethodRS256, key, expired), http.StatusUnauthorized},
+		{"other audience", http.MethodPost, "/fhir/Practitioner", sign(jwt.SigningMethodRS256, key, otherAudience), http.StatusUnauthorized},
+		{"symmetric signature", http.MethodPost, "/fhir/Practitioner", sign(jwt.SigningMethodHS256, []byte("secret"), claims("system/*.*")), http.StatusUnauthorized},
+		{"token of the tenant", http.MethodPost, "/fhir/alpha/Practitioner", sign(jwt.SigningMethodRS256, key, tenant), http.StatusOK},
+		{"token of a tenant at the top level", http.MethodPost, "/fhir/Practitioner", sign(jwt.SigningMethodRS256, key, tenant), http.StatusForbidden},
+		{"top level token at a tenant", http.MethodPost, "/fhir/alpha/Practitioner", sign(jwt.SigningMethodRS256, key, claims("system/*.*")), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		n.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, rec.Code, rec.Body.String())
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: expected a WWW-Authenticate header", test.name)
+		}
+	}
+}
+
+func TestClientCertificateScopes(t *testing.T) {
+	appConfig := &config.Config{Auth: config.AuthConfig{ClientCertScopes: "system/*.read"}}
+	authz, err := auth.NewAuthorizer(logging.NewLogger(), appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(auth.FromContext(req.Context()).ClientID))
+	})
+	router := mux.NewRouter()
+	router.Handle("/fhir/Practitioner", auth.Require("Practitioner", auth.Read, ok)).Methods("GET")
+	router.Handle("/fhir/Practitioner", auth.Require("Practitioner", auth.Write, ok)).Methods("POST")
+	n := negroni.New(authz)
+	n.UseHandler(router)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "payer", Organization: []string{"Payer Inc"}}}
+	tests := []struct {
+		name   string
+		method string
+		state  *tls.ConnectionState
+		status int
+	}{
+		{"verified certificate", http.MethodGet, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, http.StatusOK},
+		{"scope not granted to certificates", http.MethodPost, &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, http.StatusForbidden},
+		{"unverified certificate", http.MethodGet, &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}, http.StatusUnauthorized},
+		{"no certificate", http.MethodGet, nil, http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/fhir/Practitioner", nil)
+		req.TLS = test.state
+		rec := httptest.NewRecorder()
+		n.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.status, rec.Code, rec.Body.String())
+		}
+		if rec.Code == http.StatusOK && rec.Body.String() != "payer" {
+			t.Errorf("%s: expected the client to be identified by its certificate, got %q", test.name, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package auth
+
+import (
+	"crypto/x509"
+	"net/http"
+)
+
+// ClientCertificate returns the certificate with which the client of a request was authenticated
+// only certificates verified against the client CA bundle are returned, nil otherwise
+func ClientCertificate(req *http.Request) *x509.Certificate {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return req.TLS.VerifiedChains[0][0]
+}
+
+// CertificateIdentity maps the subject of a client certificate to an identity, its common name or else its distinguished name
+func CertificateIdentity(cert *x509.Certificate) string {
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	return cert.Subject.String()
+}
+
+// certificateToken grants the configured scopes to a client authenticated by a certificate
+func certificateToken(cert *x509.Certificate, scopes string) *Token {
+	return &Token{
+		ClientID: CertificateIdentity(cert),
+		Scopes:   ParseScopes(scopes),
+		Subject:  cert.Subject.String(),
+	}
+}
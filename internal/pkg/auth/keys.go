@@ -0,0 +1,219 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// defaultJWKSRefresh is the shortest interval between fetches of the JWKS when none is configured
+const defaultJWKSRefresh = time.Minute
+
+// errUnknownKey is returned when a token is signed with a key that is not in the key set
+var errUnknownKey = errors.New("token is signed with an unknown key")
+
+// jwk is a JSON Web Key, of which only the RSA and EC public key parameters are used
+type jwk struct {
+	Crv string `json:"crv"`
+	E   string `json:"e"`
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	Use string `json:"use"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts the key to an *rsa.PublicKey or *ecdsa.PublicKey
+func (k *jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid modulus")
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid x coordinate")
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid y coordinate")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// keySet holds the keys with which tokens are verified, by key ID
+// keys published by the issuer are fetched again when a token is signed with an unknown key
+type keySet struct {
+	client    *http.Client
+	issuer    string
+	jwksURL   string
+	keys      map[string]interface{}
+	lastFetch time.Time
+	log       logging.FieldLogger
+	mutex     sync.Mutex
+	refresh   time.Duration
+	static    map[string]interface{}
+}
+
+// key returns the key of a key ID
+// a token without a key ID is verified with the only key of the set, when there is a single one
+func (s *keySet) key(ctx context.Context, kid string) (interface{}, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if k, ok := s.find(kid); ok {
+		return k, nil
+	}
+	if s.jwksURL == "" && s.issuer == "" {
+		return nil, errUnknownKey
+	}
+	if !s.lastFetch.IsZero() && time.Since(s.lastFetch) < s.refresh {
+		return nil, errUnknownKey
+	}
+	s.lastFetch = time.Now()
+	if err := s.fetch(ctx); err != nil {
+		s.log.WithError(err).Error("failed to fetch signing keys")
+		return nil, errors.Wrap(err, "failed to fetch signing keys")
+	}
+	if k, ok := s.find(kid); ok {
+		return k, nil
+	}
+	return nil, errUnknownKey
+}
+
+func (s *keySet) find(kid string) (interface{}, bool) {
+	if k, ok := s.static[kid]; ok {
+		return k, true
+	}
+	if k, ok := s.keys[kid]; ok {
+		return k, true
+	}
+	if kid != "" || len(s.static)+len(s.keys) != 1 {
+		return nil, false
+	}
+	for _, k := range s.static {
+		return k, true
+	}
+	for _, k := range s.keys {
+		return k, true
+	}
+	return nil, false
+}
+
+// fetch replaces the keys published by the issuer, discovering the JWKS URL from its OpenID configuration if needed
+func (s *keySet) fetch(ctx context.Context) error {
+	if s.jwksURL == "" {
+		discovery := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		if err := s.getJSON(ctx, strings.TrimSuffix(s.issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+			return errors.Wrap(err, "failed to read OpenID configuration of issuer")
+		}
+		if discovery.JWKSURI == "" {
+			return errors.New("OpenID configuration of issuer has no jwks_uri")
+		}
+		s.jwksURL = discovery.JWKSURI
+	}
+
+	set := struct {
+		Keys []*jwk `json:"keys"`
+	}{}
+	if err := s.getJSON(ctx, s.jwksURL, &set); err != nil {
+		return errors.Wrap(err, "failed to read JWKS")
+	}
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			s.log.WithError(err).WithField("kid", k.Kid).Warn("skipping unusable key of JWKS")
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	s.keys = keys
+	s.log.WithField("keys", len(keys)).Info("fetched signing keys")
+	return nil
+}
+
+func (s *keySet) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("%s responded with status %d", url, res.StatusCode)
+	}
+	return errors.Wrap(json.NewDecoder(res.Body).Decode(v), "failed to decode response")
+}
+
+// readStaticKeys loads PEM encoded RSA or EC public keys, whose key ID is the name of their file without extension
+func readStaticKeys(paths []string) (map[string]interface{}, error) {
+	keys := map[string]interface{}{}
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read key file")
+		}
+		var key interface{}
+		if key, err = jwt.ParseRSAPublicKeyFromPEM(data); err != nil {
+			if key, err = jwt.ParseECPublicKeyFromPEM(data); err != nil {
+				return nil, errors.Errorf("%s does not hold a PEM encoded RSA or EC public key", path)
+			}
+		}
+		name := filepath.Base(path)
+		keys[strings.TrimSuffix(name, filepath.Ext(name))] = key
+	}
+	return keys, nil
+}
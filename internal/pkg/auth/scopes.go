@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+)
+
+// Access is the kind of access to resources granted by a scope
+type Access string
+
+// Access values
+const (
+	Read  Access = "read"
+	Write Access = "write"
+)
+
+// Scope is a SMART on FHIR resource scope, e.g. system/Practitioner.write or user/*.read
+type Scope struct {
+	Access       string
+	Context      string
+	ResourceType string
+}
+
+// String ...
+func (s Scope) String() string {
+	return fmt.Sprintf("%s/%s.%s", s.Context, s.ResourceType, s.Access)
+}
+
+// allows reports whether the scope grants an access to the resources of a type
+// patient scopes are not honoured, since the resources served are not in a patient compartment
+func (s Scope) allows(resourceType string, access Access) bool {
+	if s.Context != "user" && s.Context != "system" {
+		return false
+	}
+	return (s.ResourceType == "*" || s.ResourceType == resourceType) && (s.Access == "*" || s.Access == string(access))
+}
+
+// Scopes are the resource scopes granted to a token
+type Scopes []Scope
+
+// ParseScopes reads the resource scopes of a space separated list, ignoring other scopes such as openid or launch
+func ParseScopes(list string) Scopes {
+	scopes := Scopes{}
+	for _, s := range strings.Fields(list) {
+		slash := strings.Index(s, "/")
+		dot := strings.LastIndex(s, ".")
+		if slash <= 0 || dot < slash+2 || dot == len(s)-1 {
+			continue
+		}
+		scopes = append(scopes, Scope{
+			Access:       s[dot+1:],
+			Context:      s[:slash],
+			ResourceType: s[slash+1 : dot],
+		})
+	}
+	return scopes
+}
+
+// Allows reports whether any of the scopes grants an access to the resources of a type
+// a resource type of * requires a scope that covers all types
+func (s Scopes) Allows(resourceType string, access Access) bool {
+	for _, scope := range s {
+		if scope.allows(resourceType, access) {
+			return true
+		}
+	}
+	return false
+}
+
+// Token is the validated bearer token of a request
+type Token struct {
+	// ClientID identifies the client the token was issued to, from the client_id claim or the subject
+	ClientID string
+	Scopes   Scopes
+	Subject  string
+	// Tenant is the organization the token was issued for, from the tenant claim, empty for the top level organization
+	Tenant string
+}
+
+type contextKey string
+
+const (
+	tokenKey    contextKey = "token"
+	enforcedKey contextKey = "enforced"
+)
+
+// WithToken returns a context that holds the token of a request
+func WithToken(ctx context.Context, token *Token) context.Context {
+	return context.WithValue(ctx, tokenKey, token)
+}
+
+// FromContext returns the token of a request, which is nil when authorization is disabled
+func FromContext(ctx context.Context) *Token {
+	token, _ := ctx.Value(tokenKey).(*Token)
+	return token
+}
+
+// withEnforcement marks the requests of a server that requires tokens, so that the routes reached without one reject them
+func withEnforcement(ctx context.Context) context.Context {
+	return context.WithValue(ctx, enforcedKey, true)
+}
+
+// Require only passes requests to next when their token grants an access to the resources of a type
+// requests without a token are passed on when authorization is disabled, and rejected otherwise, since they can
+// only get here through a public path
+func Require(resourceType string, access Access, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token := FromContext(req.Context())
+		if token == nil {
+			if enforced, _ := req.Context().Value(enforcedKey).(bool); enforced {
+				rw.Header().Set("WWW-Authenticate", `Bearer realm="fhir"`)
+				writeOutcome(rw, http.StatusUnauthorized, models.OperationOutcomeIssueCodeLogin, "a bearer token is required")
+				return
+			}
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if token.Scopes.Allows(resourceType, access) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		required := Scope{Access: string(access), Context: "system", ResourceType: resourceType}
+		rw.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, required))
+		writeOutcome(rw, http.StatusForbidden, models.OperationOutcomeIssueCodeForbidden,
+			fmt.Sprintf("the token does not grant %s access to %s resources", access, resourceType))
+	})
+}
+
+// RequireTenant only passes requests to next when their token was issued for a tenant, or for the top level
+// organization when tenant is empty, so that the tokens of an organization cannot reach the resources of another
+// requests without a token are passed on, since the middleware rejects them when authorization is enabled
+func RequireTenant(tenant string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			token := FromContext(req.Context())
+			if token == nil || token.Tenant == tenant {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			writeOutcome(rw, http.StatusForbidden, models.OperationOutcomeIssueCodeForbidden, "the token was issued for another organization")
+		})
+	}
+}
+
+// writeOutcome reports an authorization failure as a FHIR OperationOutcome
+func writeOutcome(rw http.ResponseWriter, status int, code models.OperationOutcomeIssueCode, diagnostics string) {
+	rw.Header().Set("Content-Type", fmt.Sprintf("application/fhir+json; fhirVersion=%s", models.FHIRVersion))
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(&models.OperationOutcome{
+		Issue: []*models.OperationOutcomeIssue{
+			{Severity: models.OperationOutcomeIssueSeverityError, Code: code, Diagnostics: diagnostics},
+		},
+	})
+}
@@ -1,6 +1,11 @@
 package config
 
 import (
+	"encoding/hex"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
 	"github.com/ethereum/go-ethereum/common"
 	homedir "github.com/mitchellh/go-homedir"
@@ -15,41 +20,173 @@ type ObjectCollectionContract struct {
 	Name    string
 	Address common.Address
 	Indexes []*ObjectIndex
+	Tenant  string
+	// StartBlock is a block before the deployment of the contract, from which its events are read
+	StartBlock uint64
+	// IndexSecret keys the HMAC of the values held by the index contracts, so that they are not readable on chain
+	IndexSecret []byte
+}
+
+// StorageName identifies the collection in the database, which is shared by the tenants of a server
+func (c *ObjectCollectionContract) StorageName() string {
+	if c.Tenant == "" {
+		return c.Name
+	}
+	return c.Tenant + "/" + c.Name
 }
 
 // ObjectIndex contains information about a ObjectIndex smart contract
 type ObjectIndex struct {
-	Name     string
-	Address  common.Address
-	JSONPath *jsonpath.Compiled
+	Name        string
+	Address     common.Address
+	JSONPath    *jsonpath.Compiled
+	SearchParam string
+}
+
+// SignerConfig selects how transactions are signed
+type SignerConfig struct {
+	// Address is the account of an external signer, which may be omitted when the signer has a single account
+	Address        string        `mapstructure:"address"`
+	Keystore       string        `mapstructure:"keystore"`
+	PassphraseFile string        `mapstructure:"passphrase_file"`
+	Timeout        time.Duration `mapstructure:"timeout"`
+	// Type is private_key (dev mode only), keystore or external
+	Type string `mapstructure:"type"`
+	URL  string `mapstructure:"url"`
+}
+
+// AuthConfig selects how the bearer tokens of FHIR requests are validated
+// authorization is enabled when an issuer, a JWKS URL, static keys or the scopes of client certificates are configured
+// the tokens of a tenant name it in their tenant claim, and tokens without one are only accepted by the top level organization
+type AuthConfig struct {
+	// Audience is the value required in the aud claim of tokens, which is not checked when empty
+	Audience     string `mapstructure:"audience"`
+	AuthorizeURL string `mapstructure:"authorize_url"`
+	// ClientCertScopes are granted to clients authenticated by a verified certificate, which send no bearer token
+	ClientCertScopes string `mapstructure:"client_cert_scopes"`
+	// Issuer is the value required in the iss claim of tokens, whose signing keys are discovered from its OpenID configuration
+	Issuer  string `mapstructure:"issuer"`
+	JWKSURL string `mapstructure:"jwks_url"`
+	// JWKSRefresh is the shortest interval between fetches of the JWKS, when a token is signed with an unknown key
+	JWKSRefresh time.Duration `mapstructure:"jwks_refresh"`
+	// Keys are files holding PEM encoded public keys, named by their key ID, e.g. for tests
+	Keys     []string `mapstructure:"keys"`
+	TokenURL string   `mapstructure:"token_url"`
+}
+
+// Enabled reports whether bearer tokens are required
+func (a AuthConfig) Enabled() bool {
+	return a.Issuer != "" || a.JWKSURL != "" || len(a.Keys) > 0 || a.ClientCertScopes != ""
 }
 
+// TenantConfig is an organization served by a multi-tenant server, with its own contracts and signer
+type TenantConfig struct {
+	Contracts            map[string]interface{} `mapstructure:"contracts"`
+	EncryptionKeys       []string               `mapstructure:"encryption_keys"`
+	EncryptionRecipients []string               `mapstructure:"encryption_recipients"`
+	Name                 string                 `mapstructure:"name"`
+	OrganizationName     string                 `mapstructure:"org_name"`
+	PrivateKey           string                 `mapstructure:"private_key"`
+	Signer               SignerConfig           `mapstructure:"signer"`
+
+	OrganizationContract      common.Address
+	ObjectCollectionContracts map[string]*ObjectCollectionContract
+}
+
+// tenantNamePattern restricts tenant names to URL path segments that cannot be mistaken for resource types
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
 // Config contains application configuration information
 type Config struct {
-	Address                   string   `mapstructure:"address"`
-	CORSAllowCredentials      bool     `mapstructure:"cors_allow_credentials"`
-	CORSAllowedHeaders        []string `mapstructure:"cors_allowed_headers"`
-	CORSAllowedMethods        []string `mapstructure:"cors_allowed_methods"`
-	CORSAllowedOrigins        []string `mapstructure:"cors_allowed_origins"`
-	CORSExposedHeaders        []string `mapstructure:"cors_exposed_headers"`
-	CORSMaxAge                int      `mapstructure:"cors_max_age"`
-	DatabaseConnectionString  string   `mapstructure:"db_conn_str"`
-	DatabaseType              string   `mapstructure:"db_type"`
-	DevMode                   bool     `mapstructure:"dev_mode"`
-	GasLimit                  uint64   `mapstructure:"gas_limit"`
-	GasPrice                  int64    `mapstructure:"gas_price"`
-	LogFormat                 string   `mapstructure:"log_format"`
-	LogLevel                  string   `mapstructure:"log_level"`
-	PrivateKey                string   `mapstructure:"private_key"`
-	Profile                   bool     `mapstructure:"profile"`
-	RPCURL                    string   `mapstructure:"rpc_url"`
-	TransactionsChannelBuffer uint     `mapstructure:"txns_buffer"`
-	Pprof                     bool     `mapstructure:"pprof"`
+	Address                   string            `mapstructure:"address"`
+	AuditAnchorInterval       time.Duration     `mapstructure:"audit_anchor_interval"`
+	Auth                      AuthConfig        `mapstructure:"auth"`
+	CORSAllowCredentials      bool              `mapstructure:"cors_allow_credentials"`
+	CORSAllowedHeaders        []string          `mapstructure:"cors_allowed_headers"`
+	CORSAllowedMethods        []string          `mapstructure:"cors_allowed_methods"`
+	CORSAllowedOrigins        []string          `mapstructure:"cors_allowed_origins"`
+	CORSExposedHeaders        []string          `mapstructure:"cors_exposed_headers"`
+	CORSMaxAge                int               `mapstructure:"cors_max_age"`
+	ChainID                   int64             `mapstructure:"chain_id"`
+	DatabaseConnectionString  string            `mapstructure:"db_conn_str"`
+	DatabaseType              string            `mapstructure:"db_type"`
+	DevMode                   bool              `mapstructure:"dev_mode"`
+	EncryptionKeys            []string          `mapstructure:"encryption_keys"`
+	EncryptionRecipients      []string          `mapstructure:"encryption_recipients"`
+	ExportDir                 string            `mapstructure:"export_dir"`
+	FetchAllowedHosts         []string          `mapstructure:"fetch_allowed_hosts"`
+	FetchFileRoot             string            `mapstructure:"fetch_file_root"`
+	FetchMaxSize              int64             `mapstructure:"fetch_max_size"`
+	FetchTimeout              time.Duration     `mapstructure:"fetch_timeout"`
+	GasLimit                  uint64            `mapstructure:"gas_limit"`
+	GasLimitMultiplier        float64           `mapstructure:"gas_limit_multiplier"`
+	GasPrice                  int64             `mapstructure:"gas_price"`
+	GasPriceBlocks            int               `mapstructure:"gas_price_blocks"`
+	GasPricePercentile        int               `mapstructure:"gas_price_percentile"`
+	GasPriceStrategy          string            `mapstructure:"gas_price_strategy"`
+	IPFSMaxSize               int64             `mapstructure:"ipfs_max_size"`
+	IPFSThreshold             int               `mapstructure:"ipfs_threshold"`
+	IPFSTimeout               time.Duration     `mapstructure:"ipfs_timeout"`
+	IPFSURL                   string            `mapstructure:"ipfs_url"`
+	LogFormat                 string            `mapstructure:"log_format"`
+	LogLevel                  string            `mapstructure:"log_level"`
+	Mirror                    bool              `mapstructure:"mirror"`
+	MirrorPollInterval        time.Duration     `mapstructure:"mirror_poll_interval"`
+	MirrorReorgDepth          uint64            `mapstructure:"mirror_reorg_depth"`
+	MirrorStartBlock          uint64            `mapstructure:"mirror_start_block"`
+	OrganizationName          string            `mapstructure:"org_name"`
+	PrivateKey                string            `mapstructure:"private_key"`
+	Profile                   bool              `mapstructure:"profile"`
+	ReadFrom                  string            `mapstructure:"read_from"`
+	RPCURL                    string            `mapstructure:"rpc_url"`
+	Signer                    SignerConfig      `mapstructure:"signer"`
+	Storage                   map[string]string `mapstructure:"storage"`
+	SubscriptionPollInterval  time.Duration     `mapstructure:"subscription_poll_interval"`
+	SubscriptionRetries       int               `mapstructure:"subscription_retries"`
+	SubscriptionRetryDelay    time.Duration     `mapstructure:"subscription_retry_delay"`
+	SubscriptionTimeout       time.Duration     `mapstructure:"subscription_timeout"`
+	SubscriptionWorkers       int               `mapstructure:"subscription_workers"`
+	Tenant                    string            `mapstructure:"-"`
+	TenantHeader              string            `mapstructure:"tenant_header"`
+	Tenants                   []*TenantConfig   `mapstructure:"-"`
+	TLSCertFile               string            `mapstructure:"tls_cert_file"`
+	TLSClientCAFile           string            `mapstructure:"tls_client_ca_file"`
+	TLSClientCertRequired     bool              `mapstructure:"tls_client_cert_required"`
+	TLSKeyFile                string            `mapstructure:"tls_key_file"`
+	TransactionDropAfter      time.Duration     `mapstructure:"txn_drop_after"`
+	TransactionGasPriceBump   int64             `mapstructure:"txn_gas_price_bump"`
+	TransactionMaxGasPrice    int64             `mapstructure:"txn_max_gas_price"`
+	TransactionResubmitAfter  time.Duration     `mapstructure:"txn_resubmit_after"`
+	TransactionTimeout        time.Duration     `mapstructure:"txn_timeout"`
+	TransactionWait           time.Duration     `mapstructure:"txn_wait"`
+	TransactionsChannelBuffer uint              `mapstructure:"txns_buffer"`
+	TrustedProxies            []string          `mapstructure:"trusted_proxies"`
+	Pprof                     bool              `mapstructure:"pprof"`
 
 	OrganizationContract      common.Address
 	ObjectCollectionContracts map[string]*ObjectCollectionContract
 }
 
+// HasOrganization reports whether an organization is configured at the top level, rather than only for tenants
+func (c *Config) HasOrganization() bool {
+	return c.OrganizationContract != (common.Address{}) || len(c.ObjectCollectionContracts) > 0
+}
+
+// ForTenant returns the configuration of a tenant, which shares the other settings of the server
+func (c *Config) ForTenant(t *TenantConfig) *Config {
+	tc := *c
+	tc.EncryptionKeys = t.EncryptionKeys
+	tc.EncryptionRecipients = t.EncryptionRecipients
+	tc.ObjectCollectionContracts = t.ObjectCollectionContracts
+	tc.OrganizationContract = t.OrganizationContract
+	tc.OrganizationName = t.OrganizationName
+	tc.PrivateKey = t.PrivateKey
+	tc.Signer = t.Signer
+	tc.Tenant = t.Name
+	tc.Tenants = nil
+	return &tc
+}
+
 // GlobalSettings holds settings configured by global flags, accessible outside of fx app context
 var GlobalSettings = struct {
 	ConfigFile string
@@ -83,13 +220,23 @@ func NewConfig(log *logging.Logger) (*Config, error) {
 		return nil, errors.Wrap(err, "unable to read configuration")
 	}
 
-	// special contracts configuration setup
-	c.OrganizationContract = common.HexToAddress(viper.GetString("contracts.organization.address"))
-	contractsConfig, err := parseContractsConfiguration(viper.GetStringMap("contracts"))
+	tenants, err := parseTenantsConfiguration()
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to parse contracts configuration")
+		return nil, errors.Wrap(err, "failed to parse tenants configuration")
+	}
+	c.Tenants = tenants
+
+	// special contracts configuration setup
+	c.ObjectCollectionContracts = map[string]*ObjectCollectionContract{}
+	if viper.IsSet("contracts") || len(tenants) == 0 {
+		// a multi-tenant server may serve only its tenants
+		c.OrganizationContract = common.HexToAddress(viper.GetString("contracts.organization.address"))
+		contractsConfig, err := parseContractsConfiguration(viper.GetStringMap("contracts"))
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse contracts configuration")
+		}
+		c.ObjectCollectionContracts = contractsConfig
 	}
-	c.ObjectCollectionContracts = contractsConfig
 
 	// set up logger
 	logging.SetLevel(log, c.LogLevel)
@@ -101,6 +248,37 @@ func NewConfig(log *logging.Logger) (*Config, error) {
 	return c, nil
 }
 
+// parseTenantsConfiguration parses the tenants section of the config file
+func parseTenantsConfiguration() ([]*TenantConfig, error) {
+	tenants := []*TenantConfig{}
+	if err := viper.UnmarshalKey("tenants", &tenants); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, t := range tenants {
+		if !tenantNamePattern.MatchString(t.Name) {
+			return nil, errors.Errorf("invalid tenant name %q, names must be lowercase letters, digits, '-' and '_'", t.Name)
+		}
+		if names[t.Name] {
+			return nil, errors.Errorf("duplicate tenant %q", t.Name)
+		}
+		names[t.Name] = true
+		if org, ok := t.Contracts["organization"].(map[interface{}]interface{}); ok {
+			address, _ := org["address"].(string)
+			t.OrganizationContract = common.HexToAddress(address)
+		}
+		contractsConfig, err := parseContractsConfiguration(t.Contracts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse contracts configuration of tenant %q", t.Name)
+		}
+		for _, coll := range contractsConfig {
+			coll.Tenant = t.Name
+		}
+		t.ObjectCollectionContracts = contractsConfig
+	}
+	return tenants, nil
+}
+
 // parseContractsConfiguration parses contract configurations from the config file
 func parseContractsConfiguration(in map[string]interface{}) (map[string]*ObjectCollectionContract, error) {
 	newMap := map[string]*ObjectCollectionContract{}
@@ -112,30 +290,49 @@ func parseContractsConfiguration(in map[string]interface{}) (map[string]*ObjectC
 	for _, rawColl := range rawCollArr {
 		collData := rawColl.(map[interface{}]interface{})
 		cName := collData["name"].(string)
-		cAddr := common.HexToAddress(collData["address"].(string))
+		// collections held in the database have no contract
+		rawCAddr, _ := collData["address"].(string)
+		cAddr := common.HexToAddress(rawCAddr)
+		startBlock, _ := collData["start_block"].(int)
+		if startBlock < 0 {
+			return newMap, errors.Errorf("invalid start block of collection %q", cName)
+		}
+		var indexSecret []byte
+		if rawSecret, _ := collData["index_secret"].(string); rawSecret != "" {
+			var err error
+			indexSecret, err = hex.DecodeString(strings.TrimPrefix(rawSecret, "0x"))
+			if err != nil || len(indexSecret) < 32 {
+				return newMap, errors.Errorf("index secret of collection %q must be at least 32 hex encoded bytes", cName)
+			}
+		}
 		idxColl := []*ObjectIndex{}
 		if rawIdxs, ok := collData["indexes"].([]interface{}); ok {
 			for _, rawIdx := range rawIdxs {
 				idxData := rawIdx.(map[interface{}]interface{})
 				idxName := idxData["name"].(string)
-				idxAddr := common.HexToAddress(idxData["address"].(string))
+				rawIdxAddr, _ := idxData["address"].(string)
+				idxAddr := common.HexToAddress(rawIdxAddr)
 				idxPath := idxData["path"].(string)
 				idxPathCompiled, err := jsonpath.Compile(idxPath)
 				if err != nil {
 					return newMap, errors.Wrapf(err, "unable to compile JSON path %q", idxPath)
 				}
+				idxSearchParam, _ := idxData["search_param"].(string)
 				newIdx := ObjectIndex{
-					Name:     idxName,
-					Address:  idxAddr,
-					JSONPath: idxPathCompiled,
+					Name:        idxName,
+					Address:     idxAddr,
+					JSONPath:    idxPathCompiled,
+					SearchParam: idxSearchParam,
 				}
 				idxColl = append(idxColl, &newIdx)
 			}
 		}
 		newMap[cName] = &ObjectCollectionContract{
-			Name:    cName,
-			Address: cAddr,
-			Indexes: idxColl,
+			Name:        cName,
+			Address:     cAddr,
+			Indexes:     idxColl,
+			StartBlock:  uint64(startBlock),
+			IndexSecret: indexSecret,
 		}
 	}
 	return newMap, nil
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// WriteContractsFile writes a copy of the config file in use to path, with the addresses of the organization and
+// collections of a tenant, or of the top level organization when tenant is empty, and the start blocks of the
+// collections filled in
+// the config file must be YAML, and its comments and secrets are not copied
+func WriteContractsFile(path string, tenant string, organization common.Address, collections map[string]*ObjectCollectionContract) error {
+	in, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return errors.Wrap(err, "failed to read config file")
+	}
+	out, err := setContractAddresses(in, tenant, organization, collections)
+	if err != nil {
+		return err
+	}
+	// the mode of an existing file is changed before it is written, as it may have been readable by others
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to write config file")
+	}
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write config file")
+	}
+	if _, err := f.Write(out); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to write config file")
+	}
+	return errors.Wrap(f.Close(), "failed to write config file")
+}
+
+// secretKeys are the keys of the config file whose values are secret, in the top level section and those of tenants
+var secretKeys = []string{"encryption_keys", "private_key", "signer"}
+
+// setContractAddresses sets the addresses of the contracts section of a YAML config file, keeping the order of its keys
+// the organization address is left as it is when it is the zero address, i.e. when its deployment failed
+// the secrets of the file are removed, including the index secrets of collections
+func setContractAddresses(in []byte, tenant string, organization common.Address, collections map[string]*ObjectCollectionContract) ([]byte, error) {
+	doc := yaml.MapSlice{}
+	if err := yaml.Unmarshal(in, &doc); err != nil {
+		return nil, errors.Wrap(err, "failed to parse config file")
+	}
+	update := func(section interface{}) yaml.MapSlice {
+		contracts, _ := section.(yaml.MapSlice)
+		if organization != (common.Address{}) {
+			org, _ := getKey(contracts, "organization").(yaml.MapSlice)
+			contracts = setKey(contracts, "organization", setKey(org, "address", organization.Hex()))
+		}
+		rawColls, _ := getKey(contracts, "collections").([]interface{})
+		for i, rawColl := range rawColls {
+			coll, ok := rawColl.(yaml.MapSlice)
+			if !ok {
+				continue
+			}
+			name, _ := getKey(coll, "name").(string)
+			c, ok := collections[name]
+			if !ok {
+				continue
+			}
+			if c.Address != (common.Address{}) {
+				coll = setKey(coll, "address", c.Address.Hex())
+			}
+			if c.StartBlock != 0 {
+				coll = setKey(coll, "start_block", c.StartBlock)
+			}
+			rawIdxs, _ := getKey(coll, "indexes").([]interface{})
+			for j, rawIdx := range rawIdxs {
+				idx, ok := rawIdx.(yaml.MapSlice)
+				if !ok {
+					continue
+				}
+				idxName, _ := getKey(idx, "name").(string)
+				for _, index := range c.Indexes {
+					if index.Name == idxName && index.Address != (common.Address{}) {
+						rawIdxs[j] = setKey(idx, "address", index.Address.Hex())
+					}
+				}
+			}
+			rawColls[i] = coll
+		}
+		return contracts
+	}
+
+	if tenant == "" {
+		doc = setKey(doc, "contracts", update(getKey(doc, "contracts")))
+	} else {
+		found := false
+		rawTenants, _ := getKey(doc, "tenants").([]interface{})
+		for i, rawTenant := range rawTenants {
+			t, ok := rawTenant.(yaml.MapSlice)
+			if !ok || getKey(t, "name") != tenant {
+				continue
+			}
+			rawTenants[i] = setKey(t, "contracts", update(getKey(t, "contracts")))
+			found = true
+		}
+		if !found {
+			return nil, errors.Errorf("tenant %q is not in the config file", tenant)
+		}
+	}
+
+	doc = removeSecrets(doc)
+	rawTenants, _ := getKey(doc, "tenants").([]interface{})
+	for i, rawTenant := range rawTenants {
+		if t, ok := rawTenant.(yaml.MapSlice); ok {
+			rawTenants[i] = removeSecrets(t)
+		}
+	}
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to write config file")
+	}
+	return out, nil
+}
+
+// removeSecrets removes the secrets of the top level section of a config file or of a tenant
+func removeSecrets(section yaml.MapSlice) yaml.MapSlice {
+	for _, key := range secretKeys {
+		section = deleteKey(section, key)
+	}
+	contracts, _ := getKey(section, "contracts").(yaml.MapSlice)
+	rawColls, _ := getKey(contracts, "collections").([]interface{})
+	for i, rawColl := range rawColls {
+		if coll, ok := rawColl.(yaml.MapSlice); ok {
+			rawColls[i] = deleteKey(coll, "index_secret")
+		}
+	}
+	return section
+}
+
+// getKey returns the value of a key of a YAML mapping, or nil
+func getKey(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+	return nil
+}
+
+// setKey sets the value of a key of a YAML mapping, appending the key when it is missing
+func setKey(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i, item := range m {
+		if item.Key == key {
+			m[i].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
+
+// deleteKey removes a key from a YAML mapping
+func deleteKey(m yaml.MapSlice, key string) yaml.MapSlice {
+	out := yaml.MapSlice{}
+	for _, item := range m {
+		if item.Key != key {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,150 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/spf13/viper"
+)
+
+const contractsFile = `address: 0.0.0.0:8080
+private_key: "0x01"
+signer:
+  type: keystore
+  passphrase_file: /etc/fhir-api/passphrase
+encryption_keys:
+- org:0102
+contracts:
+  collections:
+  - name: Practitioner
+    index_secret: "0x03"
+    indexes:
+    - name: Global NPI
+      path: $.identifier.value
+      search_param: identifier
+  - name: Location
+    address: "0x0000000000000000000000000000000000000003"
+tenants:
+- name: clinic
+  private_key: "0x04"
+  contracts:
+    collections:
+    - name: Location
+`
+
+func TestSetContractAddresses(t *testing.T) {
+	collections := map[string]*ObjectCollectionContract{
+		"Practitioner": {
+			Name:       "Practitioner",
+			Address:    common.HexToAddress("0x1"),
+			Indexes:    []*ObjectIndex{{Name: "Global NPI", Address: common.HexToAddress("0x2")}},
+			StartBlock: 12,
+		},
+		"Location": {Name: "Location", Address: common.HexToAddress("0x3")},
+	}
+	out, err := setContractAddresses([]byte(contractsFile), "", common.HexToAddress("0x4"), collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `address: 0.0.0.0:8080
+contracts:
+  collections:
+  - name: Practitioner
+    indexes:
+    - name: Global NPI
+      path: $.identifier.value
+      search_param: identifier
+      address: "0x0000000000000000000000000000000000000002"
+    address: "0x0000000000000000000000000000000000000001"
+    start_block: 12
+  - name: Location
+    address: "0x0000000000000000000000000000000000000003"
+  organization:
+    address: "0x0000000000000000000000000000000000000004"
+tenants:
+- name: clinic
+  contracts:
+    collections:
+    - name: Location
+`
+	if string(out) != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, out)
+	}
+
+	out, err = setContractAddresses([]byte(contractsFile), "clinic", common.HexToAddress("0x5"), map[string]*ObjectCollectionContract{
+		"Location": {Name: "Location", Address: common.HexToAddress("0x6")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantSection := out[strings.Index(string(out), "tenants:"):]
+	expected = `tenants:
+- name: clinic
+  contracts:
+    collections:
+    - name: Location
+      address: "0x0000000000000000000000000000000000000006"
+    organization:
+      address: "0x0000000000000000000000000000000000000005"
+`
+	if string(tenantSection) != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, tenantSection)
+	}
+
+	if _, err := setContractAddresses([]byte(contractsFile), "hospital", common.Address{}, nil); err == nil {
+		t.Fatal("expected an unknown tenant to be rejected")
+	}
+
+	// the addresses of the contracts deployed before a failed deployment are written without an organization
+	out, err = setContractAddresses([]byte(contractsFile), "", common.Address{}, map[string]*ObjectCollectionContract{
+		"Practitioner": {Name: "Practitioner", Address: common.HexToAddress("0x1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "organization") || !strings.Contains(string(out), `address: "0x0000000000000000000000000000000000000001"`) {
+		t.Fatalf("expected the collection address without an organization, got\n%s", out)
+	}
+}
+
+func TestWriteContractsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-contracts-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(in, []byte(contractsFile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.SetConfigFile(in)
+	defer viper.Reset()
+
+	out := filepath.Join(dir, "deployed.yaml")
+	if err := ioutil.WriteFile(out, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteContractsFile(out, "", common.HexToAddress("0x4"), nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("expected the file to be readable by its owner only, got %v", mode)
+	}
+	written, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"private_key", "signer", "passphrase_file", "encryption_keys", "index_secret"} {
+		if strings.Contains(string(written), secret) {
+			t.Fatalf("expected %s not to be copied, got\n%s", secret, written)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package format
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gobuffalo/packr/v2"
+	"github.com/gorilla/websocket"
+)
+
+// fhirPrefix is the path under which requests and responses are converted
+const fhirPrefix = "/fhir"
+
+var (
+	jsonContentType = fmt.Sprintf("application/fhir+json; fhirVersion=%s", models.FHIRVersion)
+	xmlContentType  = fmt.Sprintf("application/fhir+xml; fhirVersion=%s", models.FHIRVersion)
+)
+
+// Negotiator lets clients exchange FHIR XML with the API, which handles JSON only
+// XML request bodies are converted to JSON before they reach the handlers, so that they are validated against the JSON schema,
+// and the JSON responses of the clients that ask for XML, with the Accept header or the _format parameter, are converted to XML
+type Negotiator struct {
+	codec *models.XMLCodec
+	log   logging.FieldLogger
+}
+
+// ServeHTTP converts the body of a FHIR request and its response to the formats of the client and the handlers
+// websocket upgrades are passed on untouched, since their connection is hijacked from the response writer
+func (n *Negotiator) ServeHTTP(rw http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	if (path != fhirPrefix && !strings.HasPrefix(path, fhirPrefix+"/")) || websocket.IsWebSocketUpgrade(req) {
+		next(rw, req)
+		return
+	}
+
+	if wantsXML(req) {
+		xw := &xmlResponseWriter{ResponseWriter: rw}
+		defer n.finish(xw)
+		rw = xw
+	}
+	if isXML(req.Header.Get("Content-Type")) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeOutcome(rw, http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, "unable to read request body")
+			return
+		}
+		if len(bytes.TrimSpace(body)) > 0 {
+			if body, err = n.codec.ToJSON(body); err != nil {
+				writeOutcome(rw, http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, fmt.Sprintf("request body is not valid FHIR XML: %s", err.Error()))
+				return
+			}
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+		req.Header.Set("Content-Type", jsonContentType)
+		req.Header.Del("Content-Length")
+	}
+	next(rw, req)
+}
+
+// finish writes the buffered JSON response as XML
+// responses that are not FHIR resources, e.g. the manifests of bulk data exports, are written as JSON
+func (n *Negotiator) finish(w *xmlResponseWriter) {
+	if w.buf == nil {
+		return
+	}
+	body := w.buf.Bytes()
+	if len(bytes.TrimSpace(body)) > 0 {
+		if doc, err := n.codec.ToXML(body); err != nil {
+			n.log.WithError(err).Debug("response is not a FHIR resource, it is sent as JSON")
+		} else {
+			body = doc
+			w.Header().Set("Content-Type", xmlContentType)
+		}
+	}
+	w.Header().Del("Content-Length")
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
+
+// xmlResponseWriter buffers JSON responses, and passes the others on
+type xmlResponseWriter struct {
+	http.ResponseWriter
+	buf         *bytes.Buffer
+	status      int
+	wroteHeader bool
+}
+
+func (w *xmlResponseWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if isJSON(w.Header().Get("Content-Type")) {
+		w.buf = &bytes.Buffer{}
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *xmlResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf != nil {
+		return w.buf.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// wantsXML reports whether the client asked for XML, with the _format parameter or else the Accept header
+// the media types of the Accept header are weighed by their quality, and JSON is preferred over XML at the same quality
+func wantsXML(req *http.Request) bool {
+	if f := req.URL.Query().Get("_format"); f != "" {
+		// the + of application/fhir+xml is decoded as a space when it is not escaped
+		return isXML(strings.Replace(f, " ", "+", -1))
+	}
+	xmlQuality, jsonQuality := -1.0, -1.0
+	for _, accept := range req.Header["Accept"] {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			switch {
+			case isXML(mediaType) && q > xmlQuality:
+				xmlQuality = q
+			case isJSON(mediaType) && q > jsonQuality:
+				jsonQuality = q
+			}
+		}
+	}
+	return xmlQuality > 0 && xmlQuality > jsonQuality
+}
+
+func mediaType(contentType string) string {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(contentType))
+	}
+	return mt
+}
+
+func isXML(contentType string) bool {
+	switch mediaType(contentType) {
+	case "application/fhir+xml", "application/xml", "text/xml", "xml":
+		return true
+	}
+	return false
+}
+
+func isJSON(contentType string) bool {
+	switch mediaType(contentType) {
+	case "application/fhir+json", "application/json", "text/json", "json":
+		return true
+	}
+	return false
+}
+
+// writeOutcome writes an OperationOutcome as JSON, which is converted to XML for the clients that asked for it
+func writeOutcome(rw http.ResponseWriter, status int, code models.OperationOutcomeIssueCode, diagnostics string) {
+	rw.Header().Set("Content-Type", jsonContentType)
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(&models.OperationOutcome{
+		Issue: []*models.OperationOutcomeIssue{
+			{Severity: models.OperationOutcomeIssueSeverityError, Code: code, Diagnostics: diagnostics},
+		},
+	})
+}
+
+// NewNegotiator ...
+func NewNegotiator(log *logging.Logger, box *packr.Box) (*Negotiator, error) {
+	codec, err := models.NewXMLCodec(box)
+	if err != nil {
+		return nil, err
+	}
+	return &Negotiator{
+		codec: codec,
+		log:   log.WithField("component", "format"),
+	}, nil
+}
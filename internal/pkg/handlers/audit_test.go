@@ -0,0 +1,95 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+func TestAuditEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-audit-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	log := logging.NewLogger()
+	router := mux.NewRouter()
+	handlers.RegisterAllFHIRResourceRoutes(router.PathPrefix("/fhir").Subrouter(), log, render.New(), registry)
+	// requests with a client header carry a token, as if the authorizer had validated one
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if client := req.Header.Get("X-Test-Client"); client != "" {
+			token := &auth.Token{ClientID: client, Scopes: auth.ParseScopes("system/Practitioner.read")}
+			req = req.WithContext(auth.WithToken(req.Context(), token))
+		}
+		router.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	res, body := doRequest(t, http.MethodPost, server.URL+"/fhir/Practitioner", nil, loadFixture(t, "practitioner.example.json"))
+	expectStatus(t, "create practitioner", res, body, http.StatusCreated)
+	entity := "Practitioner/" + body["id"].(string)
+	payer := http.Header{"X-Test-Client": []string{"payer"}}
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/"+entity, payer, nil)
+	expectStatus(t, "read practitioner", res, body, http.StatusOK)
+	res, body = doRequest(t, http.MethodDelete, server.URL+"/fhir/"+entity, payer, nil)
+	expectStatus(t, "delete practitioner without write scope", res, body, http.StatusForbidden)
+
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/AuditEvent?entity="+entity, nil, nil)
+	expectStatus(t, "search audit events", res, body, http.StatusOK)
+	entries := body["entry"].([]interface{})
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 audit events, got %d", len(entries))
+	}
+	expected := []struct {
+		action  string
+		agent   string
+		outcome string
+		subtype string
+	}{
+		{"D", "payer", "4", "delete"},
+		{"R", "payer", "0", "read"},
+		{"C", "anonymous", "0", "create"},
+	}
+	for i, e := range expected {
+		event := entries[i].(map[string]interface{})["resource"].(map[string]interface{})
+		agent := event["agent"].([]interface{})[0].(map[string]interface{})
+		what := event["entity"].([]interface{})[0].(map[string]interface{})["what"].(map[string]interface{})
+		subtype := event["subtype"].([]interface{})[0].(map[string]interface{})
+		if event["action"] != e.action || agent["name"] != e.agent || event["outcome"] != e.outcome || subtype["code"] != e.subtype {
+			t.Errorf("event %d: expected %s by %s with outcome %s, got %v", i, e.subtype, e.agent, e.outcome, event)
+		}
+		if ref, _ := what["reference"].(string); len(ref) < len(entity) || ref[:len(entity)] != entity {
+			t.Errorf("event %d: expected entity %s, got %v", i, entity, what)
+		}
+	}
+
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/AuditEvent?agent=payer&action=R", nil, nil)
+	expectStatus(t, "search audit events by agent", res, body, http.StatusOK)
+	if entries := body["entry"].([]interface{}); len(entries) != 1 {
+		t.Fatalf("expected 1 read by payer, got %d", len(entries))
+	}
+	id := body["entry"].([]interface{})[0].(map[string]interface{})["resource"].(map[string]interface{})["id"].(string)
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/AuditEvent/"+id, nil, nil)
+	expectStatus(t, "read audit event", res, body, http.StatusOK)
+
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/AuditEvent?date=lt2000-01-01", nil, nil)
+	expectStatus(t, "search audit events by date", res, body, http.StatusOK)
+	if entries, _ := body["entry"].([]interface{}); len(entries) != 0 {
+		t.Fatalf("expected no events before 2000, got %d", len(entries))
+	}
+	res, body = doRequest(t, http.MethodPost, server.URL+"/fhir/AuditEvent", nil, map[string]interface{}{"resourceType": "AuditEvent"})
+	if res.StatusCode != http.StatusMethodNotAllowed && res.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected audit events to be read-only, got status %d", res.StatusCode)
+	}
+}
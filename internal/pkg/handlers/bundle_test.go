@@ -0,0 +1,157 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+// bundleEntryStatuses returns the response status of each entry of a batch-response or transaction-response Bundle
+func bundleEntryStatuses(body map[string]interface{}) []string {
+	statuses := []string{}
+	entries, _ := body["entry"].([]interface{})
+	for _, e := range entries {
+		response := e.(map[string]interface{})["response"].(map[string]interface{})
+		statuses = append(statuses, strings.SplitN(response["status"].(string), " ", 2)[0])
+	}
+	return statuses
+}
+
+func TestBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	log := logging.NewLogger()
+	router := mux.NewRouter()
+	fhirRouter := router.PathPrefix("/fhir").Subrouter()
+	handlers.RegisterAllFHIRResourceRoutes(fhirRouter, log, render.New(), registry)
+	handlers.RegisterFHIRBundleRoutes(fhirRouter, log, registry)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	baseURL := server.URL + "/fhir/"
+
+	countPractitioners := func() int {
+		res, body := doRequest(t, "GET", baseURL+"Practitioner", nil, nil)
+		expectStatus(t, "count practitioners", res, body, http.StatusOK)
+		total, _ := body["total"].(float64)
+		return int(total)
+	}
+	practitioner := func() map[string]interface{} {
+		p := loadFixture(t, "practitioner.example.json")
+		delete(p, "id")
+		return p
+	}
+	bundle := func(bundleType string, entries ...map[string]interface{}) map[string]interface{} {
+		list := []interface{}{}
+		for _, e := range entries {
+			list = append(list, e)
+		}
+		return map[string]interface{}{"resourceType": "Bundle", "type": bundleType, "entry": list}
+	}
+	entry := func(method string, url string, fullURL string, resource map[string]interface{}, ifMatch string) map[string]interface{} {
+		request := map[string]interface{}{"method": method, "url": url}
+		if ifMatch != "" {
+			request["ifMatch"] = ifMatch
+		}
+		e := map[string]interface{}{"request": request}
+		if fullURL != "" {
+			e["fullUrl"] = fullURL
+		}
+		if resource != nil {
+			e["resource"] = resource
+		}
+		return e
+	}
+
+	res, body := doRequest(t, "POST", baseURL+"Practitioner", nil, practitioner())
+	expectStatus(t, "create existing practitioner", res, body, http.StatusCreated)
+	existing := "Practitioner/" + body["id"].(string)
+	etag := res.Header.Get("Etag")
+
+	urn := "urn:uuid:5d3a7b2e-2f0d-4c1a-9a53-8e7c3b1d6f40"
+	role := loadFixture(t, "practitionerrole-validate.example.json")
+	delete(role, "id")
+	role["practitioner"] = map[string]interface{}{"reference": urn}
+	res, body = doRequest(t, "POST", baseURL, nil, bundle("transaction",
+		entry("POST", "PractitionerRole", "", role, ""),
+		entry("POST", "Practitioner", urn, practitioner(), ""),
+	))
+	expectStatus(t, "transaction", res, body, http.StatusOK)
+	if statuses := bundleEntryStatuses(body); len(statuses) != 2 || statuses[0] != "201" || statuses[1] != "201" {
+		t.Fatalf("transaction: unexpected entry statuses %v", statuses)
+	}
+	created := body["entry"].([]interface{})
+	createdRole := created[0].(map[string]interface{})["resource"].(map[string]interface{})
+	createdPractitioner := created[1].(map[string]interface{})["resource"].(map[string]interface{})
+	reference := createdRole["practitioner"].(map[string]interface{})["reference"]
+	if reference != "Practitioner/"+createdPractitioner["id"].(string) {
+		t.Fatalf("transaction: expected the reference to be resolved, got %v", reference)
+	}
+	if n := countPractitioners(); n != 2 {
+		t.Fatalf("transaction: expected 2 practitioners, got %d", n)
+	}
+
+	rejected := []struct {
+		name    string
+		status  int
+		entries []map[string]interface{}
+	}{
+		{"invalid resource", http.StatusBadRequest, []map[string]interface{}{
+			entry("POST", "Practitioner", "", practitioner(), ""),
+			entry("POST", "Practitioner", "", map[string]interface{}{"resourceType": "Practitioner", "active": "yes"}, ""),
+		}},
+		{"stale version", http.StatusPreconditionFailed, []map[string]interface{}{
+			entry("POST", "Practitioner", "", practitioner(), ""),
+			entry("DELETE", existing, "", nil, `W/"9-9"`),
+		}},
+		{"update without a version", http.StatusBadRequest, []map[string]interface{}{
+			entry("POST", "Practitioner", "", practitioner(), ""),
+			entry("PUT", existing, "", practitioner(), ""),
+		}},
+		{"missing resource", http.StatusNotFound, []map[string]interface{}{
+			entry("POST", "Practitioner", "", practitioner(), ""),
+			entry("DELETE", "Practitioner/0b5e2c4a-7f3d-4e1b-8a6c-9d2f1e0a3b57", "", nil, ""),
+		}},
+		{"resource changed twice", http.StatusBadRequest, []map[string]interface{}{
+			entry("POST", "Practitioner", "", practitioner(), ""),
+			entry("PUT", existing, "", practitioner(), etag),
+			entry("DELETE", existing, "", nil, etag),
+		}},
+	}
+	for _, tt := range rejected {
+		res, body = doRequest(t, "POST", baseURL, nil, bundle("transaction", tt.entries...))
+		expectStatus(t, "transaction with "+tt.name, res, body, tt.status)
+		if body["resourceType"] != "OperationOutcome" {
+			t.Fatalf("transaction with %s: expected an OperationOutcome, got %v", tt.name, body)
+		}
+		if n := countPractitioners(); n != 2 {
+			t.Fatalf("transaction with %s: expected no changes, got %d practitioners", tt.name, n)
+		}
+	}
+
+	res, body = doRequest(t, "POST", baseURL, nil, bundle("batch",
+		entry("POST", "Practitioner", "", practitioner(), ""),
+		entry("DELETE", existing, "", nil, `W/"9-9"`),
+		entry("POST", "Practitioner", "", map[string]interface{}{"resourceType": "Practitioner", "active": "yes"}, ""),
+	))
+	expectStatus(t, "batch", res, body, http.StatusOK)
+	if statuses := bundleEntryStatuses(body); len(statuses) != 3 || statuses[0] != "201" || statuses[1] != "412" || statuses[2] != "400" {
+		t.Fatalf("batch: unexpected entry statuses %v", statuses)
+	}
+	if n := countPractitioners(); n != 3 {
+		t.Fatalf("batch: expected 3 practitioners, got %d", n)
+	}
+}
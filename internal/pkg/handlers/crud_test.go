@@ -0,0 +1,225 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers/resources"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum/simulated"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/mirror"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/gorilla/mux"
+	"github.com/oliveagle/jsonpath"
+	"github.com/unrolled/render"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+const fixturesDir = "../../../fixures"
+
+// newTestServer serves the FHIR resource routes from collections deployed on a simulated chain
+// the returned function stops the server and removes its database
+func newTestServer(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "fhir-api-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := simulated.NewChain(
+		&config.ObjectCollectionContract{
+			Name: "Practitioner",
+			Indexes: []*config.ObjectIndex{
+				{Name: "Global NPI", JSONPath: jsonpath.MustCompile("$.identifier.value"), SearchParam: "identifier"},
+			},
+		},
+		&config.ObjectCollectionContract{
+			Name: "PractitionerRole",
+			Indexes: []*config.ObjectIndex{
+				{Name: "Practitioner UUID", JSONPath: jsonpath.MustCompile("$.practitioner.reference"), SearchParam: "practitioner"},
+			},
+		},
+		&config.ObjectCollectionContract{Name: "Location"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := &config.Config{
+		DatabaseConnectionString:  filepath.Join(dir, "test.db"),
+		DatabaseType:              "sqlite3",
+		LogLevel:                  "warn",
+		OrganizationContract:      chain.OrganizationAddress,
+		ObjectCollectionContracts: chain.Collections,
+		TransactionWait:           10 * time.Second,
+		TransactionsChannelBuffer: 10,
+	}
+
+	var router *mux.Router
+	app := fxtest.New(t,
+		fx.Provide(
+			logging.NewLogger,
+			func() *config.Config { return appConfig },
+			func() ethereum.Backend { return chain },
+			func() *bind.TransactOpts { return chain.TransactOpts },
+			func() *render.Render {
+				return render.New(render.Options{JSONContentType: fmt.Sprintf("application/fhir+json; fhirVersion=%s", models.FHIRVersion)})
+			},
+			resources.NewRegistry,
+			ethereum.NewTransactionManager,
+			ethereum.NewTransactionsChannel,
+			ethereum.NewTransactionsListener,
+			database.NewConnection,
+			ipfs.NewClient,
+			fetcher.NewRegistry,
+			signer.NewAccount,
+			envelope.NewKeyring,
+			mirror.NewMirror,
+			static.NewStaticFilesBox,
+			subscriptions.NewEngine,
+		),
+		fx.Invoke(
+			ethereum.StartTransactionsListener,
+			func(log *logging.Logger, rndr *render.Render, registry *resources.Registry) {
+				logging.SetLevel(log, appConfig.LogLevel)
+				router = mux.NewRouter()
+				fhirRouter := router.PathPrefix("/fhir").Subrouter()
+				handlers.RegisterAllFHIRResourceRoutes(fhirRouter, log, rndr, registry)
+			},
+		),
+	)
+	app.RequireStart()
+
+	server := httptest.NewServer(router)
+	return server, func() {
+		server.Close()
+		app.RequireStop()
+		os.RemoveAll(dir)
+	}
+}
+
+// loadFixture reads the example of a resource type, unwrapping it from the Parameters of a $validate fixture if needed
+func loadFixture(t *testing.T, name string) map[string]interface{} {
+	data, err := ioutil.ReadFile(filepath.Join(fixturesDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resource := map[string]interface{}{}
+	if err := json.Unmarshal(data, &resource); err != nil {
+		t.Fatalf("failed to parse %s: %v", name, err)
+	}
+	if resource["resourceType"] == "Parameters" {
+		params := resource["parameter"].([]interface{})
+		resource = params[0].(map[string]interface{})["resource"].(map[string]interface{})
+	}
+	return resource
+}
+
+func doRequest(t *testing.T, method string, url string, header http.Header, body interface{}) (*http.Response, map[string]interface{}) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &reqBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := map[string]interface{}{}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &result); err != nil {
+			t.Fatalf("%s %s: failed to parse response %q: %v", method, url, data, err)
+		}
+	}
+	return res, result
+}
+
+func expectStatus(t *testing.T, step string, res *http.Response, body map[string]interface{}, status int) {
+	if res.StatusCode != status {
+		t.Fatalf("%s: expected status %d, got %d: %v", step, status, res.StatusCode, body)
+	}
+}
+
+func TestResourceCRUD(t *testing.T) {
+	server, stop := newTestServer(t)
+	defer stop()
+
+	tests := []struct {
+		resourceType string
+		fixture      string
+	}{
+		{"Practitioner", "practitioner.example.json"},
+		{"PractitionerRole", "practitionerrole-validate.example.json"},
+		{"Location", "location.example.json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resourceType, func(t *testing.T) {
+			typeURL := server.URL + "/fhir/" + tt.resourceType
+			resource := loadFixture(t, tt.fixture)
+			delete(resource, "id")
+
+			res, body := doRequest(t, "POST", typeURL, nil, resource)
+			expectStatus(t, "create", res, body, http.StatusCreated)
+			location := strings.Split(strings.TrimPrefix(res.Header.Get("Location"), "/fhir/"+tt.resourceType+"/"), "/")
+			if len(location) != 3 || location[1] != "_history" {
+				t.Fatalf("create: unexpected Location %q", res.Header.Get("Location"))
+			}
+			instanceURL := typeURL + "/" + location[0]
+
+			res, body = doRequest(t, "GET", instanceURL, nil, nil)
+			expectStatus(t, "read", res, body, http.StatusOK)
+			if body["id"] != location[0] {
+				t.Fatalf("read: expected id %q, got %v", location[0], body["id"])
+			}
+
+			body["language"] = "en"
+			header := http.Header{"If-Match": []string{res.Header.Get("Etag")}}
+			res, body = doRequest(t, "PUT", instanceURL, header, body)
+			expectStatus(t, "update", res, body, http.StatusOK)
+
+			res, body = doRequest(t, "GET", instanceURL, nil, nil)
+			expectStatus(t, "read updated", res, body, http.StatusOK)
+			if body["language"] != "en" {
+				t.Fatalf("read updated: expected language %q, got %v", "en", body["language"])
+			}
+
+			res, body = doRequest(t, "DELETE", instanceURL, nil, nil)
+			expectStatus(t, "delete", res, body, http.StatusNoContent)
+
+			res, body = doRequest(t, "GET", instanceURL, nil, nil)
+			expectStatus(t, "read deleted", res, body, http.StatusNotFound)
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package handlers_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+// awaitExport polls the status URL of an export until it has completed
+func awaitExport(t *testing.T, statusURL string) map[string]interface{} {
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, body := doRequest(t, http.MethodGet, statusURL, nil, nil)
+		if res.StatusCode != http.StatusAccepted {
+			expectStatus(t, "export status", res, body, http.StatusOK)
+			return body
+		}
+		if res.Header.Get("X-Progress") == "" {
+			t.Fatal("expected the progress of the running export to be reported")
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("export did not complete")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestBulkExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-export-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	log := logging.NewLogger()
+	router := mux.NewRouter()
+	fhirRouter := router.PathPrefix("/fhir").Subrouter()
+	handlers.RegisterFHIRExportRoutes(fhirRouter, log, registry)
+	handlers.RegisterAllFHIRResourceRoutes(fhirRouter, log, render.New(), registry)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	res, body := doRequest(t, http.MethodPost, server.URL+"/fhir/Practitioner", nil, loadFixture(t, "practitioner.example.json"))
+	expectStatus(t, "create practitioner", res, body, http.StatusCreated)
+	kept := body["id"]
+	res, body = doRequest(t, http.MethodPost, server.URL+"/fhir/Practitioner", nil, loadFixture(t, "practitioner.example.json"))
+	expectStatus(t, "create practitioner", res, body, http.StatusCreated)
+	res, body = doRequest(t, http.MethodDelete, server.URL+"/fhir/Practitioner/"+body["id"].(string), nil, nil)
+	expectStatus(t, "delete practitioner", res, body, http.StatusNoContent)
+	res, body = doRequest(t, http.MethodPost, server.URL+"/fhir/Location", nil, loadFixture(t, "location.example.json"))
+	expectStatus(t, "create location", res, body, http.StatusCreated)
+
+	async := http.Header{"Prefer": []string{"respond-async"}}
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/$export", nil, nil)
+	expectStatus(t, "export without Prefer header", res, body, http.StatusBadRequest)
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/Location/$export?_type=Practitioner", async, nil)
+	expectStatus(t, "type level export of another type", res, body, http.StatusBadRequest)
+
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/$export?_type=Practitioner,Location", async, nil)
+	expectStatus(t, "kick-off", res, body, http.StatusAccepted)
+	statusURL := res.Header.Get("Content-Location")
+	manifest := awaitExport(t, statusURL)
+	output := manifest["output"].([]interface{})
+	if len(output) != 2 || manifest["requiresAccessToken"] != false || manifest["transactionTime"] == "" {
+		t.Fatalf("expected a file for each type, got %v", manifest)
+	}
+	practitioners := output[0].(map[string]interface{})
+	if practitioners["type"] != "Practitioner" || practitioners["count"] != float64(1) {
+		t.Fatalf("expected the deleted practitioner to be left out, got %v", practitioners)
+	}
+
+	res, err = http.Get(practitioners["url"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/fhir+ndjson" {
+		t.Fatalf("expected an NDJSON file, got status %d and content type %q", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 1 || lines[0]["id"] != kept {
+		t.Fatalf("expected the kept practitioner to be exported, got %v", lines)
+	}
+
+	res, body = doRequest(t, http.MethodDelete, statusURL, nil, nil)
+	expectStatus(t, "delete export", res, body, http.StatusAccepted)
+	res, body = doRequest(t, http.MethodGet, statusURL, nil, nil)
+	expectStatus(t, "status of deleted export", res, body, http.StatusNotFound)
+	if files, _ := filepath.Glob(filepath.Join(dir, "exports", "*")); len(files) != 0 {
+		t.Fatalf("expected the files of the deleted export to be removed, got %v", files)
+	}
+
+	since := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/Location/$export?_since="+since, async, nil)
+	expectStatus(t, "type level kick-off", res, body, http.StatusAccepted)
+	manifest = awaitExport(t, res.Header.Get("Content-Location"))
+	if output := manifest["output"].([]interface{}); len(output) != 0 {
+		t.Fatalf("expected no resources changed since %s, got %v", since, output)
+	}
+}
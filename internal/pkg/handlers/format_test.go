@@ -0,0 +1,119 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/format"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+	"github.com/urfave/negroni"
+)
+
+func TestXMLFormat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-format-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	log := logging.NewLogger()
+	negotiator, err := format.NewNegotiator(log, static.NewStaticFilesBox())
+	if err != nil {
+		t.Fatal(err)
+	}
+	router := mux.NewRouter()
+	handlers.RegisterAllFHIRResourceRoutes(router.PathPrefix("/fhir").Subrouter(), log, render.New(), registry)
+	n := negroni.New(negotiator)
+	n.UseHandler(router)
+	server := httptest.NewServer(n)
+	defer server.Close()
+
+	codec, err := models.NewXMLCodec(static.NewStaticFilesBox())
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := ioutil.ReadFile(filepath.Join(fixturesDir, "practitioner.example.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	practitionerXML, err := codec.ToXML(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(method string, url string, contentType string, accept string, body []byte) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, server.URL+url, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		resBody, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, resBody
+	}
+	expectXML := func(step string, res *http.Response, body []byte, status int, root string) {
+		if res.StatusCode != status {
+			t.Fatalf("%s: expected status %d, got %d: %s", step, status, res.StatusCode, body)
+		}
+		if !strings.HasPrefix(res.Header.Get("Content-Type"), "application/fhir+xml") {
+			t.Fatalf("%s: expected FHIR XML, got %s", step, res.Header.Get("Content-Type"))
+		}
+		var doc struct {
+			XMLName xml.Name
+		}
+		if err := xml.Unmarshal(body, &doc); err != nil || doc.XMLName.Local != root || doc.XMLName.Space != models.FHIRNamespace {
+			t.Fatalf("%s: expected a %s, got %v: %s", step, root, err, body)
+		}
+	}
+
+	res, body := send(http.MethodPost, "/fhir/Practitioner", "application/fhir+xml", "application/fhir+xml", practitionerXML)
+	expectXML("create practitioner", res, body, http.StatusCreated, "Practitioner")
+	practitioner := &models.Practitioner{}
+	if err := codec.Unmarshal(body, practitioner); err != nil {
+		t.Fatal(err)
+	}
+	if practitioner.ID == "" || len(practitioner.Name) != 1 || practitioner.Name[0].Family != "Careful" {
+		t.Fatalf("unexpected practitioner %+v", practitioner)
+	}
+
+	res, body = send(http.MethodGet, "/fhir/Practitioner/"+practitioner.ID, "", "application/fhir+json;q=0.5, application/fhir+xml", nil)
+	expectXML("read practitioner", res, body, http.StatusOK, "Practitioner")
+	res, body = send(http.MethodGet, "/fhir/Practitioner/"+practitioner.ID+"?_format=json", "", "application/fhir+xml", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(res.Header.Get("Content-Type"), "json") || !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		t.Fatalf("expected _format to select JSON, got %d %s: %s", res.StatusCode, res.Header.Get("Content-Type"), body)
+	}
+	res, body = send(http.MethodGet, "/fhir/Practitioner/"+practitioner.ID+"?_format=xml", "", "", nil)
+	expectXML("read practitioner with _format", res, body, http.StatusOK, "Practitioner")
+
+	invalid := bytes.Replace(practitionerXML, []byte(`<active value="true"/>`), []byte(`<active value="yes"/>`), 1)
+	res, body = send(http.MethodPost, "/fhir/Practitioner", "application/fhir+xml", "application/fhir+xml", invalid)
+	expectXML("create invalid practitioner", res, body, http.StatusBadRequest, "OperationOutcome")
+	invalid = bytes.Replace(practitionerXML, []byte(`<use value="home"/>`), []byte(`<use value="moon"/>`), 1)
+	res, body = send(http.MethodPost, "/fhir/Practitioner", "application/xml", "application/xml", invalid)
+	expectXML("create practitioner failing validation", res, body, http.StatusBadRequest, "OperationOutcome")
+}
@@ -6,8 +6,11 @@ import (
 	"net/http"
 	_ "net/http/pprof" // It's magic.
 
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/audit"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers/resources"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/utils"
 	"github.com/gorilla/mux"
 	"github.com/heptiolabs/healthcheck"
@@ -29,7 +32,73 @@ func RegisterFHIRCapabilityStatementRoutes(r *mux.Router, log *logging.Logger, c
 func RegisterAllFHIRResourceRoutes(r *mux.Router, log *logging.Logger, rndr *render.Render, registry *resources.Registry) {
 	log.Debug("executing RegisterAllFHIRResourceRoutes")
 	for _, i := range registry.Resources {
-		registerFHIRResourceRoutes(r, log, rndr, i)
+		registerFHIRResourceRoutes(r, log, rndr, registry, i)
+	}
+}
+
+// RegisterFHIRBundleRoutes mounts the batch/transaction handler on the FHIR base URL
+// entries are dispatched back through r, so the resource routes must be registered on the same router
+func RegisterFHIRBundleRoutes(r *mux.Router, log *logging.Logger, registry *resources.Registry) {
+	log.Debug("executing RegisterFHIRBundleRoutes")
+	h := resources.NewBundleHandler(registry, r)
+	r.Handle("/", h.Process()).Methods("POST")
+}
+
+// RegisterFHIRExportRoutes mounts the bulk data export operation and the endpoints of its jobs
+// the type level routes must be registered before the resource routes, which would otherwise match "$export" as a resource ID
+func RegisterFHIRExportRoutes(r *mux.Router, log *logging.Logger, registry *resources.Registry) {
+	log.Debug("executing RegisterFHIRExportRoutes")
+	h := resources.NewBulkExport(registry)
+	r.Handle("/$export", auth.Require("*", auth.Read, h.KickOff(""))).Methods("GET")
+	for _, typeName := range h.Types() {
+		r.Handle("/"+typeName+"/$export", auth.Require(typeName, auth.Read, h.KickOff(typeName))).Methods("GET")
+	}
+	r.Handle("/$export-status/{jobID}", h.Status()).Methods("GET")
+	r.Handle("/$export-status/{jobID}", h.Delete()).Methods("DELETE")
+	r.Handle("/$export-file/{jobID}/{file}", h.Download()).Methods("GET")
+}
+
+// RegisterFHIRSmartConfigurationRoutes publishes the SMART configuration when bearer tokens are required
+func RegisterFHIRSmartConfigurationRoutes(r *mux.Router, log *logging.Logger, authz *auth.Authorizer, rndr *render.Render) {
+	log.Debug("executing RegisterFHIRSmartConfigurationRoutes")
+	if !authz.Enabled() {
+		return
+	}
+	r.Handle(auth.SmartConfigurationPath, authz.SmartConfiguration(rndr)).Methods("GET")
+}
+
+// RegisterFHIRSubscriptionWebsocketRoutes mounts the endpoint used by clients of the websocket subscriptions of a registry
+func RegisterFHIRSubscriptionWebsocketRoutes(r *mux.Router, log *logging.Logger, registry *resources.Registry, ws *subscriptions.WebsocketChannel) {
+	log.Debug("executing RegisterFHIRSubscriptionWebsocketRoutes")
+	r.Handle("/$subscription-ws", auth.Require("Subscription", auth.Read, ws.Handler(registry.Tenant()))).Methods("GET")
+}
+
+// RegisterFHIRTransactionStatusRoutes mounts the status endpoint of asynchronous writes
+// the resource type of a transaction is only known once it has been read, so its scopes are checked by the handler
+func RegisterFHIRTransactionStatusRoutes(r *mux.Router, log *logging.Logger, registry *resources.Registry) {
+	log.Debug("executing RegisterFHIRTransactionStatusRoutes")
+	h := resources.NewTransactionStatus(registry)
+	r.Handle("/_async/{txnHash}", h.Read()).Methods("GET")
+}
+
+// RegisterFHIRTenantRoutes mounts the FHIR base URL of each tenant under /fhir/{tenant}, and under /fhir for requests
+// that name the tenant in the tenant header, with register
+// the routes of a tenant only accept the tokens issued for it
+// it must be called before the routes of the top level organization are mounted, which would otherwise match first
+func RegisterFHIRTenantRoutes(r *mux.Router, log *logging.Logger, rndr *render.Render, tenants *resources.Tenants, register func(r *mux.Router, tenant *resources.Tenant)) {
+	for _, t := range tenants.Tenants {
+		basePath := "/fhir/" + t.Name
+		tenantRouter := r.PathPrefix(basePath).Subrouter()
+		tenantRouter.Use(resources.WithBasePath(basePath), auth.RequireTenant(t.Name))
+		register(tenantRouter, t)
+	}
+	if len(tenants.Tenants) > 0 {
+		for _, t := range tenants.Tenants {
+			headerRouter := r.PathPrefix("/fhir").Headers(tenants.Header, t.Name).Subrouter()
+			headerRouter.Use(auth.RequireTenant(t.Name))
+			register(headerRouter, t)
+		}
+		r.PathPrefix("/fhir").HeadersRegexp(tenants.Header, ".+").Handler(tenants.UnknownTenant(rndr))
 	}
 }
 
@@ -47,7 +116,9 @@ func RegisterPProfRoutes(r *mux.Router, log *logging.Logger) {
 	r.PathPrefix("/debug").Handler(http.DefaultServeMux)
 }
 
-func registerFHIRResourceRoutes(r *mux.Router, log *logging.Logger, rndr *render.Render, i interface{}) {
+// registerFHIRResourceRoutes mounts the interactions of a resource type, each of which is audited
+// the audit wraps the scope check, so that rejected requests are recorded too
+func registerFHIRResourceRoutes(r *mux.Router, log *logging.Logger, rndr *render.Render, registry *resources.Registry, i interface{}) {
 	dLog := log.WithField("function", "registerFHIRResourceRoutes")
 	dLog.Debug("executing")
 
@@ -59,41 +130,52 @@ func registerFHIRResourceRoutes(r *mux.Router, log *logging.Logger, rndr *render
 
 	if t, ok := i.(resources.CreateableResource); ok {
 		dLog.Debug("registering create method")
-		r.Handle(typePrefix, t.Create()).Methods("POST")
+		r.Handle(typePrefix, registry.Audit(seg, audit.Create, auth.Require(seg, auth.Write, t.Create()))).Methods("POST")
+	}
+
+	// must be registered before instance routes, which would otherwise match "_history" as a resource ID
+	if t, ok := i.(resources.TypeHistoryReadableResource); ok {
+		dLog.Debug("registering type history method")
+		r.Handle(typePrefix+"/_history", registry.Audit(seg, audit.HistoryType, auth.Require(seg, auth.Read, t.TypeHistory()))).Methods("GET")
 	}
 
 	if t, ok := i.(resources.SearchableResource); ok {
 		dLog.Debug("registering search method")
-		r.Handle(typePrefix, t.Search()).Methods("GET")
+		r.Handle(typePrefix, registry.Audit(seg, audit.SearchType, auth.Require(seg, auth.Read, t.Search()))).Methods("GET")
 	}
 
 	if t, ok := i.(resources.UpdateableResource); ok {
 		dLog.Debug("registering update method")
-		r.Handle(instancePrefix, t.Update()).Methods("PUT")
+		r.Handle(instancePrefix, registry.Audit(seg, audit.Update, auth.Require(seg, auth.Write, t.Update()))).Methods("PUT")
 	}
 
 	if t, ok := i.(resources.DeleteableResource); ok {
 		dLog.Debug("registering delete method")
-		r.Handle(instancePrefix, t.Delete()).Methods("DELETE")
+		r.Handle(instancePrefix, registry.Audit(seg, audit.Delete, auth.Require(seg, auth.Write, t.Delete()))).Methods("DELETE")
 	}
 
 	if t, ok := i.(resources.ReadableResource); ok {
 		dLog.Debug("registering read method")
-		r.Handle(instancePrefix, t.Read()).Methods("GET")
+		r.Handle(instancePrefix, registry.Audit(seg, audit.Read, auth.Require(seg, auth.Read, t.Read()))).Methods("GET")
 	}
 
 	if t, ok := i.(resources.PatchableResource); ok {
 		dLog.Debug("registering patch method")
-		r.Handle(instancePrefix, t.Patch()).Methods("PATCH")
+		r.Handle(instancePrefix, registry.Audit(seg, audit.Patch, auth.Require(seg, auth.Write, t.Patch()))).Methods("PATCH")
 	}
 
 	if t, ok := i.(resources.VersionReadableResource); ok {
 		dLog.Debug("registering version read method")
-		r.Handle(instancePrefix+"/_history/{versionID}", t.VersionRead()).Methods("GET")
+		r.Handle(instancePrefix+"/_history/{versionID}", registry.Audit(seg, audit.VRead, auth.Require(seg, auth.Read, t.VersionRead()))).Methods("GET")
+	}
+
+	if t, ok := i.(resources.InstanceHistoryReadableResource); ok {
+		dLog.Debug("registering instance history method")
+		r.Handle(instancePrefix+"/_history", registry.Audit(seg, audit.HistoryInstance, auth.Require(seg, auth.Read, t.InstanceHistory()))).Methods("GET")
 	}
 
 	if t, ok := i.(resources.ValidateableResource); ok {
 		dLog.Debug("registering validate method")
-		r.Handle(typePrefix+"/$validate", t.Validate()).Methods("POST")
+		r.Handle(typePrefix+"/$validate", registry.Audit(seg, audit.Operation, auth.Require(seg, auth.Read, t.Validate()))).Methods("POST")
 	}
 }
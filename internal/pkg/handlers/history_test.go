@@ -0,0 +1,107 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+// historyMethods returns the request methods of the entries of a history Bundle
+func historyMethods(body map[string]interface{}) []string {
+	methods := []string{}
+	entries, _ := body["entry"].([]interface{})
+	for _, e := range entries {
+		request := e.(map[string]interface{})["request"].(map[string]interface{})
+		methods = append(methods, request["method"].(string))
+	}
+	return methods
+}
+
+func expectHistory(t *testing.T, step string, res *http.Response, body map[string]interface{}, methods ...string) {
+	expectStatus(t, step, res, body, http.StatusOK)
+	got := historyMethods(body)
+	if len(got) != len(methods) {
+		t.Fatalf("%s: expected %v, got %v", step, methods, got)
+	}
+	for i := range methods {
+		if got[i] != methods[i] {
+			t.Fatalf("%s: expected %v, got %v", step, methods, got)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-history-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	router := mux.NewRouter()
+	handlers.RegisterAllFHIRResourceRoutes(router.PathPrefix("/fhir").Subrouter(), logging.NewLogger(), render.New(), registry)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	typeURL := server.URL + "/fhir/Practitioner"
+
+	practitioner := loadFixture(t, "practitioner.example.json")
+	delete(practitioner, "id")
+	res, body := doRequest(t, "POST", typeURL, nil, practitioner)
+	expectStatus(t, "create", res, body, http.StatusCreated)
+	id := body["id"].(string)
+	instanceURL := typeURL + "/" + id
+	versionIDs := []string{body["meta"].(map[string]interface{})["versionId"].(string)}
+
+	for _, family := range []string{"Cautious", "Careless"} {
+		body["name"].([]interface{})[0].(map[string]interface{})["family"] = family
+		delete(body, "meta")
+		header := http.Header{"If-Match": []string{res.Header.Get("Etag")}}
+		res, body = doRequest(t, "PUT", instanceURL, header, body)
+		expectStatus(t, "update to "+family, res, body, http.StatusOK)
+		versionIDs = append(versionIDs, body["meta"].(map[string]interface{})["versionId"].(string))
+	}
+
+	res, body = doRequest(t, "GET", instanceURL+"/_history", nil, nil)
+	expectHistory(t, "instance history", res, body, "PUT", "PUT", "POST")
+	for i, e := range body["entry"].([]interface{}) {
+		resource := e.(map[string]interface{})["resource"].(map[string]interface{})
+		expected := versionIDs[len(versionIDs)-1-i]
+		if resource["meta"].(map[string]interface{})["versionId"] != expected {
+			t.Fatalf("instance history: expected version %q at entry %d, got %v", expected, i, resource["meta"])
+		}
+	}
+	res, body = doRequest(t, "GET", instanceURL+"/_history?_count=1", nil, nil)
+	expectHistory(t, "instance history with _count", res, body, "PUT")
+
+	for i, versionID := range versionIDs {
+		res, body = doRequest(t, "GET", instanceURL+"/_history/"+versionID, nil, nil)
+		expectStatus(t, "version read "+versionID, res, body, http.StatusOK)
+		family := body["name"].([]interface{})[0].(map[string]interface{})["family"]
+		if expected := []string{"Careful", "Cautious", "Careless"}[i]; family != expected {
+			t.Fatalf("version read %s: expected family %q, got %v", versionID, expected, family)
+		}
+	}
+
+	res, body = doRequest(t, "DELETE", instanceURL, nil, nil)
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		t.Fatalf("delete: unexpected status %d: %v", res.StatusCode, body)
+	}
+	res, body = doRequest(t, "GET", instanceURL+"/_history", nil, nil)
+	expectHistory(t, "instance history after delete", res, body, "DELETE", "PUT", "PUT", "POST")
+
+	res, body = doRequest(t, "POST", typeURL, nil, practitioner)
+	expectStatus(t, "create another", res, body, http.StatusCreated)
+	res, body = doRequest(t, "GET", typeURL+"/_history", nil, nil)
+	expectHistory(t, "type history", res, body, "POST", "DELETE", "PUT", "PUT", "POST")
+
+	res, body = doRequest(t, "GET", typeURL+"/9a1ad6b2-0f3c-4a7e-9a36-5f5b0e0a1c11/_history", nil, nil)
+	expectStatus(t, "history of a missing resource", res, body, http.StatusNotFound)
+}
@@ -0,0 +1,289 @@
+package handlers_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers/resources"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/metadata"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/mirror"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	"github.com/oliveagle/jsonpath"
+	"github.com/unrolled/render"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+// newSQLRegistry creates a registry whose resources are held in a database, so that no chain is needed
+func newSQLRegistry(t *testing.T, dir string) (*resources.Registry, func()) {
+	registry, _, stop := newSQLTenants(t, dir)
+	return registry, stop
+}
+
+// newSQLTenants creates the registry of the top level organization and those of the named tenants, whose resources
+// are held in the same database
+func newSQLTenants(t *testing.T, dir string, names ...string) (*resources.Registry, *resources.Tenants, func()) {
+	collections := func() map[string]*config.ObjectCollectionContract {
+		return map[string]*config.ObjectCollectionContract{
+			"Practitioner": {
+				Name: "Practitioner",
+				Indexes: []*config.ObjectIndex{
+					{Name: "Global NPI", JSONPath: jsonpath.MustCompile("$.identifier.value"), SearchParam: "identifier"},
+				},
+			},
+			"PractitionerRole": {
+				Name: "PractitionerRole",
+				Indexes: []*config.ObjectIndex{
+					{Name: "Practitioner UUID", JSONPath: jsonpath.MustCompile("$.practitioner.reference"), SearchParam: "practitioner"},
+				},
+			},
+		}
+	}
+	appConfig := &config.Config{
+		DatabaseConnectionString:  filepath.Join(dir, "test.db"),
+		DatabaseType:              "sqlite3",
+		DevMode:                   true,
+		ExportDir:                 filepath.Join(dir, "exports"),
+		LogLevel:                  "warn",
+		ObjectCollectionContracts: collections(),
+		OrganizationContract:      common.HexToAddress("0x1"),
+		Storage: map[string]string{
+			"Location":         storage.BackendSQL,
+			"Practitioner":     storage.BackendSQL,
+			"PractitionerRole": storage.BackendSQL,
+		},
+	}
+	for i, name := range names {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tenantCollections := collections()
+		for _, coll := range tenantCollections {
+			coll.Tenant = name
+		}
+		appConfig.Tenants = append(appConfig.Tenants, &config.TenantConfig{
+			Name:                      name,
+			ObjectCollectionContracts: tenantCollections,
+			OrganizationContract:      common.HexToAddress(fmt.Sprintf("0x%x", i+2)),
+			PrivateKey:                hex.EncodeToString(crypto.FromECDSA(key)),
+		})
+	}
+	// the capability statement of each tenant is dated with the build time, which is set by the linker otherwise
+	if err := metadata.Data.SetBuildTime("2019-01-01T00:00:00Z"); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		registry *resources.Registry
+		tenants  *resources.Tenants
+	)
+	app := fxtest.New(t,
+		fx.Provide(
+			logging.NewLogger,
+			func() *config.Config { return appConfig },
+			func() ethereum.Backend { return nil },
+			func() *ethereum.TransactionManager { return nil },
+			func() *render.Render { return render.New() },
+			resources.NewRegistry,
+			resources.NewTenants,
+			ethereum.NewTransactionsChannel,
+			database.NewConnection,
+			ipfs.NewClient,
+			fetcher.NewRegistry,
+			signer.NewAccount,
+			envelope.NewKeyring,
+			mirror.NewMirror,
+			static.NewStaticFilesBox,
+			subscriptions.NewEngine,
+		),
+		fx.Invoke(func(log *logging.Logger, r *resources.Registry, ts *resources.Tenants) {
+			logging.SetLevel(log, appConfig.LogLevel)
+			registry = r
+			tenants = ts
+		}),
+	)
+	app.RequireStart()
+	return registry, tenants, app.RequireStop
+}
+
+// readLines decodes each line of an NDJSON file
+func readLines(t *testing.T, path string) []map[string]interface{} {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	role := loadFixture(t, "practitionerrole-validate.example.json")
+	practitioner := loadFixture(t, "practitioner.example.json")
+	practitioner["id"] = "example"
+	location := loadFixture(t, "location.example.json")
+	location["id"] = "1"
+	importPath := filepath.Join(dir, "directory.ndjson")
+	writeNDJSON := func(lines ...interface{}) {
+		var ndjson bytes.Buffer
+		for _, line := range lines {
+			b, err := json.Marshal(line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ndjson.Write(append(b, '\n'))
+		}
+		if err := ioutil.WriteFile(importPath, ndjson.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	patient := map[string]interface{}{"resourceType": "Patient"}
+	writeNDJSON(role, "not a resource", practitioner, location, patient)
+	progressPath := filepath.Join(dir, "progress.ndjson")
+	errorsPath := filepath.Join(dir, "errors.ndjson")
+
+	run := func(paths ...string) *resources.ImportSummary {
+		previous, _ := ioutil.ReadFile(progressPath)
+		progress, err := os.OpenFile(progressPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer progress.Close()
+		errs, err := os.Create(errorsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer errs.Close()
+		importer, err := resources.NewImporter(registry, 2, bytes.NewReader(previous), progress, errs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		summary, err := importer.Run(context.Background(), paths...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return summary
+	}
+
+	summary := run(importPath)
+	if summary.Created != 3 || summary.Failed != 2 || summary.Skipped != 0 {
+		t.Fatalf("expected 3 created and 2 failed resources, got %+v", summary)
+	}
+	failures := readLines(t, errorsPath)
+	if len(failures) != 2 || failures[0]["source"] != importPath+":2" || failures[1]["source"] != importPath+":5" {
+		t.Fatalf("expected lines 2 and 5 to be reported, got %v", failures)
+	}
+	created := map[string]string{}
+	for _, rec := range readLines(t, progressPath) {
+		created[rec["source"].(string)] = rec["reference"].(string)
+	}
+
+	router := mux.NewRouter()
+	handlers.RegisterAllFHIRResourceRoutes(router.PathPrefix("/fhir").Subrouter(), logging.NewLogger(), render.New(), registry)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fhir/"+created[importPath+":1"], nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the imported PractitionerRole to be readable, got status %d", rec.Code)
+	}
+	imported := struct {
+		Location     []struct{ Reference string }
+		Organization struct{ Reference string }
+		Practitioner struct{ Reference string }
+	}{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &imported); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Practitioner.Reference != created[importPath+":3"] || imported.Location[0].Reference != created[importPath+":4"] {
+		t.Fatalf("expected references to the imported resources, got %+v", imported)
+	}
+	if imported.Organization.Reference != "Organization/f001" {
+		t.Fatalf("expected references to other resources to be kept, got %q", imported.Organization.Reference)
+	}
+	if !strings.HasPrefix(created[importPath+":3"], "Practitioner/") || created[importPath+":3"] == "Practitioner/example" {
+		t.Fatalf("expected the practitioner to be created with a new id, got %q", created[importPath+":3"])
+	}
+
+	summary = run(importPath)
+	if summary.Created != 0 || summary.Failed != 2 || summary.Skipped != 3 {
+		t.Fatalf("expected the imported resources to be skipped, got %+v", summary)
+	}
+
+	// resources are recognized by their content rather than by their line
+	writeNDJSON(patient, location, practitioner, role)
+	summary = run(importPath)
+	if summary.Created != 0 || summary.Failed != 1 || summary.Skipped != 3 {
+		t.Fatalf("expected the moved resources to be skipped, got %+v", summary)
+	}
+	location["name"] = "Renamed location"
+	writeNDJSON(role, practitioner, location)
+	summary = run(importPath)
+	if summary.Created != 1 || summary.Failed != 0 || summary.Skipped != 2 {
+		t.Fatalf("expected the edited resource to be imported again, got %+v", summary)
+	}
+
+	// a file holding a single Bundle, written over several lines
+	practitioner["id"] = "bundled"
+	bundle, err := json.MarshalIndent(map[string]interface{}{
+		"resourceType": "Bundle",
+		"type":         "collection",
+		"entry": []interface{}{
+			map[string]interface{}{"fullUrl": "urn:uuid:8c3d5f37-1ab2-4b5e-9a4e-5c1d2e3f4a5b", "resource": practitioner},
+		},
+	}, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bundlePath := filepath.Join(dir, "bundle.json")
+	if err := ioutil.WriteFile(bundlePath, bundle, 0644); err != nil {
+		t.Fatal(err)
+	}
+	summary = run(bundlePath)
+	if summary.Created != 1 || summary.Failed != 0 {
+		t.Fatalf("expected the entry of the Bundle to be imported, got %+v", summary)
+	}
+	records := readLines(t, progressPath)
+	if last := records[len(records)-1]; last["source"] != bundlePath+"#Bundle.entry[0]" || last["status"] != "created" {
+		t.Fatalf("expected the entry of the Bundle to be recorded, got %v", last)
+	}
+}
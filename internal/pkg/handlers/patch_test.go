@@ -0,0 +1,90 @@
+package handlers_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+func TestJSONPatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-patch-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	router := mux.NewRouter()
+	handlers.RegisterAllFHIRResourceRoutes(router.PathPrefix("/fhir").Subrouter(), logging.NewLogger(), render.New(), registry)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	practitioner := loadFixture(t, "practitioner.example.json")
+	delete(practitioner, "id")
+	res, body := doRequest(t, "POST", server.URL+"/fhir/Practitioner", nil, practitioner)
+	expectStatus(t, "create", res, body, http.StatusCreated)
+	instanceURL := server.URL + "/fhir/Practitioner/" + body["id"].(string)
+	etag := res.Header.Get("Etag")
+
+	patch := func(ifMatch string, ops string) (*http.Response, map[string]interface{}) {
+		req, err := http.NewRequest("PATCH", instanceURL, bytes.NewBufferString(ops))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json-patch+json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body := map[string]interface{}{}
+		if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return res, body
+	}
+	rename := `[{"op": "test", "path": "/name/0/family", "value": "Careful"}, {"op": "replace", "path": "/name/0/family", "value": "Cautious"}]`
+
+	res, body = patch("", rename)
+	expectStatus(t, "patch without If-Match", res, body, http.StatusBadRequest)
+	res, body = patch(`W/"9-9"`, rename)
+	expectStatus(t, "patch with a stale If-Match", res, body, http.StatusPreconditionFailed)
+	res, body = patch(etag, `[{"op": "test", "path": "/name/0/family", "value": "Careless"}, {"op": "replace", "path": "/name/0/family", "value": "Cautious"}]`)
+	expectStatus(t, "patch with a failing test", res, body, http.StatusUnprocessableEntity)
+	res, body = patch(etag, `[{"op": "replace", "path": "/nickname/0", "value": "Cautious"}]`)
+	expectStatus(t, "patch of an invalid path", res, body, http.StatusUnprocessableEntity)
+	res, body = patch(etag, `[{"op": "replace"`)
+	expectStatus(t, "malformed patch", res, body, http.StatusBadRequest)
+	res, body = patch(etag, `[{"op": "replace", "path": "/id", "value": "other"}]`)
+	expectStatus(t, "patch of the id", res, body, http.StatusBadRequest)
+
+	res, body = doRequest(t, "GET", instanceURL, nil, nil)
+	expectStatus(t, "read after failed patches", res, body, http.StatusOK)
+	if res.Header.Get("Etag") != etag {
+		t.Fatalf("expected failed patches to leave the resource unchanged, got %s", res.Header.Get("Etag"))
+	}
+
+	res, body = patch(etag, rename)
+	expectStatus(t, "patch", res, body, http.StatusOK)
+	if family := body["name"].([]interface{})[0].(map[string]interface{})["family"]; family != "Cautious" {
+		t.Fatalf("patch: expected family Cautious, got %v", family)
+	}
+	if res.Header.Get("Etag") == etag {
+		t.Fatal("patch: expected a new version")
+	}
+	res, body = patch(etag, rename)
+	expectStatus(t, "patch of a replaced version", res, body, http.StatusPreconditionFailed)
+}
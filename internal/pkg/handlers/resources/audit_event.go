@@ -0,0 +1,169 @@
+package resources
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/audit"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/unrolled/render"
+)
+
+// defaultAuditEventCount is the number of events returned by a search without _count
+const defaultAuditEventCount = 100
+
+// auditEventColumns are the columns of the audit records that serve the token and reference search parameters
+var auditEventColumns = map[string]string{
+	"action":  "action",
+	"agent":   "agent",
+	"entity":  "entity",
+	"outcome": "outcome",
+	"subtype": "subtype",
+}
+
+// AuditEvent serves the audit events recorded for the requests of the organization, which cannot be changed through the API
+type AuditEvent struct {
+	config        *ResourceConfig
+	db            *database.DB
+	jsonValidator *models.JSONValidator
+	log           *logging.Logger
+	renderer      *render.Render
+	tenant        string
+}
+
+// Read ...
+func (h *AuditEvent) Read() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		uuid := vars["resourceID"]
+		if uuid == "" {
+			return errBadRequest(nil, "no resource ID was provided")
+		}
+		rec := &audit.Record{}
+		query := h.db.Where("tenant = ? AND uuid = ?", h.tenant, uuid).First(rec)
+		if query.RecordNotFound() {
+			return errNotFound("resource not found")
+		} else if err := query.Error; err != nil {
+			return errInternal(err, "failed to query database")
+		}
+		event := &models.AuditEvent{}
+		if err := json.Unmarshal(rec.Data, event); err != nil {
+			return errInternal(err, "failed to unmarshal data")
+		}
+		return resourceRead(h.renderer, rw, req, http.StatusOK, "", rec.Recorded, event, true)
+	})
+}
+
+// Search returns the matching events, newest first
+// repeated parameters are combined with AND, comma-separated values with OR
+func (h *AuditEvent) Search() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		query := req.URL.Query()
+		scope := h.db.Where("tenant = ?", h.tenant)
+
+		names := []string{}
+		for name := range query {
+			if !searchResultParams[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p, ok := h.config.getSearchParam(name)
+			if !ok {
+				return errNotSupported(fmt.Sprintf("unsupported search parameter %q", name))
+			}
+			for _, value := range query[name] {
+				if p.Type == models.SearchParameterTypeDate {
+					d, err := parseDateSearch(value)
+					if err != nil {
+						return errBadRequest(err, "invalid date parameter")
+					}
+					condition, args := d.sqlCondition("recorded")
+					scope = scope.Where(condition, args...)
+					continue
+				}
+				values := []string{}
+				for _, v := range strings.Split(value, ",") {
+					values = append(values, getIndexValues(p, v)...)
+				}
+				scope = scope.Where(auditEventColumns[name]+" IN (?)", values)
+			}
+		}
+
+		count := defaultAuditEventCount
+		if c := query.Get("_count"); c != "" {
+			n, err := strconv.Atoi(c)
+			if err != nil || n < 0 {
+				return errBadRequest(err, "invalid _count parameter")
+			}
+			count = n
+		}
+
+		records := []*audit.Record{}
+		if err := scope.Order("id desc").Limit(count).Find(&records).Error; err != nil {
+			return errInternal(err, "failed to query database")
+		}
+		results := []models.Resource{}
+		for _, rec := range records {
+			event := &models.AuditEvent{}
+			if err := json.Unmarshal(rec.Data, event); err != nil {
+				return errInternal(err, "failed to unmarshal data")
+			}
+			results = append(results, event)
+		}
+
+		h.renderer.JSON(rw, http.StatusOK, newSearchSetBundle(req, results))
+		return nil
+	})
+}
+
+// GetResourceConfig ...
+func (h *AuditEvent) GetResourceConfig() *ResourceConfig {
+	return h.config
+}
+
+func (h *AuditEvent) getJSONValidator() *models.JSONValidator {
+	return h.jsonValidator
+}
+
+func (h *AuditEvent) getLogger() *logging.Logger {
+	return h.log
+}
+
+func (h *AuditEvent) getRenderer() *render.Render {
+	return h.renderer
+}
+
+// NewAuditEvent ...
+func NewAuditEvent(registry *Registry) (*AuditEvent, error) {
+	v, err := models.NewJSONValidator(registry.box, "AuditEvent")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create JSON validator")
+	}
+	config := NewResourceConfig()
+	config.SearchParams = []searchParam{
+		{Name: "action", Type: models.SearchParameterTypeToken},
+		{Name: "agent", Type: models.SearchParameterTypeToken},
+		{Name: "date", Type: models.SearchParameterTypeDate},
+		{Name: "entity", Type: models.SearchParameterTypeReference},
+		{Name: "outcome", Type: models.SearchParameterTypeToken},
+		{Name: "subtype", Type: models.SearchParameterTypeToken},
+	}
+	return &AuditEvent{
+		config:        config,
+		db:            registry.db,
+		jsonValidator: v,
+		log:           registry.log,
+		renderer:      registry.renderer,
+		tenant:        registry.appConfig.Tenant,
+	}, nil
+}
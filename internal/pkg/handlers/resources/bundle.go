@@ -0,0 +1,507 @@
+package resources
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/utils"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/pborman/uuid"
+	"github.com/unrolled/render"
+)
+
+const urnUUIDPrefix = "urn:uuid:"
+
+// BundleHandler processes batch and transaction Bundles posted to the FHIR base URL
+// each entry is dispatched to the handler registered for its resource type and method
+type BundleHandler struct {
+	dispatcher http.Handler
+	handlers   map[string]interface{}
+	log        *logging.Logger
+	renderer   *render.Render
+}
+
+// NewBundleHandler ...
+func NewBundleHandler(registry *Registry, dispatcher http.Handler) *BundleHandler {
+	handlers := map[string]interface{}{}
+	for _, i := range registry.Resources {
+		handlers[utils.GetBaseTypeName(i)] = i
+	}
+	return &BundleHandler{
+		dispatcher: dispatcher,
+		handlers:   handlers,
+		log:        registry.log,
+		renderer:   registry.renderer,
+	}
+}
+
+func (h *BundleHandler) getJSONValidator() *models.JSONValidator {
+	return nil
+}
+
+func (h *BundleHandler) getLogger() *logging.Logger {
+	return h.log
+}
+
+func (h *BundleHandler) getRenderer() *render.Render {
+	return h.renderer
+}
+
+// bundleRequest is a batch or transaction Bundle with its entry resources kept as raw JSON
+type bundleRequest struct {
+	ResourceType string                `json:"resourceType"`
+	Type         models.BundleType     `json:"type"`
+	Entry        []*bundleRequestEntry `json:"entry"`
+}
+
+type bundleRequestEntry struct {
+	FullURL  string                `json:"fullUrl"`
+	Resource json.RawMessage       `json:"resource"`
+	Request  *models.BundleRequest `json:"request"`
+
+	resourceType string
+	resourceID   string
+}
+
+// Process ...
+// the entries of a transaction are checked against the current state of the store before anything is written, and a
+// transaction that would fail is rejected without changes; the changes are still written one at a time, so a
+// transaction that fails afterwards, because of a concurrent change or of the store, reports the changes already made
+func (h *BundleHandler) Process() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		bundle := &bundleRequest{}
+		if err := json.NewDecoder(req.Body).Decode(bundle); err != nil {
+			return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "unable to parse Bundle")
+		}
+		if bundle.ResourceType != "Bundle" {
+			return errBadRequest(nil, "only Bundle resources can be posted to the base URL")
+		}
+
+		var responseType models.BundleType
+		switch bundle.Type {
+		case models.BundleTypeBatch:
+			responseType = models.BundleTypeBatchResponse
+		case models.BundleTypeTransaction:
+			responseType = models.BundleTypeTransactionResponse
+		default:
+			return errNotSupported(fmt.Sprintf("unsupported Bundle type %q", bundle.Type))
+		}
+		transaction := bundle.Type == models.BundleTypeTransaction
+
+		// every entry is checked before anything is submitted, so an invalid transaction never reaches the chain
+		problems := make([]error, len(bundle.Entry))
+		invalid := &OperationError{Status: http.StatusBadRequest}
+		for i, e := range bundle.Entry {
+			if problems[i] = h.validateEntry(e); problems[i] != nil {
+				invalid.Issues = append(invalid.Issues, entryIssues(i, problems[i])...)
+			}
+		}
+		if transaction && len(invalid.Issues) > 0 {
+			return invalid
+		}
+
+		order, err := getProcessingOrder(bundle.Entry)
+		if err != nil && transaction {
+			return err
+		}
+		if transaction {
+			if err := h.checkTransaction(req.Context(), bundle.Entry); err != nil {
+				return err
+			}
+		}
+
+		resolved := map[string]string{}
+		committed := []string{}
+		entries := make([]*models.BundleEntry, len(bundle.Entry))
+		for _, i := range order {
+			e := bundle.Entry[i]
+			if problems[i] != nil {
+				entries[i] = newErrorResponseEntry(problems[i])
+				continue
+			}
+			entry, status := h.dispatch(req, e, resolved)
+			if status >= http.StatusBadRequest && transaction {
+				opErr := &OperationError{Status: status, Issues: entryIssues(i, entryError(entry, status))}
+				if len(committed) > 0 {
+					opErr.Issues = append(opErr.Issues, &models.OperationOutcomeIssue{
+						Severity:    models.OperationOutcomeIssueSeverityWarning,
+						Code:        models.OperationOutcomeIssueCodeIncomplete,
+						Diagnostics: fmt.Sprintf("the following changes had already been committed: %s", strings.Join(committed, ", ")),
+					})
+				}
+				return opErr
+			}
+			if status < http.StatusBadRequest {
+				if strings.HasPrefix(e.FullURL, urnUUIDPrefix) && entry.Resource != nil {
+					if r, ok := (*entry.Resource).(map[string]interface{}); ok {
+						resolved[e.FullURL] = fmt.Sprintf("%s/%s", r["resourceType"], r["id"])
+					}
+				}
+				committed = append(committed, fmt.Sprintf("%s %s", e.Request.Method, e.Request.URL))
+			}
+			entries[i] = entry
+		}
+
+		h.renderer.JSON(rw, http.StatusOK, &models.Bundle{Type: responseType, Entry: entries})
+		return nil
+	})
+}
+
+// validateEntry checks that an entry can be dispatched and that its resource is valid
+func (h *BundleHandler) validateEntry(e *bundleRequestEntry) error {
+	if e.Request == nil || e.Request.URL == "" {
+		return errBadRequest(nil, "entry has no request")
+	}
+	if strings.Contains(e.Request.URL, "?") || e.Request.IfNoneExist != "" {
+		return errNotSupported("conditional interactions are not supported")
+	}
+	segments := strings.Split(strings.Trim(e.Request.URL, "/"), "/")
+	e.resourceType = segments[0]
+	handler, ok := h.handlers[e.resourceType]
+	if !ok {
+		return errNotSupported(fmt.Sprintf("unsupported resource type %q", e.resourceType))
+	}
+
+	supported := false
+	switch e.Request.Method {
+	case models.BundleRequestMethodPOST:
+		_, supported = handler.(CreateableResource)
+		supported = supported && len(segments) == 1
+	case models.BundleRequestMethodPUT:
+		_, supported = handler.(UpdateableResource)
+		supported = supported && len(segments) == 2
+	case models.BundleRequestMethodDELETE:
+		_, supported = handler.(DeleteableResource)
+		supported = supported && len(segments) == 2
+	}
+	if !supported {
+		return errNotSupported(fmt.Sprintf("unsupported interaction %s %s", e.Request.Method, e.Request.URL))
+	}
+	if len(segments) == 2 {
+		e.resourceID = segments[1]
+	}
+
+	if e.Request.Method == models.BundleRequestMethodDELETE {
+		return nil
+	}
+	if len(e.Resource) == 0 {
+		return errBadRequest(nil, "entry has no resource")
+	}
+	var header struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id"`
+	}
+	if err := json.Unmarshal(e.Resource, &header); err != nil {
+		return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "unable to parse resource")
+	}
+	if header.ResourceType != e.resourceType {
+		return errBadRequest(nil, fmt.Sprintf("resource type %q does not match request URL", header.ResourceType))
+	}
+	if e.resourceID != "" && header.ID != "" && header.ID != e.resourceID {
+		return errBadRequest(nil, "resource id does not match request URL")
+	}
+	if rh, ok := handler.(resourceHandler); ok {
+		valid, vErrs, err := rh.getJSONValidator().Validate(e.Resource)
+		if err != nil {
+			return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "resource is not valid JSON")
+		}
+		if !valid {
+			return newValidationError(vErrs)
+		}
+	}
+	return nil
+}
+
+// preconditionChecker is implemented by the resources whose updates and deletes can be checked without writing
+type preconditionChecker interface {
+	checkPreconditions(ctx context.Context, id uuid.UUID, method models.BundleRequestMethod, ifMatch string) error
+}
+
+// checkTransaction rejects transactions whose entries cannot all succeed in the current state of the store: entries
+// that change the same resource, and updates or deletes of missing resources or of versions other than the one
+// required by the entry
+func (h *BundleHandler) checkTransaction(ctx context.Context, entries []*bundleRequestEntry) error {
+	targets := map[string]int{}
+	for i, e := range entries {
+		if e.resourceID == "" {
+			continue
+		}
+		target := e.resourceType + "/" + e.resourceID
+		if j, ok := targets[target]; ok {
+			return &OperationError{Status: http.StatusBadRequest, Issues: entryIssues(i, errBadRequest(nil, fmt.Sprintf("%s is also changed by entry %d", target, j)))}
+		}
+		targets[target] = i
+		if err := h.checkEntryPreconditions(ctx, e); err != nil {
+			opErr, ok := asOperationError(err)
+			if !ok {
+				opErr = errInternal(err, "an unexpected error occurred")
+			}
+			return &OperationError{Status: opErr.Status, Issues: entryIssues(i, opErr)}
+		}
+	}
+	return nil
+}
+
+// checkEntryPreconditions checks that the resource changed by an entry exists, at the version required by the entry
+// the scope of the token is checked first, so that the state of the store is not disclosed to other clients
+func (h *BundleHandler) checkEntryPreconditions(ctx context.Context, e *bundleRequestEntry) error {
+	if token := auth.FromContext(ctx); token != nil && !token.Scopes.Allows(e.resourceType, auth.Write) {
+		return NewOperationError(http.StatusForbidden, models.OperationOutcomeIssueCodeForbidden, nil,
+			fmt.Sprintf("the token does not grant %s access to %s resources", auth.Write, e.resourceType))
+	}
+	checker, ok := h.handlers[e.resourceType].(preconditionChecker)
+	if !ok {
+		return errNotSupported(fmt.Sprintf("%s resources cannot be changed in a transaction", e.resourceType))
+	}
+	id := uuid.Parse(e.resourceID)
+	if id == nil {
+		return errNotFound("resource not found")
+	}
+	return checker.checkPreconditions(ctx, id, e.Request.Method, e.Request.IfMatch)
+}
+
+// checkPreconditions checks that the current version of a resource can be updated or deleted
+func (h *EthereumResource) checkPreconditions(ctx context.Context, id uuid.UUID, method models.BundleRequestMethod, ifMatch string) error {
+	resource, _, err := h.readResource(ctx, storage.Primary(h.store), id)
+	if err != nil {
+		return errStorage(err, "failed to read record")
+	}
+	return matchETag(ifMatch, resource.GetMeta().VersionID, method == models.BundleRequestMethodPUT)
+}
+
+// getProcessingOrder returns the entry indexes in the order they should be processed
+// deletes come first, then creates (ordered so that entries are created before the entries that reference them), then updates
+// an error is returned when created entries reference each other in a cycle, in which case the order is still usable for batches
+func getProcessingOrder(entries []*bundleRequestEntry) ([]int, error) {
+	order := []int{}
+	pending := []int{}
+	created := map[string]bool{}
+	for i, e := range entries {
+		if e.Request == nil {
+			continue
+		}
+		switch e.Request.Method {
+		case models.BundleRequestMethodDELETE:
+			order = append(order, i)
+		case models.BundleRequestMethodPOST:
+			pending = append(pending, i)
+			if strings.HasPrefix(e.FullURL, urnUUIDPrefix) {
+				created[e.FullURL] = true
+			}
+		}
+	}
+
+	var err error
+	for len(pending) > 0 {
+		remaining := []int{}
+		for _, i := range pending {
+			ready := true
+			for _, ref := range findURNReferences(entries[i].Resource) {
+				if created[ref] && ref != entries[i].FullURL {
+					ready = false
+				}
+			}
+			if ready {
+				order = append(order, i)
+				delete(created, entries[i].FullURL)
+			} else {
+				remaining = append(remaining, i)
+			}
+		}
+		if len(remaining) == len(pending) {
+			err = errBadRequest(nil, "entries reference each other in a cycle")
+			order = append(order, remaining...)
+			break
+		}
+		pending = remaining
+	}
+
+	for i, e := range entries {
+		if e.Request == nil || (e.Request.Method != models.BundleRequestMethodDELETE && e.Request.Method != models.BundleRequestMethodPOST) {
+			order = append(order, i)
+		}
+	}
+	return order, err
+}
+
+// findURNReferences returns every urn:uuid value found in a JSON document
+func findURNReferences(doc json.RawMessage) []string {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil
+	}
+	refs := []string{}
+	walkJSONStrings(v, func(s string) string {
+		if strings.HasPrefix(s, urnUUIDPrefix) {
+			refs = append(refs, s)
+		}
+		return s
+	})
+	return refs
+}
+
+// walkJSONStrings replaces every string value in a decoded JSON document with the result of fn
+func walkJSONStrings(v interface{}, fn func(string) string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return fn(t)
+	case map[string]interface{}:
+		for k, c := range t {
+			t[k] = walkJSONStrings(c, fn)
+		}
+	case []interface{}:
+		for i, c := range t {
+			t[i] = walkJSONStrings(c, fn)
+		}
+	}
+	return v
+}
+
+// resolveURNReferences rewrites references to resources created earlier in the Bundle
+func resolveURNReferences(doc json.RawMessage, resolved map[string]string) (json.RawMessage, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	v = walkJSONStrings(v, func(s string) string {
+		if ref, ok := resolved[s]; ok {
+			return ref
+		}
+		return s
+	})
+	return json.Marshal(v)
+}
+
+// dispatch executes an entry against the registered handlers and converts the response to a Bundle entry
+func (h *BundleHandler) dispatch(parent *http.Request, e *bundleRequestEntry, resolved map[string]string) (*models.BundleEntry, int) {
+	body := e.Resource
+	if len(body) > 0 {
+		var err error
+		if body, err = resolveURNReferences(body, resolved); err != nil {
+			return newErrorResponseEntry(errBadRequest(err, "unable to resolve references")), http.StatusBadRequest
+		}
+	}
+
+	url := strings.TrimSuffix(parent.URL.Path, "/") + "/" + strings.Trim(e.Request.URL, "/")
+	req, err := http.NewRequest(string(e.Request.Method), url, bytes.NewReader(body))
+	if err != nil {
+		return newErrorResponseEntry(errBadRequest(err, "invalid request URL")), http.StatusBadRequest
+	}
+	req = req.WithContext(parent.Context())
+	for k, v := range parent.Header {
+		req.Header[k] = v
+	}
+	req.Header.Del("Content-Length")
+	req.Header.Del("Prefer")
+	req.Header.Set("Content-Type", "application/fhir+json")
+	req.Header.Del("If-Match")
+	if e.Request.IfMatch != "" {
+		req.Header.Set("If-Match", e.Request.IfMatch)
+	}
+	req.Host = parent.Host
+	req.RemoteAddr = parent.RemoteAddr
+	req.TLS = parent.TLS
+
+	rec := newBufferedResponseWriter()
+	h.dispatcher.ServeHTTP(rec, req)
+
+	entry := &models.BundleEntry{
+		Response: &models.BundleResponse{
+			Status:   fmt.Sprintf("%d %s", rec.status, http.StatusText(rec.status)),
+			Location: rec.Header().Get("Location"),
+			Etag:     rec.Header().Get("Etag"),
+		},
+	}
+	if lm, err := time.Parse(http.TimeFormat, rec.Header().Get("Last-Modified")); err == nil {
+		entry.Response.LastModified = lm.UTC().Format(time.RFC3339)
+	}
+	var resource models.ResourceList
+	if rec.body.Len() > 0 && json.Unmarshal(rec.body.Bytes(), &resource) == nil {
+		if rec.status >= http.StatusBadRequest {
+			entry.Response.Outcome = &resource
+		} else {
+			entry.Resource = &resource
+			if r, ok := resource.(map[string]interface{}); ok {
+				entry.FullURL = fmt.Sprintf("%s/%s/%s", getFHIRBaseURL(parent), r["resourceType"], r["id"])
+			}
+		}
+	}
+	return entry, rec.status
+}
+
+// newErrorResponseEntry creates a Bundle entry describing an entry that could not be processed
+func newErrorResponseEntry(err error) *models.BundleEntry {
+	opErr, ok := asOperationError(err)
+	if !ok {
+		opErr = errInternal(err, "an unexpected error occurred")
+	}
+	var outcome models.ResourceList = opErr.OperationOutcome()
+	return &models.BundleEntry{
+		Response: &models.BundleResponse{
+			Status:  fmt.Sprintf("%d %s", opErr.Status, http.StatusText(opErr.Status)),
+			Outcome: &outcome,
+		},
+	}
+}
+
+// entryError recovers the error reported in a failed entry response
+func entryError(entry *models.BundleEntry, status int) error {
+	if entry.Response.Outcome != nil {
+		if b, err := json.Marshal(*entry.Response.Outcome); err == nil {
+			outcome := &models.OperationOutcome{}
+			if json.Unmarshal(b, outcome) == nil && len(outcome.Issue) > 0 {
+				return &OperationError{Status: status, Issues: outcome.Issue}
+			}
+		}
+	}
+	return NewOperationError(status, models.OperationOutcomeIssueCodeProcessing, nil, entry.Response.Status)
+}
+
+// entryIssues returns the issues of an entry error, each located at the entry within the Bundle
+func entryIssues(index int, err error) []*models.OperationOutcomeIssue {
+	opErr, ok := asOperationError(err)
+	if !ok {
+		opErr = errInternal(err, "an unexpected error occurred")
+	}
+	issues := []*models.OperationOutcomeIssue{}
+	for _, issue := range opErr.Issues {
+		i := *issue
+		i.Expression = []string{fmt.Sprintf("Bundle.entry[%d]", index)}
+		for _, e := range issue.Expression {
+			i.Expression = append(i.Expression, fmt.Sprintf("Bundle.entry[%d].resource.%s", index, e))
+		}
+		issues = append(issues, &i)
+	}
+	return issues
+}
+
+// bufferedResponseWriter captures a response so that it can be embedded in a Bundle
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{header: http.Header{}, status: http.StatusOK}
+}
+
+func (w *bufferedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+func (w *bufferedResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
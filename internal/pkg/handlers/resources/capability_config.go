@@ -2,8 +2,10 @@ package resources
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/metadata"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/utils"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
@@ -88,9 +90,37 @@ func (c *CapabilityConfig) getRestfulInteractionTypes(i interface{}) []models.Ca
 	if _, ok := i.(VersionReadableResource); ok {
 		ints = append(ints, models.CapabilityStatementInteractionCodeVread)
 	}
+	if _, ok := i.(InstanceHistoryReadableResource); ok {
+		ints = append(ints, models.CapabilityStatementInteractionCodeHistoryInstance)
+	}
+	if _, ok := i.(TypeHistoryReadableResource); ok {
+		ints = append(ints, models.CapabilityStatementInteractionCodeHistoryType)
+	}
 	return ints
 }
 
+// getSecurity describes the SMART on FHIR authorization of the server, with the OAuth endpoints of the authorization server
+func getSecurity(authConfig config.AuthConfig) *models.CapabilityStatementSecurity {
+	uris := &models.Extension{URL: "http://fhir-registry.smarthealthit.org/StructureDefinition/oauth-uris"}
+	if authConfig.TokenURL != "" {
+		uris.Extension = append(uris.Extension, &models.Extension{URL: "token", ValueURI: authConfig.TokenURL})
+	}
+	if authConfig.AuthorizeURL != "" {
+		uris.Extension = append(uris.Extension, &models.Extension{URL: "authorize", ValueURI: authConfig.AuthorizeURL})
+	}
+	return &models.CapabilityStatementSecurity{
+		Service: []*models.CodeableConcept{
+			{
+				Coding: []*models.Coding{
+					{System: "http://terminology.hl7.org/CodeSystem/restful-security-service", Code: "SMART-on-FHIR"},
+				},
+				Text: "OAuth2 using SMART-on-FHIR profile (see http://docs.smarthealthit.org)",
+			},
+		},
+		Extension: []*models.Extension{uris},
+	}
+}
+
 // NewCapabilityConfig ...
 func NewCapabilityConfig(registry *Registry) *CapabilityConfig {
 	log := registry.log
@@ -101,12 +131,15 @@ func NewCapabilityConfig(registry *Registry) *CapabilityConfig {
 	newCS.Date = metadata.Data.BuildTime.UTC().Format(time.RFC3339)
 	newCS.Description = metadata.Data.AppName
 	newCS.FhirVersion = models.FHIRVersion
-	newCS.Format = []string{"json"}
+	newCS.Format = []string{"json", "xml"}
 	newCS.Kind = models.CapabilityStatementKindInstance
 	newCS.Name = metadata.Data.AppName
-	newCS.PatchFormat = []string{"application/json-patch+json"}
+	newCS.PatchFormat = []string{"application/json-patch+json", "application/fhir+json", "application/fhir+xml"}
 	newCS.Status = models.CapabilityStatementStatusDraft
 	newCS.Version = metadata.Data.Version
+	if tenant := registry.appConfig.Tenant; tenant != "" {
+		newCS.Description = fmt.Sprintf("%s (tenant %s)", metadata.Data.AppName, tenant)
+	}
 	// newCS.Copyright = "Synaptic Health Alliance 2019"
 	// newCS.Publisher = "Synaptic Health Alliance"
 	// newCS.Purpose = "Synaptic Health Alliance"
@@ -118,7 +151,20 @@ func NewCapabilityConfig(registry *Registry) *CapabilityConfig {
 	// newCS.ImplementationGuide = []string{}
 
 	newCS.Rest = []*models.CapabilityStatementRest{
-		{Mode: models.CapabilityStatementRestModeServer},
+		{
+			Mode: models.CapabilityStatementRestModeServer,
+			Interaction: []*models.CapabilityStatementInteraction1{
+				{Code: models.CapabilityStatementInteraction1CodeBatch},
+				{Code: models.CapabilityStatementInteraction1CodeTransaction},
+			},
+			Operation: []*models.CapabilityStatementOperation{
+				{Name: "export", Definition: exportOperationDefinition},
+			},
+		},
+	}
+
+	if authConfig := registry.appConfig.Auth; authConfig.Enabled() {
+		newCS.Rest[0].Security = getSecurity(authConfig)
 	}
 
 	newConfig := &CapabilityConfig{CapabilityStatement: newCS}
@@ -0,0 +1,153 @@
+package resources
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/pkg/errors"
+	"github.com/unrolled/render"
+)
+
+// OperationError is an error that is reported to the client as a FHIR OperationOutcome
+type OperationError struct {
+	Status int
+	Issues []*models.OperationOutcomeIssue
+	cause  error
+}
+
+// Error ...
+func (e *OperationError) Error() string {
+	msg := http.StatusText(e.Status)
+	if len(e.Issues) > 0 && e.Issues[0].Diagnostics != "" {
+		msg = fmt.Sprintf("%s: %s", msg, e.Issues[0].Diagnostics)
+	}
+	if e.cause != nil {
+		msg = fmt.Sprintf("%s: %s", msg, e.cause.Error())
+	}
+	return msg
+}
+
+// OperationOutcome converts the error to a FHIR OperationOutcome
+func (e *OperationError) OperationOutcome() *models.OperationOutcome {
+	return &models.OperationOutcome{Issue: e.Issues}
+}
+
+// NewOperationError creates an error with a single issue
+func NewOperationError(status int, code models.OperationOutcomeIssueCode, cause error, diagnostics string) *OperationError {
+	severity := models.OperationOutcomeIssueSeverityError
+	if status >= http.StatusInternalServerError {
+		severity = models.OperationOutcomeIssueSeverityFatal
+	}
+	return &OperationError{
+		Status: status,
+		Issues: []*models.OperationOutcomeIssue{
+			{Severity: severity, Code: code, Diagnostics: diagnostics},
+		},
+		cause: cause,
+	}
+}
+
+// newValidationError creates an error with an issue for each JSON schema violation
+func newValidationError(vErrs []models.JSONValidationError) *OperationError {
+	issues := []*models.OperationOutcomeIssue{}
+	for _, e := range vErrs {
+		issue := &models.OperationOutcomeIssue{
+			Severity:    models.OperationOutcomeIssueSeverityError,
+			Code:        models.OperationOutcomeIssueCodeInvalid,
+			Diagnostics: e.String(),
+		}
+		if f := e.Field(); f != "" && f != "(root)" {
+			issue.Expression = []string{f}
+		}
+		issues = append(issues, issue)
+	}
+	return &OperationError{Status: http.StatusBadRequest, Issues: issues}
+}
+
+func errBadRequest(cause error, diagnostics string) *OperationError {
+	return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeInvalid, cause, diagnostics)
+}
+
+func errNotSupported(diagnostics string) *OperationError {
+	return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeNotSupported, nil, diagnostics)
+}
+
+func errNotFound(diagnostics string) *OperationError {
+	return NewOperationError(http.StatusNotFound, models.OperationOutcomeIssueCodeNotFound, nil, diagnostics)
+}
+
+func errConflict(cause error, diagnostics string) *OperationError {
+	return NewOperationError(http.StatusConflict, models.OperationOutcomeIssueCodeConflict, cause, diagnostics)
+}
+
+func errPreconditionFailed(diagnostics string) *OperationError {
+	return NewOperationError(http.StatusPreconditionFailed, models.OperationOutcomeIssueCodeConflict, nil, diagnostics)
+}
+
+func errInternal(cause error, diagnostics string) *OperationError {
+	return NewOperationError(http.StatusInternalServerError, models.OperationOutcomeIssueCodeException, cause, diagnostics)
+}
+
+// errStorage converts an error reported by a store to an OperationError, keeping errors that already are one
+func errStorage(err error, diagnostics string) *OperationError {
+	if opErr, ok := err.(*OperationError); ok {
+		return opErr
+	}
+	switch errors.Cause(err) {
+	case storage.ErrObjectNotFound:
+		return errNotFound("resource not found")
+	case storage.ErrVersionConflict:
+		return errConflict(err, "resource was modified by another transaction")
+	case storage.ErrForbidden:
+		return NewOperationError(http.StatusForbidden, models.OperationOutcomeIssueCodeForbidden, err, "resource is encrypted for other organizations")
+	case storage.ErrTooLarge:
+		return NewOperationError(http.StatusRequestEntityTooLarge, models.OperationOutcomeIssueCodeTooCostly, err, "resource is too large to be stored")
+	}
+	return NewOperationError(http.StatusBadGateway, models.OperationOutcomeIssueCodeTransient, err, diagnostics)
+}
+
+// asOperationError finds an OperationError in a chain of wrapped errors
+func asOperationError(err error) (*OperationError, bool) {
+	for err != nil {
+		if opErr, ok := err.(*OperationError); ok {
+			return opErr, true
+		}
+		causer, ok := err.(interface{ Cause() error })
+		if !ok {
+			break
+		}
+		err = causer.Cause()
+	}
+	return nil, false
+}
+
+// renderError writes an error to the client as a FHIR OperationOutcome
+func renderError(rndr *render.Render, rw http.ResponseWriter, err error) {
+	opErr, ok := asOperationError(err)
+	if !ok {
+		opErr = errInternal(err, "an unexpected error occurred")
+	}
+	rndr.JSON(rw, opErr.Status, opErr.OperationOutcome())
+}
+
+// handleOperation adapts a handler function that returns an error to an http.Handler, rendering any error as an OperationOutcome
+func handleOperation(h resourceHandler, fn func(http.ResponseWriter, *http.Request) error) http.Handler {
+	log := h.getLogger()
+	rndr := h.getRenderer()
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		err := fn(rw, req)
+		if err == nil {
+			return
+		}
+		entry := log.WithError(err).WithField("path", req.URL.Path)
+		if opErr, ok := asOperationError(err); ok && opErr.Status < http.StatusInternalServerError {
+			entry.Info("request failed")
+		} else {
+			entry.Error("request failed")
+		}
+		renderError(rndr, rw, err)
+	})
+}
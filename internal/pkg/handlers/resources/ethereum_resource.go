@@ -1,35 +1,39 @@
 package resources
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"time"
 
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
-	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
 	"github.com/pborman/uuid"
 	"github.com/unrolled/render"
 )
 
-// EthereumResource provides a standard set of handlers for Ethereum-backed resources
+// EthereumResource provides a standard set of handlers for resources held by a storage.Store
 type EthereumResource struct {
-	adapter       *ethereum.Adapter
 	config        *ResourceConfig
+	engine        *subscriptions.Engine
 	jsonValidator *models.JSONValidator
 	log           *logging.Logger
 	newModelFunc  func() models.Resource
 	renderer      *render.Render
+	store         storage.Store
+	tenant        string
+	txnWait       time.Duration
 }
 
 // Create ...
 func (h *EthereumResource) Create() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		resource := h.newModelFunc()
 
-		err := loadResourceFromBody(resource, req, h.jsonValidator)
-		if err != nil {
-			h.log.WithError(err).Panic("failed to load resource")
+		if err := loadResourceFromBody(resource, req, h.jsonValidator); err != nil {
+			return err
 		}
 
 		newUUID := uuid.NewUUID()
@@ -46,125 +50,162 @@ func (h *EthereumResource) Create() http.Handler {
 
 		jsonBytes, err := json.Marshal(resource)
 		if err != nil {
-			h.log.WithError(err).Panic("failed to marshal object as JSON")
+			return errInternal(err, "failed to marshal object as JSON")
 		}
 
-		elemData := ethereum.NewObjectCollectionElementFHIRJSONData(jsonBytes)
-		if err := h.adapter.Create(req.Context(), newUUID, elemData); err != nil {
-			h.log.WithError(err).Panic("failed to save object to smart contract")
+		txn, err := h.store.Create(req.Context(), newUUID, jsonBytes)
+		if err != nil {
+			return errStorage(err, "failed to save object")
+		}
+		h.notify(txn, subscriptions.ActionCreate, resource)
+		if responded, err := h.awaitTransaction(rw, req, txn); responded || err != nil {
+			return err
 		}
 
-		resourceCreated(h.renderer, rw, newUUID, meta.VersionID, now, resource)
+		resourceCreated(h.renderer, rw, req, newUUID, meta.VersionID, now, resource)
+		return nil
 	})
 }
 
 // Read ...
 func (h *EthereumResource) Read() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		resourceID, err := getResourceID(req)
 		if err != nil {
-			h.log.WithError(err).Error("invalid resource ID provided")
-			rw.WriteHeader(http.StatusBadRequest) // TODO: More verbose errors?
-			return
+			return err
 		}
-		resource := h.newModelFunc()
-		if err := h.adapter.ReadJSONResource(req.Context(), resourceID, resource); err != nil {
-			h.log.WithError(err).Panic("failed to read record")
+		resource, _, err := h.readResource(req.Context(), h.store, resourceID)
+		if err != nil {
+			return errStorage(err, "failed to read record")
 		}
 		// TODO: support deleted records, versioning
 		meta := resource.GetMeta()
-		resourceRead(h.renderer, rw, req, http.StatusOK, meta.VersionID, meta.LastUpdated, resource, true)
+		return resourceRead(h.renderer, rw, req, http.StatusOK, meta.VersionID, meta.LastUpdated, resource, true)
+	})
+}
+
+// Search ...
+func (h *EthereumResource) Search() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		query := req.URL.Query()
+		lastUpdated, err := getLastUpdatedSearches(query)
+		if err != nil {
+			return errBadRequest(err, "invalid search parameters provided")
+		}
+		page, err := getSearchPage(query)
+		if err != nil {
+			return err
+		}
+		ids, err := h.findResourceIDs(req.Context(), query)
+		if err != nil {
+			return err
+		}
+
+		results, total, more, err := h.readSearchPage(req.Context(), ids, lastUpdated, page)
+		if err != nil {
+			return err
+		}
+		h.renderer.JSON(rw, http.StatusOK, newSearchSetPage(req, results, total, more, page))
+		return nil
 	})
 }
 
 // Update ...
 func (h *EthereumResource) Update() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		resourceID, err := getResourceID(req)
 		if err != nil {
-			h.log.WithError(err).Error("invalid resource ID provided")
-			rw.WriteHeader(http.StatusBadRequest) // TODO: More verbose errors?
-			return
+			return err
 		}
 
-		oldResource := h.newModelFunc()
-		if err := h.adapter.ReadJSONResource(req.Context(), resourceID, oldResource); err != nil {
-			h.log.WithError(err).Panic("failed to read record")
-		}
-		oldMeta := oldResource.GetMeta()
-		oldTime, err := time.Parse(time.RFC3339, oldMeta.LastUpdated)
+		oldResource, oldObject, err := h.readResource(req.Context(), storage.Primary(h.store), resourceID)
 		if err != nil {
-			h.log.WithError(err).Panic("failed to parse last updated timestamp on original resource")
+			return errStorage(err, "failed to read record")
 		}
+		oldMeta := oldResource.GetMeta()
 
 		// optimistic locking
-		expected := req.Header.Get("If-Match")
-		if expected == "" {
-			rw.WriteHeader(http.StatusBadRequest)
-			return
-		}
-		if expected != generateETag(oldMeta.VersionID) {
-			rw.WriteHeader(http.StatusPreconditionFailed)
-			return
+		if err := checkIfMatch(req, oldMeta.VersionID, true); err != nil {
+			return err
 		}
 
 		newResource := h.newModelFunc()
 		if err := loadResourceFromBody(newResource, req, h.jsonValidator); err != nil {
-			h.log.WithError(err).Panic("failed to load resource")
+			return err
 		}
 
-		now := time.Now().UTC()
-		uCount, err := getUpdateCountFromVersionID(oldMeta.VersionID)
+		now, txn, err := h.storeNewVersion(req.Context(), oldObject, oldMeta, newResource)
 		if err != nil {
-			h.log.WithError(err).Panic("failed to get current update count")
+			return err
 		}
-		curBlockNumber, err := h.adapter.CurrentBlock(req.Context())
-		if err != nil {
-			h.log.WithError(err).Panic("failed to get current block number")
+		if responded, err := h.awaitTransaction(rw, req, txn); responded || err != nil {
+			return err
 		}
-		newVersionID := generateResourceVersionID(uCount+1, curBlockNumber)
 
-		newMeta := newResource.GetMeta()
-		if newMeta == nil {
-			newMeta = &models.Meta{}
-		}
-		newMeta.VersionID = newVersionID
-		newMeta.LastUpdated = now.Format(time.RFC3339)
-		newResource.SetMeta(newMeta)
-
-		jsonBytes, err := json.Marshal(newResource)
-		if err != nil {
-			h.log.WithError(err).Panic("failed to marshal object as JSON")
-		}
+		// TODO: support upsert
 
-		changeScore := uint8(0) // TODO
+		return resourceRead(h.renderer, rw, req, http.StatusOK, newResource.GetMeta().VersionID, now, newResource, false)
+	})
+}
 
-		elemData := ethereum.NewObjectCollectionElementFHIRJSONData(jsonBytes)
-		if err := h.adapter.Update(req.Context(), resourceID, oldTime, elemData, changeScore); err != nil {
-			h.log.WithError(err).Panic("failed to save object to smart contract")
-		}
+// storeNewVersion replaces the object holding the previous version of a resource
+func (h *EthereumResource) storeNewVersion(ctx context.Context, oldObject *storage.Object, oldMeta *models.Meta, newResource models.Resource) (time.Time, storage.Write, error) {
+	now := time.Now().UTC()
+	uCount, err := getUpdateCountFromVersionID(oldMeta.VersionID)
+	if err != nil {
+		return now, nil, errInternal(err, "failed to get current update count")
+	}
+	curVersion, err := h.store.CurrentVersion(ctx)
+	if err != nil {
+		return now, nil, errStorage(err, "failed to get current store version")
+	}
+	newVersionID := generateResourceVersionID(uCount+1, curVersion)
 
-		// TODO: support upsert
+	newMeta := newResource.GetMeta()
+	if newMeta == nil {
+		newMeta = &models.Meta{}
+	}
+	newMeta.VersionID = newVersionID
+	newMeta.LastUpdated = now.Format(time.RFC3339)
+	newResource.SetMeta(newMeta)
 
-		// TODO: Return 409 if contract failed due to timestamp change
+	jsonBytes, err := json.Marshal(newResource)
+	if err != nil {
+		return now, nil, errInternal(err, "failed to marshal object as JSON")
+	}
 
-		resourceRead(h.renderer, rw, req, http.StatusOK, newMeta.VersionID, now, newResource, false)
-	})
+	txn, err := h.store.Update(ctx, oldObject.ID, oldObject.UpdatedAt, jsonBytes)
+	if err != nil {
+		return now, nil, errStorage(err, "failed to save object")
+	}
+	h.notify(txn, subscriptions.ActionUpdate, newResource)
+	return now, txn, nil
 }
 
 // Delete ...
 func (h *EthereumResource) Delete() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		resourceID, err := getResourceID(req)
 		if err != nil {
-			h.log.WithError(err).Error("invalid resource ID provided")
-			rw.WriteHeader(http.StatusBadRequest) // TODO: More verbose errors?
-			return
+			return err
 		}
-		if err := h.adapter.Destroy(req.Context(), resourceID); err != nil {
-			h.log.WithError(err).Panic("failed to destroy object")
+		resource, _, err := h.readResource(req.Context(), storage.Primary(h.store), resourceID)
+		if err != nil {
+			return errStorage(err, "failed to read record")
+		}
+		if err := checkIfMatch(req, resource.GetMeta().VersionID, false); err != nil {
+			return err
+		}
+		txn, err := h.store.Destroy(req.Context(), resourceID)
+		if err != nil {
+			return errStorage(err, "failed to destroy object")
+		}
+		h.notify(txn, subscriptions.ActionDelete, resource)
+		if responded, err := h.awaitTransaction(rw, req, txn); responded || err != nil {
+			return err
 		}
 		rw.WriteHeader(http.StatusNoContent)
+		return nil
 	})
 }
 
@@ -178,6 +219,52 @@ func (h *EthereumResource) GetResourceConfig() *ResourceConfig {
 	return h.config
 }
 
+// resourceType returns the type of the resources served by the handlers
+func (h *EthereumResource) resourceType() string {
+	return h.newModelFunc().ResourceType()
+}
+
+// notify reports a change to the subscription engine once the write that makes it has been applied
+func (h *EthereumResource) notify(txn storage.Write, action subscriptions.Action, resource models.Resource) {
+	jsonBytes, err := json.Marshal(resource)
+	if err != nil {
+		h.log.WithError(err).Warn("failed to marshal resource for subscription notifications")
+		return
+	}
+	event := &subscriptions.Event{
+		Action:       action,
+		ResourceType: resource.ResourceType(),
+		ResourceID:   resource.GetID(),
+		Resource:     jsonBytes,
+		Tenant:       h.tenant,
+	}
+	storage.WhenApplied(txn, func() {
+		h.engine.Notify(event)
+	})
+}
+
+// readResource loads the current version of a resource from store, returning the errors of the store as they are
+// so that callers can tell missing and sealed objects apart from failures
+func (h *EthereumResource) readResource(ctx context.Context, store storage.Store, id uuid.UUID) (models.Resource, *storage.Object, error) {
+	object, err := store.Read(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	resource, err := h.unmarshalObject(object)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resource, object, nil
+}
+
+func (h *EthereumResource) unmarshalObject(object *storage.Object) (models.Resource, error) {
+	resource := h.newModelFunc()
+	if err := json.Unmarshal(object.Data, resource); err != nil {
+		return nil, errInternal(err, "failed to unmarshal stored object")
+	}
+	return resource, nil
+}
+
 func (h *EthereumResource) getJSONValidator() *models.JSONValidator {
 	return h.jsonValidator
 }
@@ -0,0 +1,541 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/utils"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+	"github.com/unrolled/render"
+)
+
+const (
+	// exportOperationDefinition is the canonical URL of the bulk data export operation
+	exportOperationDefinition = "http://hl7.org/fhir/uv/bulkdata/OperationDefinition/export"
+
+	// exportConcurrency is the number of export jobs of an organization that run at the same time
+	exportConcurrency = 2
+
+	// exportRetryAfter is the number of seconds after which clients are asked to poll a running job again
+	exportRetryAfter = "10"
+)
+
+// ExportStatus is the state of a bulk data export job
+type ExportStatus string
+
+// ExportStatus values
+const (
+	ExportQueued     ExportStatus = "queued"
+	ExportInProgress ExportStatus = "in-progress"
+	ExportCompleted  ExportStatus = "completed"
+	ExportFailed     ExportStatus = "failed"
+)
+
+// ExportJob is a bulk data export request, whose files are written in the background
+type ExportJob struct {
+	ID        string `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	// Request is the URL of the kick-off request
+	Request string
+	// Types is the comma separated list of exported resource types
+	Types           string
+	Since           *time.Time
+	Status          ExportStatus
+	Progress        string
+	TransactionTime *time.Time
+	CompletedAt     *time.Time
+	// Output is the JSON encoded list of the files written by the job
+	Output []byte
+	Error  string
+	// Owner is the client that requested the job, whose token is required to read it when authorization is enabled
+	Owner string
+	// Tenant is the organization the job was requested for, empty for the top level organization
+	Tenant string `gorm:"not null;default:''"`
+}
+
+// exportFile is a file written by an export job
+type exportFile struct {
+	Count int    `json:"count"`
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+}
+
+// exportManifestFile is a file listed in the response to a completed export job
+type exportManifestFile struct {
+	Count int    `json:"count"`
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+}
+
+// exportManifest is the response to a completed export job
+type exportManifest struct {
+	Error               []*exportManifestFile `json:"error"`
+	Output              []*exportManifestFile `json:"output"`
+	Request             string                `json:"request"`
+	RequiresAccessToken bool                  `json:"requiresAccessToken"`
+	TransactionTime     string                `json:"transactionTime"`
+}
+
+// exportableResource is a resource type whose resources can be written to an NDJSON file
+type exportableResource interface {
+	exportResources(ctx context.Context, since time.Time, w io.Writer) (int, error)
+}
+
+// BulkExport runs the bulk data export jobs of an organization
+type BulkExport struct {
+	db                  *database.DB
+	dir                 string
+	log                 *logging.Logger
+	registry            *Registry
+	renderer            *render.Render
+	requiresAccessToken bool
+	resume              sync.Once
+	running             map[string]context.CancelFunc
+	runMutex            sync.Mutex
+	slots               chan struct{}
+	tenant              string
+}
+
+// KickOff starts an export of the resources of a type, or of all exportable types when resourceType is empty
+func (h *BulkExport) KickOff(resourceType string) http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		if !preferAsync(req) {
+			return errBadRequest(nil, "the export operation requires the Prefer: respond-async header")
+		}
+		query := req.URL.Query()
+		switch format := query.Get("_outputFormat"); format {
+		case "", "application/fhir+ndjson", "application/ndjson", "ndjson":
+		default:
+			return errNotSupported(fmt.Sprintf("unsupported output format %q", format))
+		}
+
+		job := &ExportJob{
+			ID:      uuid.NewUUID().String(),
+			Request: getBaseURL(req) + req.URL.RequestURI(),
+			Status:  ExportQueued,
+			Tenant:  h.tenant,
+		}
+		if token := auth.FromContext(req.Context()); token != nil {
+			job.Owner = token.ClientID
+		}
+		if since := query.Get("_since"); since != "" {
+			ts, err := time.Parse(time.RFC3339, since)
+			if err != nil {
+				return errBadRequest(err, "invalid _since parameter")
+			}
+			job.Since = &ts
+		}
+		types, err := h.getExportTypes(resourceType, query.Get("_type"))
+		if err != nil {
+			return err
+		}
+		job.Types = strings.Join(types, ",")
+
+		if err := h.db.Create(job).Error; err != nil {
+			return errInternal(err, "failed to save export job")
+		}
+		h.start(job)
+
+		rw.Header().Set("Content-Location", fmt.Sprintf("%s/$export-status/%s", getFHIRBaseURL(req), job.ID))
+		h.renderer.JSON(rw, http.StatusAccepted, &models.OperationOutcome{
+			Issue: []*models.OperationOutcomeIssue{
+				{
+					Severity:    models.OperationOutcomeIssueSeverityInformation,
+					Code:        models.OperationOutcomeIssueCodeInformational,
+					Diagnostics: fmt.Sprintf("export %s has been queued", job.ID),
+				},
+			},
+		})
+		return nil
+	})
+}
+
+// Status reports the progress of an export job, and lists its files once it has completed
+func (h *BulkExport) Status() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		job, err := h.findJob(req, mux.Vars(req)["jobID"])
+		if err != nil {
+			return err
+		}
+
+		switch job.Status {
+		case ExportQueued, ExportInProgress:
+			progress := job.Progress
+			if progress == "" {
+				progress = string(job.Status)
+			}
+			rw.Header().Set("X-Progress", progress)
+			rw.Header().Set("Retry-After", exportRetryAfter)
+			rw.WriteHeader(http.StatusAccepted)
+			return nil
+		case ExportFailed:
+			return errInternal(nil, fmt.Sprintf("export failed: %s", job.Error))
+		}
+
+		files := []*exportFile{}
+		if err := json.Unmarshal(job.Output, &files); err != nil {
+			return errInternal(err, "failed to read export output")
+		}
+		manifest := &exportManifest{
+			Error:               []*exportManifestFile{},
+			Output:              []*exportManifestFile{},
+			Request:             job.Request,
+			RequiresAccessToken: h.requiresAccessToken,
+		}
+		if job.TransactionTime != nil {
+			manifest.TransactionTime = job.TransactionTime.UTC().Format(time.RFC3339)
+		}
+		for _, f := range files {
+			manifest.Output = append(manifest.Output, &exportManifestFile{
+				Count: f.Count,
+				Type:  f.Type,
+				URL:   fmt.Sprintf("%s/$export-file/%s/%s", getFHIRBaseURL(req), job.ID, f.Name),
+			})
+		}
+		h.renderer.JSON(rw, http.StatusOK, manifest)
+		return nil
+	})
+}
+
+// Download serves a file written by a completed export job
+func (h *BulkExport) Download() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		vars := mux.Vars(req)
+		job, err := h.findJob(req, vars["jobID"])
+		if err != nil {
+			return err
+		}
+		if job.Status != ExportCompleted {
+			return errNotFound(fmt.Sprintf("export %s has not completed", job.ID))
+		}
+		files := []*exportFile{}
+		if err := json.Unmarshal(job.Output, &files); err != nil {
+			return errInternal(err, "failed to read export output")
+		}
+		// only the files listed in the output are served, so the name cannot reach outside the job directory
+		for _, file := range files {
+			if file.Name != vars["file"] {
+				continue
+			}
+			f, err := os.Open(filepath.Join(h.jobDir(job.ID), file.Name))
+			if err != nil {
+				return errInternal(err, "failed to open export file")
+			}
+			defer f.Close()
+			rw.Header().Set("Content-Type", "application/fhir+ndjson")
+			http.ServeContent(rw, req, file.Name, job.UpdatedAt, f)
+			return nil
+		}
+		return errNotFound(fmt.Sprintf("export %s has no file %q", job.ID, vars["file"]))
+	})
+}
+
+// Delete cancels an export job, and removes the job and its files
+func (h *BulkExport) Delete() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		job, err := h.findJob(req, mux.Vars(req)["jobID"])
+		if err != nil {
+			return err
+		}
+		h.runMutex.Lock()
+		if cancel, ok := h.running[job.ID]; ok {
+			cancel()
+		}
+		h.runMutex.Unlock()
+		if err := h.db.Delete(job).Error; err != nil {
+			return errInternal(err, "failed to delete export job")
+		}
+		if err := os.RemoveAll(h.jobDir(job.ID)); err != nil {
+			return errInternal(err, "failed to remove export files")
+		}
+		rw.WriteHeader(http.StatusAccepted)
+		return nil
+	})
+}
+
+// getExportTypes returns the types requested by the _type parameter, restricted to the type of a type level export
+func (h *BulkExport) getExportTypes(resourceType string, typeParam string) ([]string, error) {
+	if typeParam == "" {
+		if resourceType != "" {
+			return []string{resourceType}, nil
+		}
+		return h.Types(), nil
+	}
+	exportable := h.exportableResources()
+
+	types := []string{}
+	for _, t := range strings.Split(typeParam, ",") {
+		t = strings.TrimSpace(t)
+		if exportable[t] == nil {
+			return nil, errNotSupported(fmt.Sprintf("resource type %q cannot be exported", t))
+		}
+		if resourceType != "" && t != resourceType {
+			return nil, errBadRequest(nil, fmt.Sprintf("resource type %q cannot be exported by the %s export operation", t, resourceType))
+		}
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// Types returns the names of the resource types that can be exported, in the order of the registry
+func (h *BulkExport) Types() []string {
+	types := []string{}
+	for _, i := range h.registry.Resources {
+		if _, ok := i.(exportableResource); ok {
+			types = append(types, utils.GetBaseTypeName(i))
+		}
+	}
+	return types
+}
+
+// exportableResources returns the handlers of the exportable resource types, by type name
+func (h *BulkExport) exportableResources() map[string]exportableResource {
+	exportable := map[string]exportableResource{}
+	for _, i := range h.registry.Resources {
+		if r, ok := i.(exportableResource); ok {
+			exportable[utils.GetBaseTypeName(i)] = r
+		}
+	}
+	return exportable
+}
+
+// findJob reads a job of the organization, which must have been requested by the client of the token of the request
+func (h *BulkExport) findJob(req *http.Request, id string) (*ExportJob, error) {
+	job := &ExportJob{}
+	query := h.db.Where("tenant = ?", h.tenant).Where("id = ?", id)
+	if token := auth.FromContext(req.Context()); token != nil {
+		query = query.Where("owner = ?", token.ClientID)
+	}
+	query = query.First(job)
+	if query.RecordNotFound() {
+		return nil, errNotFound(fmt.Sprintf("export %q not found", id))
+	} else if err := query.Error; err != nil {
+		return nil, errInternal(err, "failed to query database")
+	}
+	return job, nil
+}
+
+func (h *BulkExport) jobDir(id string) string {
+	return filepath.Join(h.dir, id)
+}
+
+// resumeJobs restarts the jobs that were interrupted by a restart of the server
+func (h *BulkExport) resumeJobs() {
+	jobs := []*ExportJob{}
+	err := h.db.Where("tenant = ?", h.tenant).
+		Where("status IN (?)", []ExportStatus{ExportQueued, ExportInProgress}).
+		Order("created_at").
+		Find(&jobs).Error
+	if err != nil {
+		h.log.WithError(err).Error("failed to read interrupted export jobs")
+		return
+	}
+	for _, job := range jobs {
+		h.log.WithField("job", job.ID).Info("resuming interrupted export job")
+		h.start(job)
+	}
+}
+
+// start runs a job in the background
+func (h *BulkExport) start(job *ExportJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.runMutex.Lock()
+	h.running[job.ID] = cancel
+	h.runMutex.Unlock()
+
+	go func() {
+		defer func() {
+			h.runMutex.Lock()
+			delete(h.running, job.ID)
+			h.runMutex.Unlock()
+			cancel()
+		}()
+		jLog := h.log.WithField("job", job.ID)
+		err := h.run(ctx, job)
+		if ctx.Err() != nil {
+			// the job was deleted, so no trace of it is kept
+			os.RemoveAll(h.jobDir(job.ID))
+			jLog.Info("export job cancelled")
+			return
+		}
+		if err != nil {
+			jLog.WithError(err).Error("export job failed")
+			h.update(job, map[string]interface{}{"status": ExportFailed, "error": err.Error()})
+			return
+		}
+		jLog.Info("export job completed")
+	}()
+}
+
+// run writes a file for each type of a job, waiting for a slot when too many jobs are running
+func (h *BulkExport) run(ctx context.Context, job *ExportJob) error {
+	select {
+	case h.slots <- struct{}{}:
+		defer func() { <-h.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// a resumed job starts again from scratch
+	dir := h.jobDir(job.ID)
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrap(err, "failed to clear export directory")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "failed to create export directory")
+	}
+	transactionTime := time.Now().UTC()
+	if err := h.update(job, map[string]interface{}{"status": ExportInProgress, "transaction_time": &transactionTime}); err != nil {
+		return err
+	}
+
+	var since time.Time
+	if job.Since != nil {
+		since = *job.Since
+	}
+	exportable := h.exportableResources()
+	types := strings.Split(job.Types, ",")
+	files := []*exportFile{}
+	for i, t := range types {
+		r := exportable[t]
+		if r == nil {
+			return errors.Errorf("resource type %q cannot be exported", t)
+		}
+		file := &exportFile{Name: t + ".ndjson", Type: t}
+		count, err := h.writeFile(ctx, r, since, filepath.Join(dir, file.Name))
+		if err != nil {
+			return errors.Wrapf(err, "failed to export %s resources", t)
+		}
+		if count > 0 {
+			file.Count = count
+			files = append(files, file)
+		}
+		progress := fmt.Sprintf("exported %d of %d resource types", i+1, len(types))
+		if err := h.update(job, map[string]interface{}{"progress": progress}); err != nil {
+			return err
+		}
+	}
+
+	output, err := json.Marshal(files)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal export output")
+	}
+	completedAt := time.Now().UTC()
+	return h.update(job, map[string]interface{}{"status": ExportCompleted, "output": output, "completed_at": &completedAt})
+}
+
+// writeFile exports the resources of a type to a file, which is removed when it would be empty
+func (h *BulkExport) writeFile(ctx context.Context, r exportableResource, since time.Time, path string) (int, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create export file")
+	}
+	count, err := r.exportResources(ctx, since, f)
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		err = errors.Wrap(closeErr, "failed to write export file")
+	}
+	if err == nil && count == 0 {
+		err = os.Remove(path)
+	}
+	return count, err
+}
+
+func (h *BulkExport) update(job *ExportJob, fields map[string]interface{}) error {
+	if err := h.db.Model(&ExportJob{}).Where("id = ?", job.ID).Updates(fields).Error; err != nil {
+		return errors.Wrap(err, "failed to update export job")
+	}
+	return nil
+}
+
+func (h *BulkExport) getJSONValidator() *models.JSONValidator {
+	return nil
+}
+
+func (h *BulkExport) getLogger() *logging.Logger {
+	return h.log
+}
+
+func (h *BulkExport) getRenderer() *render.Render {
+	return h.renderer
+}
+
+// newBulkExport creates the export jobs runner of a registry
+func newBulkExport(registry *Registry) *BulkExport {
+	registry.db.AutoMigrate(&ExportJob{})
+	return &BulkExport{
+		db:       registry.db,
+		dir:      registry.appConfig.ExportDir,
+		log:      registry.log,
+		registry: registry,
+		renderer: registry.renderer,
+		// requests for the files of a job are authorized like any other FHIR request
+		requiresAccessToken: registry.appConfig.Auth.Enabled(),
+		running:             map[string]context.CancelFunc{},
+		slots:               make(chan struct{}, exportConcurrency),
+		tenant:              registry.appConfig.Tenant,
+	}
+}
+
+// NewBulkExport returns the export jobs runner of a registry, resuming the jobs interrupted by a restart on first use
+func NewBulkExport(registry *Registry) *BulkExport {
+	h := registry.exports
+	h.resume.Do(h.resumeJobs)
+	return h
+}
+
+// exportResources writes the current version of the resources changed since a time to w, one per line
+// the IDs are listed first and every resource is read on its own, so that only one is held in memory at a time
+func (h *EthereumResource) exportResources(ctx context.Context, since time.Time, w io.Writer) (int, error) {
+	ids, err := h.store.List(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to list resources")
+	}
+
+	count := 0
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		object, err := h.store.Read(ctx, id)
+		switch errors.Cause(err) {
+		case storage.ErrObjectNotFound, storage.ErrForbidden:
+			// deleted since it was listed, or sealed for other organizations
+			continue
+		}
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to read resource %s", id)
+		}
+		if !since.IsZero() && object.UpdatedAt.Before(since) {
+			continue
+		}
+		resource, err := h.unmarshalObject(object)
+		if err != nil {
+			return count, errors.Wrapf(err, "failed to read resource %s", id)
+		}
+		line, err := json.Marshal(resource)
+		if err != nil {
+			return count, errors.Wrap(err, "failed to marshal resource")
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return count, errors.Wrap(err, "failed to write resource")
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,63 @@
+package resources
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/pborman/uuid"
+)
+
+// sealedStore lists objects, some of which are encrypted for other organizations
+type sealedStore struct {
+	storage.Store
+	objects map[string][]byte
+	sealed  map[string]bool
+}
+
+func (s *sealedStore) List(ctx context.Context) ([]uuid.UUID, error) {
+	ids := []uuid.UUID{}
+	for id := range s.objects {
+		ids = append(ids, uuid.Parse(id))
+	}
+	return sortUUIDs(ids), nil
+}
+
+func (s *sealedStore) Read(ctx context.Context, id uuid.UUID) (*storage.Object, error) {
+	if s.sealed[id.String()] {
+		return nil, storage.ErrForbidden
+	}
+	data, ok := s.objects[id.String()]
+	if !ok {
+		return nil, storage.ErrObjectNotFound
+	}
+	return &storage.Object{ID: id, Data: data, UpdatedAt: time.Now()}, nil
+}
+
+func TestExportSkipsSealedResources(t *testing.T) {
+	readable, sealed := uuid.NewRandom().String(), uuid.NewRandom().String()
+	store := &sealedStore{
+		objects: map[string][]byte{
+			readable: []byte(`{"resourceType":"Practitioner","id":"` + readable + `"}`),
+			sealed:   []byte(`{}`),
+		},
+		sealed: map[string]bool{sealed: true},
+	}
+	h := &EthereumResource{
+		store:        store,
+		newModelFunc: func() models.Resource { return &models.Practitioner{} },
+	}
+
+	buf := &bytes.Buffer{}
+	count, err := h.exportResources(context.Background(), time.Time{}, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || !strings.Contains(buf.String(), readable) {
+		t.Errorf("expected the readable resource only, got %d: %s", count, buf.String())
+	}
+}
@@ -0,0 +1,284 @@
+package resources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// resourceVersion is a single entry in the history of a resource
+type resourceVersion struct {
+	id           uuid.UUID
+	resourceType string
+	resource     models.Resource // nil when the version records a deletion
+	method       models.BundleRequestMethod
+	lastModified time.Time
+}
+
+func newResourceVersion(id uuid.UUID, resource models.Resource) (*resourceVersion, error) {
+	meta := resource.GetMeta()
+	if meta == nil {
+		return nil, errors.New("resource has no meta element")
+	}
+	count, err := getUpdateCountFromVersionID(meta.VersionID)
+	if err != nil {
+		return nil, err
+	}
+	ts, err := time.Parse(time.RFC3339, meta.LastUpdated)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse last updated timestamp")
+	}
+	method := models.BundleRequestMethodPUT
+	if count == 0 {
+		method = models.BundleRequestMethodPOST
+	}
+	return &resourceVersion{
+		id:           id,
+		resourceType: resource.ResourceType(),
+		resource:     resource,
+		method:       method,
+		lastModified: ts,
+	}, nil
+}
+
+// historyParams are the parameters accepted by the history interactions
+type historyParams struct {
+	since time.Time
+	count int
+}
+
+func getHistoryParams(query url.Values) (*historyParams, error) {
+	p := &historyParams{}
+	if since := query.Get("_since"); since != "" {
+		ts, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			return nil, errBadRequest(err, "invalid _since parameter")
+		}
+		p.since = ts
+	}
+	if count := query.Get("_count"); count != "" {
+		c, err := strconv.Atoi(count)
+		if err != nil || c < 0 {
+			return nil, errBadRequest(err, "invalid _count parameter")
+		}
+		p.count = c
+	}
+	return p, nil
+}
+
+// includes reports whether a version falls within the requested time range
+func (p *historyParams) includes(v *resourceVersion) bool {
+	return p.since.IsZero() || !v.lastModified.Before(p.since)
+}
+
+// full reports whether the requested number of versions has been collected
+func (p *historyParams) full(versions []*resourceVersion) bool {
+	return p.count > 0 && len(versions) >= p.count
+}
+
+// walkVersions visits every version of a resource, newest first, until fn returns false
+// the versions are read from the store at the versions of the store that record the changes of the resource
+func (h *EthereumResource) walkVersions(ctx context.Context, id uuid.UUID, fn func(*resourceVersion) bool) error {
+	changes, err := h.store.History(ctx, id)
+	if err != nil {
+		return errStorage(err, "failed to read history")
+	}
+	changes = readableChanges(changes)
+	if len(changes) == 0 {
+		return errNotFound("resource not found")
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		v, err := h.changeVersion(ctx, changes[i])
+		if err != nil {
+			return err
+		}
+		if !fn(v) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// readableChanges drops the changes that are followed by another change of the same object in the same version of
+// the store, e.g. in the same block, since a store can only be read as it was at the end of a version
+// changes must be ordered by version, and by order of execution within a version
+func readableChanges(changes []*storage.Change) []*storage.Change {
+	readable := []*storage.Change{}
+	for i, c := range changes {
+		superseded := false
+		for _, next := range changes[i+1:] {
+			if next.Version != c.Version {
+				break
+			}
+			if uuid.Equal(next.ID, c.ID) {
+				superseded = true
+				break
+			}
+		}
+		if !superseded {
+			readable = append(readable, c)
+		}
+	}
+	return readable
+}
+
+// changeVersion reads the version of a resource recorded by a change
+func (h *EthereumResource) changeVersion(ctx context.Context, c *storage.Change) (*resourceVersion, error) {
+	if c.Type == storage.ChangeDelete {
+		return &resourceVersion{
+			id:           c.ID,
+			resourceType: h.newModelFunc().ResourceType(),
+			method:       models.BundleRequestMethodDELETE,
+			lastModified: c.Time,
+		}, nil
+	}
+	resource, err := h.readResourceAt(ctx, c.ID, c.Version)
+	if err != nil {
+		return nil, errStorage(err, fmt.Sprintf("failed to read version %d of the store", c.Version))
+	}
+	v, err := newResourceVersion(c.ID, resource)
+	if err != nil {
+		return nil, errInternal(err, "failed to read version information")
+	}
+	return v, nil
+}
+
+// readResourceAt loads a resource as it was at a version of the store
+func (h *EthereumResource) readResourceAt(ctx context.Context, id uuid.UUID, version uint64) (models.Resource, error) {
+	object, err := h.store.ReadAt(ctx, id, version)
+	if err != nil {
+		return nil, err
+	}
+	return h.unmarshalObject(object)
+}
+
+// VersionRead ...
+func (h *EthereumResource) VersionRead() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		resourceID, err := getResourceID(req)
+		if err != nil {
+			return err
+		}
+		versionID := mux.Vars(req)["versionID"]
+		var found *resourceVersion
+		err = h.walkVersions(req.Context(), resourceID, func(v *resourceVersion) bool {
+			if v.resource != nil && v.resource.GetMeta().VersionID == versionID {
+				found = v
+				return false
+			}
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if found == nil {
+			return errNotFound(fmt.Sprintf("version %q not found", versionID))
+		}
+		return resourceRead(h.renderer, rw, req, http.StatusOK, versionID, found.lastModified, found.resource, true)
+	})
+}
+
+// InstanceHistory ...
+func (h *EthereumResource) InstanceHistory() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		resourceID, err := getResourceID(req)
+		if err != nil {
+			return err
+		}
+		params, err := getHistoryParams(req.URL.Query())
+		if err != nil {
+			return err
+		}
+		versions := []*resourceVersion{}
+		err = h.walkVersions(req.Context(), resourceID, func(v *resourceVersion) bool {
+			if !params.includes(v) {
+				return false
+			}
+			versions = append(versions, v)
+			return !params.full(versions)
+		})
+		if err != nil {
+			return err
+		}
+		h.renderer.JSON(rw, http.StatusOK, newHistoryBundle(req, versions))
+		return nil
+	})
+}
+
+// TypeHistory ...
+func (h *EthereumResource) TypeHistory() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		params, err := getHistoryParams(req.URL.Query())
+		if err != nil {
+			return err
+		}
+		changes, err := h.store.History(req.Context(), nil)
+		if err != nil {
+			return errStorage(err, "failed to read collection history")
+		}
+		changes = readableChanges(changes)
+		versions := []*resourceVersion{}
+		for i := len(changes) - 1; i >= 0 && !params.full(versions); i-- {
+			v, err := h.changeVersion(req.Context(), changes[i])
+			if err != nil {
+				return err
+			}
+			if !params.includes(v) {
+				break
+			}
+			versions = append(versions, v)
+		}
+		h.renderer.JSON(rw, http.StatusOK, newHistoryBundle(req, versions))
+		return nil
+	})
+}
+
+// newHistoryBundle wraps resource versions in a FHIR history Bundle
+func newHistoryBundle(req *http.Request, versions []*resourceVersion) *models.Bundle {
+	baseURL := getBaseURL(req)
+	bundle := &models.Bundle{
+		Type:  models.BundleTypeHistory,
+		Total: uint64(len(versions)),
+		Link: []*models.BundleLink{
+			{Relation: "self", URL: baseURL + req.URL.RequestURI()},
+		},
+		Entry: []*models.BundleEntry{},
+	}
+	for _, v := range versions {
+		path := fmt.Sprintf("%s/%s", v.resourceType, v.id.String())
+		entry := &models.BundleEntry{
+			FullURL: fmt.Sprintf("%s%s/%s", baseURL, getBasePath(req), path),
+			Request: &models.BundleRequest{Method: v.method, URL: path},
+			Response: &models.BundleResponse{
+				LastModified: v.lastModified.UTC().Format(time.RFC3339),
+			},
+		}
+		switch v.method {
+		case models.BundleRequestMethodPOST:
+			entry.Request.URL = v.resourceType
+			entry.Response.Status = "201 Created"
+		case models.BundleRequestMethodPUT:
+			entry.Response.Status = "200 OK"
+		case models.BundleRequestMethodDELETE:
+			entry.Response.Status = "204 No Content"
+		}
+		if v.resource != nil {
+			var resource models.ResourceList = v.resource
+			versionID := v.resource.GetMeta().VersionID
+			entry.Resource = &resource
+			entry.Response.Etag = generateETag(versionID)
+			entry.Response.Location = fmt.Sprintf("%s/_history/%s", path, versionID)
+		}
+		bundle.Entry = append(bundle.Entry, entry)
+	}
+	return bundle
+}
@@ -0,0 +1,523 @@
+package resources
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/utils"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/pkg/errors"
+)
+
+// importLogInterval is the number of created resources between progress log messages
+const importLogInterval = 1000
+
+// maxImportLineSize is the size of the longest line of an NDJSON file that can be imported
+const maxImportLineSize = 16 * 1024 * 1024
+
+// importStatusCreated and importStatusPending are the statuses of the records of the progress file
+const (
+	importStatusCreated = "created"
+	importStatusPending = "pending"
+)
+
+// importEntry is a resource read from a line of an NDJSON file or an entry of a Bundle
+type importEntry struct {
+	// aliases are the references by which other resources of the imported files refer to the resource
+	aliases []string
+	err     error
+	failed  bool
+	// key identifies the resource across runs of the import, see importKey
+	key          string
+	pending      bool
+	references   []string
+	resource     json.RawMessage
+	resourceType string
+	source       string
+}
+
+// importRecord is a line of the progress file, written when a resource has been created, or when its transaction has
+// been submitted but was still pending when the create handler responded
+type importRecord struct {
+	Aliases     []string `json:"aliases,omitempty"`
+	Key         string   `json:"key"`
+	Reference   string   `json:"reference,omitempty"`
+	Source      string   `json:"source"`
+	Status      string   `json:"status"`
+	Transaction string   `json:"transaction,omitempty"`
+}
+
+// importFailure is a line of the error report
+type importFailure struct {
+	Outcome *models.OperationOutcome `json:"outcome"`
+	Source  string                   `json:"source"`
+}
+
+// ImportSummary counts the outcomes of the resources of an import
+type ImportSummary struct {
+	Created int
+	Failed  int
+	// Pending resources have a transaction that had not been mined when the create handler responded
+	// they are not submitted again by later runs of the import
+	Pending int
+	// Skipped resources were created, or are pending, from a previous run of the import
+	Skipped int
+}
+
+// Importer creates the resources of NDJSON and Bundle files with the handlers of a registry
+// resources are created in waves, so that the references between the resources of the files can be rewritten to the
+// IDs assigned to them, and every created resource is recorded so that an interrupted import can be resumed
+type Importer struct {
+	concurrency int
+	creators    map[string]http.Handler
+	db          *database.DB
+	done        map[string]bool
+	errors      io.Writer
+	log         logging.FieldLogger
+	mutex       sync.Mutex
+	progress    io.Writer
+	resolved    map[string]string
+	summary     ImportSummary
+	validators  map[string]*models.JSONValidator
+	writeErr    error
+}
+
+// Run imports the resources of files
+// a file holding a single Bundle is imported as the resources of its entries, other files are read as NDJSON
+func (im *Importer) Run(ctx context.Context, paths ...string) (*ImportSummary, error) {
+	entries := []*importEntry{}
+	for _, path := range paths {
+		fileEntries, err := readImportFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, fileEntries...)
+	}
+
+	pending := map[string]*importEntry{}
+	queue := []*importEntry{}
+	for _, e := range entries {
+		if im.done[e.key] {
+			im.summary.Skipped++
+			continue
+		}
+		if err := im.validate(e); err != nil {
+			im.fail(e, err)
+			continue
+		}
+		queue = append(queue, e)
+		for _, alias := range e.aliases {
+			pending[alias] = e
+		}
+	}
+
+	for len(queue) > 0 && im.writeErr == nil {
+		wave := []*importEntry{}
+		waiting := []*importEntry{}
+		for _, e := range queue {
+			if ready, err := im.ready(e, pending); err != nil {
+				im.fail(e, err)
+			} else if ready {
+				wave = append(wave, e)
+			} else {
+				waiting = append(waiting, e)
+			}
+		}
+		if len(wave) == 0 {
+			for _, e := range waiting {
+				im.fail(e, errBadRequest(nil, "resource references resources of the imported files in a cycle"))
+			}
+			break
+		}
+		im.createAll(ctx, wave)
+		if err := ctx.Err(); err != nil {
+			return &im.summary, err
+		}
+		queue = waiting
+	}
+	if im.writeErr != nil {
+		return &im.summary, im.writeErr
+	}
+	return &im.summary, nil
+}
+
+// validate checks that an entry can be created
+func (im *Importer) validate(e *importEntry) error {
+	if e.err != nil {
+		return e.err
+	}
+	if _, ok := im.creators[e.resourceType]; !ok {
+		return errNotSupported(fmt.Sprintf("resource type %q cannot be imported", e.resourceType))
+	}
+	if validator := im.validators[e.resourceType]; validator != nil {
+		valid, vErrs, err := validator.Validate(e.resource)
+		if err != nil {
+			return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "resource is not valid JSON")
+		}
+		if !valid {
+			return newValidationError(vErrs)
+		}
+	}
+	return nil
+}
+
+// ready reports whether every resource of the imported files that an entry references has been created
+// an error is returned when one of them could not be created
+func (im *Importer) ready(e *importEntry, pending map[string]*importEntry) (bool, error) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	for _, ref := range e.references {
+		if _, ok := im.resolved[ref]; ok {
+			continue
+		}
+		dependency, ok := pending[ref]
+		if !ok || dependency == e {
+			continue
+		}
+		if dependency.failed {
+			return false, errBadRequest(nil, fmt.Sprintf("referenced resource %s could not be imported", ref))
+		}
+		if dependency.pending {
+			return false, errBadRequest(nil, fmt.Sprintf("referenced resource %s has a pending transaction", ref))
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// createAll creates the entries of a wave with concurrent requests
+// when ctx is done, the entries that have not been sent are left to a later run, while those being created are completed
+func (im *Importer) createAll(ctx context.Context, wave []*importEntry) {
+	work := make(chan *importEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < im.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				im.create(e)
+			}
+		}()
+	}
+	for _, e := range wave {
+		select {
+		case work <- e:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// create sends an entry to the create handler of its resource type
+// the request is not cancelled with the import, as its transaction may already have been sent
+func (im *Importer) create(e *importEntry) {
+	im.mutex.Lock()
+	body, err := rewriteReferences(e.resource, im.resolved)
+	im.mutex.Unlock()
+	if err != nil {
+		im.fail(e, errBadRequest(err, "unable to resolve references"))
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/%s", defaultBasePath, e.resourceType), bytes.NewReader(body))
+	if err != nil {
+		im.fail(e, errInternal(err, "failed to create request"))
+		return
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	rec := newBufferedResponseWriter()
+	im.creators[e.resourceType].ServeHTTP(rec, req)
+	switch rec.status {
+	case http.StatusCreated:
+		created := struct {
+			ID string `json:"id"`
+		}{}
+		if err := json.Unmarshal(rec.body.Bytes(), &created); err != nil || created.ID == "" {
+			im.fail(e, errInternal(err, "created resource has no id"))
+			return
+		}
+		im.record(e, fmt.Sprintf("%s/%s", e.resourceType, created.ID), "")
+	case http.StatusAccepted:
+		// the transaction has been submitted, so importing the resource again may create a duplicate
+		txnHash := path.Base(rec.Header().Get("Content-Location"))
+		reference, err := im.pendingReference(txnHash)
+		if err != nil {
+			im.log.WithError(err).WithField("source", e.source).Warn("unable to find the resource of a pending transaction")
+		}
+		im.record(e, reference, txnHash)
+	default:
+		im.fail(e, responseError(rec))
+	}
+}
+
+// pendingReference returns the reference of the resource created by a pending transaction
+func (im *Importer) pendingReference(txnHash string) (string, error) {
+	if im.db == nil {
+		return "", errors.New("no database to look up transactions")
+	}
+	txn := &ethereum.TransactionRecord{}
+	if err := im.db.Where(&ethereum.TransactionRecord{Hash: txnHash}).First(txn).Error; err != nil {
+		return "", errors.Wrapf(err, "failed to query transaction %s", txnHash)
+	}
+	return fmt.Sprintf("%s/%s", txn.ResourceType, txn.ResourceID), nil
+}
+
+// record adds a created resource to the progress file, or a pending one when txnHash is set
+// the aliases of a pending resource are resolved to its reference, which is empty when it could not be found
+func (im *Importer) record(e *importEntry, reference string, txnHash string) {
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	status := importStatusCreated
+	if txnHash != "" {
+		status = importStatusPending
+		e.pending = true
+		im.summary.Pending++
+		im.log.WithField("source", e.source).WithField("transaction", txnHash).Warn("transaction of resource is still pending")
+	} else {
+		im.summary.Created++
+		if im.summary.Created%importLogInterval == 0 {
+			im.log.Infof("created %d resources", im.summary.Created)
+		}
+	}
+	if reference != "" {
+		for _, alias := range e.aliases {
+			im.resolved[alias] = reference
+		}
+	}
+	im.done[e.key] = true
+	rec := &importRecord{Aliases: e.aliases, Key: e.key, Reference: reference, Source: e.source, Status: status, Transaction: txnHash}
+	if err := json.NewEncoder(im.progress).Encode(rec); err != nil && im.writeErr == nil {
+		im.writeErr = errors.Wrap(err, "failed to write progress")
+	}
+}
+
+// fail adds an entry that could not be imported to the error report
+func (im *Importer) fail(e *importEntry, err error) {
+	opErr, ok := asOperationError(err)
+	if !ok {
+		opErr = errInternal(err, "an unexpected error occurred")
+	}
+	im.mutex.Lock()
+	defer im.mutex.Unlock()
+	e.failed = true
+	im.summary.Failed++
+	im.log.WithError(opErr).WithField("source", e.source).Warn("failed to import resource")
+	if err := json.NewEncoder(im.errors).Encode(&importFailure{Outcome: opErr.OperationOutcome(), Source: e.source}); err != nil && im.writeErr == nil {
+		im.writeErr = errors.Wrap(err, "failed to write error report")
+	}
+}
+
+// NewImporter creates an importer that sends resources to the handlers of a registry
+// the records of previous runs are read from previous, and new records are appended to progress
+func NewImporter(registry *Registry, concurrency int, previous io.Reader, progress io.Writer, errs io.Writer) (*Importer, error) {
+	im := &Importer{
+		concurrency: concurrency,
+		creators:    map[string]http.Handler{},
+		db:          registry.db,
+		done:        map[string]bool{},
+		errors:      errs,
+		log:         registry.log.WithField("component", "importer"),
+		progress:    progress,
+		resolved:    map[string]string{},
+		validators:  map[string]*models.JSONValidator{},
+	}
+	if im.concurrency <= 0 {
+		im.concurrency = 1
+	}
+	for _, i := range registry.Resources {
+		resourceType := utils.GetBaseTypeName(i)
+		if c, ok := i.(CreateableResource); ok {
+			im.creators[resourceType] = c.Create()
+		}
+		if rh, ok := i.(resourceHandler); ok {
+			im.validators[resourceType] = rh.getJSONValidator()
+		}
+	}
+
+	if previous != nil {
+		reader := bufio.NewReader(previous)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				rec := &importRecord{}
+				if err := json.Unmarshal(line, rec); err != nil {
+					return nil, errors.Wrap(err, "failed to parse progress file")
+				}
+				im.done[rec.Key] = true
+				if rec.Reference != "" {
+					for _, alias := range rec.Aliases {
+						im.resolved[alias] = rec.Reference
+					}
+				}
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to read progress file")
+			}
+		}
+	}
+	return im, nil
+}
+
+// readImportFile reads the resources of an NDJSON file, or of the entries of a Bundle when the file holds a single Bundle
+// NDJSON files are read a line at a time, so that only the resources and not the whole file are held in memory
+func readImportFile(filePath string) ([]*importEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open import file")
+	}
+	defer file.Close()
+	if entries, ok := readImportBundle(filePath, file); ok {
+		return entries, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, errors.Wrap(err, "failed to read import file")
+	}
+
+	entries := []*importEntry{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+	for i := 1; scanner.Scan(); i++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) > 0 {
+			// the scanner reuses its buffer for the next line
+			resource := append(json.RawMessage(nil), line...)
+			entries = append(entries, newImportEntry(fmt.Sprintf("%s:%d", filePath, i), "", resource))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read import file")
+	}
+	return entries, nil
+}
+
+// readImportBundle reads the entries of a file holding a single Bundle
+// ok is false when the file holds anything else, in which case it is read as NDJSON
+func readImportBundle(filePath string, r io.Reader) ([]*importEntry, bool) {
+	bundle := struct {
+		ResourceType string `json:"resourceType"`
+		Entry        []struct {
+			FullURL  string          `json:"fullUrl"`
+			Resource json.RawMessage `json:"resource"`
+		} `json:"entry"`
+	}{}
+	// only the first value is decoded, so that the lines of an NDJSON file are not read ahead
+	decoder := json.NewDecoder(r)
+	if decoder.Decode(&bundle) != nil || bundle.ResourceType != "Bundle" {
+		return nil, false
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, false
+	}
+	entries := []*importEntry{}
+	for i, e := range bundle.Entry {
+		entries = append(entries, newImportEntry(fmt.Sprintf("%s#Bundle.entry[%d]", filePath, i), e.FullURL, e.Resource))
+	}
+	return entries, true
+}
+
+// importKey identifies a resource across runs of an import by its type, its id in the imported file and a hash of its
+// content, so that a resource is skipped when it was imported before, even if the lines of the file have been moved
+func importKey(resourceType string, id string, resource json.RawMessage) string {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, resource); err != nil {
+		compact.Reset()
+		compact.Write(resource)
+	}
+	hash := sha256.Sum256(compact.Bytes())
+	return fmt.Sprintf("%s/%s#%s", resourceType, id, hex.EncodeToString(hash[:]))
+}
+
+// newImportEntry parses a resource of an import file, keeping the error to report it when the resource is invalid
+func newImportEntry(source string, fullURL string, resource json.RawMessage) *importEntry {
+	e := &importEntry{resource: resource, source: source}
+	if fullURL != "" {
+		e.aliases = append(e.aliases, fullURL)
+	}
+	var header struct {
+		ResourceType string `json:"resourceType"`
+		ID           string `json:"id"`
+	}
+	if len(resource) == 0 {
+		e.err = errBadRequest(nil, "entry has no resource")
+		return e
+	}
+	if err := json.Unmarshal(resource, &header); err != nil {
+		e.err = NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "unable to parse resource")
+		return e
+	}
+	e.resourceType = header.ResourceType
+	e.key = importKey(header.ResourceType, header.ID, resource)
+	if header.ID != "" {
+		e.aliases = append(e.aliases, fmt.Sprintf("%s/%s", header.ResourceType, header.ID))
+	}
+	var v interface{}
+	json.Unmarshal(resource, &v)
+	walkReferences(v, func(ref string) string {
+		e.references = append(e.references, ref)
+		return ref
+	})
+	return e
+}
+
+// walkReferences replaces the reference of every Reference in a decoded JSON document with the result of fn
+func walkReferences(v interface{}, fn func(string) string) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, c := range t {
+			if s, ok := c.(string); ok && k == "reference" {
+				t[k] = fn(s)
+			} else {
+				t[k] = walkReferences(c, fn)
+			}
+		}
+	case []interface{}:
+		for i, c := range t {
+			t[i] = walkReferences(c, fn)
+		}
+	}
+	return v
+}
+
+// rewriteReferences replaces references to imported resources with references to the resources created for them
+func rewriteReferences(doc json.RawMessage, resolved map[string]string) (json.RawMessage, error) {
+	var v interface{}
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, err
+	}
+	v = walkReferences(v, func(ref string) string {
+		if r, ok := resolved[ref]; ok {
+			return r
+		}
+		return ref
+	})
+	return json.Marshal(v)
+}
+
+// responseError recovers the error reported by a handler that did not create a resource
+func responseError(rec *bufferedResponseWriter) error {
+	outcome := &models.OperationOutcome{}
+	if json.Unmarshal(rec.body.Bytes(), outcome) == nil && len(outcome.Issue) > 0 {
+		return &OperationError{Status: rec.status, Issues: outcome.Issue}
+	}
+	return NewOperationError(rec.status, models.OperationOutcomeIssueCodeProcessing, nil, http.StatusText(rec.status))
+}
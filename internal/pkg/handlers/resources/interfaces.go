@@ -28,6 +28,16 @@ type VersionReadableResource interface {
 	VersionRead() http.Handler
 }
 
+// InstanceHistoryReadableResource ...
+type InstanceHistoryReadableResource interface {
+	InstanceHistory() http.Handler
+}
+
+// TypeHistoryReadableResource ...
+type TypeHistoryReadableResource interface {
+	TypeHistory() http.Handler
+}
+
 // UpdateableResource ...
 type UpdateableResource interface {
 	Update() http.Handler
@@ -1,7 +1,6 @@
 package resources
 
 import (
-	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
 	"github.com/pkg/errors"
 )
@@ -28,30 +27,23 @@ func NewLocation(registry *Registry) (*Location, error) {
 		{Name: "type", Type: models.SearchParameterTypeToken},
 	}
 
-	collContract := registry.appConfig.ObjectCollectionContracts["Location"]
-	if collContract == nil {
-		return nil, errors.New("no collection contract found")
-	}
-	newAdapter, err := ethereum.NewAdapter(
-		registry.connection,
-		registry.transactOpts,
-		registry.appConfig.OrganizationContract,
-		collContract,
-		registry.txnsChan,
-		registry.log,
-	)
+	collContract, store, err := registry.newStore("Location")
 	if err != nil {
-		return nil, errors.New("failed to create ethereum adapter")
+		return nil, err
 	}
+	newConfig.linkObjectIndexes(collContract.Indexes)
 
 	return &Location{
 		EthereumResource{
-			adapter:       newAdapter,
 			config:        newConfig,
+			engine:        registry.engine,
 			jsonValidator: validator,
 			log:           registry.log,
 			newModelFunc:  func() models.Resource { return &models.Location{} },
 			renderer:      registry.renderer,
+			store:         store,
+			tenant:        registry.appConfig.Tenant,
+			txnWait:       registry.appConfig.TransactionWait,
 		},
 	}, nil
 }
@@ -0,0 +1,405 @@
+package resources
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/pkg/errors"
+)
+
+const (
+	jsonPatchMediaType = "application/json-patch+json"
+	fhirJSONMediaType  = "application/fhir+json"
+)
+
+// Patch ...
+func (h *EthereumResource) Patch() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		resourceID, err := getResourceID(req)
+		if err != nil {
+			return err
+		}
+
+		oldResource, oldObject, err := h.readResource(req.Context(), storage.Primary(h.store), resourceID)
+		if err != nil {
+			return errStorage(err, "failed to read record")
+		}
+		oldMeta := oldResource.GetMeta()
+
+		// optimistic locking
+		if err := checkIfMatch(req, oldMeta.VersionID, true); err != nil {
+			return err
+		}
+
+		patch, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return errBadRequest(err, "unable to read request body")
+		}
+		oldBytes, err := json.Marshal(oldResource)
+		if err != nil {
+			return errInternal(err, "failed to marshal object as JSON")
+		}
+		newBytes, err := applyPatch(req.Header.Get("Content-Type"), oldBytes, patch, h.newModelFunc())
+		if err != nil {
+			return err
+		}
+
+		newResource := h.newModelFunc()
+		if err := loadResourceFromBytes(newResource, newBytes, h.jsonValidator); err != nil {
+			return err
+		}
+		if newResource.GetID() != oldResource.GetID() {
+			return errBadRequest(nil, "the id of a resource cannot be patched")
+		}
+
+		now, txn, err := h.storeNewVersion(req.Context(), oldObject, oldMeta, newResource)
+		if err != nil {
+			return err
+		}
+		if responded, err := h.awaitTransaction(rw, req, txn); responded || err != nil {
+			return err
+		}
+
+		return resourceRead(h.renderer, rw, req, http.StatusOK, newResource.GetMeta().VersionID, now, newResource, false)
+	})
+}
+
+func errUnprocessablePatch(cause error, diagnostics string) *OperationError {
+	return NewOperationError(http.StatusUnprocessableEntity, models.OperationOutcomeIssueCodeProcessing, cause, diagnostics)
+}
+
+// applyPatch applies a JSON Patch document or a FHIRPath Patch Parameters resource to a JSON document
+func applyPatch(contentType string, doc, patch []byte, model models.Resource) ([]byte, error) {
+	mediaType := jsonPatchMediaType
+	if contentType != "" {
+		mt, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, errBadRequest(err, "invalid Content-Type header")
+		}
+		mediaType = mt
+	}
+	switch {
+	case mediaType == jsonPatchMediaType, mediaType == "application/json" && bytes.HasPrefix(bytes.TrimSpace(patch), []byte("[")):
+		return applyJSONPatch(doc, patch)
+	case mediaType == fhirJSONMediaType, mediaType == "application/json":
+		return applyFHIRPathPatch(doc, patch, model)
+	}
+	return nil, NewOperationError(http.StatusUnsupportedMediaType, models.OperationOutcomeIssueCodeNotSupported, nil, fmt.Sprintf("unsupported patch format %q", mediaType))
+}
+
+// applyJSONPatch applies an RFC 6902 JSON Patch document
+func applyJSONPatch(doc, patch []byte) ([]byte, error) {
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return nil, NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "unable to parse JSON Patch document")
+	}
+	newDoc, err := p.Apply(doc)
+	if err != nil {
+		return nil, errUnprocessablePatch(err, "unable to apply JSON Patch document")
+	}
+	return newDoc, nil
+}
+
+// jsonPatchOperation is a single RFC 6902 operation
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// fhirPathPatchOperation is a single operation of a FHIRPath Patch
+// see https://www.hl7.org/fhir/fhirpatch.html
+type fhirPathPatchOperation struct {
+	Type        string
+	Path        string
+	Name        string
+	Value       interface{}
+	Index       *int
+	Source      *int
+	Destination *int
+}
+
+// applyFHIRPathPatch applies a FHIRPath Patch, expressed as a Parameters resource
+// only simple paths made of element names and indexes (e.g. "Practitioner.name[0].given") are supported
+func applyFHIRPathPatch(doc, patch []byte, model models.Resource) ([]byte, error) {
+	ops, err := parseFHIRPathPatch(patch)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range ops {
+		var current map[string]interface{}
+		if err := json.Unmarshal(doc, &current); err != nil {
+			return nil, errInternal(err, "failed to unmarshal JSON document")
+		}
+		jsonOp, err := op.toJSONPatch(current, model)
+		if err != nil {
+			return nil, errors.Wrapf(err, "operation %d", i)
+		}
+		if jsonOp == nil {
+			continue
+		}
+		jsonOpBytes, err := json.Marshal([]*jsonPatchOperation{jsonOp})
+		if err != nil {
+			return nil, errInternal(err, "failed to marshal JSON Patch operation")
+		}
+		if doc, err = applyJSONPatch(doc, jsonOpBytes); err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func parseFHIRPathPatch(patch []byte) ([]*fhirPathPatchOperation, error) {
+	var params struct {
+		ResourceType string `json:"resourceType"`
+		Parameter    []struct {
+			Name string                   `json:"name"`
+			Part []map[string]interface{} `json:"part"`
+		} `json:"parameter"`
+	}
+	if err := json.Unmarshal(patch, &params); err != nil {
+		return nil, NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "unable to parse FHIRPath Patch Parameters resource")
+	}
+	if params.ResourceType != "Parameters" {
+		return nil, errBadRequest(nil, "a FHIRPath Patch must be a Parameters resource")
+	}
+	ops := []*fhirPathPatchOperation{}
+	for _, p := range params.Parameter {
+		if p.Name != "operation" {
+			return nil, errBadRequest(nil, fmt.Sprintf("unexpected parameter %q", p.Name))
+		}
+		op := &fhirPathPatchOperation{}
+		for _, part := range p.Part {
+			name, _ := part["name"].(string)
+			value, err := getParameterPartValue(part)
+			if err != nil {
+				return nil, errors.Wrapf(err, "part %q", name)
+			}
+			switch name {
+			case "type":
+				op.Type, _ = value.(string)
+			case "path":
+				op.Path, _ = value.(string)
+			case "name":
+				op.Name, _ = value.(string)
+			case "value":
+				op.Value = value
+			case "index":
+				op.Index = toIntPointer(value)
+			case "source":
+				op.Source = toIntPointer(value)
+			case "destination":
+				op.Destination = toIntPointer(value)
+			default:
+				return nil, errBadRequest(nil, fmt.Sprintf("unexpected operation part %q", name))
+			}
+		}
+		if op.Type == "" || op.Path == "" {
+			return nil, errBadRequest(nil, "every operation requires a type and a path")
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+// getParameterPartValue returns the value[x] (or resource) of a Parameters part
+func getParameterPartValue(part map[string]interface{}) (interface{}, error) {
+	if _, ok := part["part"]; ok {
+		return nil, errNotSupported("values built from nested parts are not supported")
+	}
+	for k, v := range part {
+		if strings.HasPrefix(k, "value") || k == "resource" {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+func toIntPointer(value interface{}) *int {
+	if f, ok := value.(float64); ok {
+		i := int(f)
+		return &i
+	}
+	return nil
+}
+
+var fhirPathSegmentRegexp = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)(?:\[(\d+)\])?$`)
+
+// resolveFHIRPath finds the element selected by a simple FHIRPath expression and returns its JSON pointer
+// if the final element does not exist, the pointer it would have is returned with found set to false
+func resolveFHIRPath(doc map[string]interface{}, path string) (pointer string, value interface{}, found bool, err error) {
+	segments := strings.Split(path, ".")
+	if segments[0] != doc["resourceType"] {
+		return "", nil, false, errNotSupported(fmt.Sprintf("path %q must start with the resource type", path))
+	}
+	var cur interface{} = doc
+	for i, seg := range segments[1:] {
+		m := fhirPathSegmentRegexp.FindStringSubmatch(seg)
+		if m == nil {
+			return "", nil, false, errNotSupported(fmt.Sprintf("unsupported FHIRPath expression %q", path))
+		}
+		// step into single-item lists without an explicit index
+		if arr, ok := cur.([]interface{}); ok {
+			if len(arr) != 1 {
+				return "", nil, false, errUnprocessablePatch(nil, fmt.Sprintf("path %q matches multiple elements", path))
+			}
+			pointer += "/0"
+			cur = arr[0]
+		}
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return "", nil, false, nil
+		}
+		pointer += "/" + escapeJSONPointer(m[1])
+		next, ok := obj[m[1]]
+		if !ok {
+			if i == len(segments)-2 && m[2] == "" {
+				return pointer, nil, false, nil
+			}
+			return "", nil, false, nil
+		}
+		cur = next
+		if m[2] != "" {
+			idx, _ := strconv.Atoi(m[2])
+			arr, ok := cur.([]interface{})
+			if !ok || idx >= len(arr) {
+				return "", nil, false, nil
+			}
+			pointer += "/" + m[2]
+			cur = arr[idx]
+		}
+	}
+	return pointer, cur, true, nil
+}
+
+func escapeJSONPointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+// isRepeatingElement reports whether the element at a JSON pointer is a list in the resource model
+func isRepeatingElement(model interface{}, pointer string) bool {
+	t := reflect.TypeOf(model)
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		if _, err := strconv.Atoi(token); err == nil {
+			continue
+		}
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		var field *reflect.StructField
+		for j := 0; j < t.NumField(); j++ {
+			f := t.Field(j)
+			if strings.Split(f.Tag.Get("json"), ",")[0] == token {
+				field = &f
+				break
+			}
+		}
+		if field == nil {
+			return false
+		}
+		if i == len(tokens)-1 {
+			return field.Type.Kind() == reflect.Slice
+		}
+		t = field.Type
+	}
+	return false
+}
+
+// toJSONPatch converts the operation to the equivalent JSON Patch operation against the current document
+// a nil operation is returned when there is nothing to change
+func (op *fhirPathPatchOperation) toJSONPatch(doc map[string]interface{}, model models.Resource) (*jsonPatchOperation, error) {
+	switch op.Type {
+	case "add":
+		if op.Name == "" || op.Value == nil {
+			return nil, errBadRequest(nil, "add operations require a name and a value")
+		}
+		if _, _, found, err := resolveFHIRPath(doc, op.Path); err != nil {
+			return nil, err
+		} else if !found {
+			return nil, errUnprocessablePatch(nil, fmt.Sprintf("path %q not found", op.Path))
+		}
+		ptr, existing, found, err := resolveFHIRPath(doc, op.Path+"."+op.Name)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			if _, ok := existing.([]interface{}); !ok {
+				return nil, errUnprocessablePatch(nil, fmt.Sprintf("element %q already has a value", op.Name))
+			}
+			return &jsonPatchOperation{Op: "add", Path: ptr + "/-", Value: op.Value}, nil
+		}
+		if isRepeatingElement(model, ptr) {
+			return &jsonPatchOperation{Op: "add", Path: ptr, Value: []interface{}{op.Value}}, nil
+		}
+		return &jsonPatchOperation{Op: "add", Path: ptr, Value: op.Value}, nil
+
+	case "insert":
+		if op.Index == nil || op.Value == nil {
+			return nil, errBadRequest(nil, "insert operations require an index and a value")
+		}
+		ptr, existing, found, err := resolveFHIRPath(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := existing.([]interface{})
+		if !found || !ok || *op.Index < 0 || *op.Index > len(arr) {
+			return nil, errUnprocessablePatch(nil, fmt.Sprintf("cannot insert into %q at index %d", op.Path, *op.Index))
+		}
+		return &jsonPatchOperation{Op: "add", Path: fmt.Sprintf("%s/%d", ptr, *op.Index), Value: op.Value}, nil
+
+	case "delete":
+		ptr, _, found, err := resolveFHIRPath(doc, op.Path)
+		if err != nil || !found {
+			return nil, err
+		}
+		return &jsonPatchOperation{Op: "remove", Path: ptr}, nil
+
+	case "replace":
+		if op.Value == nil {
+			return nil, errBadRequest(nil, "replace operations require a value")
+		}
+		ptr, _, found, err := resolveFHIRPath(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, errUnprocessablePatch(nil, fmt.Sprintf("path %q not found", op.Path))
+		}
+		return &jsonPatchOperation{Op: "replace", Path: ptr, Value: op.Value}, nil
+
+	case "move":
+		if op.Source == nil || op.Destination == nil {
+			return nil, errBadRequest(nil, "move operations require a source and a destination")
+		}
+		ptr, existing, found, err := resolveFHIRPath(doc, op.Path)
+		if err != nil {
+			return nil, err
+		}
+		arr, ok := existing.([]interface{})
+		if !found || !ok || *op.Source < 0 || *op.Source >= len(arr) || *op.Destination < 0 || *op.Destination >= len(arr) {
+			return nil, errUnprocessablePatch(nil, fmt.Sprintf("cannot move within %q", op.Path))
+		}
+		return &jsonPatchOperation{
+			Op:   "move",
+			From: fmt.Sprintf("%s/%d", ptr, *op.Source),
+			Path: fmt.Sprintf("%s/%d", ptr, *op.Destination),
+		}, nil
+	}
+	return nil, errNotSupported(fmt.Sprintf("unsupported operation type %q", op.Type))
+}
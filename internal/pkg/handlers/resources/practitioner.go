@@ -1,7 +1,6 @@
 package resources
 
 import (
-	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
 	"github.com/pkg/errors"
 )
@@ -28,36 +27,30 @@ func NewPractitioner(registry *Registry) (*Practitioner, error) {
 		{Name: "_id", Type: models.SearchParameterTypeToken},
 		{Name: "_lastUpdated", Type: models.SearchParameterTypeDate},
 		{Name: "active", Type: models.SearchParameterTypeToken},
+		{Name: "family", Type: models.SearchParameterTypeString},
 		{Name: "identifier", Type: models.SearchParameterTypeToken},
-		{Name: "location", Type: models.SearchParameterTypeReference},
+		{Name: "location", Targets: []string{"Location"}, Type: models.SearchParameterTypeReference},
 		{Name: "name", Type: models.SearchParameterTypeString},
 		{Name: "telecom", Type: models.SearchParameterTypeToken},
 	}
 
-	collContract := registry.appConfig.ObjectCollectionContracts["Practitioner"]
-	if collContract == nil {
-		return nil, errors.New("no collection contract found")
-	}
-	newAdapter, err := ethereum.NewAdapter(
-		registry.connection,
-		registry.transactOpts,
-		registry.appConfig.OrganizationContract,
-		collContract,
-		registry.txnsChan,
-		registry.log,
-	)
+	collContract, store, err := registry.newStore("Practitioner")
 	if err != nil {
-		return nil, errors.New("failed to create ethereum adapter")
+		return nil, err
 	}
+	newConfig.linkObjectIndexes(collContract.Indexes)
 
 	return &Practitioner{
 		EthereumResource{
-			adapter:       newAdapter,
 			config:        newConfig,
+			engine:        registry.engine,
 			jsonValidator: validator,
 			log:           registry.log,
 			newModelFunc:  func() models.Resource { return &models.Practitioner{} },
 			renderer:      registry.renderer,
+			store:         store,
+			tenant:        registry.appConfig.Tenant,
+			txnWait:       registry.appConfig.TransactionWait,
 		},
 	}, nil
 }
@@ -1,7 +1,6 @@
 package resources
 
 import (
-	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
 	"github.com/pkg/errors"
 )
@@ -29,35 +28,28 @@ func NewPractitionerRole(registry *Registry) (*PractitionerRole, error) {
 		{Name: "_id", Type: models.SearchParameterTypeToken},
 		{Name: "_lastUpdated", Type: models.SearchParameterTypeDate},
 		{Name: "identifier", Type: models.SearchParameterTypeToken},
-		{Name: "location", Type: models.SearchParameterTypeReference},
-		{Name: "practitioner", Type: models.SearchParameterTypeReference},
+		{Name: "location", Targets: []string{"Location"}, Type: models.SearchParameterTypeReference},
+		{Name: "practitioner", Targets: []string{"Practitioner"}, Type: models.SearchParameterTypeReference},
 		{Name: "telecom", Type: models.SearchParameterTypeToken},
 	}
 
-	collContract := registry.appConfig.ObjectCollectionContracts["PractitionerRole"]
-	if collContract == nil {
-		return nil, errors.New("no collection contract found")
-	}
-	newAdapter, err := ethereum.NewAdapter(
-		registry.connection,
-		registry.transactOpts,
-		registry.appConfig.OrganizationContract,
-		collContract,
-		registry.txnsChan,
-		registry.log,
-	)
+	collContract, store, err := registry.newStore("PractitionerRole")
 	if err != nil {
-		return nil, errors.New("failed to create ethereum adapter")
+		return nil, err
 	}
+	newConfig.linkObjectIndexes(collContract.Indexes)
 
 	return &PractitionerRole{
 		EthereumResource{
-			adapter:       newAdapter,
 			config:        newConfig,
+			engine:        registry.engine,
 			jsonValidator: validator,
 			log:           registry.log,
 			newModelFunc:  func() models.Resource { return &models.PractitionerRole{} },
 			renderer:      registry.renderer,
+			store:         store,
+			tenant:        registry.appConfig.Tenant,
+			txnWait:       registry.appConfig.TransactionWait,
 		},
 	}, nil
 }
@@ -1,14 +1,23 @@
 package resources
 
 import (
+	"net/http"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/audit"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
-	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/mirror"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
 	"github.com/gobuffalo/packr/v2"
+	"github.com/pkg/errors"
 	"github.com/unrolled/render"
+	"github.com/urfave/negroni"
 )
 
 // Registry ...
@@ -17,67 +26,194 @@ type Registry struct {
 
 	box          *packr.Box
 	db           *database.DB
-	connection   *ethclient.Client
-	transactOpts *bind.TransactOpts
+	connection   ethereum.Backend
+	transactions *ethereum.TransactionManager
 	appConfig    *config.Config
 	log          *logging.Logger
 	renderer     *render.Render
 	txnsChan     ethereum.TransactionsChannel
+	engine       *subscriptions.Engine
+	exports      *BulkExport
+	recorder     *audit.Recorder
+	mirror       *mirror.Mirror
+	ipfs         *ipfs.Client
+	fetchers     *fetcher.Registry
+	keyring      *envelope.Keyring
+}
+
+// Audit records an AuditEvent for each request handled by next
+func (r *Registry) Audit(resourceType string, interaction audit.Interaction, next http.Handler) http.Handler {
+	return r.recorder.Handler(r.appConfig.Tenant, resourceType, interaction, next)
+}
+
+// AuditRejections records an AuditEvent for each request refused before it reaches a route
+func (r *Registry) AuditRejections() negroni.Handler {
+	return r.recorder.Rejections()
+}
+
+// searchMatcher is implemented by the resources whose searches can be evaluated against a single resource, which
+// evaluate the criteria of their subscriptions
+type searchMatcher interface {
+	subscriptions.Matcher
+	resourceType() string
 }
 
 func (r *Registry) add(resource interface{}) {
 	r.Resources = append(r.Resources, resource)
+	if m, ok := resource.(searchMatcher); ok {
+		r.engine.RegisterMatcher(r.appConfig.Tenant, m.resourceType(), m)
+	}
+}
+
+// newStore creates the store of a resource type, as selected by the storage configuration
+func (r *Registry) newStore(resourceType string) (*config.ObjectCollectionContract, storage.Store, error) {
+	collection := r.appConfig.ObjectCollectionContracts[resourceType]
+	switch backend := r.appConfig.Storage[resourceType]; backend {
+	case "", storage.BackendEthereum:
+		if collection == nil {
+			return nil, nil, errors.New("no collection contract found")
+		}
+		adapter, err := ethereum.NewAdapter(
+			r.connection,
+			r.transactions,
+			r.appConfig.OrganizationContract,
+			collection,
+			r.txnsChan,
+			r.ipfs,
+			r.fetchers,
+			r.keyring,
+			r.db,
+			r.log,
+		)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to create ethereum adapter")
+		}
+		return collection, ethereum.NewStore(adapter, r.newObjectReader(adapter)), nil
+	case storage.BackendSQL:
+		if collection == nil {
+			// indexes are optional, so the collection does not have to be configured
+			collection = &config.ObjectCollectionContract{Name: resourceType, Tenant: r.appConfig.Tenant}
+		}
+		store, err := database.NewStore(r.db, collection)
+		if err != nil {
+			return nil, nil, err
+		}
+		return collection, store, nil
+	default:
+		return nil, nil, errors.Errorf("unsupported storage backend %q for %s", backend, resourceType)
+	}
+}
+
+// newObjectReader returns the source from which a collection is read, tracking it when the mirror is enabled
+func (r *Registry) newObjectReader(adapter *ethereum.Adapter) ethereum.ObjectReader {
+	if !r.mirror.Enabled() {
+		return adapter
+	}
+	reader := r.mirror.Track(adapter)
+	if r.appConfig.ReadFrom == mirror.ReadFromMirror {
+		return reader
+	}
+	return adapter
 }
 
 // NewRegistry ...
 func NewRegistry(
 	box *packr.Box,
 	db *database.DB,
-	connection *ethclient.Client,
-	transactOpts *bind.TransactOpts,
+	connection ethereum.Backend,
+	transactions *ethereum.TransactionManager,
 	appConfig *config.Config,
 	log *logging.Logger,
 	renderer *render.Render,
 	txnsChan ethereum.TransactionsChannel,
+	engine *subscriptions.Engine,
+	mirror *mirror.Mirror,
+	ipfsClient *ipfs.Client,
+	fetchers *fetcher.Registry,
+	keyring *envelope.Keyring,
 ) (*Registry, error) {
 	registry := &Registry{
 		box:          box,
 		db:           db,
 		connection:   connection,
-		transactOpts: transactOpts,
+		transactions: transactions,
 		appConfig:    appConfig,
 		log:          log,
 		renderer:     renderer,
 		txnsChan:     txnsChan,
+		engine:       engine,
+		mirror:       mirror,
+		ipfs:         ipfsClient,
+		fetchers:     fetchers,
+		keyring:      keyring,
+	}
+	registry.exports = newBulkExport(registry)
+	// the tenants share the recorder, whose records are kept apart by the tenant of the registry
+	recorder, err := audit.NewRecorder(log, appConfig, db)
+	if err != nil {
+		return nil, err
 	}
+	registry.recorder = recorder
 
+	if !appConfig.HasOrganization() {
+		// only the tenants are served
+		return registry, nil
+	}
+	return registry, registry.addResources()
+}
+
+// addResources creates the handlers of the resource types served by the registry
+func (r *Registry) addResources() error {
 	// Practitioner
-	practitioner, err := NewPractitioner(registry)
+	practitioner, err := NewPractitioner(r)
 	if err != nil {
-		return registry, err
+		return err
 	}
-	registry.add(practitioner)
+	r.add(practitioner)
 
 	// PractitionerRole
-	practitionerRole, err := NewPractitionerRole(registry)
+	practitionerRole, err := NewPractitionerRole(r)
 	if err != nil {
-		return registry, err
+		return err
 	}
-	registry.add(practitionerRole)
+	r.add(practitionerRole)
 
 	// Location
-	location, err := NewLocation(registry)
+	location, err := NewLocation(r)
 	if err != nil {
-		return registry, err
+		return err
 	}
-	registry.add(location)
+	r.add(location)
 
 	// Subscription
-	subscription, err := NewSubscription(registry)
+	subscription, err := NewSubscription(r)
 	if err != nil {
-		return registry, err
+		return err
 	}
-	registry.add(subscription)
+	r.add(subscription)
+
+	// AuditEvent
+	auditEvent, err := NewAuditEvent(r)
+	if err != nil {
+		return err
+	}
+	r.add(auditEvent)
+
+	return nil
+}
+
+// Tenant returns the name of the organization of the registry, empty for the top level organization
+func (r *Registry) Tenant() string {
+	return r.appConfig.Tenant
+}
 
-	return registry, nil
+// forTenant creates a registry for a tenant, which shares the connections of r
+func (r *Registry) forTenant(tenantConfig *config.Config, transactions *ethereum.TransactionManager, keyring *envelope.Keyring) (*Registry, error) {
+	tenant := *r
+	tenant.Resources = nil
+	tenant.appConfig = tenantConfig
+	tenant.keyring = keyring
+	tenant.transactions = transactions
+	tenant.exports = newBulkExport(&tenant)
+	return &tenant, tenant.addResources()
 }
@@ -1,15 +1,20 @@
 package resources
 
 import (
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
 )
 
 type searchIncludes []string
 
 type searchParam struct {
-	Name                       string
-	ObjectIndexContractAddress string
-	Type                       models.SearchParameterType
+	Name        string
+	ObjectIndex string
+	// Targets are the resource types a reference parameter may refer to
+	Targets []string
+	Type    models.SearchParameterType
+	// index is the configuration of the index named by ObjectIndex, which tells the values it holds for a resource
+	index *config.ObjectIndex
 }
 
 // ResourceConfig ...
@@ -24,6 +29,28 @@ type ResourceConfig struct {
 	Versioning        models.CapabilityStatementResourceVersioning
 }
 
+// getSearchParam returns the declared search parameter with the provided name
+func (c *ResourceConfig) getSearchParam(name string) (searchParam, bool) {
+	for _, p := range c.SearchParams {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return searchParam{}, false
+}
+
+// linkObjectIndexes associates declared search parameters with the indexes configured to serve them
+func (c *ResourceConfig) linkObjectIndexes(indexes []*config.ObjectIndex) {
+	for _, idx := range indexes {
+		for i, p := range c.SearchParams {
+			if idx.SearchParam != "" && p.Name == idx.SearchParam {
+				c.SearchParams[i].ObjectIndex = idx.Name
+				c.SearchParams[i].index = idx
+			}
+		}
+	}
+}
+
 // NewResourceConfig ...
 func NewResourceConfig() *ResourceConfig {
 	return &ResourceConfig{
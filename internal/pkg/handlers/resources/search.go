@@ -0,0 +1,473 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// searchResultParams are parameters that control the shape of a search response rather than filter it
+var searchResultParams = map[string]bool{
+	"_contained":  true,
+	"_count":      true,
+	"_elements":   true,
+	"_format":     true,
+	"_include":    true,
+	"_offset":     true,
+	"_revinclude": true,
+	"_sort":       true,
+	"_summary":    true,
+	"_total":      true,
+}
+
+// defaultSearchCount is the number of results in a page of a search without _count
+const defaultSearchCount = 100
+
+// searchPage is the part of the results of a search that is returned, as selected by _count and _offset
+type searchPage struct {
+	count  int
+	offset int
+}
+
+// bounds returns the range of a list of n results that is on the page
+func (p *searchPage) bounds(n int) (int, int) {
+	start, end := p.offset, p.offset+p.count
+	if start > n {
+		start = n
+	}
+	if end > n {
+		end = n
+	}
+	return start, end
+}
+
+func getSearchPage(query url.Values) (*searchPage, error) {
+	p := &searchPage{count: defaultSearchCount}
+	for name, target := range map[string]*int{"_count": &p.count, "_offset": &p.offset} {
+		if v := query.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, errBadRequest(err, fmt.Sprintf("invalid %s parameter", name))
+			}
+			*target = n
+		}
+	}
+	return p, nil
+}
+
+// dateSearch is a parsed date search parameter value, e.g. "ge2019-01-01"
+type dateSearch struct {
+	prefix string
+	start  time.Time
+	end    time.Time
+}
+
+var dateSearchLayouts = []struct {
+	layout    string
+	precision func(time.Time) time.Time
+}{
+	{time.RFC3339, func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{"2006-01-02T15:04", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+}
+
+func parseDateSearch(value string) (*dateSearch, error) {
+	d := &dateSearch{prefix: "eq"}
+	if len(value) > 2 && value[0] >= 'a' && value[0] <= 'z' {
+		d.prefix, value = value[:2], value[2:]
+	}
+	switch d.prefix {
+	case "eq", "ne", "gt", "lt", "ge", "le", "sa", "eb":
+	default:
+		return nil, errors.Errorf("unsupported date search prefix %q", d.prefix)
+	}
+	for _, l := range dateSearchLayouts {
+		if t, err := time.Parse(l.layout, value); err == nil {
+			d.start = t
+			d.end = l.precision(t)
+			return d, nil
+		}
+	}
+	return nil, errors.Errorf("unable to parse date search value %q", value)
+}
+
+// matches reports whether a timestamp falls within the range described by the search value
+func (d *dateSearch) matches(ts time.Time) bool {
+	switch d.prefix {
+	case "ne":
+		return ts.Before(d.start) || !ts.Before(d.end)
+	case "gt", "sa":
+		return !ts.Before(d.end)
+	case "lt", "eb":
+		return ts.Before(d.start)
+	case "ge":
+		return !ts.Before(d.start)
+	case "le":
+		return ts.Before(d.end)
+	default:
+		return !ts.Before(d.start) && ts.Before(d.end)
+	}
+}
+
+// sqlCondition returns the condition on a timestamp column that matches the range described by the search value
+func (d *dateSearch) sqlCondition(column string) (string, []interface{}) {
+	switch d.prefix {
+	case "ne":
+		return column + " < ? OR " + column + " >= ?", []interface{}{d.start, d.end}
+	case "gt", "sa":
+		return column + " >= ?", []interface{}{d.end}
+	case "lt", "eb":
+		return column + " < ?", []interface{}{d.start}
+	case "ge":
+		return column + " >= ?", []interface{}{d.start}
+	case "le":
+		return column + " < ?", []interface{}{d.end}
+	default:
+		return column + " >= ? AND " + column + " < ?", []interface{}{d.start, d.end}
+	}
+}
+
+// getLastUpdatedSearches parses all _lastUpdated values of a search request
+func getLastUpdatedSearches(query url.Values) ([]*dateSearch, error) {
+	searches := []*dateSearch{}
+	for _, v := range query["_lastUpdated"] {
+		d, err := parseDateSearch(v)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid _lastUpdated parameter")
+		}
+		searches = append(searches, d)
+	}
+	return searches, nil
+}
+
+// matchesLastUpdated reports whether a resource satisfies all of the provided _lastUpdated searches
+func matchesLastUpdated(resource models.Resource, searches []*dateSearch) bool {
+	if len(searches) == 0 {
+		return true
+	}
+	meta := resource.GetMeta()
+	if meta == nil {
+		return false
+	}
+	ts, err := time.Parse(time.RFC3339, meta.LastUpdated)
+	if err != nil {
+		return false
+	}
+	for _, d := range searches {
+		if !d.matches(ts) {
+			return false
+		}
+	}
+	return true
+}
+
+// getIndexValues converts a search parameter value to the raw values that may be stored for it in an index
+func getIndexValues(p searchParam, value string) []string {
+	switch p.Type {
+	case models.SearchParameterTypeToken:
+		// the index stores codes only, so any "system|" qualifier is dropped
+		if i := strings.LastIndex(value, "|"); i >= 0 {
+			return []string{value[i+1:]}
+		}
+	case models.SearchParameterTypeReference:
+		return getReferenceValues(p, value)
+	}
+	return []string{value}
+}
+
+// getReferenceValues returns the forms in which a reference may be stored: references are usually written as
+// "Type/id", but may be searched for by id alone, or by absolute URL
+func getReferenceValues(p searchParam, value string) []string {
+	segments := strings.Split(strings.TrimSuffix(value, "/"), "/")
+	if len(segments) == 1 {
+		values := []string{value}
+		for _, target := range p.Targets {
+			values = append(values, target+"/"+value)
+		}
+		return values
+	}
+	resourceType, id := segments[len(segments)-2], segments[len(segments)-1]
+	if len(segments) >= 4 && segments[len(segments)-2] == "_history" {
+		resourceType, id = segments[len(segments)-4], segments[len(segments)-3]
+	}
+	return []string{resourceType + "/" + id, id}
+}
+
+// findResourceIDs resolves the filtering parameters of a search request to the matching resource IDs
+// repeated parameters are combined with AND, comma-separated values with OR
+func (h *EthereumResource) findResourceIDs(ctx context.Context, query url.Values) ([]uuid.UUID, error) {
+	names := []string{}
+	for name := range query {
+		if searchResultParams[name] || name == "_lastUpdated" {
+			continue
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		ids, err := h.store.List(ctx)
+		if err != nil {
+			return nil, errStorage(err, "failed to list resources")
+		}
+		return sortUUIDs(ids), nil
+	}
+	sort.Strings(names)
+
+	var result []uuid.UUID
+	for i, name := range names {
+		p, ok := h.config.getSearchParam(name)
+		if !ok {
+			return nil, errNotSupported(fmt.Sprintf("unsupported search parameter %q", name))
+		}
+		for j, value := range query[name] {
+			ids, err := h.findResourceIDsForValue(ctx, p, value)
+			if err != nil {
+				return nil, err
+			}
+			if i == 0 && j == 0 {
+				result = ids
+			} else {
+				result = intersectUUIDs(result, ids)
+			}
+		}
+	}
+	return sortUUIDs(result), nil
+}
+
+// CheckSearch returns an error when a search with the provided parameters is not supported
+func (h *EthereumResource) CheckSearch(query url.Values) error {
+	for name := range query {
+		if searchResultParams[name] || name == "_lastUpdated" {
+			continue
+		}
+		p, ok := h.config.getSearchParam(name)
+		if !ok {
+			return errors.Errorf("unsupported search parameter %q", name)
+		}
+		if p.Name != "_id" && p.index == nil {
+			return errors.Errorf("search parameter %q is not backed by an index", name)
+		}
+	}
+	_, err := getLastUpdatedSearches(query)
+	return err
+}
+
+// MatchesSearch reports whether a JSON resource would be found by a search with the provided parameters, comparing
+// their values with the values that the indexes serving the search hold for the resource
+func (h *EthereumResource) MatchesSearch(query url.Values, data []byte) (bool, error) {
+	if err := h.CheckSearch(query); err != nil {
+		return false, err
+	}
+	resource := h.newModelFunc()
+	if err := json.Unmarshal(data, resource); err != nil {
+		return false, errors.Wrap(err, "failed to unmarshal resource")
+	}
+	lastUpdated, err := getLastUpdatedSearches(query)
+	if err != nil {
+		return false, err
+	}
+	if !matchesLastUpdated(resource, lastUpdated) {
+		return false, nil
+	}
+	for name, values := range query {
+		if searchResultParams[name] || name == "_lastUpdated" {
+			continue
+		}
+		p, _ := h.config.getSearchParam(name)
+		indexed := []string{resource.GetID()}
+		if p.Name != "_id" {
+			if indexed, err = storage.IndexValues(p.index, data); err != nil {
+				return false, err
+			}
+		}
+		for _, value := range values {
+			if !matchesIndexValues(p, value, indexed) {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// matchesIndexValues reports whether any of the comma-separated values of a search parameter is one of the values
+// held for a resource, as a lookup of the index would find it
+func matchesIndexValues(p searchParam, value string, indexed []string) bool {
+	for _, v := range strings.Split(value, ",") {
+		if v == "" {
+			continue
+		}
+		candidates := []string{v}
+		if p.Name != "_id" {
+			candidates = getIndexValues(p, v)
+		}
+		for _, candidate := range candidates {
+			for _, s := range indexed {
+				if candidate == s {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (h *EthereumResource) findResourceIDsForValue(ctx context.Context, p searchParam, value string) ([]uuid.UUID, error) {
+	ids := []uuid.UUID{}
+	for _, v := range strings.Split(value, ",") {
+		if v == "" {
+			continue
+		}
+		switch {
+		case p.Name == "_id":
+			if id := uuid.Parse(v); id != nil {
+				ids = unionUUIDs(ids, []uuid.UUID{id})
+			}
+		case p.ObjectIndex != "":
+			for _, indexValue := range getIndexValues(p, v) {
+				found, err := h.store.Find(ctx, p.ObjectIndex, indexValue)
+				if err != nil {
+					return nil, errStorage(err, fmt.Sprintf("failed to query index for search parameter %q", p.Name))
+				}
+				ids = unionUUIDs(ids, found)
+			}
+		default:
+			return nil, errNotSupported(fmt.Sprintf("search parameter %q is not backed by an index", p.Name))
+		}
+	}
+	return ids, nil
+}
+
+// readSearchPage reads the resources on a page of the results of a search, and counts the results
+// only the IDs on the page are read, unless _lastUpdated, which is not indexed, requires every match to be read; IDs
+// that cannot be read, such as those of removed resources, are left out of the page and of the total
+func (h *EthereumResource) readSearchPage(ctx context.Context, ids []uuid.UUID, lastUpdated []*dateSearch, page *searchPage) ([]models.Resource, int, bool, error) {
+	if len(lastUpdated) == 0 {
+		start, end := page.bounds(len(ids))
+		results, err := h.readSearchResults(ctx, ids[start:end], nil)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		return results, len(ids) - (end - start - len(results)), end < len(ids), nil
+	}
+	results, err := h.readSearchResults(ctx, ids, lastUpdated)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	start, end := page.bounds(len(results))
+	return results[start:end], len(results), end < len(results), nil
+}
+
+// readSearchResults reads the resources of a list of IDs that satisfy the _lastUpdated searches
+func (h *EthereumResource) readSearchResults(ctx context.Context, ids []uuid.UUID, lastUpdated []*dateSearch) ([]models.Resource, error) {
+	results := []models.Resource{}
+	for _, id := range ids {
+		resource, _, err := h.readResource(ctx, h.store, id)
+		switch errors.Cause(err) {
+		case storage.ErrObjectNotFound, storage.ErrForbidden:
+			// indexes may still reference removed objects, and objects of other organizations cannot be read
+			continue
+		}
+		if err != nil {
+			return nil, errStorage(err, "failed to read record")
+		}
+		if matchesLastUpdated(resource, lastUpdated) {
+			results = append(results, resource)
+		}
+	}
+	return results, nil
+}
+
+func unionUUIDs(a, b []uuid.UUID) []uuid.UUID {
+	for _, id := range b {
+		if !containsUUID(a, id) {
+			a = append(a, id)
+		}
+	}
+	return a
+}
+
+func intersectUUIDs(a, b []uuid.UUID) []uuid.UUID {
+	result := []uuid.UUID{}
+	for _, id := range a {
+		if containsUUID(b, id) {
+			result = append(result, id)
+		}
+	}
+	return result
+}
+
+// sortUUIDs orders search results, so that pages of the results do not overlap
+func sortUUIDs(ids []uuid.UUID) []uuid.UUID {
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	return ids
+}
+
+func containsUUID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, i := range ids {
+		if uuid.Equal(i, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// newSearchSetBundle wraps search results in a FHIR searchset Bundle
+func newSearchSetBundle(req *http.Request, resources []models.Resource) *models.Bundle {
+	baseURL := getBaseURL(req)
+	bundle := &models.Bundle{
+		Type:  models.BundleTypeSearchset,
+		Total: uint64(len(resources)),
+		Link: []*models.BundleLink{
+			{Relation: "self", URL: baseURL + req.URL.RequestURI()},
+		},
+		Entry: []*models.BundleEntry{},
+	}
+	for _, r := range resources {
+		var resource models.ResourceList = r
+		bundle.Entry = append(bundle.Entry, &models.BundleEntry{
+			FullURL:  getResourceURL(baseURL+getBasePath(req), r),
+			Resource: &resource,
+			Search:   &models.BundleSearch{Mode: models.BundleSearchModeMatch},
+		})
+	}
+	return bundle
+}
+
+// newSearchSetPage wraps a page of search results in a searchset Bundle, whose total counts every result
+// and whose links lead to the neighbouring pages
+func newSearchSetPage(req *http.Request, resources []models.Resource, total int, more bool, page *searchPage) *models.Bundle {
+	bundle := newSearchSetBundle(req, resources)
+	bundle.Total = uint64(total)
+	link := func(relation string, offset int) {
+		query := req.URL.Query()
+		query.Set("_count", strconv.Itoa(page.count))
+		query.Set("_offset", strconv.Itoa(offset))
+		bundle.Link = append(bundle.Link, &models.BundleLink{
+			Relation: relation,
+			URL:      getBaseURL(req) + req.URL.Path + "?" + query.Encode(),
+		})
+	}
+	if page.offset > 0 {
+		previous := page.offset - page.count
+		if previous < 0 {
+			previous = 0
+		}
+		link("previous", previous)
+	}
+	if more && page.count > 0 {
+		link("next", page.offset+page.count)
+	}
+	return bundle
+}
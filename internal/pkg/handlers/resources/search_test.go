@@ -0,0 +1,94 @@
+package resources
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/oliveagle/jsonpath"
+)
+
+const smithJSON = `{
+	"resourceType": "Practitioner",
+	"id": "a1",
+	"meta": {"lastUpdated": "2019-06-01T12:00:00Z"},
+	"active": true,
+	"identifier": [{"system": "http://hl7.org/fhir/sid/us-npi", "value": "1234567890"}],
+	"name": [{"family": "Smith", "given": ["Adam"]}]
+}`
+
+func TestMatchesSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-matcher-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := logging.NewLogger()
+	appConfig := &config.Config{
+		DatabaseType:             "sqlite3",
+		DatabaseConnectionString: filepath.Join(dir, "test.db"),
+		Storage:                  map[string]string{"Practitioner": storage.BackendSQL},
+		ObjectCollectionContracts: map[string]*config.ObjectCollectionContract{
+			"Practitioner": {
+				Name: "Practitioner",
+				Indexes: []*config.ObjectIndex{
+					{Name: "Global NPI", JSONPath: jsonpath.MustCompile("$.identifier.value"), SearchParam: "identifier"},
+					{Name: "Family name", JSONPath: jsonpath.MustCompile("$.name.family"), SearchParam: "family"},
+				},
+			},
+		},
+	}
+	db, err := database.NewConnection(log, appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+	practitioner, err := NewPractitioner(&Registry{box: static.NewStaticFilesBox(), db: db, appConfig: appConfig, log: log})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query   string
+		matches bool
+		err     bool
+	}{
+		{"", true, false},
+		{"family=Smith", true, false},
+		{"family=Jones", false, false},
+		{"family=Jones,Smith", true, false},
+		{"identifier=1234567890", true, false},
+		{"identifier=http://hl7.org/fhir/sid/us-npi|1234567890", true, false},
+		{"identifier=123", false, false},
+		{"identifier=http://hl7.org/fhir/sid/us-npi", false, false},
+		{"identifier=1234567890&family=Jones", false, false},
+		{"_id=a1", true, false},
+		{"_id=a2", false, false},
+		{"_lastUpdated=ge2019-01-01", true, false},
+		{"_lastUpdated=lt2019-01-01", false, false},
+		{"_count=1&family=Smith", true, false},
+		{"active=true", false, true},
+		{"gender=male", false, true},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, err := practitioner.MatchesSearch(query, []byte(smithJSON))
+		if matches != tt.matches || tt.err != (err != nil) {
+			t.Errorf("%s: expected %v with error %v, got %v, %v", tt.query, tt.matches, tt.err, matches, err)
+		}
+		if err := practitioner.CheckSearch(query); tt.err != (err != nil) {
+			t.Errorf("%s: expected the check to fail %v, got %v", tt.query, tt.err, err)
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package resources
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math/big"
 	"net/http"
 	"strconv"
 	"strings"
@@ -22,26 +22,73 @@ import (
 const (
 	versionDelimiter         = "-"
 	initialResourceVersionID = "0" + versionDelimiter + "0"
+
+	// defaultBasePath is the path of the FHIR base URL of the top level organization
+	defaultBasePath = "/fhir"
 )
 
+type contextKey string
+
+// basePathKey holds the path of the FHIR base URL through which a request was received
+const basePathKey contextKey = "basePath"
+
+// WithBasePath sets the path of the FHIR base URL of the requests handled by next, e.g. /fhir/{tenant}
+func WithBasePath(basePath string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			next.ServeHTTP(rw, req.WithContext(context.WithValue(req.Context(), basePathKey, basePath)))
+		})
+	}
+}
+
+// getBasePath returns the path of the FHIR base URL through which the request was received
+func getBasePath(req *http.Request) string {
+	if basePath, ok := req.Context().Value(basePathKey).(string); ok {
+		return basePath
+	}
+	return defaultBasePath
+}
+
 func getResourceID(req *http.Request) (uuid.UUID, error) {
 	uuidStr := mux.Vars(req)["resourceID"]
 	if uuidStr == "" {
-		return nil, errors.New("no resource ID was provided")
+		return nil, errBadRequest(nil, "no resource ID was provided")
 	}
 	uuidObj := uuid.Parse(uuidStr)
 	if uuidObj == nil {
-		return nil, errors.New("unable to parse UUID from resource ID")
+		return nil, errBadRequest(nil, "unable to parse UUID from resource ID")
 	}
 	return uuidObj, nil
 }
 
+// getBaseURL returns the scheme and host through which the request was received
+func getBaseURL(req *http.Request) string {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	if proto := req.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s", scheme, req.Host)
+}
+
+// getFHIRBaseURL returns the FHIR base URL through which the request was received
+func getFHIRBaseURL(req *http.Request) string {
+	return getBaseURL(req) + getBasePath(req)
+}
+
+// getResourceURL returns the absolute URL of a resource
+func getResourceURL(fhirBaseURL string, resource models.Resource) string {
+	return fmt.Sprintf("%s/%s/%s", fhirBaseURL, resource.ResourceType(), resource.GetID())
+}
+
 func getRequestParameters(req *http.Request, h resourceHandler) (*models.Parameters, error) {
 	log := h.getLogger()
 	params := &models.Parameters{}
 	decoder := json.NewDecoder(req.Body)
 	if err := decoder.Decode(params); err != nil {
-		return nil, err
+		return nil, NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "unable to parse Parameters resource")
 	}
 	log.Debug(spew.Sdump(params))
 	return params, nil
@@ -58,33 +105,42 @@ func getValidationParameters(req *http.Request, h resourceHandler) (interface{},
 			return p.Resource, nil
 		}
 	}
-	return nil, errors.New("unable to find resource parameter")
+	return nil, NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeRequired, nil, "unable to find resource parameter")
 }
 
 func loadResourceFromBody(target interface{}, req *http.Request, validator *models.JSONValidator) error {
 	bArr, err := ioutil.ReadAll(req.Body)
 	if err != nil {
-		return err
+		return errBadRequest(err, "unable to read request body")
 	}
-	valid, _, err := validator.Validate(bArr)
+	return loadResourceFromBytes(target, bArr, validator)
+}
+
+// loadResourceFromBytes validates a JSON resource against the schema and unmarshals it into target
+func loadResourceFromBytes(target interface{}, bArr []byte, validator *models.JSONValidator) error {
+	valid, vErrs, err := validator.Validate(bArr)
 	if err != nil {
-		return err
+		return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "request body is not valid JSON")
 	}
 	if !valid {
-		return errors.New("resource failed FHIR validation")
+		return newValidationError(vErrs)
 	}
-	return json.Unmarshal(bArr, target)
+	if err := json.Unmarshal(bArr, target); err != nil {
+		return NewOperationError(http.StatusBadRequest, models.OperationOutcomeIssueCodeStructure, err, "unable to parse resource")
+	}
+	return nil
 }
 
 func resourceCreated(
 	rndr *render.Render,
 	rw http.ResponseWriter,
+	req *http.Request,
 	resourceID uuid.UUID,
 	versionID string,
 	lastModified time.Time,
 	resource interface{},
 ) {
-	location := fmt.Sprintf("/fhir/%s/%s", utils.GetBaseTypeName(resource), resourceID.String())
+	location := fmt.Sprintf("%s/%s/%s", getBasePath(req), utils.GetBaseTypeName(resource), resourceID.String())
 	if versionID != "" {
 		location = fmt.Sprintf("%s/_history/%s", location, versionID)
 		rw.Header().Set("Etag", generateETag(versionID))
@@ -94,6 +150,25 @@ func resourceCreated(
 	rndr.JSON(rw, http.StatusCreated, resource)
 }
 
+// checkIfMatch enforces optimistic locking using the If-Match header
+func checkIfMatch(req *http.Request, versionID string, required bool) error {
+	return matchETag(req.Header.Get("If-Match"), versionID, required)
+}
+
+// matchETag checks that an expected ETag, which may be empty when it is not required, matches a version
+func matchETag(expected string, versionID string, required bool) error {
+	if expected == "" {
+		if required {
+			return errBadRequest(nil, "an If-Match header is required to update a resource")
+		}
+		return nil
+	}
+	if expected != generateETag(versionID) {
+		return errPreconditionFailed(fmt.Sprintf("resource version %q does not match If-Match header", versionID))
+	}
+	return nil
+}
+
 func generateETag(versionID string) string {
 	return fmt.Sprintf(`W/"%s"`, versionID)
 }
@@ -125,7 +200,7 @@ func resourceRead(
 		if since := req.Header.Get("If-Modified-Since"); since != "" {
 			sinceTs, err := time.Parse(http.TimeFormat, since)
 			if err != nil {
-				return errors.Wrap(err, "unable to parse If-Modified-Since timestamp")
+				return errBadRequest(err, "unable to parse If-Modified-Since timestamp")
 			}
 			if ts.Equal(sinceTs) || ts.Before(sinceTs) {
 				skip = true
@@ -150,22 +225,21 @@ func resourceRead(
 }
 
 func validateJSONResource(h resourceHandler) http.Handler {
-	log := h.getLogger()
 	rndr := h.getRenderer()
 	validator := h.getJSONValidator()
 
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		resource, err := getValidationParameters(req, h)
 		if err != nil {
-			log.WithError(err).Panic("could not get validation parameters")
+			return err
 		}
 		bytes, err := json.Marshal(resource)
 		if err != nil {
-			log.WithError(err).Panic("could not marshal resource")
+			return errInternal(err, "could not marshal resource")
 		}
 		valid, vErrs, err := validator.Validate(bytes)
 		if err != nil {
-			log.WithError(err).Panic("could not validate resource")
+			return errInternal(err, "could not validate resource")
 		}
 		issues := []*models.OperationOutcomeIssue{}
 		if valid {
@@ -186,13 +260,14 @@ func validateJSONResource(h resourceHandler) http.Handler {
 		outcome := &models.OperationOutcome{}
 		outcome.Issue = issues
 		rndr.JSON(rw, http.StatusOK, outcome)
+		return nil
 	})
 }
 
-// generateResourceVersionID creates a version string for a resource based on an update nonce and the block number of the previous version
+// generateResourceVersionID creates a version string for a resource based on an update nonce and the store version (the block number on chain) of the previous version
 // must adhere to "id" regexp: https://www.hl7.org/fhir/datatypes.html#id
-func generateResourceVersionID(updateCount uint, previousBlockNumber *big.Int) string {
-	return fmt.Sprintf("%d%s%s", updateCount, versionDelimiter, previousBlockNumber.String())
+func generateResourceVersionID(updateCount uint, previousBlockNumber uint64) string {
+	return fmt.Sprintf("%d%s%d", updateCount, versionDelimiter, previousBlockNumber)
 }
 
 func getUpdateCountFromVersionID(versionID string) (uint, error) {
@@ -2,11 +2,14 @@ package resources
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/subscriptions"
 	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
 	"github.com/gorilla/mux"
 	"github.com/pborman/uuid"
@@ -14,31 +17,25 @@ import (
 	"github.com/unrolled/render"
 )
 
-type subscriptionDB struct {
-	UUID      string `gorm:"primary_key"`
-	CreatedAt time.Time
-	UpdatedAt time.Time
-	DeletedAt *time.Time `sql:"index"`
-	Data      []byte
-	Active    bool
-}
+type subscriptionDB = subscriptions.Record
 
 // Subscription ...
 type Subscription struct {
 	config        *ResourceConfig
 	db            *database.DB
+	engine        *subscriptions.Engine
 	jsonValidator *models.JSONValidator
 	log           *logging.Logger
 	renderer      *render.Render
+	tenant        string
 }
 
 // Create ...
 func (h *Subscription) Create() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		newSub := &models.Subscription{}
-		err := loadResourceFromBody(newSub, req, h.jsonValidator)
-		if err != nil {
-			h.log.WithError(err).Panic("failed to load resource")
+		if err := loadResourceFromBody(newSub, req, h.jsonValidator); err != nil {
+			return err
 		}
 		if newSub.ID == "" {
 			newSub.ID = uuid.NewUUID().String()
@@ -54,82 +51,80 @@ func (h *Subscription) Create() http.Handler {
 		}
 		jsonBytes, err := json.Marshal(newSub)
 		if err != nil {
-			h.log.WithError(err).Panic("failed to marshal object as JSON")
+			return errInternal(err, "failed to marshal object as JSON")
 		}
 		newDBRec := &subscriptionDB{
 			UUID:      newSub.ID,
 			Data:      jsonBytes,
 			CreatedAt: now,
 			UpdatedAt: now,
+			Tenant:    h.tenant,
+		}
+		if token := auth.FromContext(req.Context()); token != nil {
+			newDBRec.Owner = token.ClientID
 		}
 		if err := h.db.Create(newDBRec).Error; err != nil {
-			h.log.WithError(err).Panic("failed to save object to database")
+			return errInternal(err, "failed to save object to database")
 		}
-		resourceCreated(h.renderer, rw, uuid.Parse(newSub.ID), "", now, newSub)
+		h.engine.Wake()
+		resourceCreated(h.renderer, rw, req, uuid.Parse(newSub.ID), "", now, newSub)
+		return nil
 	})
 }
 
 // Read ...
 func (h *Subscription) Read() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		vars := mux.Vars(req)
 		uuid := vars["resourceID"]
 		if uuid == "" {
-			rw.WriteHeader(http.StatusBadRequest) // TODO: More verbose errors?
-			return
+			return errBadRequest(nil, "no resource ID was provided")
 		}
 		dbRec := &subscriptionDB{}
-		query := h.db.Unscoped().Where(&subscriptionDB{UUID: uuid}).First(dbRec)
+		query := h.db.Unscoped().Where("tenant = ?", h.tenant).Where(&subscriptionDB{UUID: uuid}).First(dbRec)
 		if query.RecordNotFound() {
-			rw.WriteHeader(http.StatusNotFound)
-			return
+			return errNotFound("resource not found")
 		} else if err := query.Error; err != nil {
-			h.log.WithError(err).Panic("failed to query database")
+			return errInternal(err, "failed to query database")
 		}
 		if dbRec.DeletedAt != nil {
-			rw.WriteHeader(http.StatusGone)
-			return
+			return NewOperationError(http.StatusGone, models.OperationOutcomeIssueCodeDeleted, nil, "resource has been deleted")
 		}
 		newSub := &models.Subscription{}
 		if err := json.Unmarshal(dbRec.Data, newSub); err != nil {
-			h.log.WithError(err).Panic("failed to unmarshal data")
+			return errInternal(err, "failed to unmarshal data")
 		}
-		resourceRead(h.renderer, rw, req, http.StatusOK, "", dbRec.UpdatedAt, newSub, true)
+		return resourceRead(h.renderer, rw, req, http.StatusOK, "", dbRec.UpdatedAt, newSub, true)
 	})
 }
 
 // Update ...
 func (h *Subscription) Update() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		resourceID, err := getResourceID(req)
 		if err != nil {
-			h.log.WithError(err).Error("invalid resource ID provided")
-			rw.WriteHeader(http.StatusBadRequest) // TODO: More verbose errors?
-			return
+			return err
 		}
 
 		newSub := &models.Subscription{}
 		if err := loadResourceFromBody(newSub, req, h.jsonValidator); err != nil {
-			h.log.WithError(err).Panic("failed to load resource")
+			return err
 		}
 		if newSub.ID != resourceID.String() {
-			h.log.Errorf("resourceID provided (%q) does not match ID inside of document (%q)", resourceID.String(), newSub.ID)
-			rw.WriteHeader(http.StatusBadRequest)
-			return
+			return errBadRequest(nil, fmt.Sprintf("resourceID provided (%q) does not match ID inside of document (%q)", resourceID.String(), newSub.ID))
 		}
 
 		scope := h.db.Unscoped()
 		dbRec := &subscriptionDB{}
-		query := scope.Where(&subscriptionDB{UUID: resourceID.String()}).First(dbRec)
+		query := scope.Where("tenant = ?", h.tenant).Where(&subscriptionDB{UUID: resourceID.String()}).First(dbRec)
 		if query.RecordNotFound() {
-			rw.WriteHeader(http.StatusNotFound)
-			return
+			return errNotFound("resource not found")
 		} else if err := query.Error; err != nil {
-			h.log.WithError(err).Panic("failed to query database")
+			return errInternal(err, "failed to query database")
 		}
 		oldSub := &models.Subscription{}
 		if err := json.Unmarshal(dbRec.Data, oldSub); err != nil {
-			h.log.WithError(err).Panic("failed to unmarshal data")
+			return errInternal(err, "failed to unmarshal data")
 		}
 
 		now := time.Now().UTC()
@@ -149,7 +144,7 @@ func (h *Subscription) Update() http.Handler {
 		}
 		jsonBytes, err := json.Marshal(newSub)
 		if err != nil {
-			h.log.WithError(err).Panic("failed to marshal object as JSON")
+			return errInternal(err, "failed to marshal object as JSON")
 		}
 
 		dbRec.UpdatedAt = now
@@ -158,26 +153,27 @@ func (h *Subscription) Update() http.Handler {
 		dbRec.Active = false
 
 		if err := scope.Save(dbRec).Error; err != nil {
-			h.log.WithError(err).Panic("failed to update record in database")
+			return errInternal(err, "failed to update record in database")
 		}
+		h.engine.Wake()
 
-		resourceRead(h.renderer, rw, req, status, "", dbRec.UpdatedAt, newSub, false)
+		return resourceRead(h.renderer, rw, req, status, "", dbRec.UpdatedAt, newSub, false)
 	})
 }
 
 // Delete ...
 func (h *Subscription) Delete() http.Handler {
-	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
 		vars := mux.Vars(req)
 		uuid := vars["resourceID"]
 		if uuid == "" {
-			rw.WriteHeader(http.StatusBadRequest) // TODO: More verbose errors?
-			return
+			return errBadRequest(nil, "no resource ID was provided")
 		}
-		if err := h.db.Where(&subscriptionDB{UUID: uuid}).Delete(subscriptionDB{}).Error; err != nil {
-			h.log.WithError(err).Panic("failed to delete record")
+		if err := h.db.Where("tenant = ?", h.tenant).Where(&subscriptionDB{UUID: uuid}).Delete(subscriptionDB{}).Error; err != nil {
+			return errInternal(err, "failed to delete record")
 		}
 		rw.WriteHeader(http.StatusNoContent)
+		return nil
 	})
 }
 
@@ -214,8 +210,10 @@ func NewSubscription(registry *Registry) (*Subscription, error) {
 	return &Subscription{
 		config:        config,
 		db:            registry.db,
+		engine:        registry.engine,
 		jsonValidator: v,
 		log:           registry.log,
 		renderer:      registry.renderer,
+		tenant:        registry.appConfig.Tenant,
 	}, nil
 }
@@ -0,0 +1,80 @@
+package resources
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/pkg/errors"
+	"github.com/unrolled/render"
+	"go.uber.org/fx"
+)
+
+// defaultTenantHeader is the header that selects the tenant of requests sent to the FHIR base URL of the server
+const defaultTenantHeader = "X-Tenant-ID"
+
+// Tenant is an organization served by a multi-tenant server, with its own contracts and signer
+type Tenant struct {
+	Capability *CapabilityConfig
+	Name       string
+	Registry   *Registry
+}
+
+// Tenants holds the tenants served in addition to the top level organization
+// each tenant is served under /fhir/{tenant}, and under /fhir when requests name it in the tenant header
+type Tenants struct {
+	Header  string
+	Tenants []*Tenant
+}
+
+// NewTenants creates the registry of each configured tenant, sharing the connections of the top level registry
+func NewTenants(lc fx.Lifecycle, log *logging.Logger, appConfig *config.Config, registry *Registry) (*Tenants, error) {
+	tenants := &Tenants{
+		Header:  appConfig.TenantHeader,
+		Tenants: []*Tenant{},
+	}
+	if tenants.Header == "" {
+		tenants.Header = defaultTenantHeader
+	}
+	for _, t := range appConfig.Tenants {
+		tenantConfig := appConfig.ForTenant(t)
+		account, err := signer.NewAccount(tenantConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read signer of tenant %q", t.Name)
+		}
+		opts, err := ethereum.NewTransactOpts(lc, log, tenantConfig, account)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create signer of tenant %q", t.Name)
+		}
+		transactions, err := ethereum.NewTransactionManager(log, tenantConfig, registry.connection, opts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create transaction manager of tenant %q", t.Name)
+		}
+		keyring, err := envelope.NewKeyring(log, tenantConfig, account)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create keyring of tenant %q", t.Name)
+		}
+		tenantRegistry, err := registry.forTenant(tenantConfig, transactions, keyring)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to create registry of tenant %q", t.Name)
+		}
+		tenants.Tenants = append(tenants.Tenants, &Tenant{
+			Capability: NewCapabilityConfig(tenantRegistry),
+			Name:       t.Name,
+			Registry:   tenantRegistry,
+		})
+		log.WithField("tenant", t.Name).Info("serving tenant")
+	}
+	return tenants, nil
+}
+
+// UnknownTenant responds to requests whose tenant header names no tenant
+func (t *Tenants) UnknownTenant(rndr *render.Render) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		renderError(rndr, rw, errNotFound(fmt.Sprintf("unknown tenant %q", req.Header.Get(t.Header))))
+	})
+}
@@ -0,0 +1,158 @@
+package resources
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/unrolled/render"
+)
+
+// preferAsync reports whether the client asked for the request to be processed asynchronously
+func preferAsync(req *http.Request) bool {
+	for _, h := range req.Header["Prefer"] {
+		for _, p := range strings.Split(h, ",") {
+			if strings.TrimSpace(p) == "respond-async" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getTransactionStatusURL returns the URL at which the outcome of a transaction is reported
+func getTransactionStatusURL(req *http.Request, txn storage.Write) string {
+	return fmt.Sprintf("%s/_async/%s", getFHIRBaseURL(req), txn.ID())
+}
+
+// respondAccepted tells the client where to find the outcome of a transaction that has not been mined yet
+func respondAccepted(rndr *render.Render, rw http.ResponseWriter, req *http.Request, txn storage.Write) {
+	rw.Header().Set("Content-Location", getTransactionStatusURL(req, txn))
+	rndr.JSON(rw, http.StatusAccepted, &models.OperationOutcome{
+		Issue: []*models.OperationOutcomeIssue{
+			{
+				Severity:    models.OperationOutcomeIssueSeverityInformation,
+				Code:        models.OperationOutcomeIssueCodeInformational,
+				Diagnostics: fmt.Sprintf("transaction %s has been submitted", txn.ID()),
+			},
+		},
+	})
+}
+
+// awaitTransaction completes a write according to the client preference and server configuration
+// it returns true when a response has been written, in which case the caller must not write its own
+func (h *EthereumResource) awaitTransaction(rw http.ResponseWriter, req *http.Request, txn storage.Write) (bool, error) {
+	if txn == nil {
+		// the store has already applied the change
+		return false, nil
+	}
+	if preferAsync(req) {
+		respondAccepted(h.renderer, rw, req, txn)
+		return true, nil
+	}
+	if h.txnWait <= 0 {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), h.txnWait)
+	defer cancel()
+	err := txn.Wait(ctx)
+	switch {
+	case err == nil:
+		return false, nil
+	case errors.Cause(err) == storage.ErrWriteFailed:
+		return false, errConflict(err, fmt.Sprintf("transaction %s failed", txn.ID()))
+	}
+	// still pending, so the client has to poll for the outcome
+	respondAccepted(h.renderer, rw, req, txn)
+	return true, nil
+}
+
+// TransactionStatus reports the outcome of submitted transactions
+// when authorization is enabled, a transaction is only reported to the client that sent it, whose token must still
+// grant access to the resources of its type
+type TransactionStatus struct {
+	db       *database.DB
+	log      *logging.Logger
+	renderer *render.Render
+	tenant   string
+}
+
+// Read ...
+func (h *TransactionStatus) Read() http.Handler {
+	return handleOperation(h, func(rw http.ResponseWriter, req *http.Request) error {
+		hash := mux.Vars(req)["txnHash"]
+		rec := &ethereum.TransactionRecord{}
+		query := h.db.Where("tenant = ?", h.tenant).Where(&ethereum.TransactionRecord{Hash: hash})
+		token := auth.FromContext(req.Context())
+		if token != nil {
+			query = query.Where("owner = ?", token.ClientID)
+		}
+		query = query.First(rec)
+		if query.RecordNotFound() {
+			return errNotFound(fmt.Sprintf("transaction %q not found", hash))
+		} else if err := query.Error; err != nil {
+			return errInternal(err, "failed to query database")
+		}
+		if token != nil && !token.Scopes.Allows(rec.ResourceType, auth.Read) && !token.Scopes.Allows(rec.ResourceType, auth.Write) {
+			return NewOperationError(http.StatusForbidden, models.OperationOutcomeIssueCodeForbidden, nil,
+				fmt.Sprintf("the token does not grant access to %s resources", rec.ResourceType))
+		}
+
+		params := &models.Parameters{
+			Parameter: []*models.ParametersParameter{
+				{Name: "hash", ValueString: rec.Hash},
+				{Name: "status", ValueCode: string(rec.Status)},
+				{Name: "operation", ValueCode: string(rec.Operation)},
+				{Name: "resource", ValueString: fmt.Sprintf("%s/%s", rec.ResourceType, rec.ResourceID)},
+			},
+		}
+		if rec.BlockNumber > 0 {
+			params.Parameter = append(params.Parameter, &models.ParametersParameter{Name: "blockNumber", ValueUnsignedInt: rec.BlockNumber})
+		}
+		if rec.GasUsed > 0 {
+			params.Parameter = append(params.Parameter, &models.ParametersParameter{Name: "gasUsed", ValueUnsignedInt: rec.GasUsed})
+		}
+		if rec.Error != "" {
+			params.Parameter = append(params.Parameter, &models.ParametersParameter{Name: "error", ValueString: rec.Error})
+		}
+
+		status := http.StatusOK
+		if rec.Status == ethereum.TransactionPending || rec.Status == ethereum.TransactionUnknown {
+			status = http.StatusAccepted
+			rw.Header().Set("X-Progress", string(rec.Status))
+		}
+		h.renderer.JSON(rw, status, params)
+		return nil
+	})
+}
+
+func (h *TransactionStatus) getJSONValidator() *models.JSONValidator {
+	return nil
+}
+
+func (h *TransactionStatus) getLogger() *logging.Logger {
+	return h.log
+}
+
+func (h *TransactionStatus) getRenderer() *render.Render {
+	return h.renderer
+}
+
+// NewTransactionStatus ...
+func NewTransactionStatus(registry *Registry) *TransactionStatus {
+	return &TransactionStatus{
+		db:       registry.db,
+		log:      registry.log,
+		renderer: registry.renderer,
+		tenant:   registry.appConfig.Tenant,
+	}
+}
@@ -0,0 +1,116 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+// searchLink returns the URL of a link of a searchset Bundle
+func searchLink(body map[string]interface{}, relation string) string {
+	links, _ := body["link"].([]interface{})
+	for _, l := range links {
+		link := l.(map[string]interface{})
+		if link["relation"] == relation {
+			return link["url"].(string)
+		}
+	}
+	return ""
+}
+
+func expectSearchResults(t *testing.T, step string, res *http.Response, body map[string]interface{}, total int, entries int) {
+	expectStatus(t, step, res, body, http.StatusOK)
+	found, _ := body["entry"].([]interface{})
+	// a total of zero is omitted
+	got, _ := body["total"].(float64)
+	if got != float64(total) || len(found) != entries {
+		t.Fatalf("%s: expected %d of %d results, got %d of %v", step, entries, total, len(found), got)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-search-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	router := mux.NewRouter()
+	handlers.RegisterAllFHIRResourceRoutes(router.PathPrefix("/fhir").Subrouter(), logging.NewLogger(), render.New(), registry)
+	server := httptest.NewServer(router)
+	defer server.Close()
+	baseURL := server.URL + "/fhir/"
+
+	practitionerIDs := []string{}
+	for i := 0; i < 3; i++ {
+		practitioner := loadFixture(t, "practitioner.example.json")
+		delete(practitioner, "id")
+		res, body := doRequest(t, "POST", baseURL+"Practitioner", nil, practitioner)
+		expectStatus(t, "create practitioner", res, body, http.StatusCreated)
+		practitionerIDs = append(practitionerIDs, body["id"].(string))
+	}
+	role := loadFixture(t, "practitionerrole-validate.example.json")
+	delete(role, "id")
+	role["practitioner"] = map[string]interface{}{"reference": "Practitioner/" + practitionerIDs[0]}
+	res, body := doRequest(t, "POST", baseURL+"PractitionerRole", nil, role)
+	expectStatus(t, "create practitioner role", res, body, http.StatusCreated)
+
+	res, body = doRequest(t, "GET", baseURL+"Practitioner", nil, nil)
+	expectSearchResults(t, "search without criteria", res, body, 3, 3)
+	res, body = doRequest(t, "GET", baseURL+"Practitioner?_lastUpdated=ge2000-01-01", nil, nil)
+	expectSearchResults(t, "search by _lastUpdated only", res, body, 3, 3)
+	res, body = doRequest(t, "GET", baseURL+"Practitioner?_lastUpdated=lt2000-01-01", nil, nil)
+	expectSearchResults(t, "search by _lastUpdated before the resources", res, body, 0, 0)
+
+	res, body = doRequest(t, "GET", baseURL+"Practitioner?_count=2", nil, nil)
+	expectSearchResults(t, "first page", res, body, 3, 2)
+	first := body["entry"].([]interface{})
+	next := searchLink(body, "next")
+	if next == "" || searchLink(body, "previous") != "" {
+		t.Fatalf("first page: expected a next link only, got %v", body["link"])
+	}
+	res, body = doRequest(t, "GET", next, nil, nil)
+	expectSearchResults(t, "second page", res, body, 3, 1)
+	if searchLink(body, "next") != "" || searchLink(body, "previous") == "" {
+		t.Fatalf("second page: expected a previous link only, got %v", body["link"])
+	}
+	last := body["entry"].([]interface{})[0].(map[string]interface{})["fullUrl"]
+	for _, e := range first {
+		if e.(map[string]interface{})["fullUrl"] == last {
+			t.Fatalf("expected the pages not to overlap, got %v on both", last)
+		}
+	}
+	res, body = doRequest(t, "GET", baseURL+"Practitioner?_count=x", nil, nil)
+	expectStatus(t, "invalid _count", res, body, http.StatusBadRequest)
+
+	for _, value := range []string{
+		practitionerIDs[0],
+		"Practitioner/" + practitionerIDs[0],
+		server.URL + "/fhir/Practitioner/" + practitionerIDs[0],
+	} {
+		res, body = doRequest(t, "GET", baseURL+"PractitionerRole?practitioner="+url.QueryEscape(value), nil, nil)
+		expectSearchResults(t, "search by reference "+value, res, body, 1, 1)
+	}
+	res, body = doRequest(t, "GET", baseURL+"PractitionerRole?practitioner="+practitionerIDs[1], nil, nil)
+	expectSearchResults(t, "search by another reference", res, body, 0, 0)
+
+	res, body = doRequest(t, "GET", baseURL+"Practitioner?_id="+strings.Join(practitionerIDs[1:], ","), nil, nil)
+	expectSearchResults(t, "search by _id", res, body, 2, 2)
+
+	// the IDs of removed resources are left out of the results
+	res, body = doRequest(t, "DELETE", baseURL+"Practitioner/"+practitionerIDs[2], nil, nil)
+	expectStatus(t, "delete practitioner", res, body, http.StatusNoContent)
+	res, body = doRequest(t, "GET", baseURL+"Practitioner?_id="+strings.Join(practitionerIDs[1:], ","), nil, nil)
+	expectSearchResults(t, "search by _id of a removed resource", res, body, 1, 1)
+}
@@ -0,0 +1,85 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers/resources"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/gorilla/mux"
+	"github.com/unrolled/render"
+)
+
+func TestTenantRouting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-tenants-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, tenants, stop := newSQLTenants(t, dir, "alpha", "beta")
+	defer stop()
+
+	log := logging.NewLogger()
+	rndr := render.New()
+	router := mux.NewRouter()
+	handlers.RegisterFHIRTenantRoutes(router, log, rndr, tenants, func(r *mux.Router, tenant *resources.Tenant) {
+		handlers.RegisterAllFHIRResourceRoutes(r, log, rndr, tenant.Registry)
+	})
+	handlers.RegisterAllFHIRResourceRoutes(router.PathPrefix("/fhir").Subrouter(), log, rndr, registry)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	tenantHeader := func(name string) http.Header {
+		return http.Header{"X-Tenant-ID": []string{name}}
+	}
+	practitioner := loadFixture(t, "practitioner.example.json")
+	npi := practitioner["identifier"].([]interface{})[0].(map[string]interface{})["value"].(string)
+
+	// a resource created under the path of a tenant
+	res, body := doRequest(t, http.MethodPost, server.URL+"/fhir/alpha/Practitioner", nil, practitioner)
+	expectStatus(t, "create in tenant path", res, body, http.StatusCreated)
+	pathID := body["id"].(string)
+	if location := res.Header.Get("Location"); !strings.Contains(location, "/fhir/alpha/Practitioner/"+pathID) {
+		t.Fatalf("expected the location to be under the base URL of the tenant, got %q", location)
+	}
+	// a resource created under the base URL, naming the tenant in the header
+	res, body = doRequest(t, http.MethodPost, server.URL+"/fhir/Practitioner", tenantHeader("alpha"), practitioner)
+	expectStatus(t, "create with tenant header", res, body, http.StatusCreated)
+	headerID := body["id"].(string)
+
+	for _, id := range []string{pathID, headerID} {
+		res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/alpha/Practitioner/"+id, nil, nil)
+		expectStatus(t, "read in tenant path", res, body, http.StatusOK)
+		res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/Practitioner/"+id, tenantHeader("alpha"), nil)
+		expectStatus(t, "read with tenant header", res, body, http.StatusOK)
+
+		// the resources of a tenant are not served to the other tenant, nor to the top level organization
+		res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/beta/Practitioner/"+id, nil, nil)
+		expectStatus(t, "read in path of another tenant", res, body, http.StatusNotFound)
+		res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/Practitioner/"+id, tenantHeader("beta"), nil)
+		expectStatus(t, "read with header of another tenant", res, body, http.StatusNotFound)
+		res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/Practitioner/"+id, nil, nil)
+		expectStatus(t, "read without tenant", res, body, http.StatusNotFound)
+		res, body = doRequest(t, http.MethodDelete, server.URL+"/fhir/beta/Practitioner/"+id, nil, nil)
+		if res.StatusCode != http.StatusNotFound && res.StatusCode != http.StatusNoContent {
+			t.Fatalf("delete in path of another tenant: unexpected status %d: %v", res.StatusCode, body)
+		}
+	}
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/alpha/Practitioner/"+pathID, nil, nil)
+	expectStatus(t, "read after delete by another tenant", res, body, http.StatusOK)
+
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/alpha/Practitioner?identifier="+npi, nil, nil)
+	expectSearchResults(t, "search in tenant", res, body, 2, 2)
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/beta/Practitioner?identifier="+npi, nil, nil)
+	expectSearchResults(t, "search in another tenant", res, body, 0, 0)
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/Practitioner?identifier="+npi, nil, nil)
+	expectSearchResults(t, "search without tenant", res, body, 0, 0)
+
+	res, body = doRequest(t, http.MethodGet, server.URL+"/fhir/Practitioner/"+pathID, tenantHeader("gamma"), nil)
+	expectStatus(t, "unknown tenant header", res, body, http.StatusNotFound)
+}
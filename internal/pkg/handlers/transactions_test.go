@@ -0,0 +1,125 @@
+package handlers_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/handlers"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/gorilla/mux"
+)
+
+// parameterValues returns the values of a Parameters resource by name
+func parameterValues(body map[string]interface{}) map[string]interface{} {
+	values := map[string]interface{}{}
+	params, _ := body["parameter"].([]interface{})
+	for _, p := range params {
+		param := p.(map[string]interface{})
+		for k, v := range param {
+			if k != "name" {
+				values[param["name"].(string)] = v
+			}
+		}
+	}
+	return values
+}
+
+func TestTransactionStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-transactions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	registry, stop := newSQLRegistry(t, dir)
+	defer stop()
+
+	log := logging.NewLogger()
+	db, err := database.NewConnection(log, &config.Config{
+		DatabaseType:             "sqlite3",
+		DatabaseConnectionString: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+	if err := db.AutoMigrate(&ethereum.TransactionRecord{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	records := []*ethereum.TransactionRecord{
+		{Hash: "0x01", Status: ethereum.TransactionPending},
+		{Hash: "0x02", Status: ethereum.TransactionUnknown, Error: "transaction was not mined in time"},
+		{Hash: "0x03", Status: ethereum.TransactionSucceeded, BlockNumber: 7, GasUsed: 21000},
+		{Hash: "0x04", Status: ethereum.TransactionFailed, BlockNumber: 8, Error: "transaction was reverted"},
+		{Hash: "0x05", Status: ethereum.TransactionSucceeded, Owner: "payer"},
+		{Hash: "0x06", Status: ethereum.TransactionSucceeded, Tenant: "beta"},
+	}
+	for _, rec := range records {
+		rec.CreatedAt, rec.UpdatedAt = now, now
+		rec.ResourceType, rec.ResourceID, rec.Operation = "Practitioner", "p1", ethereum.OperationCreate
+		if err := db.Create(rec).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router := mux.NewRouter()
+	handlers.RegisterFHIRTransactionStatusRoutes(router.PathPrefix("/fhir").Subrouter(), log, registry)
+	// requests with a client header carry a token, as if the authorizer had validated one
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if client := req.Header.Get("X-Test-Client"); client != "" {
+			token := &auth.Token{ClientID: client, Scopes: auth.ParseScopes(req.Header.Get("X-Test-Scopes"))}
+			req = req.WithContext(auth.WithToken(req.Context(), token))
+		}
+		router.ServeHTTP(rw, req)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		hash        string
+		status      int
+		blockNumber interface{}
+	}{
+		{"0x01", http.StatusAccepted, nil},
+		{"0x02", http.StatusAccepted, nil},
+		{"0x03", http.StatusOK, float64(7)},
+		{"0x04", http.StatusOK, float64(8)},
+	}
+	for i, tt := range tests {
+		res, body := doRequest(t, "GET", server.URL+"/fhir/_async/"+tt.hash, nil, nil)
+		expectStatus(t, "status of "+tt.hash, res, body, tt.status)
+		values := parameterValues(body)
+		if values["status"] != string(records[i].Status) {
+			t.Fatalf("status of %s: expected %q, got %v", tt.hash, records[i].Status, values["status"])
+		}
+		if values["blockNumber"] != tt.blockNumber {
+			t.Fatalf("status of %s: expected block %v, got %v", tt.hash, tt.blockNumber, values["blockNumber"])
+		}
+		if progress := res.Header.Get("X-Progress"); (tt.status == http.StatusAccepted) != (progress != "") {
+			t.Fatalf("status of %s: unexpected progress %q", tt.hash, progress)
+		}
+	}
+	res, body := doRequest(t, "GET", server.URL+"/fhir/_async/0x07", nil, nil)
+	expectStatus(t, "status of a missing transaction", res, body, http.StatusNotFound)
+	res, body = doRequest(t, "GET", server.URL+"/fhir/_async/0x06", nil, nil)
+	expectStatus(t, "status of a transaction of another organization", res, body, http.StatusNotFound)
+
+	client := func(scopes string) http.Header {
+		return http.Header{"X-Test-Client": []string{"payer"}, "X-Test-Scopes": []string{scopes}}
+	}
+	res, body = doRequest(t, "GET", server.URL+"/fhir/_async/0x05", client("system/Practitioner.write"), nil)
+	expectStatus(t, "status of a transaction of the client", res, body, http.StatusOK)
+	res, body = doRequest(t, "GET", server.URL+"/fhir/_async/0x03", client("system/Practitioner.write"), nil)
+	expectStatus(t, "status of a transaction of another client", res, body, http.StatusNotFound)
+	res, body = doRequest(t, "GET", server.URL+"/fhir/_async/0x05", client("system/Location.read"), nil)
+	expectStatus(t, "status of a transaction without scope", res, body, http.StatusForbidden)
+}
@@ -0,0 +1,156 @@
+package signer
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/pkg/errors"
+)
+
+// defaultTimeout leaves time for an operator to approve a transaction in the signer
+const defaultTimeout = time.Minute
+
+// sendTxArgs are the parameters of account_signTransaction
+type sendTxArgs struct {
+	From     string          `json:"from"`
+	To       *common.Address `json:"to"`
+	Gas      hexutil.Uint64  `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Value    *hexutil.Big    `json:"value"`
+	Nonce    hexutil.Uint64  `json:"nonce"`
+	Data     hexutil.Bytes   `json:"data"`
+}
+
+// signTxResult is the result of account_signTransaction
+type signTxResult struct {
+	Raw hexutil.Bytes `json:"raw"`
+}
+
+// External signs transactions with an account held by a Clef compatible signer
+type External struct {
+	address common.Address
+	chainID *big.Int
+	client  *rpc.Client
+	timeout time.Duration
+}
+
+// Address returns the account that signs transactions
+func (e *External) Address() common.Address {
+	return e.address
+}
+
+// SignTx asks the signer to sign a transaction
+// the signed transaction must be the requested one, bound to the chain and signed by the configured account
+func (e *External) SignTx(ctx context.Context, txn *types.Transaction) (*types.Transaction, error) {
+	args := &sendTxArgs{
+		From:     e.address.Hex(),
+		To:       txn.To(),
+		Gas:      hexutil.Uint64(txn.Gas()),
+		GasPrice: (*hexutil.Big)(txn.GasPrice()),
+		Value:    (*hexutil.Big)(txn.Value()),
+		Nonce:    hexutil.Uint64(txn.Nonce()),
+		Data:     hexutil.Bytes(txn.Data()),
+	}
+	result := &signTxResult{}
+	if err := e.client.CallContext(ctx, result, "account_signTransaction", args); err != nil {
+		return nil, errors.Wrap(err, "external signer failed to sign transaction")
+	}
+	signed := &types.Transaction{}
+	if err := rlp.DecodeBytes(result.Raw, signed); err != nil {
+		return nil, errors.Wrap(err, "failed to decode transaction signed by external signer")
+	}
+	if !sameTransaction(signed, txn) {
+		return nil, errors.New("external signer returned a different transaction")
+	}
+	if !signed.Protected() || signed.ChainId().Cmp(e.chainID) != 0 {
+		return nil, errors.Errorf("external signer did not sign the transaction for chain %v", e.chainID)
+	}
+	sender, err := types.Sender(types.NewEIP155Signer(e.chainID), signed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to recover the sender of the transaction signed by external signer")
+	}
+	if sender != e.address {
+		return nil, errors.Errorf("external signer signed the transaction with %s instead of %s", sender.Hex(), e.address.Hex())
+	}
+	return signed, nil
+}
+
+// sameTransaction returns whether a signed transaction has the fields of the requested one
+func sameTransaction(signed *types.Transaction, txn *types.Transaction) bool {
+	if (signed.To() == nil) != (txn.To() == nil) || (txn.To() != nil && *signed.To() != *txn.To()) {
+		return false
+	}
+	return signed.Nonce() == txn.Nonce() &&
+		signed.Gas() == txn.Gas() &&
+		signed.GasPrice().Cmp(txn.GasPrice()) == 0 &&
+		signed.Value().Cmp(txn.Value()) == 0 &&
+		bytes.Equal(signed.Data(), txn.Data())
+}
+
+// SignerFn returns a bind.SignerFn that signs with the external signer
+func (e *External) SignerFn() bind.SignerFn {
+	return func(signer types.Signer, address common.Address, txn *types.Transaction) (*types.Transaction, error) {
+		if address != e.address {
+			return nil, errors.Errorf("external signer is not configured to sign for %s", address.Hex())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+		defer cancel()
+		return e.SignTx(ctx, txn)
+	}
+}
+
+// Close ...
+func (e *External) Close() {
+	e.client.Close()
+}
+
+// NewExternal connects to an external signer at an HTTP or IPC endpoint, which signs transactions for chainID
+// when no address is configured, the signer must have a single account
+func NewExternal(ctx context.Context, c *config.SignerConfig, chainID int64) (*External, error) {
+	if c.URL == "" {
+		return nil, errors.New("the external signer requires a url")
+	}
+	if chainID <= 0 {
+		return nil, errors.New("the external signer requires the chain_id of the network")
+	}
+	client, err := rpc.DialContext(ctx, c.URL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to connect to external signer")
+	}
+	e := &External{
+		chainID: big.NewInt(chainID),
+		client:  client,
+		timeout: c.Timeout,
+	}
+	if e.timeout <= 0 {
+		e.timeout = defaultTimeout
+	}
+	if c.Address != "" {
+		if !common.IsHexAddress(c.Address) {
+			client.Close()
+			return nil, errors.Errorf("invalid signer address %q", c.Address)
+		}
+		e.address = common.HexToAddress(c.Address)
+		return e, nil
+	}
+	accounts := []common.Address{}
+	if err := client.CallContext(ctx, &accounts, "account_list"); err != nil {
+		client.Close()
+		return nil, errors.Wrap(err, "failed to list accounts of external signer")
+	}
+	if len(accounts) != 1 {
+		client.Close()
+		return nil, errors.Errorf("external signer has %d accounts, configure the address of the one to sign with", len(accounts))
+	}
+	e.address = accounts[0]
+	return e, nil
+}
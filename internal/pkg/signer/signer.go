@@ -0,0 +1,89 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"io/ioutil"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// TypePrivateKey signs with the hex encoded private_key, which is only accepted in dev mode
+	TypePrivateKey = "private_key"
+	// TypeKeystore signs with a key read from an encrypted go-ethereum keystore file
+	TypeKeystore = "keystore"
+	// TypeExternal sends transactions to a Clef compatible signer over JSON-RPC
+	TypeExternal = "external"
+)
+
+// Type returns the configured signer type, which defaults to private_key when a private key is configured
+func Type(config *config.Config) string {
+	if config.Signer.Type != "" {
+		return config.Signer.Type
+	}
+	if config.PrivateKey != "" {
+		return TypePrivateKey
+	}
+	return ""
+}
+
+// Account holds the key of the account of the server, which is read once so that a keystore is only decrypted once
+// Key is nil when no signer is configured, or when the key is held by an external signer
+type Account struct {
+	Key *ecdsa.PrivateKey
+}
+
+// NewAccount reads the key of the configured signer
+func NewAccount(config *config.Config) (*Account, error) {
+	key, err := PrivateKey(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{Key: key}, nil
+}
+
+// PrivateKey returns the key of the account of the server
+// nil is returned when no signer is configured, or when the key is held by an external signer
+func PrivateKey(config *config.Config) (*ecdsa.PrivateKey, error) {
+	switch t := Type(config); t {
+	case TypePrivateKey:
+		if !config.DevMode {
+			return nil, errors.New("private_key is only accepted in dev_mode, configure a keystore or external signer")
+		}
+		key, err := crypto.HexToECDSA(strings.TrimPrefix(config.PrivateKey, "0x"))
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to parse private key")
+		}
+		return key, nil
+	case TypeKeystore:
+		return readKeystore(config.Signer.Keystore, config.Signer.PassphraseFile)
+	case TypeExternal, "":
+		return nil, nil
+	default:
+		return nil, errors.Errorf("unknown signer type %q", t)
+	}
+}
+
+// readKeystore decrypts a keystore file with the passphrase on the first line of passphraseFile
+func readKeystore(path string, passphraseFile string) (*ecdsa.PrivateKey, error) {
+	if path == "" || passphraseFile == "" {
+		return nil, errors.New("the keystore signer requires a keystore and a passphrase_file")
+	}
+	keyJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read keystore")
+	}
+	passphrase, err := ioutil.ReadFile(passphraseFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read passphrase file")
+	}
+	key, err := keystore.DecryptKey(keyJSON, strings.TrimRight(strings.SplitN(string(passphrase), "\n", 2)[0], "\r"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decrypt keystore %q", path)
+	}
+	return key.PrivateKey, nil
+}
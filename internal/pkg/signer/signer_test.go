@@ -0,0 +1,218 @@
+package signer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+func TestPrivateKeyDevModeOnly(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &config.Config{PrivateKey: "0x" + hex.EncodeToString(crypto.FromECDSA(key))}
+	if _, err := PrivateKey(c); err == nil {
+		t.Fatal("expected private key to be rejected outside of dev mode")
+	}
+	c.DevMode = true
+	loaded, err := PrivateKey(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(loaded.PublicKey) != crypto.PubkeyToAddress(key.PublicKey) {
+		t.Fatal("expected the configured key")
+	}
+}
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	keyJSON, err := keystore.EncryptKey(&keystore.Key{Address: address, PrivateKey: key}, "correct horse", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keystorePath := filepath.Join(dir, "keystore.json")
+	passphrasePath := filepath.Join(dir, "passphrase")
+	if err := ioutil.WriteFile(keystorePath, keyJSON, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(passphrasePath, []byte("correct horse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &config.Config{Signer: config.SignerConfig{Type: TypeKeystore, Keystore: keystorePath, PassphraseFile: passphrasePath}}
+	loaded, err := PrivateKey(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crypto.PubkeyToAddress(loaded.PublicKey) != address {
+		t.Fatal("expected the key of the keystore")
+	}
+
+	if err := ioutil.WriteFile(passphrasePath, []byte("battery staple\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := PrivateKey(c); err == nil {
+		t.Fatal("expected a wrong passphrase to be rejected")
+	}
+}
+
+// testChainID is the chain for which the external signer signs
+const testChainID = 1337
+
+// stubSigner serves account_list and account_signTransaction for a single key
+// tamper may change the transaction and chain that are signed
+func stubSigner(t *testing.T, key *ecdsa.PrivateKey, tamper func(args *sendTxArgs, chainID *big.Int)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var call struct {
+			ID     json.RawMessage   `json:"id"`
+			Method string            `json:"method"`
+			Params []json.RawMessage `json:"params"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&call); err != nil {
+			t.Error(err)
+			return
+		}
+		var result interface{}
+		switch call.Method {
+		case "account_list":
+			result = []common.Address{crypto.PubkeyToAddress(key.PublicKey)}
+		case "account_signTransaction":
+			args := &sendTxArgs{}
+			if err := json.Unmarshal(call.Params[0], args); err != nil {
+				t.Error(err)
+				return
+			}
+			chainID := big.NewInt(testChainID)
+			if tamper != nil {
+				tamper(args, chainID)
+			}
+			raw := types.NewTransaction(uint64(args.Nonce), *args.To, args.Value.ToInt(), uint64(args.Gas), args.GasPrice.ToInt(), args.Data)
+			signed, err := types.SignTx(raw, types.NewEIP155Signer(chainID), key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			encoded, err := rlp.EncodeToBytes(signed)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			result = &signTxResult{Raw: encoded}
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]interface{}{"jsonrpc": "2.0", "id": call.ID, "result": result})
+	}))
+}
+
+func TestExternal(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	server := stubSigner(t, key, nil)
+	defer server.Close()
+
+	if _, err := NewExternal(context.Background(), &config.SignerConfig{URL: server.URL}, 0); err == nil {
+		t.Fatal("expected a missing chain id to be rejected")
+	}
+	ext, err := NewExternal(context.Background(), &config.SignerConfig{URL: server.URL}, testChainID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ext.Close()
+	if ext.Address() != address {
+		t.Fatalf("expected account %s, got %s", address.Hex(), ext.Address().Hex())
+	}
+
+	raw := types.NewTransaction(3, common.HexToAddress("0x1"), big.NewInt(1), 21000, big.NewInt(1), []byte{0x01})
+	signed, err := ext.SignerFn()(types.HomesteadSigner{}, address, raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender, err := types.Sender(types.NewEIP155Signer(big.NewInt(testChainID)), signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sender != address || signed.Nonce() != 3 {
+		t.Fatalf("expected transaction 3 signed by %s, got %d signed by %s", address.Hex(), signed.Nonce(), sender.Hex())
+	}
+
+	if _, err := ext.SignerFn()(types.HomesteadSigner{}, common.HexToAddress("0x2"), raw); err == nil {
+		t.Fatal("expected other accounts to be rejected")
+	}
+}
+
+func TestExternalRejectsOtherTransactions(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		tamper func(args *sendTxArgs, chainID *big.Int)
+	}{
+		{"recipient", key, func(args *sendTxArgs, chainID *big.Int) {
+			to := common.HexToAddress("0x2")
+			args.To = &to
+		}},
+		{"value", key, func(args *sendTxArgs, chainID *big.Int) {
+			args.Value = (*hexutil.Big)(big.NewInt(1000))
+		}},
+		{"gas price", key, func(args *sendTxArgs, chainID *big.Int) {
+			args.GasPrice = (*hexutil.Big)(big.NewInt(1000))
+		}},
+		{"nonce", key, func(args *sendTxArgs, chainID *big.Int) {
+			args.Nonce++
+		}},
+		{"chain", key, func(args *sendTxArgs, chainID *big.Int) {
+			chainID.SetInt64(1)
+		}},
+		{"sender", other, nil},
+	}
+	for _, tt := range tests {
+		server := stubSigner(t, tt.key, tt.tamper)
+		ext, err := NewExternal(context.Background(), &config.SignerConfig{URL: server.URL, Address: address.Hex()}, testChainID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := types.NewTransaction(3, common.HexToAddress("0x1"), big.NewInt(1), 21000, big.NewInt(1), []byte{0x01})
+		if _, err := ext.SignerFn()(types.HomesteadSigner{}, address, raw); err == nil {
+			t.Errorf("%s: expected a transaction that was not requested to be rejected", tt.name)
+		}
+		ext.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,361 @@
+package database
+
+import (
+	"context"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// StoreObject is the current version of an object held by a Store
+type StoreObject struct {
+	Collection string `gorm:"primary_key"`
+	ObjectID   string `gorm:"primary_key"`
+	Data       []byte
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// TableName ...
+func (StoreObject) TableName() string {
+	return "store_objects"
+}
+
+// StoreRevision is a change made to an object held by a Store
+// its ID is the version of the store that contains the change
+type StoreRevision struct {
+	ID         uint64 `gorm:"primary_key"`
+	Collection string `gorm:"index"`
+	ObjectID   string `gorm:"index"`
+	Type       storage.ChangeType
+	Data       []byte
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// TableName ...
+func (StoreRevision) TableName() string {
+	return "store_revisions"
+}
+
+// StoreIndexEntry is a value under which an index of a Store holds an object
+type StoreIndexEntry struct {
+	ID         uint   `gorm:"primary_key"`
+	Collection string `gorm:"index:idx_store_index_entries_lookup"`
+	Index      string `gorm:"index:idx_store_index_entries_lookup"`
+	Value      string `gorm:"index:idx_store_index_entries_lookup;type:text"`
+	ObjectID   string `gorm:"index"`
+}
+
+// TableName ...
+func (StoreIndexEntry) TableName() string {
+	return "store_index_entries"
+}
+
+// Store is a storage.Store that keeps objects and their revisions in the database
+// writes are applied before they return, so they never report a storage.Write
+type Store struct {
+	collection *config.ObjectCollectionContract
+	db         *DB
+}
+
+// Create ...
+func (s *Store) Create(ctx context.Context, id uuid.UUID, data []byte) (storage.Write, error) {
+	now := storeTime()
+	object := &StoreObject{
+		Collection: s.collection.StorageName(),
+		ObjectID:   id.String(),
+		Data:       data,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	return nil, s.transaction(func(tx *DB) error {
+		if err := tx.Create(object).Error; err != nil {
+			return errors.Wrap(err, "failed to save object")
+		}
+		if err := s.index(tx, object); err != nil {
+			return err
+		}
+		return s.addRevision(tx, storage.ChangeCreate, object)
+	})
+}
+
+// Read ...
+func (s *Store) Read(ctx context.Context, id uuid.UUID) (*storage.Object, error) {
+	object := &StoreObject{}
+	query := s.db.Where(&StoreObject{Collection: s.collection.StorageName(), ObjectID: id.String()}).First(object)
+	if query.RecordNotFound() {
+		return nil, storage.ErrObjectNotFound
+	} else if err := query.Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query object")
+	}
+	return &storage.Object{
+		ID:        id,
+		Data:      object.Data,
+		CreatedAt: object.CreatedAt,
+		UpdatedAt: object.UpdatedAt,
+	}, nil
+}
+
+// ReadAt returns the latest revision of an object up to a version of the store
+func (s *Store) ReadAt(ctx context.Context, id uuid.UUID, version uint64) (*storage.Object, error) {
+	rev := &StoreRevision{}
+	query := s.db.Where(&StoreRevision{Collection: s.collection.StorageName(), ObjectID: id.String()}).
+		Where("id <= ?", version).
+		Order("id desc").
+		First(rev)
+	if query.RecordNotFound() || rev.Type == storage.ChangeDelete {
+		return nil, storage.ErrObjectNotFound
+	} else if err := query.Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query revision")
+	}
+	return &storage.Object{
+		ID:        id,
+		Data:      rev.Data,
+		CreatedAt: rev.CreatedAt,
+		UpdatedAt: rev.UpdatedAt,
+	}, nil
+}
+
+// Update ...
+func (s *Store) Update(ctx context.Context, id uuid.UUID, lastUpdatedAt time.Time, data []byte) (storage.Write, error) {
+	return nil, s.transaction(func(tx *DB) error {
+		object := &StoreObject{}
+		query := tx.Where(&StoreObject{Collection: s.collection.StorageName(), ObjectID: id.String()}).First(object)
+		if query.RecordNotFound() {
+			return storage.ErrObjectNotFound
+		} else if err := query.Error; err != nil {
+			return errors.Wrap(err, "failed to query object")
+		}
+		if !object.UpdatedAt.Equal(lastUpdatedAt) {
+			return storage.ErrVersionConflict
+		}
+		now := storeTime()
+		// only replace the version that was read, in case another update was committed in the meantime
+		update := tx.Model(&StoreObject{}).
+			Where("collection = ? AND object_id = ? AND updated_at = ?", object.Collection, object.ObjectID, object.UpdatedAt).
+			Updates(map[string]interface{}{"data": data, "updated_at": now})
+		if err := update.Error; err != nil {
+			return errors.Wrap(err, "failed to update object")
+		}
+		if update.RowsAffected == 0 {
+			return storage.ErrVersionConflict
+		}
+		object.Data = data
+		object.UpdatedAt = now
+		if err := s.index(tx, object); err != nil {
+			return err
+		}
+		return s.addRevision(tx, storage.ChangeUpdate, object)
+	})
+}
+
+// Destroy ...
+func (s *Store) Destroy(ctx context.Context, id uuid.UUID) (storage.Write, error) {
+	return nil, s.transaction(func(tx *DB) error {
+		object := &StoreObject{}
+		query := tx.Where(&StoreObject{Collection: s.collection.StorageName(), ObjectID: id.String()}).First(object)
+		if query.RecordNotFound() {
+			return storage.ErrObjectNotFound
+		} else if err := query.Error; err != nil {
+			return errors.Wrap(err, "failed to query object")
+		}
+		if err := tx.Delete(object).Error; err != nil {
+			return errors.Wrap(err, "failed to delete object")
+		}
+		object.Data = nil
+		object.UpdatedAt = storeTime()
+		if err := s.index(tx, object); err != nil {
+			return err
+		}
+		return s.addRevision(tx, storage.ChangeDelete, object)
+	})
+}
+
+// CurrentVersion returns the ID of the latest revision in the database
+func (s *Store) CurrentVersion(ctx context.Context) (uint64, error) {
+	var version uint64
+	row := s.db.Model(&StoreRevision{}).Select("COALESCE(MAX(id), 0)").Row()
+	if err := row.Scan(&version); err != nil {
+		return 0, errors.Wrap(err, "failed to query current version")
+	}
+	return version, nil
+}
+
+// History ...
+func (s *Store) History(ctx context.Context, id uuid.UUID) ([]*storage.Change, error) {
+	query := s.db.Where(&StoreRevision{Collection: s.collection.StorageName()})
+	if id != nil {
+		query = query.Where(&StoreRevision{ObjectID: id.String()})
+	}
+	revs := []*StoreRevision{}
+	if err := query.Order("id").Find(&revs).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query revisions")
+	}
+	changes := make([]*storage.Change, len(revs))
+	for i, rev := range revs {
+		changes[i] = &storage.Change{
+			ID:      uuid.Parse(rev.ObjectID),
+			Type:    rev.Type,
+			Version: rev.ID,
+			Time:    rev.UpdatedAt,
+		}
+	}
+	return changes, nil
+}
+
+// Find queries the entries of an index
+func (s *Store) Find(ctx context.Context, index string, value string) ([]uuid.UUID, error) {
+	if _, err := storage.GetIndex(s.collection, index); err != nil {
+		return nil, err
+	}
+	objectIDs := []string{}
+	err := s.db.Model(&StoreIndexEntry{}).
+		Where(&StoreIndexEntry{Collection: s.collection.StorageName(), Index: index, Value: value}).
+		Order("id").
+		Pluck("object_id", &objectIDs).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query index")
+	}
+	ids := []uuid.UUID{}
+	seen := map[string]bool{}
+	for _, id := range objectIDs {
+		// a document may hold the same value more than once
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, uuid.Parse(id))
+		}
+	}
+	return ids, nil
+}
+
+// List ...
+func (s *Store) List(ctx context.Context) ([]uuid.UUID, error) {
+	objectIDs := []string{}
+	err := s.db.Model(&StoreObject{}).Where(&StoreObject{Collection: s.collection.StorageName()}).Pluck("object_id", &objectIDs).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query objects")
+	}
+	ids := make([]uuid.UUID, len(objectIDs))
+	for i, id := range objectIDs {
+		ids[i] = uuid.Parse(id)
+	}
+	return ids, nil
+}
+
+// index replaces the index entries of an object with those of its data, which is nil once it has been destroyed
+func (s *Store) index(tx *DB, object *StoreObject) error {
+	err := tx.Where(&StoreIndexEntry{Collection: object.Collection, ObjectID: object.ObjectID}).Delete(&StoreIndexEntry{}).Error
+	if err != nil {
+		return errors.Wrap(err, "failed to delete index entries")
+	}
+	if object.Data == nil {
+		return nil
+	}
+	for _, idx := range s.collection.Indexes {
+		if err := s.addIndexEntries(tx, idx, object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) addIndexEntries(tx *DB, idx *config.ObjectIndex, object *StoreObject) error {
+	values, err := storage.IndexValues(idx, object.Data)
+	if err != nil {
+		return errors.Wrapf(err, "failed to index object %s", object.ObjectID)
+	}
+	for _, value := range values {
+		entry := &StoreIndexEntry{
+			Collection: object.Collection,
+			Index:      idx.Name,
+			Value:      value,
+			ObjectID:   object.ObjectID,
+		}
+		if err := tx.Create(entry).Error; err != nil {
+			return errors.Wrap(err, "failed to save index entry")
+		}
+	}
+	return nil
+}
+
+// reindex fills the entries of the indexes that have none, such as indexes added to the configuration after objects
+// were stored
+func (s *Store) reindex() error {
+	for _, idx := range s.collection.Indexes {
+		count := 0
+		err := s.db.Model(&StoreIndexEntry{}).Where(&StoreIndexEntry{Collection: s.collection.StorageName(), Index: idx.Name}).Count(&count).Error
+		if err != nil {
+			return errors.Wrap(err, "failed to count index entries")
+		}
+		if count > 0 {
+			continue
+		}
+		objects := []*StoreObject{}
+		if err := s.db.Where(&StoreObject{Collection: s.collection.StorageName()}).Find(&objects).Error; err != nil {
+			return errors.Wrap(err, "failed to query objects")
+		}
+		if len(objects) == 0 {
+			continue
+		}
+		if err := s.transaction(func(tx *DB) error {
+			for _, object := range objects {
+				if err := s.addIndexEntries(tx, idx, object); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return errors.Wrapf(err, "failed to fill index %q", idx.Name)
+		}
+	}
+	return nil
+}
+
+func (s *Store) addRevision(tx *DB, changeType storage.ChangeType, object *StoreObject) error {
+	rev := &StoreRevision{
+		Collection: object.Collection,
+		ObjectID:   object.ObjectID,
+		Type:       changeType,
+		Data:       object.Data,
+		CreatedAt:  object.CreatedAt,
+		UpdatedAt:  object.UpdatedAt,
+	}
+	return errors.Wrap(tx.Create(rev).Error, "failed to save revision")
+}
+
+// transaction runs fn in a database transaction, which is committed if fn succeeds
+func (s *Store) transaction(fn func(tx *DB) error) error {
+	tx := s.db.Begin()
+	if err := tx.Error; err != nil {
+		return errors.Wrap(err, "failed to begin transaction")
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return errors.Wrap(tx.Commit().Error, "failed to commit transaction")
+}
+
+// storeTime returns the current time at the precision kept by every supported database
+func storeTime() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// NewStore creates a store for a collection, creating its tables if needed
+func NewStore(db *DB, collection *config.ObjectCollectionContract) (*Store, error) {
+	if err := db.AutoMigrate(&StoreObject{}, &StoreRevision{}, &StoreIndexEntry{}).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to migrate store tables")
+	}
+	s := &Store{
+		collection: collection,
+		db:         db,
+	}
+	if err := s.reindex(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,94 @@
+package database_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/oliveagle/jsonpath"
+	"github.com/pborman/uuid"
+)
+
+func TestStoreFind(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-store-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := database.NewConnection(logging.NewLogger(), &config.Config{
+		DatabaseType:             "sqlite3",
+		DatabaseConnectionString: filepath.Join(dir, "test.db"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+
+	npi := &config.ObjectIndex{Name: "Global NPI", JSONPath: jsonpath.MustCompile("$.identifier.value")}
+	collection := &config.ObjectCollectionContract{Name: "Practitioner", Indexes: []*config.ObjectIndex{npi}}
+	store, err := database.NewStore(db, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	expectFound := func(name string, s *database.Store, index string, value string, expected ...uuid.UUID) {
+		ids, err := s.Find(ctx, index, value)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(ids) != len(expected) {
+			t.Fatalf("%s: expected %v, got %v", name, expected, ids)
+		}
+		for i := range ids {
+			if !uuid.Equal(ids[i], expected[i]) {
+				t.Fatalf("%s: expected %v, got %v", name, expected, ids)
+			}
+		}
+	}
+
+	first, second := uuid.NewRandom(), uuid.NewRandom()
+	if _, err := store.Create(ctx, first, []byte(`{"identifier": [{"value": "1"}, {"value": "2"}, {"value": "1"}], "active": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(ctx, second, []byte(`{"identifier": [{"value": "2"}], "active": false}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectFound("value of one object", store, npi.Name, "1", first)
+	expectFound("value of both objects", store, npi.Name, "2", first, second)
+	expectFound("missing value", store, npi.Name, "3")
+	if _, err := store.Find(ctx, "Unknown", "1"); err == nil {
+		t.Fatal("expected an unknown index to be rejected")
+	}
+
+	object, err := store.Read(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Update(ctx, first, object.UpdatedAt, []byte(`{"identifier": [{"value": "3"}], "active": true}`)); err != nil {
+		t.Fatal(err)
+	}
+	expectFound("replaced value", store, npi.Name, "1")
+	expectFound("value kept by another object", store, npi.Name, "2", second)
+	expectFound("new value", store, npi.Name, "3", first)
+
+	if _, err := store.Destroy(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+	expectFound("value of a destroyed object", store, npi.Name, "2")
+
+	// an index added to the configuration is filled from the stored objects
+	active := &config.ObjectIndex{Name: "Active", JSONPath: jsonpath.MustCompile("$.active")}
+	collection.Indexes = append(collection.Indexes, active)
+	reopened, err := database.NewStore(db, collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectFound("added index", reopened, active.Name, "true", first)
+	expectFound("existing index", reopened, npi.Name, "3", first)
+}
@@ -0,0 +1,269 @@
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/crypto/ecies"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MediaType identifies payloads that are envelopes
+	MediaType = "application/vnd.fhir-api.envelope+json"
+
+	envelopeVersion = 1
+	algorithmAESGCM = "A256GCM"
+	dataKeySize     = 32
+	gcmNonceSize    = 12
+
+	// KeyTypeAES marks data keys wrapped with an organization key using AES-GCM
+	KeyTypeAES = "aes-gcm"
+	// KeyTypeECIES marks data keys encrypted to the public key of an Ethereum account
+	KeyTypeECIES = "ecies-secp256k1"
+)
+
+// ErrNotRecipient is returned when an envelope has no data key that can be unwrapped with the keys of the keyring
+var ErrNotRecipient = storage.ErrForbidden
+
+// Envelope is a payload encrypted with a random data key, which is wrapped for each reader
+type Envelope struct {
+	Version    int           `json:"version"`
+	Algorithm  string        `json:"alg"`
+	Nonce      []byte        `json:"nonce"`
+	Ciphertext []byte        `json:"ciphertext"`
+	Keys       []*WrappedKey `json:"keys"`
+}
+
+// WrappedKey is the data key of an envelope, encrypted for one reader
+type WrappedKey struct {
+	Type string `json:"type"`
+	// ID is the ID of an organization key, or the address of the account of a recipient
+	ID  string `json:"kid"`
+	Key []byte `json:"key"`
+}
+
+// organizationKey is a symmetric key shared by the members of an organization
+type organizationKey struct {
+	id  string
+	key []byte
+}
+
+// Keyring holds the keys used to seal and open envelopes
+// the first organization key wraps the data keys of new envelopes, the others are only used to open envelopes sealed
+// before a key rotation; envelopes are also sealed for every recipient, and opened with the key of the account
+type Keyring struct {
+	account    *ecdsa.PrivateKey
+	keys       []*organizationKey
+	log        logging.FieldLogger
+	recipients []*ecdsa.PublicKey
+}
+
+// Enabled reports whether payloads are sealed before they are stored
+func (k *Keyring) Enabled() bool {
+	return k != nil && (len(k.keys) > 0 || len(k.recipients) > 0)
+}
+
+// Seal encrypts a payload and returns the envelope
+func (k *Keyring) Seal(plaintext []byte) ([]byte, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, errors.Wrap(err, "failed to generate data key")
+	}
+	nonce, ciphertext, err := encryptGCM(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	e := &Envelope{
+		Version:    envelopeVersion,
+		Algorithm:  algorithmAESGCM,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+		Keys:       []*WrappedKey{},
+	}
+	if len(k.keys) > 0 {
+		active := k.keys[0]
+		wrapNonce, wrapped, err := encryptGCM(active.key, dataKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to wrap data key")
+		}
+		e.Keys = append(e.Keys, &WrappedKey{Type: KeyTypeAES, ID: active.id, Key: append(wrapNonce, wrapped...)})
+	}
+	recipients := k.recipients
+	if len(recipients) > 0 && k.account != nil {
+		// the account that writes the payload must be able to read it back
+		recipients = append([]*ecdsa.PublicKey{&k.account.PublicKey}, recipients...)
+	}
+	for _, pub := range recipients {
+		wrapped, err := ecies.Encrypt(rand.Reader, ecies.ImportECDSAPublic(pub), dataKey, nil, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encrypt data key")
+		}
+		e.Keys = append(e.Keys, &WrappedKey{Type: KeyTypeECIES, ID: crypto.PubkeyToAddress(*pub).Hex(), Key: wrapped})
+	}
+	return json.Marshal(e)
+}
+
+// Open decrypts an envelope with the first data key that one of the keys of the keyring unwraps
+func (k *Keyring) Open(data []byte) ([]byte, error) {
+	e := &Envelope{}
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, errors.Wrap(err, "failed to parse envelope")
+	}
+	if e.Version != envelopeVersion || e.Algorithm != algorithmAESGCM {
+		return nil, errors.Errorf("unsupported envelope version %d with algorithm %q", e.Version, e.Algorithm)
+	}
+	dataKey, err := k.unwrap(e.Keys)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := decryptGCM(dataKey, e.Nonce, e.Ciphertext)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt payload")
+	}
+	return plaintext, nil
+}
+
+func (k *Keyring) unwrap(keys []*WrappedKey) ([]byte, error) {
+	var address string
+	if k.account != nil {
+		address = crypto.PubkeyToAddress(k.account.PublicKey).Hex()
+	}
+	for _, wk := range keys {
+		switch wk.Type {
+		case KeyTypeAES:
+			for _, ok := range k.keys {
+				if ok.id != wk.ID {
+					continue
+				}
+				if len(wk.Key) < gcmNonceSize {
+					return nil, errors.Errorf("invalid data key wrapped with %q", wk.ID)
+				}
+				dataKey, err := decryptGCM(ok.key, wk.Key[:gcmNonceSize], wk.Key[gcmNonceSize:])
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to unwrap data key with %q", wk.ID)
+				}
+				return dataKey, nil
+			}
+		case KeyTypeECIES:
+			if address == "" || !strings.EqualFold(wk.ID, address) {
+				continue
+			}
+			dataKey, err := ecies.ImportECDSA(k.account).Decrypt(wk.Key, nil, nil)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to decrypt data key")
+			}
+			return dataKey, nil
+		}
+	}
+	return nil, ErrNotRecipient
+}
+
+// IsEnvelope reports whether a payload is an envelope rather than a plain resource
+func IsEnvelope(data []byte) bool {
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return false
+	}
+	e := &Envelope{}
+	return json.Unmarshal(data, e) == nil && e.Version > 0 && e.Ciphertext != nil
+}
+
+func encryptGCM(key []byte, plaintext []byte) ([]byte, []byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate nonce")
+	}
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func decryptGCM(key []byte, nonce []byte, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid nonce")
+	}
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key")
+	}
+	return cipher.NewGCM(block)
+}
+
+// parseOrganizationKey parses a key configured as "<id>:<hex encoded 32 byte key>"
+func parseOrganizationKey(s string) (*organizationKey, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return nil, errors.New("encryption keys must be formatted as <id>:<hex key>")
+	}
+	key, err := hex.DecodeString(strings.TrimPrefix(parts[1], "0x"))
+	if err != nil || len(key) != dataKeySize {
+		return nil, errors.Errorf("encryption key %q must be %d hex encoded bytes", parts[0], dataKeySize)
+	}
+	return &organizationKey{id: parts[0], key: key}, nil
+}
+
+// NewKeyring creates a keyring from the configured organization keys and recipients
+// the account of the server is used to open envelopes sealed for it, unless its key is held by an external signer
+func NewKeyring(log *logging.Logger, config *config.Config, account *signer.Account) (*Keyring, error) {
+	k := &Keyring{
+		keys:       []*organizationKey{},
+		log:        log.WithField("component", "envelope"),
+		recipients: []*ecdsa.PublicKey{},
+	}
+	ids := map[string]bool{}
+	for _, s := range config.EncryptionKeys {
+		key, err := parseOrganizationKey(s)
+		if err != nil {
+			return nil, err
+		}
+		if ids[key.id] {
+			return nil, errors.Errorf("duplicate encryption key %q", key.id)
+		}
+		ids[key.id] = true
+		k.keys = append(k.keys, key)
+	}
+	for _, s := range config.EncryptionRecipients {
+		b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid recipient public key %q", s)
+		}
+		pub, err := crypto.UnmarshalPubkey(b)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid recipient public key %q", s)
+		}
+		k.recipients = append(k.recipients, pub)
+	}
+	if account != nil {
+		k.account = account.Key
+	}
+	if k.Enabled() {
+		fields := logging.Fields{"recipients": len(k.recipients)}
+		if len(k.keys) > 0 {
+			fields["key"] = k.keys[0].id
+		}
+		k.log.WithFields(fields).Info("payloads are encrypted")
+	}
+	return k, nil
+}
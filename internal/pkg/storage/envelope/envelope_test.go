@@ -0,0 +1,144 @@
+package envelope
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const payload = `{"resourceType":"Practitioner","active":true}`
+
+func newTestKeyring(t *testing.T, c *config.Config) *Keyring {
+	account, err := signer.NewAccount(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKeyring(logging.NewLogger(), c, account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func testKey(id string, b byte) string {
+	key := make([]byte, dataKeySize)
+	for i := range key {
+		key[i] = b
+	}
+	return id + ":" + hex.EncodeToString(key)
+}
+
+func TestSealOpen(t *testing.T) {
+	k := newTestKeyring(t, &config.Config{EncryptionKeys: []string{testKey("2019-01", 1)}})
+	if !k.Enabled() {
+		t.Fatal("expected keyring with a key to be enabled")
+	}
+	sealed, err := k.Seal([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEnvelope(sealed) {
+		t.Fatalf("expected an envelope, got %q", sealed)
+	}
+	if IsEnvelope([]byte(payload)) {
+		t.Fatal("expected a resource not to be an envelope")
+	}
+	opened, err := k.Open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(opened) != payload {
+		t.Fatalf("expected %q, got %q", payload, opened)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old := newTestKeyring(t, &config.Config{EncryptionKeys: []string{testKey("2019-01", 1)}})
+	sealed, err := old.Seal([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestKeyring(t, &config.Config{EncryptionKeys: []string{testKey("2019-02", 2), testKey("2019-01", 1)}})
+	if _, err := rotated.Open(sealed); err != nil {
+		t.Fatalf("expected envelope sealed before the rotation to open: %v", err)
+	}
+	resealed, err := rotated.Seal([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Open(resealed); err != ErrNotRecipient {
+		t.Fatalf("expected envelope sealed with the new key to be unreadable with the old key, got %v", err)
+	}
+}
+
+func TestOpenWithoutKey(t *testing.T) {
+	k := newTestKeyring(t, &config.Config{EncryptionKeys: []string{testKey("org-a", 1)}})
+	sealed, err := k.Seal([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestKeyring(t, &config.Config{EncryptionKeys: []string{testKey("org-b", 1)}})
+	if _, err := other.Open(sealed); err != ErrNotRecipient {
+		t.Fatalf("expected %v, got %v", ErrNotRecipient, err)
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	writerKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	readerKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	outsiderKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := newTestKeyring(t, &config.Config{
+		EncryptionRecipients: []string{hex.EncodeToString(crypto.FromECDSAPub(&readerKey.PublicKey))},
+		DevMode:              true,
+		PrivateKey:           hex.EncodeToString(crypto.FromECDSA(writerKey)),
+	})
+	sealed, err := writer.Seal([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]string{
+		"writer": hex.EncodeToString(crypto.FromECDSA(writerKey)),
+		"reader": hex.EncodeToString(crypto.FromECDSA(readerKey)),
+	} {
+		k := newTestKeyring(t, &config.Config{DevMode: true, PrivateKey: key})
+		opened, err := k.Open(sealed)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(opened) != payload {
+			t.Fatalf("%s: expected %q, got %q", name, payload, opened)
+		}
+	}
+
+	outsider := newTestKeyring(t, &config.Config{DevMode: true, PrivateKey: hex.EncodeToString(crypto.FromECDSA(outsiderKey))})
+	if _, err := outsider.Open(sealed); err != ErrNotRecipient {
+		t.Fatalf("expected %v, got %v", ErrNotRecipient, err)
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	for _, keys := range [][]string{
+		{"no-separator"},
+		{"short:0102"},
+		{testKey("dup", 1), testKey("dup", 2)},
+	} {
+		if _, err := NewKeyring(logging.NewLogger(), &config.Config{EncryptionKeys: keys}, nil); err == nil {
+			t.Errorf("expected keys %v to be rejected", keys)
+		}
+	}
+}
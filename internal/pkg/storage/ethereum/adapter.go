@@ -2,49 +2,72 @@ package ethereum
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"math/big"
+	"sync"
 	"time"
 
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
 	"github.com/SynapticHealthAlliance/pdx-contracts/go/contracts"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 )
 
+var (
+	// ErrObjectNotFound is returned when an object does not exist in the collection contract
+	ErrObjectNotFound = storage.ErrObjectNotFound
+	// ErrVersionConflict is returned when the collection contract rejects an update of an object that has changed
+	ErrVersionConflict = storage.ErrVersionConflict
+)
+
 // Adapter ...
 type Adapter struct {
-	connection                 *ethclient.Client
-	transactOpts               *bind.TransactOpts
+	connection                 Backend
+	transactions               *TransactionManager
 	organizationAddress        common.Address
 	objectCollectionContract   *config.ObjectCollectionContract
 	objectCollectionCaller     contracts.ObjectCollectionCaller
 	objectCollectionTransactor contracts.ObjectCollectionTransactor
-	submittedTransactions      chan<- *types.Transaction
+	objectCollectionFilterer   contracts.ObjectCollectionFilterer
+	objectIndexCallers         map[common.Address]*contracts.ObjectIndexCaller
+	ipfs                       *ipfs.Client
+	fetchers                   *fetcher.Registry
+	keyring                    *envelope.Keyring
+	submittedTransactions      chan<- *PendingTransaction
+	db                         *database.DB
 	log                        logging.FieldLogger
+	startBlock                 *uint64
+	startBlockLock             sync.Mutex
 }
 
 // Create ...
-func (a *Adapter) Create(ctx context.Context, uuid uuid.UUID, data ObjectCollectionElementData) error {
+func (a *Adapter) Create(ctx context.Context, uuid uuid.UUID, data ObjectCollectionElementData) (*PendingTransaction, error) {
 	log := a.log.WithField("uuid", uuid.String())
 	addrs := []common.Address{}
 	keys := []objectIndexKey{}
 	log.WithField("uri", data.URI()).Debug("storing data")
 	bytes, err := data.Bytes()
 	if err != nil {
-		return errors.Wrap(err, "failed to get bytes from data")
+		return nil, errors.Wrap(err, "failed to get bytes from data")
 	}
 	var jsonData interface{}
 	log.Debugf("unmarshalling JSON data: %v", string(bytes))
 	err = json.Unmarshal(bytes, &jsonData)
 	if err != nil {
-		return errors.Wrap(err, "failed to unmarshal json data")
+		return nil, errors.Wrap(err, "failed to unmarshal json data")
 	}
 	log.Debug("generating index keys")
 	for _, idx := range a.objectCollectionContract.Indexes {
@@ -52,7 +75,7 @@ func (a *Adapter) Create(ctx context.Context, uuid uuid.UUID, data ObjectCollect
 		log.Debugf("generating index key for address %v using %v", idx.Address.String(), idx.JSONPath.String())
 		newKeys, err := a.generateObjectIndexKeys(idx, jsonData)
 		if err != nil {
-			return errors.Wrapf(err, "unable to generate index key from data using provided json path %q", idx.JSONPath)
+			return nil, errors.Wrapf(err, "unable to generate index key from data using provided json path %q", idx.JSONPath)
 		}
 		keys = append(keys, newKeys...)
 		for i := 0; i < len(newKeys); i++ {
@@ -61,32 +84,83 @@ func (a *Adapter) Create(ctx context.Context, uuid uuid.UUID, data ObjectCollect
 	}
 	log.Debugf("index keys (%d): %v", len(keys), keys)
 	log.Debugf("index addresses (%d): %v", len(addrs), addrs)
-	txn, err := a.objectCollectionTransactor.AddObject(a.transactOpts, uuid.Array(), a.organizationAddress, data.URI(), addrs, keys)
-	return a.handleTransaction(txn, err)
+	txn, err := a.transactions.Transact(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return a.objectCollectionTransactor.AddObject(opts, uuid.Array(), a.organizationAddress, data.URI(), addrs, keys)
+	})
+	return a.handleTransaction(ctx, OperationCreate, uuid, txn, err)
 }
 
-func (a *Adapter) handleTransaction(txn *types.Transaction, err error) error {
-	if txn != nil {
-		a.log.Debugf("transaction received: %v", txn.Hash().String())
-		if err == nil {
-			a.submittedTransactions <- txn
+// handleTransaction records a submitted transaction, with the client whose request sent it, and passes it to the
+// TransactionsListener, which reports its outcome
+func (a *Adapter) handleTransaction(ctx context.Context, op TransactionOperation, id uuid.UUID, txn *types.Transaction, err error) (*PendingTransaction, error) {
+	if err != nil {
+		return nil, err
+	}
+	a.log.Debugf("transaction received: %v", txn.Hash().String())
+	now := time.Now().UTC()
+	record := &TransactionRecord{
+		Hash:         txn.Hash().Hex(),
+		LatestHash:   txn.Hash().Hex(),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		ResourceType: a.objectCollectionContract.Name,
+		ResourceID:   id.String(),
+		Operation:    op,
+		Status:       TransactionPending,
+		Tenant:       a.objectCollectionContract.Tenant,
+	}
+	if token := auth.FromContext(ctx); token != nil {
+		record.Owner = token.ClientID
+	}
+	if err := a.db.Create(record).Error; err != nil {
+		// the transaction has been sent, so it is still tracked by the listener
+		a.log.WithError(err).Error("failed to save transaction")
+	}
+	pending := newPendingTransaction(txn, record, a.transactions)
+	a.submittedTransactions <- pending
+	return pending, nil
+}
+
+// Update replaces the data of an object
+// the contract reverts updates whose timestamp does not match the object, so the timestamp is compared with the
+// state of the contract, before the transaction is sent and again when it cannot be sent
+func (a *Adapter) Update(ctx context.Context, id uuid.UUID, lastUpdatedAt time.Time, data ObjectCollectionElementData, changeScore uint8) (*PendingTransaction, error) {
+	if err := a.checkUpdatedAt(ctx, id, lastUpdatedAt); err != nil {
+		return nil, err
+	}
+	txn, err := a.transactions.Transact(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return a.objectCollectionTransactor.UpdateObject(opts, id.Array(), timeToBigint(lastUpdatedAt), data.URI(), changeScore)
+	})
+	if err != nil {
+		if checkErr := a.checkUpdatedAt(ctx, id, lastUpdatedAt); checkErr != nil {
+			return nil, errors.Wrap(checkErr, err.Error())
 		}
 	}
-	return err
+	return a.handleTransaction(ctx, OperationUpdate, id, txn, err)
 }
 
-// Update ...
-func (a *Adapter) Update(ctx context.Context, id uuid.UUID, lastUpdatedAt time.Time, data ObjectCollectionElementData, changeScore uint8) error {
-	return a.handleTransaction(
-		a.objectCollectionTransactor.UpdateObject(a.transactOpts, id.Array(), timeToBigint(lastUpdatedAt), data.URI(), changeScore),
-	)
+// checkUpdatedAt returns ErrVersionConflict when an object has been updated since lastUpdatedAt
+func (a *Adapter) checkUpdatedAt(ctx context.Context, id uuid.UUID, lastUpdatedAt time.Time) error {
+	current, err := a.Read(ctx, id)
+	if err != nil {
+		return err
+	}
+	// the contract keeps timestamps in seconds
+	if current.UpdatedAt.Unix() != lastUpdatedAt.Unix() {
+		return ErrVersionConflict
+	}
+	return nil
 }
 
 // Destroy ...
-func (a *Adapter) Destroy(ctx context.Context, id uuid.UUID) error {
-	return a.handleTransaction(
-		a.objectCollectionTransactor.RemoveObject(a.transactOpts, id.Array()),
-	)
+func (a *Adapter) Destroy(ctx context.Context, id uuid.UUID) (*PendingTransaction, error) {
+	if _, err := a.Read(ctx, id); err != nil {
+		return nil, err
+	}
+	txn, err := a.transactions.Transact(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		return a.objectCollectionTransactor.RemoveObject(opts, id.Array())
+	})
+	return a.handleTransaction(ctx, OperationDelete, id, txn, err)
 }
 
 // Read ...
@@ -95,7 +169,11 @@ func (a *Adapter) Read(ctx context.Context, id uuid.UUID) (*ObjectCollectionElem
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to read from contract")
 	}
-	return NewObjectCollectionElement(r.Uri, r.CreatedAt, r.UpdatedAt)
+	// the contract returns an empty record for unknown or removed objects
+	if r.Uri == "" {
+		return nil, ErrObjectNotFound
+	}
+	return NewObjectCollectionElement(r.Uri, r.CreatedAt, r.UpdatedAt, a.fetchers, a.keyring)
 }
 
 // ReadJSONResource ...
@@ -114,6 +192,32 @@ func (a *Adapter) ReadJSONResource(ctx context.Context, id uuid.UUID, resource i
 	return nil
 }
 
+// FindObjectIDs returns the IDs of all objects stored under a value in the ObjectIndex contract at the provided address
+func (a *Adapter) FindObjectIDs(ctx context.Context, indexAddress common.Address, value string) ([]uuid.UUID, error) {
+	caller, ok := a.objectIndexCallers[indexAddress]
+	if !ok {
+		return nil, errors.Errorf("no index configured at address %v", indexAddress.String())
+	}
+	key, err := a.stringToIndexKey(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate index key")
+	}
+	rawIDs, err := caller.GetObjectIds(&bind.CallOpts{Context: ctx}, key)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read from index contract")
+	}
+	ids := make([]uuid.UUID, len(rawIDs))
+	for i, rawID := range rawIDs {
+		ids[i] = bytesToUUID(rawID)
+	}
+	return ids, nil
+}
+
+// Collection returns the configuration of the collection contract used by the adapter
+func (a *Adapter) Collection() *config.ObjectCollectionContract {
+	return a.objectCollectionContract
+}
+
 // CurrentBlock ...
 func (a *Adapter) CurrentBlock(ctx context.Context) (*big.Int, error) {
 	h, err := a.connection.HeaderByNumber(ctx, nil)
@@ -149,9 +253,30 @@ func (a *Adapter) generateObjectIndexKeys(idx *config.ObjectIndex, jsonData inte
 	return keys, nil
 }
 
+// IndexKeys returns the keys under which the ObjectIndex contract of an index holds a JSON document when it is created
+func (a *Adapter) IndexKeys(idx *config.ObjectIndex, data []byte) ([][32]byte, error) {
+	var jsonData interface{}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal json data")
+	}
+	return a.generateObjectIndexKeys(idx, jsonData)
+}
+
+// IndexKey returns the key under which the ObjectIndex contracts hold a value
+func (a *Adapter) IndexKey(value string) ([32]byte, error) {
+	return a.stringToIndexKey(value)
+}
+
+// stringToIndexKey returns the HMAC of a value when the collection has an index secret, and the value itself otherwise
 func (a *Adapter) stringToIndexKey(str string) (objectIndexKey, error) {
 	bytes := []byte(str)
 	var key objectIndexKey
+	if secret := a.objectCollectionContract.IndexSecret; len(secret) > 0 {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(bytes)
+		copy(key[:], mac.Sum(nil))
+		return key, nil
+	}
 	if len(bytes) > 32 {
 		return key, errors.Errorf("string provided is too long; must be less than 32 characters: %q", str)
 	}
@@ -161,25 +286,55 @@ func (a *Adapter) stringToIndexKey(str string) (objectIndexKey, error) {
 
 // NewAdapter ...
 func NewAdapter(
-	connection *ethclient.Client,
-	transactOpts *bind.TransactOpts,
+	connection Backend,
+	transactions *TransactionManager,
 	organizationAddress common.Address,
 	objectCollectionContract *config.ObjectCollectionContract,
-	submittedTransactions chan<- *types.Transaction,
+	submittedTransactions chan<- *PendingTransaction,
+	ipfsClient *ipfs.Client,
+	fetchers *fetcher.Registry,
+	keyring *envelope.Keyring,
+	db *database.DB,
 	log *logging.Logger,
 ) (*Adapter, error) {
+	if objectCollectionContract.Address == (common.Address{}) {
+		return nil, errors.Errorf("no contract address configured for collection %q", objectCollectionContract.Name)
+	}
+	for _, idx := range objectCollectionContract.Indexes {
+		if idx.Address == (common.Address{}) {
+			return nil, errors.Errorf("no contract address configured for index %q of collection %q", idx.Name, objectCollectionContract.Name)
+		}
+	}
+	if keyring.Enabled() && len(objectCollectionContract.Indexes) > 0 && len(objectCollectionContract.IndexSecret) == 0 {
+		// the values of the indexes would be readable on chain although the payloads are encrypted
+		return nil, errors.Errorf("collection %q is encrypted, so its indexes require an index secret", objectCollectionContract.Name)
+	}
 	coll, err := contracts.NewObjectCollection(objectCollectionContract.Address, connection)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to get collection contract")
 	}
+	idxCallers := map[common.Address]*contracts.ObjectIndexCaller{}
+	for _, idx := range objectCollectionContract.Indexes {
+		idxCaller, err := contracts.NewObjectIndexCaller(idx.Address, connection)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to get index contract %q", idx.Name)
+		}
+		idxCallers[idx.Address] = idxCaller
+	}
 	return &Adapter{
 		connection:                 connection,
-		transactOpts:               transactOpts,
+		transactions:               transactions,
 		organizationAddress:        organizationAddress,
 		objectCollectionContract:   objectCollectionContract,
 		objectCollectionCaller:     coll.ObjectCollectionCaller,
 		objectCollectionTransactor: coll.ObjectCollectionTransactor,
+		objectCollectionFilterer:   coll.ObjectCollectionFilterer,
+		objectIndexCallers:         idxCallers,
+		ipfs:                       ipfsClient,
+		fetchers:                   fetchers,
+		keyring:                    keyring,
 		submittedTransactions:      submittedTransactions,
+		db:                         db,
 		log:                        log.WithField("component", "ethereum"),
 	}, nil
 }
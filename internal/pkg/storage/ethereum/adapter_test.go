@@ -0,0 +1,95 @@
+package ethereum_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/oliveagle/jsonpath"
+)
+
+func TestNewAdapterRequiresAddresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		collection *config.ObjectCollectionContract
+	}{
+		{"collection", &config.ObjectCollectionContract{Name: "Practitioner"}},
+		{"index", &config.ObjectCollectionContract{
+			Name:    "Practitioner",
+			Address: common.HexToAddress("0x1"),
+			Indexes: []*config.ObjectIndex{{Name: "Global NPI"}},
+		}},
+	}
+	for _, tt := range tests {
+		_, err := ethereum.NewAdapter(nil, nil, common.Address{}, tt.collection, nil, nil, nil, nil, nil, logging.NewLogger())
+		if err == nil {
+			t.Fatalf("%s: expected a missing address to be rejected", tt.name)
+		}
+	}
+}
+
+func TestIndexKeysOfEncryptedCollections(t *testing.T) {
+	log := logging.NewLogger()
+	keyring, err := envelope.NewKeyring(log, &config.Config{EncryptionKeys: []string{"org:" + strings.Repeat("01", 32)}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := func(secret []byte) *config.ObjectCollectionContract {
+		return &config.ObjectCollectionContract{
+			Name:        "Practitioner",
+			Address:     common.HexToAddress("0x1"),
+			Indexes:     []*config.ObjectIndex{{Name: "Global NPI", Address: common.HexToAddress("0x2")}},
+			IndexSecret: secret,
+		}
+	}
+	if _, err := ethereum.NewAdapter(nil, nil, common.Address{}, collection(nil), nil, nil, nil, keyring, nil, log); err == nil {
+		t.Fatal("expected the indexes of an encrypted collection to require an index secret")
+	}
+
+	indexKey := func(secret []byte, value string) [32]byte {
+		adapter, err := ethereum.NewAdapter(nil, nil, common.Address{}, collection(secret), nil, nil, nil, keyring, nil, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := adapter.IndexKey(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	secret := bytes.Repeat([]byte{1}, 32)
+	var plaintext [32]byte
+	copy(plaintext[:], "1234567890")
+	key := indexKey(secret, "1234567890")
+	if key == plaintext {
+		t.Fatal("expected the on-chain key not to be the plaintext value")
+	}
+	if indexKey(secret, "1234567890") != key {
+		t.Fatal("expected the key of a value to be deterministic")
+	}
+	if indexKey(bytes.Repeat([]byte{2}, 32), "1234567890") == key {
+		t.Fatal("expected the key to depend on the index secret")
+	}
+
+	// the keys written with an object are the ones searched for
+	encrypted := collection(secret)
+	encrypted.Indexes[0].JSONPath = jsonpath.MustCompile("$.identifier.value")
+	adapter, err := ethereum.NewAdapter(nil, nil, common.Address{}, encrypted, nil, nil, nil, keyring, nil, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := adapter.IndexKeys(encrypted.Indexes[0], []byte(`{"identifier": [{"value": "1234567890"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("expected the written keys to be %x, got %x", key, keys)
+	}
+	// values longer than a key are hashed rather than rejected
+	indexKey(secret, strings.Repeat("1", 40))
+}
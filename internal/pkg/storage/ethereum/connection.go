@@ -3,34 +3,101 @@ package ethereum
 import (
 	"context"
 	"math/big"
-	"strings"
+	"strconv"
 
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
-	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
 	"github.com/pkg/errors"
+	"go.uber.org/fx"
 )
 
-// NewConnection ...
-func NewConnection(log *logging.Logger, config *config.Config) (*ethclient.Client, error) {
-	return ethclient.Dial(config.RPCURL)
+// Backend is the interface to an Ethereum node used to call, transact with and deploy contracts
+// it is implemented by *ethclient.Client, and by simulated chains in tests
+type Backend interface {
+	bind.ContractBackend
+	// CodeAt is shared with bind.DeployBackend, which Backend also implements
+	TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error)
+	HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error)
+}
+
+// client is a connection to an Ethereum node over RPC
+type client struct {
+	*ethclient.Client
+	rpc *rpc.Client
 }
 
-// NewTransactOpts ...
-func NewTransactOpts(config *config.Config) (*bind.TransactOpts, error) {
-	pk := config.PrivateKey
-	if pk == "" {
-		return nil, errors.New("no private key was provided")
+// ReceiptBlockNumber returns the number of the block in which a transaction was mined
+func (c *client) ReceiptBlockNumber(ctx context.Context, txHash common.Hash) (uint64, error) {
+	var receipt struct {
+		BlockNumber string `json:"blockNumber"`
+	}
+	if err := c.rpc.CallContext(ctx, &receipt, "eth_getTransactionReceipt", txHash); err != nil {
+		return 0, err
+	}
+	if receipt.BlockNumber == "" {
+		return 0, errors.New("receipt has no block number")
+	}
+	n, err := strconv.ParseUint(receipt.BlockNumber, 0, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid block number %q", receipt.BlockNumber)
 	}
-	key, err := crypto.HexToECDSA(strings.TrimPrefix(pk, "0x"))
+	return n, nil
+}
+
+// NewConnection ...
+func NewConnection(log *logging.Logger, config *config.Config) (Backend, error) {
+	rpcClient, err := rpc.Dial(config.RPCURL)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to parse private key")
+		return nil, err
+	}
+	return &client{Client: ethclient.NewClient(rpcClient), rpc: rpcClient}, nil
+}
+
+// NewTransactOpts creates the options with which the transactions of the server are signed by the configured signer
+func NewTransactOpts(lc fx.Lifecycle, log *logging.Logger, config *config.Config, account *signer.Account) (*bind.TransactOpts, error) {
+	var opts *bind.TransactOpts
+	switch signer.Type(config) {
+	case "":
+		if len(config.Tenants) > 0 && !config.HasOrganization() {
+			// each tenant has its own signer
+			return nil, nil
+		}
+		return nil, errors.New("no signer was configured")
+	case signer.TypeExternal:
+		ext, err := signer.NewExternal(context.Background(), &config.Signer, config.ChainID)
+		if err != nil {
+			return nil, err
+		}
+		lc.Append(fx.Hook{
+			OnStop: func(ctx context.Context) error {
+				ext.Close()
+				return nil
+			},
+		})
+		opts = &bind.TransactOpts{
+			From:   ext.Address(),
+			Signer: ext.SignerFn(),
+		}
+	default:
+		if account == nil || account.Key == nil {
+			return nil, errors.New("the key of the signer was not read")
+		}
+		opts = bind.NewKeyedTransactor(account.Key)
+	}
+	opts.Context = context.Background()
+	// without a price and limit, the node suggests the price and the gas is estimated for each transaction
+	if config.GasPrice > 0 {
+		opts.GasPrice = big.NewInt(config.GasPrice)
 	}
-	t := bind.NewKeyedTransactor(key)
-	t.Context = context.Background()
-	t.GasPrice = big.NewInt(config.GasPrice)
-	t.GasLimit = config.GasLimit
-	return t, nil
+	log.WithFields(logging.Fields{
+		"account": opts.From.Hex(),
+		"signer":  signer.Type(config),
+	}).Info("signing transactions")
+	return opts, nil
 }
@@ -0,0 +1,170 @@
+package ethereum
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/pdx-contracts/go/contracts"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// Deployer deploys the contracts of an organization with the account of the server
+type Deployer struct {
+	connection   Backend
+	log          logging.FieldLogger
+	transactions *TransactionManager
+}
+
+// Deploy deploys an Organization contract when organization is the zero address, and the ObjectCollection and
+// ObjectIndex contracts of the collections and indexes that have no address, filling in their addresses
+// the start block of a deployed collection is set to the latest block before its deployment
+// collections are not linked on chain: the adapter passes the addresses of the indexes of a collection with each object
+// when a deployment fails, the addresses of the contracts deployed before it are filled in, and the organization
+// address is returned if it was deployed, so that they can be saved
+func (d *Deployer) Deploy(ctx context.Context, name string, organization common.Address, collections []*config.ObjectCollectionContract) (common.Address, error) {
+	if organization == (common.Address{}) {
+		if name == "" {
+			return organization, errors.New("an organization name is required to deploy an Organization contract")
+		}
+		address, err := d.deploy(ctx, "organization "+name, func(opts *bind.TransactOpts) (common.Address, *types.Transaction, error) {
+			address, txn, _, err := contracts.DeployOrganization(opts, d.connection, name)
+			return address, txn, err
+		})
+		if err != nil {
+			return organization, err
+		}
+		organization = address
+	}
+	for _, coll := range collections {
+		if coll.Address == (common.Address{}) {
+			head, err := d.connection.HeaderByNumber(ctx, nil)
+			if err != nil {
+				return organization, errors.Wrap(err, "failed to get latest block")
+			}
+			address, err := d.deploy(ctx, coll.StorageName()+" collection", func(opts *bind.TransactOpts) (common.Address, *types.Transaction, error) {
+				address, txn, _, err := contracts.DeployObjectCollection(opts, d.connection)
+				return address, txn, err
+			})
+			if err != nil {
+				return organization, err
+			}
+			coll.Address = address
+			coll.StartBlock = head.Number.Uint64()
+		}
+		for _, idx := range coll.Indexes {
+			if idx.Address != (common.Address{}) {
+				continue
+			}
+			address, err := d.deploy(ctx, coll.StorageName()+" index "+idx.Name, func(opts *bind.TransactOpts) (common.Address, *types.Transaction, error) {
+				address, txn, _, err := contracts.DeployObjectIndex(opts, d.connection)
+				return address, txn, err
+			})
+			if err != nil {
+				return organization, err
+			}
+			idx.Address = address
+		}
+	}
+	return organization, nil
+}
+
+// deploy sends a contract creation transaction and waits for the contract to be mined
+func (d *Deployer) deploy(ctx context.Context, contract string, fn func(opts *bind.TransactOpts) (common.Address, *types.Transaction, error)) (common.Address, error) {
+	var address common.Address
+	txn, err := d.transactions.Transact(ctx, func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		a, txn, err := fn(opts)
+		address = a
+		return txn, err
+	})
+	if err != nil {
+		return address, errors.Wrapf(err, "failed to deploy %s", contract)
+	}
+	d.log.WithFields(logging.Fields{"contract": contract, "txn": txn.Hash().Hex()}).Info("waiting for deployment")
+	if _, err := bind.WaitDeployed(ctx, d.connection, txn); err != nil {
+		// the contract may still be deployed by the transaction
+		return address, errors.Wrapf(err, "failed to deploy %s at %s with transaction %s", contract, address.Hex(), txn.Hash().Hex())
+	}
+	d.log.WithFields(logging.Fields{"contract": contract, "address": address.Hex()}).Info("deployed contract")
+	return address, nil
+}
+
+// NewDeployer ...
+func NewDeployer(log *logging.Logger, conn Backend, transactions *TransactionManager) *Deployer {
+	return &Deployer{
+		connection:   conn,
+		log:          log.WithField("component", "contract_deployer"),
+		transactions: transactions,
+	}
+}
+
+// VerifyContracts checks that the Organization contract and the contracts of collections have code, and that the code
+// dispatches every method of the ABI of the contract
+// a description of each problem found is returned
+func VerifyContracts(ctx context.Context, conn Backend, organization common.Address, collections []*config.ObjectCollectionContract) ([]string, error) {
+	problems := []string{}
+	check := func(contract string, address common.Address, abiJSON string) error {
+		if address == (common.Address{}) {
+			problems = append(problems, contract+" has no address")
+			return nil
+		}
+		problem, err := checkContract(ctx, conn, address, abiJSON)
+		if err != nil {
+			return errors.Wrapf(err, "failed to verify %s", contract)
+		}
+		if problem != "" {
+			problems = append(problems, fmt.Sprintf("%s at %s %s", contract, address.Hex(), problem))
+		}
+		return nil
+	}
+	if err := check("organization", organization, contracts.OrganizationABI); err != nil {
+		return problems, err
+	}
+	for _, coll := range collections {
+		if err := check(coll.StorageName()+" collection", coll.Address, contracts.ObjectCollectionABI); err != nil {
+			return problems, err
+		}
+		for _, idx := range coll.Indexes {
+			if err := check(coll.StorageName()+" index "+idx.Name, idx.Address, contracts.ObjectIndexABI); err != nil {
+				return problems, err
+			}
+		}
+	}
+	return problems, nil
+}
+
+// checkContract returns a description of what is wrong with the code at address, or an empty string
+// the selectors of the methods of a contract are pushed by its dispatcher, so each of them appears in the code
+func checkContract(ctx context.Context, conn Backend, address common.Address, abiJSON string) (string, error) {
+	code, err := conn.CodeAt(ctx, address, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(code) == 0 {
+		return "has no code", nil
+	}
+	parsed, err := abi.JSON(strings.NewReader(abiJSON))
+	if err != nil {
+		return "", errors.Wrap(err, "failed to parse ABI")
+	}
+	missing := []string{}
+	for name, method := range parsed.Methods {
+		// selectors with leading zero bytes are pushed with a shorter PUSH instruction
+		if !bytes.Contains(code, bytes.TrimLeft(method.Id(), "\x00")) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return "does not implement " + strings.Join(missing, ", "), nil
+	}
+	return "", nil
+}
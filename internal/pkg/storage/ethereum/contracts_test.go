@@ -0,0 +1,50 @@
+package ethereum_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestDeployAndVerifyContracts(t *testing.T) {
+	m, chain := newTestManager(t, &config.Config{})
+	ctx := context.Background()
+	collections := []*config.ObjectCollectionContract{
+		{Name: "Practitioner", Indexes: []*config.ObjectIndex{{Name: "Global NPI"}}},
+		// configured with the address of a contract of another type
+		{Name: "Location", Address: chain.OrganizationAddress},
+	}
+
+	organization, err := ethereum.NewDeployer(logging.NewLogger(), chain.Backend, m).Deploy(ctx, "Test Organization", common.Address{}, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if organization == (common.Address{}) || collections[0].Address == (common.Address{}) || collections[0].Indexes[0].Address == (common.Address{}) {
+		t.Fatal("expected the organization, collection and index to be deployed")
+	}
+	if collections[1].Address != chain.OrganizationAddress {
+		t.Fatal("expected a configured address to be kept")
+	}
+
+	problems, err := ethereum.VerifyContracts(ctx, chain.Backend, organization, collections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "Location collection") || !strings.Contains(problems[0], "does not implement") {
+		t.Fatalf("expected the Location collection to be reported, got %v", problems)
+	}
+
+	collections[0].Indexes[0].Address = common.HexToAddress("0x1")
+	problems, err = ethereum.VerifyContracts(ctx, chain.Backend, organization, collections[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 1 || !strings.HasSuffix(problems[0], "has no code") {
+		t.Fatalf("expected the index without code to be reported, got %v", problems)
+	}
+}
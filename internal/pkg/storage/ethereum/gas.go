@@ -0,0 +1,203 @@
+package ethereum
+
+import (
+	"context"
+	"math"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+const (
+	// GasPriceFixed uses the configured gas price
+	GasPriceFixed = "fixed"
+	// GasPriceNode uses the gas price suggested by the node
+	GasPriceNode = "node"
+	// GasPricePercentile uses a percentile of the gas prices paid in recent blocks
+	GasPricePercentile = "percentile"
+
+	defaultGasLimitMultiplier = 1.2
+	defaultGasPriceBlocks     = 20
+)
+
+// ErrGasLimitExceeded is returned when a transaction needs more gas than fits in a block, or than the configured cap
+var ErrGasLimitExceeded = storage.ErrTooLarge
+
+// GasEstimator sets the gas limit of each transaction from an estimate of the gas it uses
+type GasEstimator struct {
+	connection Backend
+	maxGas     uint64
+	multiplier float64
+}
+
+// Estimate returns the gas limit of a call
+// the estimate is not capped by the block gas limit, so that calls that would not fit in a block are rejected
+// before they are sent
+func (e *GasEstimator) Estimate(ctx context.Context, call ethereum.CallMsg) (uint64, error) {
+	head, err := e.connection.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to get latest block")
+	}
+	blockGasLimit := head.GasLimit
+	if blockGasLimit > 0 {
+		call.Gas = 2 * blockGasLimit
+	}
+	gas, err := e.connection.EstimateGas(ctx, call)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to estimate gas")
+	}
+	if blockGasLimit > 0 && gas > blockGasLimit {
+		return 0, errors.Wrapf(ErrGasLimitExceeded, "transaction needs %d gas, blocks hold %d", gas, blockGasLimit)
+	}
+	if e.maxGas > 0 && gas > e.maxGas {
+		return 0, errors.Wrapf(ErrGasLimitExceeded, "transaction needs %d gas, the limit is %d", gas, e.maxGas)
+	}
+	limit := uint64(math.Ceil(float64(gas) * e.multiplier))
+	if e.maxGas > 0 && limit > e.maxGas {
+		limit = e.maxGas
+	}
+	if blockGasLimit > 0 && limit > blockGasLimit {
+		limit = blockGasLimit
+	}
+	return limit, nil
+}
+
+// NewGasEstimator creates an estimator that raises estimates by the configured multiplier, up to the gas_limit cap
+func NewGasEstimator(config *config.Config, conn Backend) (*GasEstimator, error) {
+	multiplier := config.GasLimitMultiplier
+	if multiplier == 0 {
+		multiplier = defaultGasLimitMultiplier
+	} else if multiplier < 1 {
+		return nil, errors.New("gas_limit_multiplier must be at least 1")
+	}
+	return &GasEstimator{
+		connection: conn,
+		maxGas:     config.GasLimit,
+		multiplier: multiplier,
+	}, nil
+}
+
+// GasPricer chooses the gas price of new transactions
+type GasPricer interface {
+	GasPrice(ctx context.Context) (*big.Int, error)
+}
+
+// FixedGasPricer always uses the same gas price
+type FixedGasPricer struct {
+	price *big.Int
+}
+
+// GasPrice ...
+func (p *FixedGasPricer) GasPrice(ctx context.Context) (*big.Int, error) {
+	return new(big.Int).Set(p.price), nil
+}
+
+// NodeGasPricer uses the gas price suggested by the node
+type NodeGasPricer struct {
+	connection Backend
+}
+
+// GasPrice ...
+func (p *NodeGasPricer) GasPrice(ctx context.Context) (*big.Int, error) {
+	price, err := p.connection.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get suggested gas price")
+	}
+	return price, nil
+}
+
+// blockReader is implemented by backends that return the transactions of blocks, e.g. *ethclient.Client
+type blockReader interface {
+	BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error)
+}
+
+// PercentileGasPricer uses a percentile of the gas prices of the transactions in recent blocks
+// the price is computed again when a new block is mined
+type PercentileGasPricer struct {
+	blocks     int
+	connection Backend
+	head       *big.Int
+	mutex      sync.Mutex
+	percentile int
+	price      *big.Int
+	reader     blockReader
+}
+
+// GasPrice ...
+func (p *PercentileGasPricer) GasPrice(ctx context.Context) (*big.Int, error) {
+	head, err := p.connection.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get latest block")
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.head != nil && p.head.Cmp(head.Number) == 0 {
+		return new(big.Int).Set(p.price), nil
+	}
+
+	prices := []*big.Int{}
+	number := new(big.Int).Set(head.Number)
+	for i := 0; i < p.blocks && number.Sign() >= 0; i++ {
+		block, err := p.reader.BlockByNumber(ctx, number)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get block %v", number)
+		}
+		for _, txn := range block.Transactions() {
+			prices = append(prices, txn.GasPrice())
+		}
+		number.Sub(number, big.NewInt(1))
+	}
+	var price *big.Int
+	if len(prices) == 0 {
+		// recent blocks are empty, so any price is accepted by the miners
+		price, err = p.connection.SuggestGasPrice(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get suggested gas price")
+		}
+	} else {
+		sort.Slice(prices, func(i, j int) bool { return prices[i].Cmp(prices[j]) < 0 })
+		price = prices[(len(prices)-1)*p.percentile/100]
+	}
+	p.head = head.Number
+	p.price = price
+	return new(big.Int).Set(price), nil
+}
+
+// NewGasPricer creates the pricer of the configured gas_price_strategy
+func NewGasPricer(config *config.Config, conn Backend) (GasPricer, error) {
+	switch config.GasPriceStrategy {
+	case GasPriceFixed:
+		if config.GasPrice <= 0 {
+			return nil, errors.New("a gas_price is required by the fixed gas price strategy")
+		}
+		return &FixedGasPricer{price: big.NewInt(config.GasPrice)}, nil
+	case GasPriceNode, "":
+		return &NodeGasPricer{connection: conn}, nil
+	case GasPricePercentile:
+		reader, ok := conn.(blockReader)
+		if !ok {
+			return nil, errors.New("the connection does not support the percentile gas price strategy")
+		}
+		p := &PercentileGasPricer{
+			blocks:     config.GasPriceBlocks,
+			connection: conn,
+			percentile: config.GasPricePercentile,
+			reader:     reader,
+		}
+		if p.blocks <= 0 {
+			p.blocks = defaultGasPriceBlocks
+		}
+		// 0 selects the lowest price paid, the default of the gas_price_percentile flag is set by the root command
+		if p.percentile < 0 || p.percentile > 100 {
+			return nil, errors.New("gas_price_percentile must be between 0 and 100")
+		}
+		return p, nil
+	}
+	return nil, errors.Errorf("unknown gas price strategy %q", config.GasPriceStrategy)
+}
@@ -0,0 +1,145 @@
+package ethereum_test
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	goethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// gasBackend is a node whose blocks hold blockGasLimit gas and whose calls use gas gas
+type gasBackend struct {
+	ethereum.Backend
+
+	blockGasLimit uint64
+	gas           uint64
+}
+
+func (b *gasBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(1), GasLimit: b.blockGasLimit}, nil
+}
+
+func (b *gasBackend) EstimateGas(ctx context.Context, call goethereum.CallMsg) (uint64, error) {
+	if call.Gas < b.gas {
+		return 0, errors.New("gas required exceeds allowance or always failing transaction")
+	}
+	return b.gas, nil
+}
+
+func (b *gasBackend) SuggestGasPrice(ctx context.Context) (*big.Int, error) {
+	return big.NewInt(7), nil
+}
+
+// pricesBackend is a node whose latest block holds transactions with the gas prices prices
+type pricesBackend struct {
+	gasBackend
+
+	prices []int64
+}
+
+func (b *pricesBackend) BlockByNumber(ctx context.Context, number *big.Int) (*types.Block, error) {
+	txns := []*types.Transaction{}
+	if number.Cmp(big.NewInt(1)) == 0 {
+		for i, price := range b.prices {
+			txns = append(txns, types.NewTransaction(uint64(i), common.Address{}, nil, 21000, big.NewInt(price), nil))
+		}
+	}
+	return types.NewBlock(&types.Header{Number: number}, txns, nil, nil), nil
+}
+
+func TestGasEstimate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		config   *config.Config
+		gas      uint64
+		expected uint64
+		err      error
+	}{
+		{"multiplied", &config.Config{GasLimitMultiplier: 1.5}, 100000, 150000, nil},
+		{"default multiplier", &config.Config{}, 100000, 120000, nil},
+		{"capped", &config.Config{GasLimit: 110000}, 100000, 110000, nil},
+		{"block gas limit", &config.Config{}, 900000, 1000000, nil},
+		{"above cap", &config.Config{GasLimit: 50000}, 100000, 0, ethereum.ErrGasLimitExceeded},
+		{"above block gas limit", &config.Config{}, 1500000, 0, ethereum.ErrGasLimitExceeded},
+	} {
+		e, err := ethereum.NewGasEstimator(test.config, &gasBackend{blockGasLimit: 1000000, gas: test.gas})
+		if err != nil {
+			t.Fatal(err)
+		}
+		gas, err := e.Estimate(context.Background(), goethereum.CallMsg{})
+		if errors.Cause(err) != test.err {
+			t.Fatalf("%s: expected error %v, got %v", test.name, test.err, err)
+		}
+		if gas != test.expected {
+			t.Fatalf("%s: expected %d, got %d", test.name, test.expected, gas)
+		}
+	}
+}
+
+func TestGasPricer(t *testing.T) {
+	conn := &gasBackend{}
+	for _, test := range []struct {
+		config   *config.Config
+		expected int64
+	}{
+		{&config.Config{GasPriceStrategy: ethereum.GasPriceFixed, GasPrice: 3}, 3},
+		{&config.Config{GasPriceStrategy: ethereum.GasPriceNode}, 7},
+		{&config.Config{}, 7},
+	} {
+		p, err := ethereum.NewGasPricer(test.config, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		price, err := p.GasPrice(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if price.Int64() != test.expected {
+			t.Fatalf("%q: expected %d, got %v", test.config.GasPriceStrategy, test.expected, price)
+		}
+	}
+
+	prices := &pricesBackend{prices: []int64{50, 10, 40, 20, 30}}
+	for _, test := range []struct {
+		percentile int
+		expected   int64
+	}{
+		{0, 10},
+		{50, 30},
+		{60, 30},
+		{100, 50},
+	} {
+		p, err := ethereum.NewGasPricer(&config.Config{GasPriceStrategy: ethereum.GasPricePercentile, GasPricePercentile: test.percentile}, prices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		price, err := p.GasPrice(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if price.Int64() != test.expected {
+			t.Fatalf("percentile %d: expected %d, got %v", test.percentile, test.expected, price)
+		}
+	}
+
+	for _, c := range []*config.Config{
+		{GasPriceStrategy: ethereum.GasPriceFixed},
+		{GasPriceStrategy: ethereum.GasPricePercentile},
+		{GasPriceStrategy: "auction"},
+	} {
+		if _, err := ethereum.NewGasPricer(c, conn); err == nil {
+			t.Errorf("expected strategy %q to be rejected", c.GasPriceStrategy)
+		}
+	}
+	for _, percentile := range []int{-1, 101} {
+		if _, err := ethereum.NewGasPricer(&config.Config{GasPriceStrategy: ethereum.GasPricePercentile, GasPricePercentile: percentile}, prices); err == nil {
+			t.Errorf("expected percentile %d to be rejected", percentile)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package ethereum
+
+import (
+	"context"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/SynapticHealthAlliance/pdx-contracts/go/contracts"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// ObjectEventType identifies the kind of change recorded by an ObjectCollection event
+type ObjectEventType string
+
+const (
+	// ObjectAdded is emitted when an object is added to a collection
+	ObjectAdded ObjectEventType = "added"
+	// ObjectUpdated is emitted when an object in a collection is updated
+	ObjectUpdated ObjectEventType = "updated"
+	// ObjectRemoved is emitted when an object is removed from a collection
+	ObjectRemoved ObjectEventType = "removed"
+)
+
+// ObjectEvent is a change to an object recorded by the ObjectCollection contract
+type ObjectEvent struct {
+	ID          uuid.UUID
+	Type        ObjectEventType
+	BlockNumber uint64
+	BlockHash   common.Hash
+	TxHash      common.Hash
+	LogIndex    uint
+	Removed     bool
+}
+
+func newObjectEvent(id [16]byte, eventType ObjectEventType, raw types.Log) *ObjectEvent {
+	return &ObjectEvent{
+		ID:          bytesToUUID(id),
+		Type:        eventType,
+		BlockNumber: raw.BlockNumber,
+		BlockHash:   raw.BlockHash,
+		TxHash:      raw.TxHash,
+		LogIndex:    raw.Index,
+		Removed:     raw.Removed,
+	}
+}
+
+// blockCaller is a bind.ContractCaller that executes every call against the state at a fixed block
+type blockCaller struct {
+	caller      bind.ContractCaller
+	blockNumber *big.Int
+}
+
+func (c *blockCaller) CodeAt(ctx context.Context, contract common.Address, _ *big.Int) ([]byte, error) {
+	return c.caller.CodeAt(ctx, contract, c.blockNumber)
+}
+
+func (c *blockCaller) CallContract(ctx context.Context, call ethereum.CallMsg, _ *big.Int) ([]byte, error) {
+	return c.caller.CallContract(ctx, call, c.blockNumber)
+}
+
+// ReadAt reads an object as it was stored at the end of the provided block
+func (a *Adapter) ReadAt(ctx context.Context, id uuid.UUID, blockNumber *big.Int) (*ObjectCollectionElement, error) {
+	caller, err := contracts.NewObjectCollectionCaller(a.objectCollectionContract.Address, &blockCaller{a.connection, blockNumber})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get collection contract")
+	}
+	r, err := caller.GetObject(&bind.CallOpts{Context: ctx}, id.Array())
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read from contract at block %v", blockNumber)
+	}
+	if r.Uri == "" {
+		return nil, ErrObjectNotFound
+	}
+	return NewObjectCollectionElement(r.Uri, r.CreatedAt, r.UpdatedAt, a.fetchers, a.keyring)
+}
+
+// ObjectEvents returns the changes recorded by the collection contract between two blocks (inclusive), oldest first
+// a nil toBlock reads up to the latest block, and a nil id reads the changes of every object
+// blocks before the deployment of the contract are skipped
+func (a *Adapter) ObjectEvents(ctx context.Context, fromBlock uint64, toBlock *uint64, id uuid.UUID) ([]*ObjectEvent, error) {
+	start, err := a.deploymentBlock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if fromBlock < start {
+		fromBlock = start
+	}
+	opts := &bind.FilterOpts{Start: fromBlock, End: toBlock, Context: ctx}
+	var ids [][16]byte
+	if id != nil {
+		ids = [][16]byte{id.Array()}
+	}
+	events := []*ObjectEvent{}
+
+	added, err := a.objectCollectionFilterer.FilterObjectAdded(opts, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to filter added events")
+	}
+	for added.Next() {
+		events = append(events, newObjectEvent(added.Event.Id, ObjectAdded, added.Event.Raw))
+	}
+	added.Close()
+	if err := added.Error(); err != nil {
+		return nil, errors.Wrap(err, "unable to read added events")
+	}
+
+	updated, err := a.objectCollectionFilterer.FilterObjectUpdated(opts, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to filter updated events")
+	}
+	for updated.Next() {
+		events = append(events, newObjectEvent(updated.Event.Id, ObjectUpdated, updated.Event.Raw))
+	}
+	updated.Close()
+	if err := updated.Error(); err != nil {
+		return nil, errors.Wrap(err, "unable to read updated events")
+	}
+
+	removed, err := a.objectCollectionFilterer.FilterObjectRemoved(opts, ids)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to filter removed events")
+	}
+	for removed.Next() {
+		events = append(events, newObjectEvent(removed.Event.Id, ObjectRemoved, removed.Event.Raw))
+	}
+	removed.Close()
+	if err := removed.Error(); err != nil {
+		return nil, errors.Wrap(err, "unable to read removed events")
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].BlockNumber != events[j].BlockNumber {
+			return events[i].BlockNumber < events[j].BlockNumber
+		}
+		return events[i].LogIndex < events[j].LogIndex
+	})
+	return events, nil
+}
+
+// deploymentBlock returns the block in which the collection contract was deployed, or an earlier block
+// the block is set by the contracts deploy command, and is otherwise found by searching for the first block in which
+// the contract has code; nodes that do not keep old states cannot be searched, and the whole chain is read instead
+func (a *Adapter) deploymentBlock(ctx context.Context) (uint64, error) {
+	a.startBlockLock.Lock()
+	defer a.startBlockLock.Unlock()
+	if a.startBlock != nil {
+		return *a.startBlock, nil
+	}
+	start := a.objectCollectionContract.StartBlock
+	if start == 0 {
+		head, err := a.connection.HeaderByNumber(ctx, nil)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to get latest block")
+		}
+		if start, err = a.searchDeploymentBlock(ctx, head.Number.Uint64()); err != nil {
+			a.log.WithError(err).Warn("unable to find deployment block of collection contract, reading events from the first block")
+			start = 0
+		}
+	}
+	a.startBlock = &start
+	return start, nil
+}
+
+// searchDeploymentBlock finds the first block up to head in which the collection contract has code
+func (a *Adapter) searchDeploymentBlock(ctx context.Context, head uint64) (uint64, error) {
+	address := a.objectCollectionContract.Address
+	low, high := uint64(0), head
+	for low < high {
+		mid := low + (high-low)/2
+		code, err := a.connection.CodeAt(ctx, address, new(big.Int).SetUint64(mid))
+		if err != nil {
+			return 0, errors.Wrapf(err, "failed to get code at block %d", mid)
+		}
+		if len(code) > 0 {
+			high = mid
+		} else {
+			low = mid + 1
+		}
+	}
+	return low, nil
+}
+
+// BlockTime returns the timestamp of a block
+func (a *Adapter) BlockTime(ctx context.Context, blockNumber uint64) (time.Time, error) {
+	h, err := a.connection.HeaderByNumber(ctx, new(big.Int).SetUint64(blockNumber))
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to get header of block %d", blockNumber)
+	}
+	return bigintToTime(h.Time), nil
+}
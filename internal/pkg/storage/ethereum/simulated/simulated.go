@@ -0,0 +1,150 @@
+package simulated
+
+import (
+	"context"
+	"math/big"
+	"sync"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/pdx-contracts/go/contracts"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind/backends"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	// blockInterval is the number of seconds between the blocks of a simulated chain
+	blockInterval = 10
+	// blockGasLimit is the gas limit of the genesis block of simulated chains, params.GenesisGasLimit
+	blockGasLimit = 4712388
+)
+
+var balance = new(big.Int).Mul(big.NewInt(1000), big.NewInt(1e18))
+
+// Backend is an ethereum.Backend backed by a simulated chain
+// every transaction is mined in its own block as soon as it is sent
+type Backend struct {
+	*backends.SimulatedBackend
+
+	blockNumber uint64
+	mutex       sync.Mutex
+}
+
+// SendTransaction ...
+func (b *Backend) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err := b.SimulatedBackend.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+	b.SimulatedBackend.Commit()
+	b.blockNumber++
+	return nil
+}
+
+// CodeAt ...
+func (b *Backend) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) ([]byte, error) {
+	return b.SimulatedBackend.CodeAt(ctx, contract, b.latest(blockNumber))
+}
+
+// CallContract ...
+func (b *Backend) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) ([]byte, error) {
+	return b.SimulatedBackend.CallContract(ctx, call, b.latest(blockNumber))
+}
+
+// HeaderByNumber returns the number, gas limit and time of a block, or of the latest block when number is nil
+func (b *Backend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	b.mutex.Lock()
+	head := b.blockNumber
+	b.mutex.Unlock()
+	n := head
+	if number != nil {
+		if !number.IsUint64() || number.Uint64() > head {
+			return nil, ethereum.NotFound
+		}
+		n = number.Uint64()
+	}
+	return &types.Header{
+		Number:   new(big.Int).SetUint64(n),
+		GasLimit: blockGasLimit,
+		Time:     new(big.Int).SetUint64(n * blockInterval),
+	}, nil
+}
+
+// latest replaces the number of the head block with nil, as the simulated backend only executes calls against the latest state
+func (b *Backend) latest(blockNumber *big.Int) *big.Int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if blockNumber != nil && blockNumber.IsUint64() && blockNumber.Uint64() == b.blockNumber {
+		return nil
+	}
+	return blockNumber
+}
+
+// Chain is a simulated chain with the contracts of an organization deployed on it
+type Chain struct {
+	*Backend
+
+	TransactOpts        *bind.TransactOpts
+	OrganizationAddress common.Address
+	Collections         map[string]*config.ObjectCollectionContract
+}
+
+// deploy waits for a deployment and returns the address of the contract
+func (c *Chain) deploy(name string, address common.Address, tx *types.Transaction, err error) (common.Address, error) {
+	if err != nil {
+		return address, errors.Wrapf(err, "failed to deploy %s", name)
+	}
+	if _, err := bind.WaitDeployed(context.Background(), c.Backend, tx); err != nil {
+		return address, errors.Wrapf(err, "failed to deploy %s", name)
+	}
+	return address, nil
+}
+
+// NewBackend creates a simulated chain in which the account of transactOpts is funded
+func NewBackend(transactOpts *bind.TransactOpts) *Backend {
+	alloc := core.GenesisAlloc{
+		transactOpts.From: core.GenesisAccount{Balance: balance},
+	}
+	return &Backend{SimulatedBackend: backends.NewSimulatedBackend(alloc)}
+}
+
+// NewChain creates a simulated chain and deploys an Organization contract, and an ObjectCollection
+// contract with its ObjectIndex contracts for each collection, filling in their addresses
+func NewChain(collections ...*config.ObjectCollectionContract) (*Chain, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate key")
+	}
+	opts := bind.NewKeyedTransactor(key)
+	opts.Context = context.Background()
+	c := &Chain{
+		Backend:      NewBackend(opts),
+		TransactOpts: opts,
+		Collections:  map[string]*config.ObjectCollectionContract{},
+	}
+
+	addr, tx, _, err := contracts.DeployOrganization(opts, c.Backend, "Simulated Organization")
+	if c.OrganizationAddress, err = c.deploy("organization", addr, tx, err); err != nil {
+		return nil, err
+	}
+	for _, coll := range collections {
+		addr, tx, _, err := contracts.DeployObjectCollection(opts, c.Backend)
+		if coll.Address, err = c.deploy(coll.Name+" collection", addr, tx, err); err != nil {
+			return nil, err
+		}
+		for _, idx := range coll.Indexes {
+			addr, tx, _, err := contracts.DeployObjectIndex(opts, c.Backend)
+			if idx.Address, err = c.deploy(coll.Name+" index "+idx.Name, addr, tx, err); err != nil {
+				return nil, err
+			}
+		}
+		c.Collections[coll.Name] = coll
+	}
+	return c, nil
+}
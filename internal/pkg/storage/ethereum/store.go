@@ -0,0 +1,241 @@
+package ethereum
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"reflect"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// ObjectReader reads the objects of a collection contract, either from the chain or from a copy of it
+type ObjectReader interface {
+	Read(ctx context.Context, id uuid.UUID) (*ObjectCollectionElement, error)
+	ReadAt(ctx context.Context, id uuid.UUID, blockNumber *big.Int) (*ObjectCollectionElement, error)
+	ObjectEvents(ctx context.Context, fromBlock uint64, toBlock *uint64, id uuid.UUID) ([]*ObjectEvent, error)
+	BlockTime(ctx context.Context, blockNumber uint64) (time.Time, error)
+	FindObjectIDs(ctx context.Context, indexAddress common.Address, value string) ([]uuid.UUID, error)
+}
+
+var changeTypes = map[ObjectEventType]storage.ChangeType{
+	ObjectAdded:   storage.ChangeCreate,
+	ObjectUpdated: storage.ChangeUpdate,
+	ObjectRemoved: storage.ChangeDelete,
+}
+
+// transactionWrite reports the outcome of a transaction as a storage.Write
+type transactionWrite struct {
+	*PendingTransaction
+}
+
+func (w transactionWrite) ID() string {
+	return w.Hash()
+}
+
+func (w transactionWrite) Wait(ctx context.Context) error {
+	_, err := w.PendingTransaction.Wait(ctx)
+	return err
+}
+
+func (w transactionWrite) OnApplied(fn func()) {
+	w.OnSuccess(fn)
+}
+
+func newTransactionWrite(txn *PendingTransaction, err error) (storage.Write, error) {
+	if err != nil {
+		return nil, err
+	}
+	return transactionWrite{txn}, nil
+}
+
+// Store is a storage.Store backed by a collection contract
+// the version of the store is the block number, and writes complete when their transaction is mined
+type Store struct {
+	adapter *Adapter
+	reader  ObjectReader
+}
+
+// Create ...
+func (s *Store) Create(ctx context.Context, id uuid.UUID, data []byte) (storage.Write, error) {
+	elementData, err := NewObjectCollectionElementData(ctx, s.adapter.ipfs, s.adapter.keyring, data)
+	if err != nil {
+		return nil, err
+	}
+	return newTransactionWrite(s.adapter.Create(ctx, id, elementData))
+}
+
+// Read ...
+func (s *Store) Read(ctx context.Context, id uuid.UUID) (*storage.Object, error) {
+	element, err := s.reader.Read(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return elementToObject(id, element)
+}
+
+// ReadAt returns an object as it was stored at the end of a block
+func (s *Store) ReadAt(ctx context.Context, id uuid.UUID, version uint64) (*storage.Object, error) {
+	element, err := s.reader.ReadAt(ctx, id, new(big.Int).SetUint64(version))
+	if err != nil {
+		return nil, err
+	}
+	return elementToObject(id, element)
+}
+
+// Update ...
+func (s *Store) Update(ctx context.Context, id uuid.UUID, lastUpdatedAt time.Time, data []byte) (storage.Write, error) {
+	var previous []byte
+	if element, err := s.adapter.Read(ctx, id); err == nil {
+		// unreadable data, such as a payload that cannot be fetched or decrypted, counts as a complete change
+		previous, _ = element.Data.Bytes()
+	}
+	elementData, err := NewObjectCollectionElementData(ctx, s.adapter.ipfs, s.adapter.keyring, data)
+	if err != nil {
+		return nil, err
+	}
+	return newTransactionWrite(s.adapter.Update(ctx, id, lastUpdatedAt, elementData, changeScore(previous, data)))
+}
+
+// changeScore returns the percentage of the top-level elements of a JSON document that an update changes, ignoring
+// meta, which changes with every version
+// 100 is returned when either document cannot be read
+func changeScore(previous []byte, data []byte) uint8 {
+	var before, after map[string]interface{}
+	if err := json.Unmarshal(previous, &before); err != nil || before == nil {
+		return 100
+	}
+	if err := json.Unmarshal(data, &after); err != nil || after == nil {
+		return 100
+	}
+	elements := map[string]bool{}
+	for k := range before {
+		elements[k] = true
+	}
+	for k := range after {
+		elements[k] = true
+	}
+	delete(elements, "meta")
+	if len(elements) == 0 {
+		return 0
+	}
+	changed := 0
+	for k := range elements {
+		if !reflect.DeepEqual(before[k], after[k]) {
+			changed++
+		}
+	}
+	return uint8(changed * 100 / len(elements))
+}
+
+// Destroy ...
+func (s *Store) Destroy(ctx context.Context, id uuid.UUID) (storage.Write, error) {
+	return newTransactionWrite(s.adapter.Destroy(ctx, id))
+}
+
+// CurrentVersion returns the current block number
+func (s *Store) CurrentVersion(ctx context.Context) (uint64, error) {
+	n, err := s.adapter.CurrentBlock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return n.Uint64(), nil
+}
+
+// History returns the changes recorded by the events of the collection contract, ordered by block and log index
+func (s *Store) History(ctx context.Context, id uuid.UUID) ([]*storage.Change, error) {
+	events, err := s.reader.ObjectEvents(ctx, 0, nil, id)
+	if err != nil {
+		return nil, err
+	}
+	blockTimes := map[uint64]time.Time{}
+	changes := []*storage.Change{}
+	for _, e := range events {
+		if e.Removed {
+			continue
+		}
+		ts, ok := blockTimes[e.BlockNumber]
+		if !ok {
+			if ts, err = s.reader.BlockTime(ctx, e.BlockNumber); err != nil {
+				return nil, err
+			}
+			blockTimes[e.BlockNumber] = ts
+		}
+		changes = append(changes, &storage.Change{
+			ID:      e.ID,
+			Type:    changeTypes[e.Type],
+			Version: e.BlockNumber,
+			Time:    ts,
+		})
+	}
+	return changes, nil
+}
+
+// Find queries the ObjectIndex contract of an index
+func (s *Store) Find(ctx context.Context, index string, value string) ([]uuid.UUID, error) {
+	idx, err := storage.GetIndex(s.adapter.Collection(), index)
+	if err != nil {
+		return nil, err
+	}
+	return s.reader.FindObjectIDs(ctx, idx.Address, value)
+}
+
+// List replays the events of the collection contract, since the contract cannot enumerate its objects
+func (s *Store) List(ctx context.Context) ([]uuid.UUID, error) {
+	events, err := s.reader.ObjectEvents(ctx, 0, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uuid.UUID{}
+	removed := map[string]bool{}
+	for _, e := range events {
+		if e.Removed {
+			continue
+		}
+		key := e.ID.String()
+		if _, seen := removed[key]; !seen {
+			ids = append(ids, e.ID)
+		}
+		removed[key] = e.Type == ObjectRemoved
+	}
+	current := []uuid.UUID{}
+	for _, id := range ids {
+		if !removed[id.String()] {
+			current = append(current, id)
+		}
+	}
+	return current, nil
+}
+
+// Primary returns a store that reads from the chain, when reads are served from a mirror
+func (s *Store) Primary() storage.Store {
+	if s.reader == ObjectReader(s.adapter) {
+		return s
+	}
+	return NewStore(s.adapter, s.adapter)
+}
+
+func elementToObject(id uuid.UUID, element *ObjectCollectionElement) (*storage.Object, error) {
+	data, err := element.Data.Bytes()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get bytes from object data")
+	}
+	return &storage.Object{
+		ID:        id,
+		Data:      data,
+		CreatedAt: element.CreatedAt,
+		UpdatedAt: element.UpdatedAt,
+	}, nil
+}
+
+// NewStore creates a store that writes through an adapter and reads from a reader, which may be the adapter itself
+func NewStore(adapter *Adapter, reader ObjectReader) *Store {
+	return &Store{
+		adapter: adapter,
+		reader:  reader,
+	}
+}
@@ -0,0 +1,25 @@
+package ethereum
+
+import "testing"
+
+func TestChangeScore(t *testing.T) {
+	tests := []struct {
+		name     string
+		previous string
+		data     string
+		score    uint8
+	}{
+		{"unchanged", `{"resourceType": "Practitioner", "active": true}`, `{"resourceType": "Practitioner", "active": true}`, 0},
+		{"meta only", `{"active": true, "meta": {"versionId": "1"}}`, `{"active": true, "meta": {"versionId": "2"}}`, 0},
+		{"one of four", `{"resourceType": "Practitioner", "active": true, "gender": "male", "name": [{"family": "Careful"}]}`, `{"resourceType": "Practitioner", "active": false, "gender": "male", "name": [{"family": "Careful"}]}`, 25},
+		{"nested change", `{"resourceType": "Practitioner", "name": [{"family": "Careful"}]}`, `{"resourceType": "Practitioner", "name": [{"family": "Cautious"}]}`, 50},
+		{"added and removed", `{"resourceType": "Practitioner", "active": true}`, `{"resourceType": "Practitioner", "gender": "male"}`, 66},
+		{"unreadable previous data", ``, `{"resourceType": "Practitioner"}`, 100},
+		{"not an object", `[1, 2]`, `{"resourceType": "Practitioner"}`, 100},
+	}
+	for _, tt := range tests {
+		if score := changeScore([]byte(tt.previous), []byte(tt.data)); score != tt.score {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.score, score)
+		}
+	}
+}
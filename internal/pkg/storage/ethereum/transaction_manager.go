@@ -0,0 +1,269 @@
+package ethereum
+
+import (
+	"context"
+	"expvar"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// metrics are published at /debug/vars when pprof is enabled
+var metrics = expvar.NewMap("ethereum")
+
+// knownErrors are reported by nodes when a transaction is already in their pool, i.e. it was submitted before
+var knownErrors = []string{
+	"known transaction",
+	"already known",
+}
+
+// errCaptured is returned by the signer of a dry run, which captures the transaction instead of sending it
+var errCaptured = errors.New("transaction captured")
+
+// TransactFunc sends a transaction with the provided options, e.g. a method of a bound contract transactor
+type TransactFunc func(opts *bind.TransactOpts) (*types.Transaction, error)
+
+// TransactionManager sends the transactions of the account of the server
+// nonces are allocated locally, so that concurrent requests do not submit transactions with the same nonce, and are
+// synced with the pending nonce of the node when it starts, after a submission fails and after a transaction times out
+type TransactionManager struct {
+	connection    Backend
+	estimator     *GasEstimator
+	gasPriceBump  int64
+	log           logging.FieldLogger
+	maxGasPrice   *big.Int
+	mutex         sync.Mutex
+	nonce         uint64
+	opts          *bind.TransactOpts
+	pricer        GasPricer
+	queued        int64
+	resubmitAfter time.Duration
+	synced        bool
+}
+
+// QueueDepth returns the number of transactions waiting to be submitted
+func (m *TransactionManager) QueueDepth() int64 {
+	return atomic.LoadInt64(&m.queued)
+}
+
+// nonceErrors are reported by nodes when the nonce of a transaction was already used, or leaves a gap
+var nonceErrors = []string{
+	"nonce too low",
+	"nonce too high",
+}
+
+// Transact sends a transaction with the next nonce of the account
+// when the node rejects the nonce, it is synced again and the transaction is retried once
+func (m *TransactionManager) Transact(ctx context.Context, fn TransactFunc) (*types.Transaction, error) {
+	if m == nil {
+		return nil, errors.New("no account is configured to send transactions")
+	}
+	atomic.AddInt64(&m.queued, 1)
+	m.mutex.Lock()
+	atomic.AddInt64(&m.queued, -1)
+	defer m.mutex.Unlock()
+
+	txn, err := m.send(ctx, fn)
+	if err != nil && isNonceError(err) {
+		m.log.WithError(err).Warn("nonce rejected, syncing with node and retrying")
+		txn, err = m.send(ctx, fn)
+	}
+	return txn, err
+}
+
+// send must be called with the mutex held
+func (m *TransactionManager) send(ctx context.Context, fn TransactFunc) (*types.Transaction, error) {
+	gasLimit, err := m.estimateGas(ctx, fn)
+	if err != nil {
+		return nil, err
+	}
+	gasPrice, err := m.pricer.GasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if m.maxGasPrice != nil && gasPrice.Cmp(m.maxGasPrice) > 0 {
+		gasPrice = m.maxGasPrice
+	}
+	if !m.synced {
+		nonce, err := m.connection.PendingNonceAt(ctx, m.opts.From)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to get pending nonce")
+		}
+		m.log.WithField("nonce", nonce).Debug("synced nonce")
+		m.nonce = nonce
+		m.synced = true
+	}
+	var signed *types.Transaction
+	opts := *m.opts
+	opts.Context = ctx
+	opts.Nonce = new(big.Int).SetUint64(m.nonce)
+	opts.GasLimit = gasLimit
+	opts.GasPrice = gasPrice
+	opts.Signer = func(signer types.Signer, from common.Address, txn *types.Transaction) (*types.Transaction, error) {
+		s, err := m.opts.Signer(signer, from, txn)
+		signed = s
+		return s, err
+	}
+	txn, err := fn(&opts)
+	if err != nil && signed != nil && isKnownError(err) {
+		// the node already holds the transaction, so it was submitted
+		m.log.WithError(err).WithField("hash", signed.Hash().Hex()).Debug("transaction already known")
+		txn, err = signed, nil
+	}
+	if err != nil {
+		// the node may have taken the nonce or moved past it, so the next transaction syncs it again
+		m.synced = false
+		return nil, err
+	}
+	m.nonce++
+	return txn, nil
+}
+
+// Resync makes the next transaction sync its nonce with the node, e.g. after a transaction timed out and may have
+// been dropped from the pool, which would leave a gap that every later transaction waits behind
+func (m *TransactionManager) Resync() {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.synced = false
+}
+
+// estimateGas captures the transaction that fn would send, and estimates the gas it needs
+func (m *TransactionManager) estimateGas(ctx context.Context, fn TransactFunc) (uint64, error) {
+	var captured *types.Transaction
+	opts := &bind.TransactOpts{
+		From:    m.opts.From,
+		Context: ctx,
+		// the nonce, price and limit are set so that the bound contract does not request them from the node
+		Nonce:    new(big.Int),
+		GasPrice: new(big.Int),
+		GasLimit: 1,
+		Signer: func(signer types.Signer, from common.Address, txn *types.Transaction) (*types.Transaction, error) {
+			captured = txn
+			return nil, errCaptured
+		},
+	}
+	if _, err := fn(opts); err != errCaptured {
+		if err == nil {
+			err = errors.New("transaction was not signed")
+		}
+		return 0, err
+	}
+	return m.estimator.Estimate(ctx, ethereum.CallMsg{
+		From:  m.opts.From,
+		To:    captured.To(),
+		Value: captured.Value(),
+		Data:  captured.Data(),
+	})
+}
+
+// ResubmitAfter returns how long a transaction may stay unmined before it is resubmitted with a higher gas price
+// zero disables resubmission
+func (m *TransactionManager) ResubmitAfter() time.Duration {
+	if m == nil {
+		return 0
+	}
+	return m.resubmitAfter
+}
+
+// Resubmit replaces a transaction that has not been mined with one that has the same nonce and a higher gas price
+func (m *TransactionManager) Resubmit(ctx context.Context, txn *types.Transaction) (*types.Transaction, error) {
+	gasPrice := new(big.Int).Mul(txn.GasPrice(), big.NewInt(100+m.gasPriceBump))
+	gasPrice.Div(gasPrice, big.NewInt(100))
+	// nodes only accept a replacement with a strictly higher price
+	gasPrice.Add(gasPrice, big.NewInt(1))
+	if m.maxGasPrice != nil && gasPrice.Cmp(m.maxGasPrice) > 0 {
+		return nil, errors.Errorf("gas price %v would exceed the maximum of %v", gasPrice, m.maxGasPrice)
+	}
+	if txn.To() == nil {
+		return nil, errors.New("contract creations are not resubmitted")
+	}
+	raw := types.NewTransaction(txn.Nonce(), *txn.To(), txn.Value(), txn.Gas(), gasPrice, txn.Data())
+	signed, err := m.opts.Signer(types.HomesteadSigner{}, m.opts.From, raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign replacement transaction")
+	}
+	if err := m.connection.SendTransaction(ctx, signed); err != nil {
+		return nil, errors.Wrap(err, "failed to send replacement transaction")
+	}
+	m.log.WithFields(logging.Fields{
+		"nonce":       txn.Nonce(),
+		"gas_price":   gasPrice.String(),
+		"replaced":    txn.Hash().Hex(),
+		"replacement": signed.Hash().Hex(),
+	}).Warn("resubmitted stuck transaction")
+	return signed, nil
+}
+
+func isKnownError(err error) bool {
+	return containsAny(err, knownErrors)
+}
+
+func isNonceError(err error) bool {
+	return containsAny(err, nonceErrors)
+}
+
+func containsAny(err error, errs []string) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range errs {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewTransactionManager creates the manager of the transactions sent with the options of the account of the server
+// nil is returned when there is no account, as on a multi-tenant server that only serves its tenants
+func NewTransactionManager(log *logging.Logger, config *config.Config, conn Backend, opts *bind.TransactOpts) (*TransactionManager, error) {
+	if opts == nil {
+		return nil, nil
+	}
+	estimator, err := NewGasEstimator(config, conn)
+	if err != nil {
+		return nil, err
+	}
+	pricer, err := NewGasPricer(config, conn)
+	if err != nil {
+		return nil, err
+	}
+	bump := config.TransactionGasPriceBump
+	if bump == 0 {
+		bump = 10
+	} else if bump < 10 {
+		// nodes reject replacements that raise the price by less than 10%
+		return nil, errors.New("txn_gas_price_bump must be at least 10")
+	}
+	m := &TransactionManager{
+		connection:    conn,
+		estimator:     estimator,
+		gasPriceBump:  bump,
+		log:           log.WithField("component", "transactions"),
+		opts:          opts,
+		pricer:        pricer,
+		resubmitAfter: config.TransactionResubmitAfter,
+	}
+	if config.TransactionMaxGasPrice > 0 {
+		m.maxGasPrice = big.NewInt(config.TransactionMaxGasPrice)
+	}
+	metric := "transaction_queue_depth"
+	if config.Tenant != "" {
+		metric += "." + config.Tenant
+	}
+	metrics.Set(metric, expvar.Func(func() interface{} {
+		return m.QueueDepth()
+	}))
+	return m, nil
+}
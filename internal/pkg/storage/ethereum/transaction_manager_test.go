@@ -0,0 +1,182 @@
+package ethereum_test
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum/simulated"
+	goethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// transfer sends 1 wei to an empty account with the provided options
+func transfer(backend *simulated.Backend) ethereum.TransactFunc {
+	return func(opts *bind.TransactOpts) (*types.Transaction, error) {
+		raw := types.NewTransaction(opts.Nonce.Uint64(), common.HexToAddress("0x1"), big.NewInt(1), opts.GasLimit, opts.GasPrice, nil)
+		txn, err := opts.Signer(types.HomesteadSigner{}, opts.From, raw)
+		if err != nil {
+			return nil, err
+		}
+		return txn, backend.SendTransaction(opts.Context, txn)
+	}
+}
+
+func newTestManager(t *testing.T, c *config.Config) (*ethereum.TransactionManager, *simulated.Chain) {
+	chain, err := simulated.NewChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ethereum.NewTransactionManager(logging.NewLogger(), c, chain.Backend, chain.TransactOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, chain
+}
+
+func TestConcurrentTransact(t *testing.T) {
+	m, chain := newTestManager(t, &config.Config{})
+	ctx := context.Background()
+	start, err := chain.PendingNonceAt(ctx, chain.TransactOpts.From)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const count = 20
+	nonces := make(chan uint64, count)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			txn, err := m.Transact(ctx, transfer(chain.Backend))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			nonces <- txn.Nonce()
+		}()
+	}
+	wg.Wait()
+	close(nonces)
+
+	seen := map[uint64]bool{}
+	for nonce := range nonces {
+		if seen[nonce] {
+			t.Fatalf("nonce %d was used twice", nonce)
+		}
+		seen[nonce] = true
+	}
+	for nonce := start; nonce < start+count; nonce++ {
+		if !seen[nonce] {
+			t.Fatalf("nonce %d was skipped", nonce)
+		}
+	}
+	if depth := m.QueueDepth(); depth != 0 {
+		t.Fatalf("expected an empty queue, got %d", depth)
+	}
+}
+
+func TestNewTransactionManagerRejectsSmallBump(t *testing.T) {
+	if _, err := ethereum.NewTransactionManager(logging.NewLogger(), &config.Config{TransactionGasPriceBump: 5}, nil, &bind.TransactOpts{}); err == nil {
+		t.Fatal("expected a gas price bump below 10% to be rejected")
+	}
+}
+
+// nonceBackend reports a fixed pending nonce, and counts how often it is asked for it
+type nonceBackend struct {
+	ethereum.Backend
+	nonce uint64
+	syncs int
+}
+
+func (b *nonceBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: big.NewInt(1)}, nil
+}
+
+func (b *nonceBackend) EstimateGas(ctx context.Context, call goethereum.CallMsg) (uint64, error) {
+	return 21000, nil
+}
+
+func (b *nonceBackend) PendingNonceAt(ctx context.Context, account common.Address) (uint64, error) {
+	b.syncs++
+	return b.nonce, nil
+}
+
+func TestTransactSubmissionErrors(t *testing.T) {
+	backend := &nonceBackend{nonce: 5}
+	opts := &bind.TransactOpts{
+		From: common.HexToAddress("0x1"),
+		Signer: func(signer types.Signer, from common.Address, txn *types.Transaction) (*types.Transaction, error) {
+			return txn, nil
+		},
+	}
+	m, err := ethereum.NewTransactionManager(logging.NewLogger(), &config.Config{GasPriceStrategy: ethereum.GasPriceFixed, GasPrice: 1}, backend, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// failing signs the transaction and fails to send it with the provided errors in turn
+	failing := func(errs ...error) ethereum.TransactFunc {
+		return func(opts *bind.TransactOpts) (*types.Transaction, error) {
+			raw := types.NewTransaction(opts.Nonce.Uint64(), common.HexToAddress("0x2"), big.NewInt(1), opts.GasLimit, opts.GasPrice, nil)
+			txn, err := opts.Signer(types.HomesteadSigner{}, opts.From, raw)
+			if err != nil || len(errs) == 0 {
+				return txn, err
+			}
+			err, errs = errs[0], errs[1:]
+			return nil, err
+		}
+	}
+	ctx := context.Background()
+
+	txn, err := m.Transact(ctx, failing(errors.New("known transaction: 0xabc")))
+	if err != nil || txn == nil || txn.Nonce() != 5 {
+		t.Fatalf("expected a known transaction to be submitted with nonce 5, got %v, %v", txn, err)
+	}
+	txn, err = m.Transact(ctx, failing(errors.New("already known")))
+	if err != nil || txn == nil || txn.Nonce() != 6 {
+		t.Fatalf("expected an already known transaction to be submitted with nonce 6, got %v, %v", txn, err)
+	}
+
+	// other failures keep the nonce, and sync it with the node again in case the node took it
+	backend.nonce = 7
+	if _, err := m.Transact(ctx, failing(errors.New("replacement transaction underpriced"))); err == nil {
+		t.Fatal("expected an underpriced replacement to fail")
+	}
+	if _, err := m.Transact(ctx, failing(errors.New("insufficient funds for gas * price + value"))); err == nil {
+		t.Fatal("expected a failed submission to fail")
+	}
+	txn, err = m.Transact(ctx, failing())
+	if err != nil || txn.Nonce() != 7 || backend.syncs != 3 {
+		t.Fatalf("expected nonce 7 after syncing again, got %v, %v after %d syncs", txn, err, backend.syncs)
+	}
+
+	// a nonce that is too low is synced with the node and retried
+	backend.nonce = 20
+	txn, err = m.Transact(ctx, failing(errors.New("nonce too low")))
+	if err != nil || txn.Nonce() != 20 || backend.syncs != 4 {
+		t.Fatalf("expected nonce 20 after syncing, got %v, %v after %d syncs", txn, err, backend.syncs)
+	}
+
+	// as is a nonce that leaves a gap, e.g. after a transaction was dropped from the pool
+	backend.nonce = 18
+	txn, err = m.Transact(ctx, failing(errors.New("nonce too high")))
+	if err != nil || txn.Nonce() != 18 || backend.syncs != 5 {
+		t.Fatalf("expected nonce 18 after syncing, got %v, %v after %d syncs", txn, err, backend.syncs)
+	}
+
+	// a transaction that timed out makes the next one sync
+	backend.nonce = 19
+	m.Resync()
+	txn, err = m.Transact(ctx, failing())
+	if err != nil || txn.Nonce() != 19 || backend.syncs != 6 {
+		t.Fatalf("expected nonce 19 after resyncing, got %v, %v after %d syncs", txn, err, backend.syncs)
+	}
+}
@@ -0,0 +1,134 @@
+package ethereum
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/pkg/errors"
+)
+
+// ErrTransactionFailed is returned when a transaction was mined but reverted
+var ErrTransactionFailed = storage.ErrWriteFailed
+
+// TransactionStatus is the outcome of a submitted transaction
+type TransactionStatus string
+
+const (
+	// TransactionPending is the status of a transaction that has not been mined yet
+	TransactionPending TransactionStatus = "pending"
+	// TransactionSucceeded is the status of a transaction that was mined successfully
+	TransactionSucceeded TransactionStatus = "succeeded"
+	// TransactionFailed is the status of a transaction that was reverted
+	TransactionFailed TransactionStatus = "failed"
+	// TransactionUnknown is the status of a transaction that was not mined in time, which may still be mined
+	TransactionUnknown TransactionStatus = "unknown"
+	// TransactionDropped is the status of a transaction that was still not mined long after it was submitted, which
+	// the node is assumed to have dropped
+	TransactionDropped TransactionStatus = "dropped"
+)
+
+// TransactionOperation is the change a transaction makes to an object
+type TransactionOperation string
+
+const (
+	// OperationCreate adds an object to a collection
+	OperationCreate TransactionOperation = "create"
+	// OperationUpdate updates an object in a collection
+	OperationUpdate TransactionOperation = "update"
+	// OperationDelete removes an object from a collection
+	OperationDelete TransactionOperation = "delete"
+)
+
+// TransactionRecord is a submitted transaction and its outcome, as stored in the database
+// Hash identifies the transaction to clients, while LatestHash is the last submission, which differs once a stuck
+// transaction has been resubmitted with a higher gas price
+type TransactionRecord struct {
+	Hash         string `gorm:"primary_key"`
+	LatestHash   string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	ResourceType string
+	ResourceID   string `gorm:"index"`
+	Operation    TransactionOperation
+	Status       TransactionStatus
+	GasUsed      uint64
+	BlockNumber  uint64
+	Error        string
+	// Owner is the client whose request sent the transaction, whose token is required to read its status when
+	// authorization is enabled
+	Owner string
+	// Tenant is the organization of the collection the transaction was sent to, empty for the top level organization
+	Tenant string `gorm:"not null;default:''"`
+}
+
+// PendingTransaction is a submitted transaction whose outcome is reported by the TransactionsListener
+// the manager that sent it resubmits it, so that the transactions of a tenant are resubmitted with its own account
+type PendingTransaction struct {
+	Transaction *types.Transaction
+	Record      *TransactionRecord
+	done        chan struct{}
+	manager     *TransactionManager
+	mutex       sync.Mutex
+	onSuccess   []func()
+	finished    bool
+}
+
+func newPendingTransaction(txn *types.Transaction, record *TransactionRecord, manager *TransactionManager) *PendingTransaction {
+	return &PendingTransaction{
+		Transaction: txn,
+		Record:      record,
+		done:        make(chan struct{}),
+		manager:     manager,
+	}
+}
+
+// Hash ...
+func (t *PendingTransaction) Hash() string {
+	return t.Record.Hash
+}
+
+// Wait blocks until the outcome of the transaction is known
+// ErrTransactionFailed is returned if the transaction was reverted
+func (t *PendingTransaction) Wait(ctx context.Context) (*TransactionRecord, error) {
+	select {
+	case <-t.done:
+		if t.Record.Status != TransactionSucceeded {
+			return t.Record, errors.Wrap(ErrTransactionFailed, t.Record.Error)
+		}
+		return t.Record, nil
+	case <-ctx.Done():
+		return t.Record, ctx.Err()
+	}
+}
+
+// OnSuccess calls fn from the TransactionsListener once the transaction has been mined successfully
+// fn is called straight away when the transaction has already succeeded, and never when it failed
+func (t *PendingTransaction) OnSuccess(fn func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.finished {
+		t.onSuccess = append(t.onSuccess, fn)
+		return
+	}
+	if t.Record.Status == TransactionSucceeded {
+		fn()
+	}
+}
+
+// finish releases everyone waiting for the outcome, which must already be recorded
+func (t *PendingTransaction) finish() {
+	t.mutex.Lock()
+	t.finished = true
+	callbacks := t.onSuccess
+	t.onSuccess = nil
+	t.mutex.Unlock()
+	close(t.done)
+	if t.Record.Status == TransactionSucceeded {
+		for _, fn := range callbacks {
+			fn()
+		}
+	}
+}
@@ -2,41 +2,89 @@ package ethereum
 
 import (
 	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
 	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
-	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"go.uber.org/fx"
 )
 
+// receiptPollInterval is the interval at which the receipts of pending transactions are requested
+const receiptPollInterval = time.Second
+
 // TransactionsChannel ...
-type TransactionsChannel chan *types.Transaction
+type TransactionsChannel chan *PendingTransaction
 
 // NewTransactionsChannel ...
 func NewTransactionsChannel(c *config.Config) TransactionsChannel {
 	return make(TransactionsChannel, c.TransactionsChannelBuffer)
 }
 
+// receiptBlockReader is implemented by the connections that can read the block number of a receipt, which the
+// receipts of go-ethereum do not carry
+type receiptBlockReader interface {
+	ReceiptBlockNumber(ctx context.Context, txHash common.Hash) (uint64, error)
+}
+
+// watchedTransaction is a transaction whose receipt the TransactionsListener is waiting for
+type watchedTransaction struct {
+	txn         *PendingTransaction
+	submissions []*types.Transaction
+	timedOut    bool
+}
+
 // TransactionsListener ...
+// transactions that are not mined within the timeout are recorded with an unknown status, and checked again at the
+// same interval until their receipt is found, as are the transactions left pending by a previous run of the server
+// those still without a receipt once they are older than dropAfter are recorded as dropped
 type TransactionsListener struct {
 	log           logging.FieldLogger
 	txnsChan      TransactionsChannel
 	context       context.Context
 	contextCancel context.CancelFunc
-	connection    *ethclient.Client
+	connection    Backend
+	db            *database.DB
+	dropAfter     time.Duration
+	pending       int64
+	timeout       time.Duration
+	watched       map[string]*watchedTransaction
+	watchedLock   sync.Mutex
 }
 
 // Start ...
 func (l *TransactionsListener) Start() {
 	l.log.Info("started")
+	// rechecks poll the node for every transaction of unknown outcome, so they run apart from the intake
+	go func() {
+		ticker := time.NewTicker(l.timeout)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				l.recheck(l.context)
+			case <-l.context.Done():
+				return
+			}
+		}
+	}()
 	go func() {
 		for {
 			select {
 			case txn := <-l.txnsChan:
-				l.processTxn(txn)
+				// transactions are mined out of order when stuck ones are resubmitted, so each one is watched separately
+				atomic.AddInt64(&l.pending, 1)
+				go func() {
+					defer atomic.AddInt64(&l.pending, -1)
+					l.processTxn(txn)
+				}()
 			case <-l.context.Done():
 				l.log.Info("stopped")
 				return
@@ -45,41 +93,226 @@ func (l *TransactionsListener) Start() {
 	}()
 }
 
-func (l *TransactionsListener) processTxn(txn *types.Transaction) {
-	log := l.log.WithField("txn", txn.Hash().String())
+func (l *TransactionsListener) processTxn(txn *PendingTransaction) {
+	log := l.log.WithField("txn", txn.Hash())
 	log.Debug("listener received transaction")
-	ctx, cancel := context.WithTimeout(l.context, (30 * time.Second))
+	watched := &watchedTransaction{txn: txn}
+	l.watchedLock.Lock()
+	l.watched[txn.Hash()] = watched
+	l.watchedLock.Unlock()
+	ctx, cancel := context.WithTimeout(l.context, l.timeout)
 	defer cancel()
-	receipt, err := bind.WaitMined(ctx, l.connection, txn)
+	receipt, submissions, err := l.waitMined(ctx, txn)
 	if err != nil {
-		log.WithError(err).Error("error reported while waiting for transaction to be mined")
-	}
-	if receipt != nil {
-		msg := "receipt received"
-		entry := log.WithFields(logging.Fields{
-			"gas_used":       receipt.GasUsed,
-			"total_gas_used": receipt.CumulativeGasUsed,
-		})
-		if receipt.Status != types.ReceiptStatusSuccessful {
-			entry.WithField("status", "failed").Error(msg)
+		if l.context.Err() != nil {
+			// shutting down, the transaction may still be mined
 			return
 		}
-		entry.WithField("status", "success").Info(msg)
+		log.WithError(err).Warn("transaction was not mined in time, its outcome is checked again later")
+		// the transaction may have been dropped from the pool, leaving a gap before the nonces sent after it
+		txn.manager.Resync()
+		txn.Record.Status = TransactionUnknown
+		txn.Record.Error = "transaction was not mined in time: " + err.Error()
+		txn.Record.UpdatedAt = time.Now().UTC()
+		if err := l.db.Save(txn.Record).Error; err != nil {
+			log.WithError(err).Error("failed to save transaction outcome")
+		}
+		l.watchedLock.Lock()
+		watched.submissions = submissions
+		watched.timedOut = true
+		l.watchedLock.Unlock()
+		return
+	}
+	l.watchedLock.Lock()
+	delete(l.watched, txn.Hash())
+	l.watchedLock.Unlock()
+	l.recordReceipt(ctx, txn.Record, receipt)
+	txn.finish()
+}
+
+// recordReceipt saves the outcome of a mined transaction
+func (l *TransactionsListener) recordReceipt(ctx context.Context, record *TransactionRecord, receipt *types.Receipt) {
+	log := l.log.WithFields(logging.Fields{
+		"txn":            record.Hash,
+		"gas_used":       receipt.GasUsed,
+		"total_gas_used": receipt.CumulativeGasUsed,
+	})
+	record.GasUsed = receipt.GasUsed
+	record.BlockNumber = l.receiptBlockNumber(ctx, receipt)
+	record.Error = ""
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		log.WithField("status", "failed").Error("receipt received")
+		record.Status = TransactionFailed
+		record.Error = "transaction was reverted"
+	} else {
+		log.WithField("status", "success").Info("receipt received")
+		record.Status = TransactionSucceeded
+	}
+	record.UpdatedAt = time.Now().UTC()
+	if err := l.db.Save(record).Error; err != nil {
+		log.WithError(err).Error("failed to save transaction outcome")
+	}
+}
+
+// recheck looks for the receipts of the transactions whose outcome is unknown, including the transactions left
+// pending by a previous run of the server, and records the ones that are too old to be mined any more as dropped
+func (l *TransactionsListener) recheck(ctx context.Context) {
+	records := []*TransactionRecord{}
+	orphaned := time.Now().UTC().Add(-2 * l.timeout)
+	err := l.db.Where("status = ? OR (status = ? AND updated_at < ?)", TransactionUnknown, TransactionPending, orphaned).Find(&records).Error
+	if err != nil {
+		l.log.WithError(err).Error("failed to query transactions of unknown outcome")
+		return
+	}
+	for _, record := range records {
+		l.watchedLock.Lock()
+		watched := l.watched[record.Hash]
+		l.watchedLock.Unlock()
+		if watched != nil && !watched.timedOut {
+			// still waited for by processTxn
+			continue
+		}
+		hashes := []common.Hash{common.HexToHash(record.Hash)}
+		if record.LatestHash != "" && record.LatestHash != record.Hash {
+			hashes = append(hashes, common.HexToHash(record.LatestHash))
+		}
+		if watched != nil {
+			for _, tx := range watched.submissions {
+				hashes = append(hashes, tx.Hash())
+			}
+			record = watched.txn.Record
+		}
+		receipt := l.findReceipt(ctx, hashes)
+		if receipt != nil {
+			l.recordReceipt(ctx, record, receipt)
+		} else if !l.drop(record) {
+			continue
+		}
+		if watched != nil {
+			l.watchedLock.Lock()
+			delete(l.watched, record.Hash)
+			l.watchedLock.Unlock()
+			watched.txn.finish()
+		}
+	}
+}
+
+// drop records a transaction without a receipt as dropped once it is older than dropAfter, reporting whether it was
+func (l *TransactionsListener) drop(record *TransactionRecord) bool {
+	if l.dropAfter <= 0 || time.Since(record.CreatedAt) < l.dropAfter {
+		return false
+	}
+	l.log.WithField("txn", record.Hash).Warn("transaction was not mined, it is considered dropped")
+	record.Status = TransactionDropped
+	record.Error = fmt.Sprintf("transaction was not mined within %v", l.dropAfter)
+	record.UpdatedAt = time.Now().UTC()
+	if err := l.db.Save(record).Error; err != nil {
+		l.log.WithError(err).Error("failed to save transaction outcome")
+	}
+	return true
+}
+
+// findReceipt returns the receipt of the first of several submissions of a transaction that was mined
+func (l *TransactionsListener) findReceipt(ctx context.Context, hashes []common.Hash) *types.Receipt {
+	for _, hash := range hashes {
+		receipt, err := l.connection.TransactionReceipt(ctx, hash)
+		if receipt != nil {
+			return receipt
+		}
+		if err != nil && err != ethereum.NotFound {
+			l.log.WithError(err).WithField("txn", hash.Hex()).Debug("failed to get receipt")
+		}
+	}
+	return nil
+}
+
+// waitMined polls for the receipt of a transaction, resubmitting it with a higher gas price when it is not mined in time
+// the receipt of whichever submission is mined is returned, along with every submission
+func (l *TransactionsListener) waitMined(ctx context.Context, txn *PendingTransaction) (*types.Receipt, []*types.Transaction, error) {
+	submissions := []*types.Transaction{txn.Transaction}
+	lastSubmitted := time.Now()
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+	for {
+		hashes := []common.Hash{}
+		for _, tx := range submissions {
+			hashes = append(hashes, tx.Hash())
+		}
+		if receipt := l.findReceipt(ctx, hashes); receipt != nil {
+			return receipt, submissions, nil
+		}
+		if resubmitAfter := txn.manager.ResubmitAfter(); resubmitAfter > 0 && time.Since(lastSubmitted) >= resubmitAfter {
+			latest := submissions[len(submissions)-1]
+			replacement, err := txn.manager.Resubmit(ctx, latest)
+			if err != nil {
+				// e.g. an earlier submission was mined in the meantime, which the next poll finds
+				l.log.WithError(err).WithField("txn", txn.Hash()).Warn("failed to resubmit transaction")
+			} else {
+				submissions = append(submissions, replacement)
+				txn.Record.LatestHash = replacement.Hash().Hex()
+				if err := l.db.Model(txn.Record).Update("latest_hash", txn.Record.LatestHash).Error; err != nil {
+					l.log.WithError(err).Error("failed to save resubmitted transaction")
+				}
+			}
+			lastSubmitted = time.Now()
+		}
+		select {
+		case <-ctx.Done():
+			return nil, submissions, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// receiptBlockNumber finds the block in which a transaction was mined, from its logs or else from the receipt held by
+// the node, or returns 0 when the connection cannot tell
+func (l *TransactionsListener) receiptBlockNumber(ctx context.Context, receipt *types.Receipt) uint64 {
+	if len(receipt.Logs) > 0 {
+		return receipt.Logs[0].BlockNumber
 	}
+	reader, ok := l.connection.(receiptBlockReader)
+	if !ok {
+		return 0
+	}
+	n, err := reader.ReceiptBlockNumber(ctx, receipt.TxHash)
+	if err != nil {
+		l.log.WithError(err).WithField("txn", receipt.TxHash.Hex()).Warn("failed to get block number of receipt")
+		return 0
+	}
+	return n
 }
 
 // NewTransactionsListener ...
-func NewTransactionsListener(lc fx.Lifecycle, log *logging.Logger, txnsChan TransactionsChannel, conn *ethclient.Client) *TransactionsListener {
+func NewTransactionsListener(
+	lc fx.Lifecycle,
+	log *logging.Logger,
+	config *config.Config,
+	txnsChan TransactionsChannel,
+	conn Backend,
+	db *database.DB,
+) *TransactionsListener {
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 
+	db.AutoMigrate(&TransactionRecord{})
+
 	txnL := &TransactionsListener{
 		log:           log.WithField("component", "listener"),
 		txnsChan:      txnsChan,
 		context:       ctx,
 		contextCancel: cancel,
 		connection:    conn,
+		db:            db,
+		timeout:       config.TransactionTimeout,
+		dropAfter:     config.TransactionDropAfter,
+		watched:       map[string]*watchedTransaction{},
+	}
+	if txnL.timeout <= 0 {
+		txnL.timeout = 30 * time.Second
 	}
+	metrics.Set("transactions_pending", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&txnL.pending)
+	}))
 	lc.Append(fx.Hook{
 		OnStop: func(ctx context.Context) error {
 			cancel()
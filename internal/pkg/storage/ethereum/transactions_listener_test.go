@@ -0,0 +1,238 @@
+package ethereum
+
+import (
+	"context"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	ethereum "github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"go.uber.org/fx/fxtest"
+)
+
+// receiptsBackend serves the receipts of the transactions that have been mined, and the blocks they were mined in
+type receiptsBackend struct {
+	Backend
+	mutex    sync.Mutex
+	receipts map[common.Hash]*types.Receipt
+	blocks   map[common.Hash]uint64
+	sent     []*types.Transaction
+}
+
+func (b *receiptsBackend) SendTransaction(ctx context.Context, txn *types.Transaction) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.sent = append(b.sent, txn)
+	return nil
+}
+
+func (b *receiptsBackend) mine(txn *types.Transaction, status uint64, block uint64, logs bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	receipt := &types.Receipt{Status: status, TxHash: txn.Hash(), GasUsed: 21000}
+	if logs {
+		receipt.Logs = []*types.Log{{TxHash: txn.Hash(), BlockNumber: block}}
+	}
+	b.receipts[txn.Hash()] = receipt
+	b.blocks[txn.Hash()] = block
+}
+
+func (b *receiptsBackend) TransactionReceipt(ctx context.Context, txHash common.Hash) (*types.Receipt, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if receipt, ok := b.receipts[txHash]; ok {
+		return receipt, nil
+	}
+	return nil, ethereum.NotFound
+}
+
+func (b *receiptsBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	panic("the block number of a receipt must not be taken from the head")
+}
+
+func (b *receiptsBackend) ReceiptBlockNumber(ctx context.Context, txHash common.Hash) (uint64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.blocks[txHash], nil
+}
+
+func TestTransactionsListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-listener-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := logging.NewLogger()
+	appConfig := &config.Config{
+		DatabaseType:             "sqlite3",
+		DatabaseConnectionString: filepath.Join(dir, "test.db"),
+		TransactionTimeout:       100 * time.Millisecond,
+		TransactionDropAfter:     time.Hour,
+	}
+	db, err := database.NewConnection(log, appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+
+	backend := &receiptsBackend{receipts: map[common.Hash]*types.Receipt{}, blocks: map[common.Hash]uint64{}}
+	lc := fxtest.NewLifecycle(t)
+	listener := NewTransactionsListener(lc, log, appConfig, NewTransactionsChannel(appConfig), backend, db)
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	nonce := uint64(0)
+	submitWith := func(manager *TransactionManager) (*PendingTransaction, *bool) {
+		nonce++
+		txn := types.NewTransaction(nonce, common.HexToAddress("0x1"), big.NewInt(0), 21000, big.NewInt(1), nil)
+		now := time.Now().UTC()
+		record := &TransactionRecord{Hash: txn.Hash().Hex(), LatestHash: txn.Hash().Hex(), CreatedAt: now, UpdatedAt: now, Status: TransactionPending}
+		if err := db.Create(record).Error; err != nil {
+			t.Fatal(err)
+		}
+		pending := newPendingTransaction(txn, record, manager)
+		notified := new(bool)
+		pending.OnSuccess(func() { *notified = true })
+		return pending, notified
+	}
+	submit := func() (*PendingTransaction, *bool) {
+		return submitWith(nil)
+	}
+	stored := func(hash string) *TransactionRecord {
+		record := &TransactionRecord{}
+		if err := db.Where(&TransactionRecord{Hash: hash}).First(record).Error; err != nil {
+			t.Fatal(err)
+		}
+		return record
+	}
+	expectDone := func(name string, txn *PendingTransaction, failed bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, err := txn.Wait(ctx)
+		if err == context.DeadlineExceeded {
+			t.Fatalf("%s: expected the outcome to be known", name)
+		}
+		if failed != (err != nil) {
+			t.Fatalf("%s: expected failure %v, got %v", name, failed, err)
+		}
+	}
+
+	mined, notified := submit()
+	backend.mine(mined.Transaction, types.ReceiptStatusSuccessful, 7, true)
+	listener.processTxn(mined)
+	expectDone("mined", mined, false)
+	if record := stored(mined.Hash()); record.Status != TransactionSucceeded || record.BlockNumber != 7 || record.GasUsed != 21000 {
+		t.Fatalf("mined: unexpected record %+v", record)
+	}
+	if !*notified {
+		t.Fatal("mined: expected the success callbacks to be called")
+	}
+
+	slow, notified := submit()
+	listener.processTxn(slow)
+	if record := stored(slow.Hash()); record.Status != TransactionUnknown {
+		t.Fatalf("timed out: expected status %q, got %q", TransactionUnknown, record.Status)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	if _, err := slow.Wait(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("timed out: expected the outcome to be unknown, got %v", err)
+	}
+	cancel()
+	listener.recheck(context.Background())
+	if record := stored(slow.Hash()); record.Status != TransactionUnknown {
+		t.Fatalf("timed out: expected the status to stay %q until mined, got %q", TransactionUnknown, record.Status)
+	}
+	backend.mine(slow.Transaction, types.ReceiptStatusSuccessful, 9, false)
+	listener.recheck(context.Background())
+	expectDone("mined late", slow, false)
+	if record := stored(slow.Hash()); record.Status != TransactionSucceeded || record.BlockNumber != 9 || record.Error != "" {
+		t.Fatalf("mined late: unexpected record %+v", record)
+	}
+	if !*notified {
+		t.Fatal("mined late: expected the success callbacks to be called")
+	}
+
+	reverted, notified := submit()
+	backend.mine(reverted.Transaction, types.ReceiptStatusFailed, 10, true)
+	listener.processTxn(reverted)
+	expectDone("reverted", reverted, true)
+	if record := stored(reverted.Hash()); record.Status != TransactionFailed {
+		t.Fatalf("reverted: expected status %q, got %q", TransactionFailed, record.Status)
+	}
+	if *notified {
+		t.Fatal("reverted: expected the success callbacks not to be called")
+	}
+
+	// a transaction left pending by a previous run of the server
+	orphan, _ := submit()
+	if err := db.Model(orphan.Record).UpdateColumn("updated_at", time.Now().UTC().Add(-time.Hour)).Error; err != nil {
+		t.Fatal(err)
+	}
+	backend.mine(orphan.Transaction, types.ReceiptStatusSuccessful, 11, true)
+	listener.recheck(context.Background())
+	if record := stored(orphan.Hash()); record.Status != TransactionSucceeded || record.BlockNumber != 11 {
+		t.Fatalf("orphaned: unexpected record %+v", record)
+	}
+
+	// a transaction is resubmitted by the manager of the account that sent it, e.g. that of a tenant
+	signed := map[common.Address]int{}
+	newManager := func(from common.Address) *TransactionManager {
+		return &TransactionManager{
+			connection:    backend,
+			gasPriceBump:  10,
+			log:           log.WithField("component", "transactions"),
+			resubmitAfter: time.Nanosecond,
+			opts: &bind.TransactOpts{
+				From: from,
+				Signer: func(signer types.Signer, address common.Address, txn *types.Transaction) (*types.Transaction, error) {
+					signed[address]++
+					return txn, nil
+				},
+			},
+		}
+	}
+	tenant := common.HexToAddress("0x20")
+	stuck, _ := submitWith(newManager(tenant))
+	listener.processTxn(stuck)
+	if len(signed) != 1 || signed[tenant] != 1 {
+		t.Fatalf("stuck: expected the replacement to be signed by the tenant only, got %v", signed)
+	}
+	if len(backend.sent) != 1 || backend.sent[0].GasPrice().Cmp(stuck.Transaction.GasPrice()) <= 0 {
+		t.Fatalf("stuck: expected a replacement with a higher gas price, got %v", backend.sent)
+	}
+	replacement := backend.sent[0]
+	if record := stored(stuck.Hash()); record.LatestHash != replacement.Hash().Hex() {
+		t.Fatalf("stuck: expected the latest hash to be the replacement, got %q", record.LatestHash)
+	}
+	backend.mine(replacement, types.ReceiptStatusSuccessful, 12, true)
+	listener.recheck(context.Background())
+	expectDone("replaced", stuck, false)
+
+	// transactions that are never mined are dropped once they are old enough
+	lost, _ := submit()
+	listener.processTxn(lost)
+	listener.recheck(context.Background())
+	if record := stored(lost.Hash()); record.Status != TransactionUnknown {
+		t.Fatalf("lost: expected status %q before it is old enough, got %q", TransactionUnknown, record.Status)
+	}
+	lost.Record.CreatedAt = time.Now().UTC().Add(-2 * time.Hour)
+	if err := db.Model(lost.Record).UpdateColumn("created_at", lost.Record.CreatedAt).Error; err != nil {
+		t.Fatal(err)
+	}
+	listener.recheck(context.Background())
+	expectDone("lost", lost, true)
+	if record := stored(lost.Hash()); record.Status != TransactionDropped || record.Error == "" {
+		t.Fatalf("lost: unexpected record %+v", record)
+	}
+}
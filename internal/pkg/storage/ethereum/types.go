@@ -1,11 +1,15 @@
 package ethereum
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 	"strings"
 	"time"
 
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
 	"github.com/pkg/errors"
 	"github.com/vincent-petithory/dataurl"
 )
@@ -43,10 +47,72 @@ func NewObjectCollectionElementFHIRJSONData(data []byte) *ObjectCollectionElemen
 	}
 }
 
+// NewObjectCollectionElementData returns the data to store for a FHIR JSON payload
+// payloads are sealed in an envelope when the keyring is enabled, and payloads selected by the IPFS client are added
+// to IPFS and only referenced by their CID
+func NewObjectCollectionElementData(ctx context.Context, client *ipfs.Client, keyring *envelope.Keyring, data []byte) (ObjectCollectionElementData, error) {
+	payload := data
+	mediaType := fhirJSONMediaType
+	if keyring.Enabled() {
+		sealed, err := keyring.Seal(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to encrypt payload")
+		}
+		payload = sealed
+		mediaType = envelope.MediaType
+	}
+	var stored ObjectCollectionElementData = &ObjectCollectionElementBytesData{payload, mediaType}
+	if client.Stores(payload) {
+		cid, err := client.Add(ctx, payload)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to add payload to IPFS")
+		}
+		stored = &ObjectCollectionElementIPFSData{address: cid, data: payload}
+	}
+	if !keyring.Enabled() {
+		return stored, nil
+	}
+	return &ObjectCollectionElementEncryptedData{
+		ObjectCollectionElementData: stored,
+		keyring:                     keyring,
+		plaintext:                   data,
+	}, nil
+}
+
+// ObjectCollectionElementEncryptedData is data that may be sealed in an envelope, which is opened when it is read
+// payloads that are not envelopes are returned unchanged, so that plain and encrypted objects are read alike
+type ObjectCollectionElementEncryptedData struct {
+	ObjectCollectionElementData
+	keyring   *envelope.Keyring
+	plaintext []byte
+}
+
+// Bytes returns the decrypted payload
+func (o *ObjectCollectionElementEncryptedData) Bytes() ([]byte, error) {
+	if o.plaintext != nil {
+		return o.plaintext, nil
+	}
+	data, err := o.ObjectCollectionElementData.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if !envelope.IsEnvelope(data) {
+		return data, nil
+	}
+	plaintext, err := o.keyring.Open(data)
+	if err != nil {
+		return nil, err
+	}
+	o.plaintext = plaintext
+	return plaintext, nil
+}
+
 // ObjectCollectionElementIPFSData ...
 type ObjectCollectionElementIPFSData struct {
-	address string
-	path    string
+	address  string
+	path     string
+	data     []byte
+	fetchers *fetcher.Registry
 }
 
 // URI ...
@@ -58,15 +124,24 @@ func (o *ObjectCollectionElementIPFSData) URI() string {
 	return s
 }
 
-// Bytes ...
+// Bytes fetches the payload from IPFS, verifying it against its CID
 func (o *ObjectCollectionElementIPFSData) Bytes() ([]byte, error) {
-	// TODO: fetch from IPFS
-	return []byte{}, nil
+	if o.data != nil {
+		return o.data, nil
+	}
+	data, err := o.fetchers.Fetch(context.Background(), o.URI())
+	if err != nil {
+		return nil, err
+	}
+	o.data = data
+	return data, nil
 }
 
-// ObjectCollectionElementURIData ...
+// ObjectCollectionElementURIData is data held outside of the chain, e.g. on the servers of an organization
+// a sha256 hash in the fragment of the URI is verified when the data is fetched
 type ObjectCollectionElementURIData struct {
-	uri string
+	uri      string
+	fetchers *fetcher.Registry
 }
 
 // URI ...
@@ -74,10 +149,9 @@ func (o *ObjectCollectionElementURIData) URI() string {
 	return o.uri
 }
 
-// Bytes ...
+// Bytes fetches the data with the fetcher registered for the scheme of the URI
 func (o *ObjectCollectionElementURIData) Bytes() ([]byte, error) {
-	// TODO: fetch?
-	return []byte{}, nil
+	return o.fetchers.Fetch(context.Background(), o.uri)
 }
 
 // ObjectCollectionElement ...
@@ -88,7 +162,7 @@ type ObjectCollectionElement struct {
 }
 
 // NewObjectCollectionElement ...
-func NewObjectCollectionElement(uri string, createdAt, updatedAt *big.Int) (*ObjectCollectionElement, error) {
+func NewObjectCollectionElement(uri string, createdAt, updatedAt *big.Int, fetchers *fetcher.Registry, keyring *envelope.Keyring) (*ObjectCollectionElement, error) {
 	newObj := &ObjectCollectionElement{
 		CreatedAt: bigintToTime(createdAt),
 		UpdatedAt: bigintToTime(updatedAt),
@@ -97,8 +171,13 @@ func NewObjectCollectionElement(uri string, createdAt, updatedAt *big.Int) (*Obj
 	dataElems := strings.Split(uri, ":")
 	switch dataElems[0] {
 	case "ipfs":
-		ipfsData := strings.Split(dataElems[1], "/")
-		newObj.Data = &ObjectCollectionElementIPFSData{ipfsData[0], ipfsData[1]}
+		ipfsData := &ObjectCollectionElementIPFSData{fetchers: fetchers}
+		ipfsPath := strings.SplitN(strings.TrimPrefix(uri, "ipfs:"), "/", 2)
+		ipfsData.address = ipfsPath[0]
+		if len(ipfsPath) > 1 {
+			ipfsData.path = ipfsPath[1]
+		}
+		newObj.Data = &ObjectCollectionElementEncryptedData{ObjectCollectionElementData: ipfsData, keyring: keyring}
 	case "data":
 		u, err := dataurl.DecodeString(uri)
 		if err != nil {
@@ -107,11 +186,17 @@ func NewObjectCollectionElement(uri string, createdAt, updatedAt *big.Int) (*Obj
 		switch u.MediaType.ContentType() {
 		case fhirJSONMediaType:
 			newObj.Data = NewObjectCollectionElementFHIRJSONData(u.Data)
+		case envelope.MediaType:
+			newObj.Data = &ObjectCollectionElementEncryptedData{
+				ObjectCollectionElementData: &ObjectCollectionElementBytesData{u.Data, envelope.MediaType},
+				keyring:                     keyring,
+			}
 		default:
 			newObj.Data = &ObjectCollectionElementBytesData{u.Data, u.MediaType.ContentType()}
 		}
 	default:
-		newObj.Data = &ObjectCollectionElementURIData{uri}
+		uriData := &ObjectCollectionElementURIData{uri, fetchers}
+		newObj.Data = &ObjectCollectionElementEncryptedData{ObjectCollectionElementData: uriData, keyring: keyring}
 	}
 
 	return newObj, nil
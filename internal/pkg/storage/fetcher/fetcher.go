@@ -0,0 +1,133 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/pkg/errors"
+)
+
+// hashParam is the name of the fragment parameter that holds the SHA-256 hash of a payload, e.g. https://example.org/a.json#sha256=<hex>
+const hashParam = "sha256"
+
+var (
+	// ErrHashMismatch is returned when a payload does not match the hash stored alongside its URI
+	ErrHashMismatch = errors.New("payload does not match hash")
+	// ErrTooLarge is returned when a payload is larger than the configured limit
+	ErrTooLarge = errors.New("payload is too large")
+	// ErrUnsupportedScheme is returned when no fetcher is registered for the scheme of a URI
+	ErrUnsupportedScheme = errors.New("unsupported URI scheme")
+)
+
+// Fetcher reads the payload referenced by a URI
+type Fetcher interface {
+	Fetch(ctx context.Context, u *url.URL) ([]byte, error)
+}
+
+// Registry selects the fetcher of a URI by its scheme
+type Registry struct {
+	fetchers map[string]Fetcher
+	log      logging.FieldLogger
+}
+
+// Register sets the fetcher of a scheme, replacing any previous one
+func (r *Registry) Register(scheme string, f Fetcher) {
+	r.fetchers[strings.ToLower(scheme)] = f
+}
+
+// Fetch reads the payload referenced by a URI
+// when the URI carries a hash in its fragment, the payload is verified against it
+func (r *Registry) Fetch(ctx context.Context, uri string) ([]byte, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid URI")
+	}
+	f, ok := r.fetchers[strings.ToLower(u.Scheme)]
+	if !ok {
+		return nil, errors.Wrapf(ErrUnsupportedScheme, "scheme %q", u.Scheme)
+	}
+	expected, err := parseHash(u.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	u.Fragment = ""
+	r.log.WithField("uri", u.String()).Debug("fetching payload")
+	data, err := f.Fetch(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	if expected != nil {
+		digest := sha256.Sum256(data)
+		if !bytes.Equal(digest[:], expected) {
+			return nil, ErrHashMismatch
+		}
+	}
+	return data, nil
+}
+
+// parseHash returns the hash held by the fragment of a URI, or nil if it has none
+func parseHash(fragment string) ([]byte, error) {
+	if fragment == "" {
+		return nil, nil
+	}
+	values, err := url.ParseQuery(fragment)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid URI fragment %q", fragment)
+	}
+	h := values.Get(hashParam)
+	if h == "" {
+		return nil, nil
+	}
+	digest, err := hex.DecodeString(h)
+	if err != nil || len(digest) != sha256.Size {
+		return nil, errors.Errorf("invalid %s hash %q", hashParam, h)
+	}
+	return digest, nil
+}
+
+// WithHash returns a URI that carries the hash of its payload, so that fetched content is verified
+func WithHash(uri string, data []byte) string {
+	digest := sha256.Sum256(data)
+	return fmt.Sprintf("%s#%s=%s", uri, hashParam, hex.EncodeToString(digest[:]))
+}
+
+// NewRegistry creates a registry with fetchers for the data and ipfs schemes, for the http and https schemes when
+// hosts are allowed, and for the file scheme when a root directory is configured
+func NewRegistry(log *logging.Logger, config *config.Config, ipfsClient *ipfs.Client) (*Registry, error) {
+	timeout := config.FetchTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	maxSize := config.FetchMaxSize
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+	r := &Registry{
+		fetchers: map[string]Fetcher{},
+		log:      log.WithField("component", "fetcher"),
+	}
+	r.Register("data", &DataFetcher{})
+	if len(config.FetchAllowedHosts) > 0 {
+		httpFetcher := NewHTTPFetcher(timeout, maxSize, config.FetchAllowedHosts)
+		r.Register("http", httpFetcher)
+		r.Register("https", httpFetcher)
+	}
+	r.Register("ipfs", &IPFSFetcher{client: ipfsClient})
+	if config.FetchFileRoot != "" {
+		fileFetcher, err := NewFileFetcher(config.FetchFileRoot, maxSize)
+		if err != nil {
+			return nil, err
+		}
+		r.Register("file", fileFetcher)
+	}
+	return r, nil
+}
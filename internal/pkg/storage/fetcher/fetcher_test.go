@@ -0,0 +1,157 @@
+package fetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/pkg/errors"
+)
+
+const payload = `{"resourceType":"Location","status":"active"}`
+
+func newTestRegistry(t *testing.T, c *config.Config) *Registry {
+	log := logging.NewLogger()
+	ipfsClient, err := ipfs.NewClient(log, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRegistry(log, c, ipfsClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestFetchHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/location.json":
+			rw.Write([]byte(payload))
+		case "/redirect":
+			http.Redirect(rw, req, "http://localhost"+strings.TrimPrefix(req.URL.Query().Get("to"), "http://127.0.0.1"), http.StatusFound)
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	disabled := newTestRegistry(t, &config.Config{})
+	if _, err := disabled.Fetch(ctx, server.URL+"/location.json"); errors.Cause(err) != ErrUnsupportedScheme {
+		t.Fatalf("expected %v without allowed hosts, got %v", ErrUnsupportedScheme, err)
+	}
+	other := newTestRegistry(t, &config.Config{FetchAllowedHosts: []string{"*.example.org"}})
+	if _, err := other.Fetch(ctx, server.URL+"/location.json"); err == nil {
+		t.Fatal("expected a host that is not allowed to be rejected")
+	}
+
+	r := newTestRegistry(t, &config.Config{FetchAllowedHosts: []string{"127.0.0.1"}})
+
+	data, err := r.Fetch(ctx, server.URL+"/location.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != payload {
+		t.Fatalf("expected %q, got %q", payload, data)
+	}
+
+	if _, err := r.Fetch(ctx, WithHash(server.URL+"/location.json", []byte(payload))); err != nil {
+		t.Fatalf("expected hash to match: %v", err)
+	}
+	if _, err := r.Fetch(ctx, WithHash(server.URL+"/location.json", []byte("{}"))); err != ErrHashMismatch {
+		t.Fatalf("expected %v, got %v", ErrHashMismatch, err)
+	}
+	if _, err := r.Fetch(ctx, server.URL+"/missing.json"); err == nil {
+		t.Fatal("expected missing payload to fail")
+	}
+	if _, err := r.Fetch(ctx, server.URL+"/redirect?to="+url.QueryEscape(server.URL+"/location.json")); err == nil {
+		t.Fatal("expected a redirect to a host that is not allowed to be rejected")
+	}
+}
+
+func TestFetchHTTPTooLarge(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(payload))
+	}))
+	defer server.Close()
+	r := newTestRegistry(t, &config.Config{FetchMaxSize: 10, FetchAllowedHosts: []string{"127.0.0.1"}})
+
+	if _, err := r.Fetch(context.Background(), server.URL); err != ErrTooLarge {
+		t.Fatalf("expected %v, got %v", ErrTooLarge, err)
+	}
+}
+
+func TestFetchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fetcher-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "location.json")
+	if err := ioutil.WriteFile(path, []byte(payload), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	disabled := newTestRegistry(t, &config.Config{})
+	if _, err := disabled.Fetch(ctx, "file://"+filepath.ToSlash(path)); errors.Cause(err) != ErrUnsupportedScheme {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedScheme, err)
+	}
+
+	r := newTestRegistry(t, &config.Config{FetchFileRoot: dir})
+	data, err := r.Fetch(ctx, "file://"+filepath.ToSlash(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != payload {
+		t.Fatalf("expected %q, got %q", payload, data)
+	}
+	if _, err := r.Fetch(ctx, "file://"+filepath.ToSlash(filepath.Join(dir, "..", "location.json"))); err == nil {
+		t.Fatal("expected file outside of the root to be rejected")
+	}
+
+	outside, err := ioutil.TempDir("", "fetcher-test-outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outside)
+	secret := filepath.Join(outside, "secret.json")
+	if err := ioutil.WriteFile(secret, []byte(payload), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.json")
+	if err := os.Symlink(secret, link); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Fetch(ctx, "file://"+filepath.ToSlash(link)); err == nil {
+		t.Fatal("expected a link to a file outside of the root to be rejected")
+	}
+}
+
+func TestFetchData(t *testing.T) {
+	r := newTestRegistry(t, &config.Config{})
+	data, err := r.Fetch(context.Background(), "data:application/fhir+json,%7B%7D")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "{}" {
+		t.Fatalf("expected %q, got %q", "{}", data)
+	}
+}
+
+func TestFetchUnsupportedScheme(t *testing.T) {
+	r := newTestRegistry(t, &config.Config{})
+	if _, err := r.Fetch(context.Background(), "ftp://example.org/location.json"); errors.Cause(err) != ErrUnsupportedScheme {
+		t.Fatalf("expected %v, got %v", ErrUnsupportedScheme, err)
+	}
+}
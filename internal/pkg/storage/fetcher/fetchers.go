@@ -0,0 +1,174 @@
+package fetcher
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/pkg/errors"
+	"github.com/vincent-petithory/dataurl"
+)
+
+// DataFetcher decodes payloads embedded in data URIs
+type DataFetcher struct{}
+
+// Fetch ...
+func (f *DataFetcher) Fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	d, err := dataurl.DecodeString(u.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decode data uri")
+	}
+	return d.Data, nil
+}
+
+// HTTPFetcher downloads payloads from the web servers of an allowlist, so that stored URIs cannot make the server
+// request internal addresses
+type HTTPFetcher struct {
+	allowedHosts []string
+	client       *http.Client
+	maxSize      int64
+}
+
+// allowed reports whether a host is in the allowlist, which may contain wildcards such as *.example.org
+func (f *HTTPFetcher) allowed(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range f.allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fetch ...
+func (f *HTTPFetcher) Fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	if !f.allowed(u) {
+		return nil, errors.Errorf("host %q is not allowed", u.Hostname())
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	res, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s", u.String())
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to fetch %s: status %d", u.String(), res.StatusCode)
+	}
+	if res.ContentLength > f.maxSize {
+		return nil, ErrTooLarge
+	}
+	return readLimited(res.Body, f.maxSize)
+}
+
+// NewHTTPFetcher creates a fetcher for the allowed hosts whose requests time out and whose payloads are limited to
+// maxSize bytes
+func NewHTTPFetcher(timeout time.Duration, maxSize int64, allowedHosts []string) *HTTPFetcher {
+	f := &HTTPFetcher{
+		allowedHosts: allowedHosts,
+		maxSize:      maxSize,
+	}
+	f.client = &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !f.allowed(req.URL) {
+				return errors.Errorf("redirect to host %q is not allowed", req.URL.Hostname())
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// FileFetcher reads payloads from a local directory, for development
+type FileFetcher struct {
+	root    string
+	maxSize int64
+}
+
+// Fetch reads a file, which must be inside the root directory
+func (f *FileFetcher) Fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return nil, errors.Errorf("unsupported file host %q", u.Host)
+	}
+	path := filepath.Clean(filepath.FromSlash(u.Path))
+	// links are resolved before the check, so that a link inside the root cannot point outside of it
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to resolve %q", path)
+	}
+	rel, err := filepath.Rel(f.root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, errors.Errorf("file %q is outside of %q", path, f.root)
+	}
+	path = resolved
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+	defer file.Close()
+	return readLimited(file, f.maxSize)
+}
+
+// NewFileFetcher creates a fetcher for the files under root
+func NewFileFetcher(root string, maxSize int64) (*FileFetcher, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid file root %q", root)
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return nil, errors.Wrapf(err, "invalid file root %q", root)
+	}
+	return &FileFetcher{
+		root:    abs,
+		maxSize: maxSize,
+	}, nil
+}
+
+// IPFSFetcher reads payloads from IPFS, verifying them against their CID
+type IPFSFetcher struct {
+	client *ipfs.Client
+}
+
+// Fetch ...
+func (f *IPFSFetcher) Fetch(ctx context.Context, u *url.URL) ([]byte, error) {
+	cid := u.Opaque
+	if cid == "" {
+		// ipfs://<cid>
+		cid = u.Host
+	}
+	if strings.Contains(cid, "/") || (u.Opaque == "" && strings.Trim(u.Path, "/") != "") {
+		// only whole payloads can be verified against their CID
+		return nil, errors.Errorf("unsupported IPFS path in %q", u.String())
+	}
+	data, err := f.client.Cat(ctx, cid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch %s from IPFS", cid)
+	}
+	return data, nil
+}
+
+// readLimited reads at most maxSize bytes, failing with ErrTooLarge if there are more
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read payload")
+	}
+	if int64(len(data)) > maxSize {
+		return nil, ErrTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,49 @@
+package ipfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	cidVersion1  = 0x01
+	codecRaw     = 0x55
+	hashSHA2256  = 0x12
+	sha256Length = 0x20
+	// multibaseBase32 is the prefix of CIDs encoded in lower case base32 without padding, the default for version 1
+	multibaseBase32 = "b"
+)
+
+var base32Encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// CID returns the version 1 CID of a payload stored as a single raw block
+func CID(data []byte) string {
+	digest := sha256.Sum256(data)
+	b := append([]byte{cidVersion1, codecRaw, hashSHA2256, sha256Length}, digest[:]...)
+	return multibaseBase32 + strings.ToLower(base32Encoding.EncodeToString(b))
+}
+
+// Verify checks that a payload is the content identified by a CID
+// only the CIDs of single raw blocks hashed with SHA2-256 can be verified, which is how Client.Add stores payloads
+func Verify(cid string, data []byte) error {
+	if !strings.HasPrefix(cid, multibaseBase32) {
+		return errors.Errorf("unsupported CID %q", cid)
+	}
+	b, err := base32Encoding.DecodeString(strings.ToUpper(strings.TrimPrefix(cid, multibaseBase32)))
+	if err != nil {
+		return errors.Wrapf(err, "invalid CID %q", cid)
+	}
+	prefix := []byte{cidVersion1, codecRaw, hashSHA2256, sha256Length}
+	if len(b) != len(prefix)+sha256Length || !bytes.Equal(b[:len(prefix)], prefix) {
+		return errors.Errorf("unsupported CID %q", cid)
+	}
+	digest := sha256.Sum256(data)
+	if !bytes.Equal(b[len(prefix):], digest[:]) {
+		return ErrContentMismatch
+	}
+	return nil
+}
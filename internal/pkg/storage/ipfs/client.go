@@ -0,0 +1,160 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+// MaxPayloadSize is the size of the largest payload that can be stored
+// payloads are added as a single block, so that their CID is the hash of their content
+const MaxPayloadSize = 1 << 20
+
+var (
+	// ErrContentMismatch is returned when the content fetched for a CID does not match its hash
+	ErrContentMismatch = errors.New("content does not match CID")
+	// ErrPayloadTooLarge is returned when a payload is larger than MaxPayloadSize
+	ErrPayloadTooLarge = errors.Errorf("payload is larger than %d bytes", MaxPayloadSize)
+)
+
+// Client stores payloads through the HTTP API of an IPFS node
+type Client struct {
+	apiURL     string
+	httpClient *http.Client
+	log        logging.FieldLogger
+	maxSize    int64
+	threshold  int
+}
+
+// addResponse is the result of /api/v0/add
+type addResponse struct {
+	Name string
+	Hash string
+	Size string
+}
+
+// Enabled reports whether an IPFS API is configured
+func (c *Client) Enabled() bool {
+	return c.apiURL != ""
+}
+
+// Stores reports whether a payload should be stored in IPFS rather than on chain
+func (c *Client) Stores(data []byte) bool {
+	return c.Enabled() && len(data) > c.threshold
+}
+
+// Add stores a payload and returns its CID
+func (c *Client) Add(ctx context.Context, data []byte) (string, error) {
+	if len(data) > MaxPayloadSize {
+		return "", ErrPayloadTooLarge
+	}
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("file", "payload")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create request body")
+	}
+	if _, err := part.Write(data); err != nil {
+		return "", errors.Wrap(err, "failed to create request body")
+	}
+	if err := w.Close(); err != nil {
+		return "", errors.Wrap(err, "failed to create request body")
+	}
+	query := url.Values{
+		"chunker":     []string{fmt.Sprintf("size-%d", MaxPayloadSize)},
+		"cid-version": []string{"1"},
+		"pin":         []string{"true"},
+		"raw-leaves":  []string{"true"},
+	}
+	respBody, err := c.post(ctx, "add", query, w.FormDataContentType(), &body)
+	if err != nil {
+		return "", err
+	}
+	res := &addResponse{}
+	if err := json.Unmarshal(respBody, res); err != nil {
+		return "", errors.Wrap(err, "failed to parse response of IPFS add")
+	}
+	// the node returns the CID it computed, which must be the one the content is later verified against
+	if err := Verify(res.Hash, data); err != nil {
+		return "", errors.Wrapf(err, "IPFS node returned unexpected CID %q", res.Hash)
+	}
+	c.log.WithField("cid", res.Hash).Debug("added payload")
+	return res.Hash, nil
+}
+
+// Cat fetches a payload of at most the configured size and verifies it against its CID
+func (c *Client) Cat(ctx context.Context, cid string) ([]byte, error) {
+	data, err := c.post(ctx, "cat", url.Values{"arg": []string{cid}}, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := Verify(cid, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// post calls a command of the HTTP API, which only accepts POST requests
+func (c *Client) post(ctx context.Context, command string, query url.Values, contentType string, body io.Reader) ([]byte, error) {
+	if !c.Enabled() {
+		return nil, errors.New("no IPFS API configured")
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/api/v0/%s?%s", c.apiURL, command, query.Encode()), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create IPFS %s request", command)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	res, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "IPFS %s request failed", command)
+	}
+	defer res.Body.Close()
+	// a node must not be able to exhaust memory with a response, so one byte more than allowed is read to detect it
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, c.maxSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read response of IPFS %s", command)
+	}
+	if int64(len(data)) > c.maxSize {
+		return nil, errors.Errorf("response of IPFS %s is larger than %d bytes", command, c.maxSize)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("IPFS %s failed with status %d: %s", command, res.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// NewClient creates a client for the configured IPFS API, which is disabled when no URL is set
+func NewClient(log *logging.Logger, config *config.Config) (*Client, error) {
+	if config.IPFSThreshold < 0 {
+		return nil, errors.New("ipfs_threshold must not be negative")
+	}
+	maxSize := config.IPFSMaxSize
+	if maxSize <= 0 {
+		maxSize = MaxPayloadSize
+	}
+	timeout := config.IPFSTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	return &Client{
+		apiURL:     strings.TrimSuffix(config.IPFSURL, "/"),
+		httpClient: &http.Client{Timeout: timeout},
+		log:        log.WithField("component", "ipfs"),
+		maxSize:    maxSize,
+		threshold:  config.IPFSThreshold,
+	}, nil
+}
@@ -0,0 +1,185 @@
+package ipfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// CIDs of payloads added with cid-version=1 and raw-leaves=true, as computed by an IPFS node
+	helloCID        = "bafkreibm6jg3ux5qumhcn2b3flc3tyu6dmlb4xa7u5bf44yegnrjhc4yeq"
+	practitionerCID = "bafkreiaahjllko4he5uxv6ug24iyc2podzx2u7d57f7jqdvke6qpm4uqxu"
+	activeCID       = "bafkreif32av7tiknalkb623y3u3mpgby3eiplirjg5zcccn7aa2sks3c7a"
+)
+
+// nodeCIDs are the CIDs the stub node returns for the payloads it knows
+var nodeCIDs = map[string]string{
+	"hello": helloCID,
+	`{"resourceType":"Practitioner","active":true}`: practitionerCID,
+	`{"active":true}`: activeCID,
+}
+
+// stubNode implements the /api/v0/add and /api/v0/cat endpoints of an IPFS node in memory
+type stubNode struct {
+	blocks map[string][]byte
+	mutex  sync.Mutex
+}
+
+func (n *stubNode) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	switch req.URL.Path {
+	case "/api/v0/add":
+		file, _, err := req.FormFile("file")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cid, ok := nodeCIDs[string(data)]
+		if !ok {
+			http.Error(rw, "no fixture for payload", http.StatusInternalServerError)
+			return
+		}
+		n.blocks[cid] = data
+		json.NewEncoder(rw).Encode(&addResponse{Name: cid, Hash: cid})
+	case "/api/v0/cat":
+		data, ok := n.blocks[req.URL.Query().Get("arg")]
+		if !ok {
+			http.Error(rw, "not found", http.StatusInternalServerError)
+			return
+		}
+		rw.Write(data)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+func newTestClient(t *testing.T, threshold int) (*Client, *stubNode, func()) {
+	return newTestClientWithConfig(t, &config.Config{IPFSThreshold: threshold})
+}
+
+func newTestClientWithConfig(t *testing.T, c *config.Config) (*Client, *stubNode, func()) {
+	node := &stubNode{blocks: map[string][]byte{}}
+	server := httptest.NewServer(node)
+	c.IPFSURL = server.URL
+	client, err := NewClient(logging.NewLogger(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, node, server.Close
+}
+
+func TestAddCat(t *testing.T) {
+	client, _, stop := newTestClient(t, 0)
+	defer stop()
+
+	payload := []byte(`{"resourceType":"Practitioner","active":true}`)
+	cid, err := client.Add(context.Background(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cid != practitionerCID {
+		t.Fatalf("expected CID %q, got %q", practitionerCID, cid)
+	}
+	data, err := client.Cat(context.Background(), cid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Fatalf("expected %q, got %q", payload, data)
+	}
+}
+
+func TestCatRejectsModifiedContent(t *testing.T) {
+	client, node, stop := newTestClient(t, 0)
+	defer stop()
+
+	cid, err := client.Add(context.Background(), []byte(`{"active":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.blocks[cid] = []byte(`{"active":false}`)
+	if _, err := client.Cat(context.Background(), cid); errors.Cause(err) != ErrContentMismatch {
+		t.Fatalf("expected %v, got %v", ErrContentMismatch, err)
+	}
+}
+
+func TestCatRejectsLargeResponse(t *testing.T) {
+	client, node, stop := newTestClientWithConfig(t, &config.Config{IPFSMaxSize: 8})
+	defer stop()
+
+	node.blocks[helloCID] = []byte("hello, world")
+	if _, err := client.Cat(context.Background(), helloCID); err == nil {
+		t.Fatal("expected a response larger than the maximum size to be rejected")
+	}
+	node.blocks[helloCID] = []byte("hello")
+	if _, err := client.Cat(context.Background(), helloCID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddRejectsLargePayload(t *testing.T) {
+	client, _, stop := newTestClient(t, 0)
+	defer stop()
+
+	if _, err := client.Add(context.Background(), make([]byte, MaxPayloadSize+1)); err != ErrPayloadTooLarge {
+		t.Fatalf("expected %v, got %v", ErrPayloadTooLarge, err)
+	}
+}
+
+func TestStores(t *testing.T) {
+	client, _, stop := newTestClient(t, 10)
+	defer stop()
+
+	if client.Stores(make([]byte, 10)) {
+		t.Error("expected payload at the threshold to be stored on chain")
+	}
+	if !client.Stores(make([]byte, 11)) {
+		t.Error("expected payload above the threshold to be stored in IPFS")
+	}
+
+	disabled, err := NewClient(logging.NewLogger(), &config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disabled.Stores(make([]byte, 11)) {
+		t.Error("expected no payload to be stored in IPFS without an API URL")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	payload := []byte("hello")
+	for data, cid := range nodeCIDs {
+		if CID([]byte(data)) != cid {
+			t.Fatalf("expected CID %q of %q, got %q", cid, data, CID([]byte(data)))
+		}
+	}
+	if err := Verify(helloCID, payload); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(helloCID, []byte("hellO")); err != ErrContentMismatch {
+		t.Fatalf("expected %v, got %v", ErrContentMismatch, err)
+	}
+	if err := Verify("QmWATWQ7fVPP2EFGu71UkfnqhYXDYH566qy47CnJDgvs8u", payload); err == nil {
+		t.Fatal("expected version 0 CID to be unsupported")
+	}
+}
@@ -0,0 +1,351 @@
+package mirror
+
+import (
+	"context"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pkg/errors"
+	"go.uber.org/fx"
+)
+
+const (
+	// ReadFromChain serves reads from the collection contracts
+	ReadFromChain = "chain"
+	// ReadFromMirror serves reads from the mirror database
+	ReadFromMirror = "mirror"
+)
+
+// Mirror copies the objects stored in collection contracts to the database by following contract events
+type Mirror struct {
+	adapters      map[string]*ethereum.Adapter
+	context       context.Context
+	contextCancel context.CancelFunc
+	db            *database.DB
+	enabled       bool
+	log           logging.FieldLogger
+	mutex         sync.Mutex
+	pollInterval  time.Duration
+	reorgDepth    uint64
+	startBlock    uint64
+}
+
+// Enabled reports whether collection contracts are copied to the mirror
+func (m *Mirror) Enabled() bool {
+	return m.enabled
+}
+
+// Track adds the collection contract used by an adapter to the mirror and returns a reader of its copy
+func (m *Mirror) Track(adapter *ethereum.Adapter) *Reader {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.adapters[adapter.Collection().StorageName()] = adapter
+	return NewReader(m.db, adapter)
+}
+
+// Start ...
+func (m *Mirror) Start() {
+	if !m.enabled {
+		return
+	}
+	m.log.Info("started")
+	go func() {
+		ticker := time.NewTicker(m.pollInterval)
+		defer ticker.Stop()
+		m.syncAll()
+		for {
+			select {
+			case <-ticker.C:
+				m.syncAll()
+			case <-m.context.Done():
+				m.log.Info("stopped")
+				return
+			}
+		}
+	}()
+}
+
+func (m *Mirror) syncAll() {
+	m.mutex.Lock()
+	adapters := make([]*ethereum.Adapter, 0, len(m.adapters))
+	for _, adapter := range m.adapters {
+		adapters = append(adapters, adapter)
+	}
+	m.mutex.Unlock()
+	for _, adapter := range adapters {
+		if err := m.Sync(m.context, adapter); err != nil && m.context.Err() == nil {
+			m.log.WithError(err).WithField("collection", adapter.Collection().StorageName()).Error("failed to sync mirror")
+		}
+	}
+}
+
+// Sync copies the events of a collection contract recorded since the last sync
+// the last reorgDepth blocks before the cursor are copied again, so that changes from blocks
+// that have been replaced by a chain reorganization are discarded
+func (m *Mirror) Sync(ctx context.Context, adapter *ethereum.Adapter) error {
+	name := adapter.Collection().StorageName()
+	log := m.log.WithField("collection", name)
+
+	currentBlock, err := adapter.CurrentBlock(ctx)
+	if err != nil {
+		return err
+	}
+	head := currentBlock.Uint64()
+
+	cursor := &Cursor{Collection: name, BlockNumber: m.startBlock}
+	query := m.db.Where(&Cursor{Collection: name}).First(cursor)
+	if err := query.Error; err != nil && !query.RecordNotFound() {
+		return errors.Wrap(err, "failed to read cursor")
+	}
+	from := m.startBlock
+	if !query.RecordNotFound() {
+		from = cursor.BlockNumber + 1
+		if from > m.reorgDepth {
+			from -= m.reorgDepth
+		} else {
+			from = 0
+		}
+		if from < m.startBlock {
+			from = m.startBlock
+		}
+	}
+	if from > head {
+		return nil
+	}
+
+	events, err := adapter.ObjectEvents(ctx, from, &head, nil)
+	if err != nil {
+		return err
+	}
+	log.Debugf("syncing blocks %d to %d (%d events)", from, head, len(events))
+
+	tx := m.db.Begin()
+	if err := m.sync(ctx, tx, adapter, from, events); err != nil {
+		tx.Rollback()
+		return err
+	}
+	cursor.BlockNumber = head
+	if err := tx.Save(cursor).Error; err != nil {
+		tx.Rollback()
+		return errors.Wrap(err, "failed to save cursor")
+	}
+	return errors.Wrap(tx.Commit().Error, "failed to commit mirror changes")
+}
+
+func (m *Mirror) sync(ctx context.Context, tx *database.DB, adapter *ethereum.Adapter, from uint64, events []*ethereum.ObjectEvent) error {
+	name := adapter.Collection().StorageName()
+
+	// objects changed in the blocks being copied again must be recalculated even if their events are gone
+	affected := map[string]bool{}
+	replaced := []*Version{}
+	if err := tx.Where("collection = ? AND block_number >= ?", name, from).Find(&replaced).Error; err != nil {
+		return errors.Wrap(err, "failed to query versions")
+	}
+	for _, v := range replaced {
+		affected[v.ObjectID] = true
+	}
+	if err := tx.Where("collection = ? AND block_number >= ?", name, from).Delete(&Version{}).Error; err != nil {
+		return errors.Wrap(err, "failed to delete versions")
+	}
+
+	blockTimes := map[uint64]time.Time{}
+	for _, event := range events {
+		if event.Removed {
+			continue
+		}
+		blockTime, ok := blockTimes[event.BlockNumber]
+		if !ok {
+			var err error
+			if blockTime, err = adapter.BlockTime(ctx, event.BlockNumber); err != nil {
+				return err
+			}
+			blockTimes[event.BlockNumber] = blockTime
+		}
+		version := &Version{
+			Collection:  name,
+			ObjectID:    event.ID.String(),
+			Type:        event.Type,
+			BlockNumber: event.BlockNumber,
+			BlockHash:   event.BlockHash.Hex(),
+			BlockTime:   blockTime,
+			TxHash:      event.TxHash.Hex(),
+			LogIndex:    event.LogIndex,
+		}
+		if event.Type != ethereum.ObjectRemoved {
+			element, err := adapter.ReadAt(ctx, event.ID, new(big.Int).SetUint64(event.BlockNumber))
+			switch {
+			case errors.Cause(err) == ethereum.ErrObjectNotFound:
+				// removed later in the same block
+			case err != nil:
+				return err
+			default:
+				if err := setElement(version, element); err != nil {
+					return err
+				}
+			}
+		}
+		if err := tx.Create(version).Error; err != nil {
+			return errors.Wrap(err, "failed to save version")
+		}
+		affected[version.ObjectID] = true
+	}
+
+	for id := range affected {
+		if err := m.updateObject(tx, adapter, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// updateObject sets the current state of an object from its latest version
+func (m *Mirror) updateObject(tx *database.DB, adapter *ethereum.Adapter, id string) error {
+	collection := adapter.Collection().StorageName()
+	if err := tx.Where(&IndexEntry{Collection: collection, ObjectID: id}).Delete(&IndexEntry{}).Error; err != nil {
+		return errors.Wrap(err, "failed to delete index entries")
+	}
+	latest := &Version{}
+	query := tx.Where(&Version{Collection: collection, ObjectID: id}).Order("block_number desc, log_index desc").First(latest)
+	if query.RecordNotFound() {
+		err := tx.Where(&Object{Collection: collection, ObjectID: id}).Delete(&Object{}).Error
+		return errors.Wrap(err, "failed to delete object")
+	} else if err := query.Error; err != nil {
+		return errors.Wrap(err, "failed to query versions")
+	}
+	object := &Object{
+		Collection:  collection,
+		ObjectID:    id,
+		URI:         latest.URI,
+		Data:        latest.Data,
+		CreatedAt:   latest.CreatedAt,
+		UpdatedAt:   latest.UpdatedAt,
+		BlockNumber: latest.BlockNumber,
+		Removed:     latest.URI == "",
+	}
+	if err := tx.Save(object).Error; err != nil {
+		return errors.Wrap(err, "failed to save object")
+	}
+	if object.Removed {
+		return nil
+	}
+	return m.indexObject(tx, adapter, id)
+}
+
+// indexObject records the keys under which the index contracts hold an object
+// like the contracts, the keys are those of the data the object was created with, since updates do not change them
+func (m *Mirror) indexObject(tx *database.DB, adapter *ethereum.Adapter, id string) error {
+	collection := adapter.Collection().StorageName()
+	created := &Version{}
+	query := tx.Where(&Version{Collection: collection, ObjectID: id, Type: ethereum.ObjectAdded}).Order("block_number desc, log_index desc").First(created)
+	if query.RecordNotFound() || created.Data == nil {
+		// created before the mirror started, or encrypted for other organizations
+		return nil
+	} else if err := query.Error; err != nil {
+		return errors.Wrap(err, "failed to query versions")
+	}
+	for _, idx := range adapter.Collection().Indexes {
+		keys, err := adapter.IndexKeys(idx, created.Data)
+		if err != nil {
+			// the contracts reject such objects, so they are not indexed
+			m.log.WithError(err).WithFields(logging.Fields{"collection": collection, "object": id}).Warn("failed to generate index keys")
+			continue
+		}
+		for _, key := range keys {
+			entry := &IndexEntry{
+				Collection: collection,
+				Index:      idx.Address.Hex(),
+				Key:        common.Bytes2Hex(key[:]),
+				ObjectID:   id,
+			}
+			if err := tx.Create(entry).Error; err != nil {
+				return errors.Wrap(err, "failed to save index entry")
+			}
+		}
+	}
+	return nil
+}
+
+func setElement(version *Version, element *ethereum.ObjectCollectionElement) error {
+	data, err := element.Data.Bytes()
+	if errors.Cause(err) == storage.ErrForbidden {
+		// objects encrypted for other organizations are mirrored without their data
+		data = nil
+	} else if err != nil {
+		return errors.Wrap(err, "failed to get bytes from object data")
+	}
+	version.URI = element.Data.URI()
+	version.Data = data
+	version.CreatedAt = element.CreatedAt
+	version.UpdatedAt = element.UpdatedAt
+	return nil
+}
+
+// Cursor returns the last block of a collection contract that has been copied to the mirror
+func (m *Mirror) Cursor(collection string) (uint64, error) {
+	cursor := &Cursor{}
+	if err := m.db.Where(&Cursor{Collection: collection}).First(cursor).Error; err != nil {
+		return 0, errors.Wrapf(err, "failed to read cursor of collection %q", collection)
+	}
+	return cursor.BlockNumber, nil
+}
+
+// Objects returns every object of a collection contract in the mirror, including removed objects
+func (m *Mirror) Objects(collection string) ([]*Object, error) {
+	objects := []*Object{}
+	err := m.db.Where(&Object{Collection: collection}).Find(&objects).Error
+	return objects, errors.Wrap(err, "failed to query objects")
+}
+
+// NewMirror ...
+func NewMirror(lc fx.Lifecycle, log *logging.Logger, db *database.DB, config *config.Config) (*Mirror, error) {
+	switch config.ReadFrom {
+	case "", ReadFromChain:
+	case ReadFromMirror:
+		if !config.Mirror {
+			return nil, errors.New("reading from the mirror requires the mirror to be enabled")
+		}
+	default:
+		return nil, errors.Errorf("unsupported read source %q", config.ReadFrom)
+	}
+
+	if err := db.AutoMigrate(&Object{}, &Version{}, &Cursor{}, &IndexEntry{}).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to migrate mirror tables")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mirror{
+		adapters:      map[string]*ethereum.Adapter{},
+		context:       ctx,
+		contextCancel: cancel,
+		db:            db,
+		enabled:       config.Mirror,
+		log:           log.WithField("component", "mirror"),
+		pollInterval:  config.MirrorPollInterval,
+		reorgDepth:    config.MirrorReorgDepth,
+		startBlock:    config.MirrorStartBlock,
+	}
+	if m.pollInterval <= 0 {
+		m.pollInterval = 15 * time.Second
+	}
+
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+
+	return m, nil
+}
+
+// StartMirror ...
+func StartMirror(mirror *Mirror) {
+	mirror.Start()
+}
@@ -0,0 +1,157 @@
+package mirror_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/signer"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/envelope"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum/simulated"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/fetcher"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ipfs"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/mirror"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/oliveagle/jsonpath"
+	"github.com/pborman/uuid"
+	"go.uber.org/fx"
+	"go.uber.org/fx/fxtest"
+)
+
+// sortedIDs returns the string form of IDs in order, so that results can be compared
+func sortedIDs(ids []uuid.UUID) []string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = id.String()
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestMirror(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-mirror-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	collection := &config.ObjectCollectionContract{
+		Name: "Practitioner",
+		Indexes: []*config.ObjectIndex{
+			{Name: "Global NPI", JSONPath: jsonpath.MustCompile("$.identifier.value"), SearchParam: "identifier"},
+		},
+	}
+	chain, err := simulated.NewChain(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := &config.Config{
+		DatabaseConnectionString:  filepath.Join(dir, "test.db"),
+		DatabaseType:              "sqlite3",
+		Mirror:                    true,
+		OrganizationContract:      chain.OrganizationAddress,
+		ObjectCollectionContracts: chain.Collections,
+		TransactionsChannelBuffer: 10,
+	}
+	var (
+		adapter *ethereum.Adapter
+		m       *mirror.Mirror
+	)
+	app := fxtest.New(t,
+		fx.Provide(
+			logging.NewLogger,
+			func() *config.Config { return appConfig },
+			func() ethereum.Backend { return chain },
+			func() *bind.TransactOpts { return chain.TransactOpts },
+			ethereum.NewTransactionManager,
+			ethereum.NewTransactionsChannel,
+			ethereum.NewTransactionsListener,
+			database.NewConnection,
+			ipfs.NewClient,
+			fetcher.NewRegistry,
+			signer.NewAccount,
+			envelope.NewKeyring,
+			mirror.NewMirror,
+		),
+		fx.Invoke(
+			ethereum.StartTransactionsListener,
+			func(log *logging.Logger, db *database.DB, manager *ethereum.TransactionManager, txns ethereum.TransactionsChannel, ipfsClient *ipfs.Client, fetchers *fetcher.Registry, keyring *envelope.Keyring, mm *mirror.Mirror) error {
+				logging.SetLevel(log, "warn")
+				m = mm
+				var err error
+				adapter, err = ethereum.NewAdapter(chain, manager, chain.OrganizationAddress, collection, txns, ipfsClient, fetchers, keyring, db, log)
+				return err
+			},
+		),
+	)
+	app.RequireStart()
+	defer app.RequireStop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	store := ethereum.NewStore(adapter, adapter)
+	write := func(w storage.Write, err error) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Wait(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	practitioner := func(npi string) []byte {
+		return []byte(`{"resourceType": "Practitioner", "identifier": [{"system": "http://hl7.org/fhir/sid/us-npi", "value": "` + npi + `"}]}`)
+	}
+	first, second, third := uuid.NewRandom(), uuid.NewRandom(), uuid.NewRandom()
+	write(store.Create(ctx, first, practitioner("1234567890")))
+	write(store.Create(ctx, second, practitioner("1234567890")))
+	write(store.Create(ctx, third, practitioner("0987654321")))
+	created, err := store.Read(ctx, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(store.Update(ctx, first, created.UpdatedAt, practitioner("5555555555")))
+
+	if err := m.Sync(ctx, adapter); err != nil {
+		t.Fatal(err)
+	}
+	reader := m.Track(adapter)
+	address := collection.Indexes[0].Address
+
+	// the mirror must find exactly what the index contract finds, including for values that cannot be keys
+	for _, value := range []string{"1234567890", "0987654321", "5555555555", "123456789", "", strings.Repeat("1", 40)} {
+		onChain, chainErr := adapter.FindObjectIDs(ctx, address, value)
+		mirrored, mirrorErr := reader.FindObjectIDs(ctx, address, value)
+		if (chainErr == nil) != (mirrorErr == nil) {
+			t.Fatalf("value %q: chain error %v, mirror error %v", value, chainErr, mirrorErr)
+		}
+		if got, expected := sortedIDs(mirrored), sortedIDs(onChain); strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Fatalf("value %q: expected %v as on chain, got %v", value, expected, got)
+		}
+	}
+
+	write(store.Destroy(ctx, second))
+	if err := m.Sync(ctx, adapter); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := reader.FindObjectIDs(ctx, address, "1234567890")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if uuid.Equal(id, second) {
+			t.Fatal("expected a removed object not to be found in the mirror")
+		}
+	}
+	if _, err := reader.Read(ctx, second); err != ethereum.ErrObjectNotFound {
+		t.Fatalf("expected a removed object not to be read from the mirror, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package mirror
+
+import (
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+)
+
+// Object is the current state of an object stored in a collection contract
+type Object struct {
+	Collection  string `gorm:"primary_key"`
+	ObjectID    string `gorm:"primary_key"`
+	URI         string `gorm:"type:text"`
+	Data        []byte
+	CreatedAt   time.Time // as recorded by the contract
+	UpdatedAt   time.Time // as recorded by the contract
+	BlockNumber uint64
+	Removed     bool
+}
+
+// TableName ...
+func (Object) TableName() string {
+	return "mirror_objects"
+}
+
+// Version is a change to an object recorded by an event of a collection contract
+type Version struct {
+	ID          uint   `gorm:"primary_key"`
+	Collection  string `gorm:"index"`
+	ObjectID    string `gorm:"index"`
+	Type        ethereum.ObjectEventType
+	BlockNumber uint64 `gorm:"index"`
+	BlockHash   string
+	BlockTime   time.Time
+	TxHash      string
+	LogIndex    uint
+	URI         string `gorm:"type:text"`
+	Data        []byte
+	CreatedAt   time.Time // as recorded by the contract
+	UpdatedAt   time.Time // as recorded by the contract
+}
+
+// TableName ...
+func (Version) TableName() string {
+	return "mirror_versions"
+}
+
+// Cursor is the last block of a collection contract that has been copied to the mirror
+type Cursor struct {
+	Collection  string `gorm:"primary_key"`
+	BlockNumber uint64
+}
+
+// TableName ...
+func (Cursor) TableName() string {
+	return "mirror_cursors"
+}
+
+// IndexEntry is a key under which the ObjectIndex contract of an index holds an object
+type IndexEntry struct {
+	ID         uint   `gorm:"primary_key"`
+	Collection string `gorm:"index"`
+	Index      string
+	Key        string `gorm:"index"`
+	ObjectID   string `gorm:"index"`
+}
+
+// TableName ...
+func (IndexEntry) TableName() string {
+	return "mirror_index_entries"
+}
@@ -0,0 +1,159 @@
+package mirror
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// Reader reads the objects of a collection contract from the mirror
+// it returns the same results as an ethereum.Adapter at the last block copied to the mirror
+type Reader struct {
+	adapter    *ethereum.Adapter
+	collection *config.ObjectCollectionContract
+	db         *database.DB
+}
+
+// mirroredData is the data of an object as copied to the mirror
+type mirroredData struct {
+	uri  string
+	data []byte
+}
+
+// URI ...
+func (d *mirroredData) URI() string {
+	return d.uri
+}
+
+// Bytes returns the data, which is only missing for objects that could not be decrypted
+func (d *mirroredData) Bytes() ([]byte, error) {
+	if d.data == nil {
+		return nil, storage.ErrForbidden
+	}
+	return d.data, nil
+}
+
+// Read ...
+func (r *Reader) Read(ctx context.Context, id uuid.UUID) (*ethereum.ObjectCollectionElement, error) {
+	object := &Object{}
+	query := r.db.Where(&Object{Collection: r.collection.StorageName(), ObjectID: id.String()}).First(object)
+	if query.RecordNotFound() || object.Removed {
+		return nil, ethereum.ErrObjectNotFound
+	} else if err := query.Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query mirror")
+	}
+	return &ethereum.ObjectCollectionElement{
+		CreatedAt: object.CreatedAt,
+		UpdatedAt: object.UpdatedAt,
+		Data:      &mirroredData{uri: object.URI, data: object.Data},
+	}, nil
+}
+
+// ReadAt reads an object as it was stored at the end of the provided block
+func (r *Reader) ReadAt(ctx context.Context, id uuid.UUID, blockNumber *big.Int) (*ethereum.ObjectCollectionElement, error) {
+	version := &Version{}
+	query := r.db.Where(&Version{Collection: r.collection.StorageName(), ObjectID: id.String()}).
+		Where("block_number <= ?", blockNumber.Uint64()).
+		Order("block_number desc, log_index desc").
+		First(version)
+	if query.RecordNotFound() || version.URI == "" {
+		return nil, ethereum.ErrObjectNotFound
+	} else if err := query.Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query mirror")
+	}
+	return &ethereum.ObjectCollectionElement{
+		CreatedAt: version.CreatedAt,
+		UpdatedAt: version.UpdatedAt,
+		Data:      &mirroredData{uri: version.URI, data: version.Data},
+	}, nil
+}
+
+// ObjectEvents returns all changes recorded by the collection contract between two blocks (inclusive), oldest first
+// a nil toBlock reads up to the last block copied to the mirror, and a nil id reads the changes of every object
+func (r *Reader) ObjectEvents(ctx context.Context, fromBlock uint64, toBlock *uint64, id uuid.UUID) ([]*ethereum.ObjectEvent, error) {
+	filter := &Version{Collection: r.collection.StorageName()}
+	if id != nil {
+		filter.ObjectID = id.String()
+	}
+	query := r.db.Where(filter).Where("block_number >= ?", fromBlock)
+	if toBlock != nil {
+		query = query.Where("block_number <= ?", *toBlock)
+	}
+	versions := []*Version{}
+	if err := query.Order("block_number, log_index").Find(&versions).Error; err != nil {
+		return nil, errors.Wrap(err, "failed to query mirror")
+	}
+	events := make([]*ethereum.ObjectEvent, len(versions))
+	for i, v := range versions {
+		events[i] = versionToEvent(v)
+	}
+	return events, nil
+}
+
+// BlockTime returns the timestamp of a block that contains a change to the collection
+func (r *Reader) BlockTime(ctx context.Context, blockNumber uint64) (time.Time, error) {
+	version := &Version{}
+	err := r.db.Where(&Version{Collection: r.collection.StorageName(), BlockNumber: blockNumber}).First(version).Error
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "failed to get time of block %d", blockNumber)
+	}
+	return version.BlockTime, nil
+}
+
+// FindObjectIDs returns the IDs of all objects stored under a value in the ObjectIndex contract at the provided address
+// the value is turned into a key as the adapter does for the contract, so both find the same objects
+func (r *Reader) FindObjectIDs(ctx context.Context, indexAddress common.Address, value string) ([]uuid.UUID, error) {
+	found := false
+	for _, idx := range r.collection.Indexes {
+		if idx.Address == indexAddress {
+			found = true
+		}
+	}
+	if !found {
+		return nil, errors.Errorf("no index configured at address %v", indexAddress.String())
+	}
+	key, err := r.adapter.IndexKey(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate index key")
+	}
+	entries := []*IndexEntry{}
+	err = r.db.Where(&IndexEntry{Collection: r.collection.StorageName(), Index: indexAddress.Hex(), Key: common.Bytes2Hex(key[:])}).
+		Order("id").
+		Find(&entries).Error
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to query mirror")
+	}
+	ids := make([]uuid.UUID, len(entries))
+	for i, entry := range entries {
+		ids[i] = uuid.Parse(entry.ObjectID)
+	}
+	return ids, nil
+}
+
+func versionToEvent(v *Version) *ethereum.ObjectEvent {
+	return &ethereum.ObjectEvent{
+		ID:          uuid.Parse(v.ObjectID),
+		Type:        v.Type,
+		BlockNumber: v.BlockNumber,
+		BlockHash:   common.HexToHash(v.BlockHash),
+		TxHash:      common.HexToHash(v.TxHash),
+		LogIndex:    v.LogIndex,
+	}
+}
+
+// NewReader ...
+func NewReader(db *database.DB, adapter *ethereum.Adapter) *Reader {
+	return &Reader{
+		adapter:    adapter,
+		collection: adapter.Collection(),
+		db:         db,
+	}
+}
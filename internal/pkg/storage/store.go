@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BackendEthereum stores resources in collection contracts
+	BackendEthereum = "ethereum"
+	// BackendSQL stores resources in the database
+	BackendSQL = "sql"
+)
+
+var (
+	// ErrObjectNotFound is returned when an object does not exist in a store
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrVersionConflict is returned when a store rejects an update of an object that has changed
+	ErrVersionConflict = errors.New("object has been modified")
+	// ErrWriteFailed is returned when a write that was accepted for processing is rejected
+	ErrWriteFailed = errors.New("write failed")
+	// ErrForbidden is returned when an object exists but cannot be read with the keys of the server
+	ErrForbidden = errors.New("not authorized to read object")
+	// ErrTooLarge is returned when a write is larger than a store accepts
+	ErrTooLarge = errors.New("write is too large")
+)
+
+// Object is a version of an object held by a store
+type Object struct {
+	ID        uuid.UUID
+	Data      []byte
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// ChangeType identifies the kind of change made to an object
+type ChangeType string
+
+const (
+	// ChangeCreate is recorded when an object is added to a store
+	ChangeCreate ChangeType = "create"
+	// ChangeUpdate is recorded when an object is replaced
+	ChangeUpdate ChangeType = "update"
+	// ChangeDelete is recorded when an object is removed from a store
+	ChangeDelete ChangeType = "delete"
+)
+
+// Change is an entry in the history of a store
+type Change struct {
+	ID      uuid.UUID
+	Type    ChangeType
+	Version uint64 // version of the store that contains the change
+	Time    time.Time
+}
+
+// Write is a change that has been accepted by a store but may not have been applied yet
+type Write interface {
+	// ID identifies the write, e.g. the hash of a transaction
+	ID() string
+	// Wait blocks until the write has been applied, returning ErrWriteFailed if it was rejected
+	Wait(ctx context.Context) error
+	// OnApplied calls fn once the write has been applied, and never when it is rejected
+	OnApplied(fn func())
+}
+
+// WhenApplied calls fn once a write has been applied, straight away for writes applied before they returned
+func WhenApplied(w Write, fn func()) {
+	if w == nil {
+		fn()
+		return
+	}
+	w.OnApplied(fn)
+}
+
+// Store holds the versions of the objects of a single resource type
+// writes that are applied before they return report a nil Write
+type Store interface {
+	// Create adds a new object
+	Create(ctx context.Context, id uuid.UUID, data []byte) (Write, error)
+	// Read returns the current version of an object
+	Read(ctx context.Context, id uuid.UUID) (*Object, error)
+	// ReadAt returns an object as it was at a version of the store
+	ReadAt(ctx context.Context, id uuid.UUID, version uint64) (*Object, error)
+	// Update replaces an object, failing with ErrVersionConflict if it has changed since lastUpdatedAt
+	Update(ctx context.Context, id uuid.UUID, lastUpdatedAt time.Time, data []byte) (Write, error)
+	// Destroy removes an object
+	Destroy(ctx context.Context, id uuid.UUID) (Write, error)
+	// CurrentVersion returns the version of the store, which increases with every change
+	CurrentVersion(ctx context.Context) (uint64, error)
+	// History returns the changes made to an object, or to every object when id is nil, oldest first
+	History(ctx context.Context, id uuid.UUID) ([]*Change, error)
+	// Find returns the IDs of the objects stored under a value in an index
+	Find(ctx context.Context, index string, value string) ([]uuid.UUID, error)
+	// List returns the IDs of every object that has not been removed
+	List(ctx context.Context) ([]uuid.UUID, error)
+}
+
+// Replica is implemented by stores that serve reads from a copy which may lag behind their writes
+type Replica interface {
+	// Primary returns a store that reads the authoritative copy
+	Primary() Store
+}
+
+// Primary returns the store to read from when the result must reflect every completed write
+func Primary(s Store) Store {
+	if r, ok := s.(Replica); ok {
+		return r.Primary()
+	}
+	return s
+}
+
+// GetIndex returns the configuration of an index of a collection
+func GetIndex(collection *config.ObjectCollectionContract, name string) (*config.ObjectIndex, error) {
+	for _, idx := range collection.Indexes {
+		if idx.Name == name {
+			return idx, nil
+		}
+	}
+	return nil, errors.Errorf("no index %q configured for collection %q", name, collection.Name)
+}
+
+// IndexValues returns the values under which an index holds a JSON document
+func IndexValues(index *config.ObjectIndex, data []byte) ([]string, error) {
+	var jsonData interface{}
+	if err := json.Unmarshal(data, &jsonData); err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal json data")
+	}
+	result, err := index.JSONPath.Lookup(jsonData)
+	if err != nil {
+		// documents without the element are not indexed
+		return nil, nil
+	}
+	keys, ok := result.([]interface{})
+	if !ok {
+		keys = []interface{}{result}
+	}
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = fmt.Sprintf("%v", k)
+	}
+	return values, nil
+}
@@ -0,0 +1,65 @@
+package subscriptions
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Criteria is a parsed Subscription criteria string, e.g. "Practitioner?identifier=1234567890"
+type Criteria struct {
+	ResourceType string
+	Params       url.Values
+}
+
+// ParseCriteria parses a Subscription criteria string
+func ParseCriteria(criteria string) (*Criteria, error) {
+	parts := strings.SplitN(strings.TrimPrefix(criteria, "/"), "?", 2)
+	if parts[0] == "" || strings.Contains(parts[0], "/") {
+		return nil, errors.Errorf("invalid criteria %q", criteria)
+	}
+	c := &Criteria{ResourceType: parts[0], Params: url.Values{}}
+	if len(parts) == 2 {
+		params, err := url.ParseQuery(parts[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid criteria %q", criteria)
+		}
+		c.Params = params
+	}
+	return c, nil
+}
+
+// Matcher evaluates search parameters against the resources of one type, the way a search of that type does
+type Matcher interface {
+	// CheckSearch returns an error when the parameters cannot be evaluated
+	CheckSearch(params url.Values) error
+	// MatchesSearch reports whether a JSON resource would be found by a search with the parameters
+	MatchesSearch(params url.Values, resource []byte) (bool, error)
+}
+
+// Matches reports whether a JSON resource satisfies the criteria, whose parameters are evaluated by matcher
+func (c *Criteria) Matches(resourceType string, resource []byte, matcher Matcher) (bool, error) {
+	if c.ResourceType != resourceType || !json.Valid(resource) {
+		return false, nil
+	}
+	if len(c.Params) == 0 {
+		return true, nil
+	}
+	if matcher == nil {
+		return false, errors.Errorf("%s resources cannot be searched", resourceType)
+	}
+	return matcher.MatchesSearch(c.Params, resource)
+}
+
+// Check returns an error when the parameters of the criteria cannot be evaluated by matcher
+func (c *Criteria) Check(matcher Matcher) error {
+	if len(c.Params) == 0 {
+		return nil
+	}
+	if matcher == nil {
+		return errors.Errorf("%s resources cannot be searched", c.ResourceType)
+	}
+	return matcher.CheckSearch(c.Params)
+}
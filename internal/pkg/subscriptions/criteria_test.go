@@ -0,0 +1,90 @@
+package subscriptions
+
+import (
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+const practitionerJSON = `{
+	"resourceType": "Practitioner",
+	"id": "a1",
+	"active": true,
+	"identifier": [{"system": "http://hl7.org/fhir/sid/us-npi", "value": "1234567890"}],
+	"name": [{"family": "Careful", "given": ["Adam"]}],
+	"managingOrganization": {"reference": "Organization/o1"}
+}`
+
+func TestParseCriteria(t *testing.T) {
+	c, err := ParseCriteria("/Practitioner?name=car&active=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ResourceType != "Practitioner" || c.Params.Get("name") != "car" || c.Params.Get("active") != "true" {
+		t.Fatalf("unexpected criteria %+v", c)
+	}
+	for _, invalid := range []string{"", "?name=x", "Practitioner/a1", "Practitioner?name=%zz"} {
+		if _, err := ParseCriteria(invalid); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+// activeMatcher supports the active parameter only, which it matches against the active element of a resource
+type activeMatcher struct{}
+
+func (activeMatcher) CheckSearch(params url.Values) error {
+	for name := range params {
+		if name != "active" {
+			return errors.Errorf("unsupported search parameter %q", name)
+		}
+	}
+	return nil
+}
+
+func (m activeMatcher) MatchesSearch(params url.Values, resource []byte) (bool, error) {
+	if err := m.CheckSearch(params); err != nil {
+		return false, err
+	}
+	doc := struct{ Active bool }{}
+	if err := json.Unmarshal(resource, &doc); err != nil {
+		return false, err
+	}
+	return params.Get("active") == strconv.FormatBool(doc.Active), nil
+}
+
+func TestCriteriaMatches(t *testing.T) {
+	tests := []struct {
+		criteria string
+		matcher  Matcher
+		matches  bool
+		err      bool
+	}{
+		{"Practitioner", nil, true, false},
+		{"Location", activeMatcher{}, false, false},
+		{"Practitioner?active=true", activeMatcher{}, true, false},
+		{"Practitioner?active=false", activeMatcher{}, false, false},
+		{"Practitioner?active=true", nil, false, true},
+		{"Practitioner?gender=male", activeMatcher{}, false, true},
+	}
+	for _, tt := range tests {
+		c, err := ParseCriteria(tt.criteria)
+		if err != nil {
+			t.Fatal(err)
+		}
+		matches, err := c.Matches("Practitioner", []byte(practitionerJSON), tt.matcher)
+		if matches != tt.matches || tt.err != (err != nil) {
+			t.Errorf("%s: expected %v with error %v, got %v, %v", tt.criteria, tt.matches, tt.err, matches, err)
+		}
+		if err := c.Check(tt.matcher); tt.err != (err != nil) {
+			t.Errorf("%s: expected the check to fail %v, got %v", tt.criteria, tt.err, err)
+		}
+	}
+	c, _ := ParseCriteria("Practitioner")
+	if matches, _ := c.Matches("Practitioner", []byte("not json"), nil); matches {
+		t.Error("expected invalid JSON not to match")
+	}
+}
@@ -0,0 +1,385 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/pkg/errors"
+	"go.uber.org/fx"
+)
+
+// Action is the kind of change made to a resource
+type Action string
+
+const (
+	// ActionCreate is reported when a resource is created
+	ActionCreate Action = "create"
+	// ActionUpdate is reported when a resource is updated or patched
+	ActionUpdate Action = "update"
+	// ActionDelete is reported when a resource is deleted
+	ActionDelete Action = "delete"
+)
+
+// Event is a change to a resource observed by the server
+type Event struct {
+	Action       Action
+	ResourceType string
+	ResourceID   string
+	Resource     []byte // JSON of the resource after the change, or before it for deletes
+	Tenant       string // only subscriptions of the same tenant are notified
+}
+
+// Channel delivers notifications for a subscription channel type
+type Channel interface {
+	// Handshake verifies that notifications can be delivered to a newly requested subscription
+	Handshake(ctx context.Context, id string, sub *models.Subscription) error
+	// Deliver sends a notification about an event that matches the subscription criteria
+	Deliver(ctx context.Context, id string, sub *models.Subscription, event *Event) error
+}
+
+// eventsBuffer is the number of events that can be queued before new events are dropped
+const eventsBuffer = 256
+
+// defaultDeliveryWorkers is the number of notifications delivered concurrently when none is configured
+const defaultDeliveryWorkers = 4
+
+// delivery is a notification waiting for a delivery worker
+type delivery struct {
+	id    string
+	sub   *models.Subscription
+	event *Event
+}
+
+// Engine activates requested subscriptions and delivers notifications when resources change
+type Engine struct {
+	activating    map[string]bool
+	channels      map[models.SubscriptionChannelType]Channel
+	context       context.Context
+	contextCancel context.CancelFunc
+	db            *database.DB
+	deliveries    chan *delivery
+	events        chan *Event
+	log           logging.FieldLogger
+	matchers      map[matcherKey]Matcher
+	mutex         sync.Mutex
+	pollInterval  time.Duration
+	retries       int
+	retryDelay    time.Duration
+	wake          chan struct{}
+	workers       int
+}
+
+// RegisterChannel sets the channel used to deliver notifications of a channel type
+func (e *Engine) RegisterChannel(channelType models.SubscriptionChannelType, channel Channel) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.channels[channelType] = channel
+}
+
+// matcherKey identifies the resources of a type held by an organization, whose criteria are evaluated alike
+type matcherKey struct {
+	tenant       string
+	resourceType string
+}
+
+// RegisterMatcher sets the matcher that evaluates the criteria of the subscriptions to the resources of a type held by
+// an organization, empty for the top level organization
+func (e *Engine) RegisterMatcher(tenant, resourceType string, matcher Matcher) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.matchers[matcherKey{tenant: tenant, resourceType: resourceType}] = matcher
+}
+
+func (e *Engine) getMatcher(tenant, resourceType string) Matcher {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.matchers[matcherKey{tenant: tenant, resourceType: resourceType}]
+}
+
+// Notify queues an event for evaluation against all active subscriptions
+func (e *Engine) Notify(event *Event) {
+	select {
+	case e.events <- event:
+	default:
+		e.log.WithField("resource", event.ResourceType+"/"+event.ResourceID).Warn("event queue is full, dropping event")
+	}
+}
+
+// Wake requests that pending subscriptions are activated without waiting for the next poll
+func (e *Engine) Wake() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start ...
+// notifications are delivered by a fixed number of workers, so that slow endpoints hold back deliveries instead of
+// accumulating goroutines
+func (e *Engine) Start() {
+	e.log.Info("started")
+	for i := 0; i < e.workers; i++ {
+		go func() {
+			for {
+				select {
+				case d := <-e.deliveries:
+					e.deliver(d.id, d.sub, d.event)
+				case <-e.context.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(e.pollInterval)
+		defer ticker.Stop()
+		e.activatePending()
+		for {
+			select {
+			case event := <-e.events:
+				e.processEvent(event)
+			case <-ticker.C:
+				e.activatePending()
+			case <-e.wake:
+				e.activatePending()
+			case <-e.context.Done():
+				e.log.Info("stopped")
+				return
+			}
+		}
+	}()
+}
+
+// activatePending performs the handshake for every requested subscription
+func (e *Engine) activatePending() {
+	records := []*Record{}
+	if err := e.db.Where("active = ?", false).Find(&records).Error; err != nil {
+		e.log.WithError(err).Error("failed to query pending subscriptions")
+		return
+	}
+	for _, rec := range records {
+		sub := &models.Subscription{}
+		if err := json.Unmarshal(rec.Data, sub); err != nil {
+			e.log.WithError(err).WithField("subscription", rec.UUID).Error("failed to unmarshal subscription")
+			continue
+		}
+		if sub.Status != models.SubscriptionStatusRequested || !e.startActivation(rec.UUID) {
+			continue
+		}
+		go e.activate(rec.UUID, rec.Tenant, sub)
+	}
+}
+
+// startActivation marks a subscription as being activated, returning false if an activation is already in progress
+func (e *Engine) startActivation(id string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.activating[id] {
+		return false
+	}
+	e.activating[id] = true
+	return true
+}
+
+func (e *Engine) activate(id, tenant string, sub *models.Subscription) {
+	defer func() {
+		e.mutex.Lock()
+		delete(e.activating, id)
+		e.mutex.Unlock()
+	}()
+
+	log := e.log.WithField("subscription", id)
+	channel, err := e.getChannel(sub)
+	if err == nil {
+		var criteria *Criteria
+		if criteria, err = ParseCriteria(sub.Criteria); err == nil {
+			err = criteria.Check(e.getMatcher(tenant, criteria.ResourceType))
+		}
+	}
+	if err == nil {
+		err = e.retry(func() error { return channel.Handshake(e.context, id, sub) })
+	}
+	if err != nil && e.context.Err() != nil {
+		// shutting down
+		return
+	}
+	if err != nil {
+		log.WithError(err).Warn("subscription could not be activated")
+		e.setStatus(id, models.SubscriptionStatusError, err.Error())
+		return
+	}
+	log.Info("subscription activated")
+	e.setStatus(id, models.SubscriptionStatusActive, "")
+}
+
+// processEvent queues the delivery of an event to every active subscription whose criteria it matches
+// it blocks while every worker is busy and the queue of deliveries is full
+func (e *Engine) processEvent(event *Event) {
+	records := []*Record{}
+	if err := e.db.Where("active = ? AND tenant = ?", true, event.Tenant).Find(&records).Error; err != nil {
+		e.log.WithError(err).Error("failed to query active subscriptions")
+		return
+	}
+	for _, rec := range records {
+		sub := &models.Subscription{}
+		if err := json.Unmarshal(rec.Data, sub); err != nil {
+			e.log.WithError(err).WithField("subscription", rec.UUID).Error("failed to unmarshal subscription")
+			continue
+		}
+		criteria, err := ParseCriteria(sub.Criteria)
+		if err != nil {
+			continue
+		}
+		matches, err := criteria.Matches(event.ResourceType, event.Resource, e.getMatcher(event.Tenant, event.ResourceType))
+		if err != nil {
+			e.log.WithError(err).WithField("subscription", rec.UUID).Warn("failed to evaluate subscription criteria")
+		}
+		if !matches {
+			continue
+		}
+		select {
+		case e.deliveries <- &delivery{id: rec.UUID, sub: sub, event: event}:
+		case <-e.context.Done():
+			return
+		}
+	}
+}
+
+func (e *Engine) deliver(id string, sub *models.Subscription, event *Event) {
+	log := e.log.WithFields(logging.Fields{
+		"subscription": id,
+		"resource":     event.ResourceType + "/" + event.ResourceID,
+	})
+	channel, err := e.getChannel(sub)
+	if err == nil {
+		err = e.retry(func() error { return channel.Deliver(e.context, id, sub, event) })
+	}
+	if err != nil && e.context.Err() != nil {
+		// shutting down
+		return
+	}
+	if err != nil {
+		log.WithError(err).Warn("notification could not be delivered")
+		e.setStatus(id, models.SubscriptionStatusError, err.Error())
+		return
+	}
+	log.Debug("notification delivered")
+}
+
+func (e *Engine) getChannel(sub *models.Subscription) (Channel, error) {
+	if sub.Channel == nil {
+		return nil, errors.New("subscription has no channel")
+	}
+	e.mutex.Lock()
+	channel, ok := e.channels[sub.Channel.Type]
+	e.mutex.Unlock()
+	if !ok {
+		return nil, errors.Errorf("unsupported channel type %q", sub.Channel.Type)
+	}
+	return channel, nil
+}
+
+// retry calls fn until it succeeds, doubling the delay between attempts
+func (e *Engine) retry(fn func() error) error {
+	delay := e.retryDelay
+	err := fn()
+	for attempt := 0; err != nil && attempt < e.retries; attempt++ {
+		select {
+		case <-time.After(delay):
+		case <-e.context.Done():
+			return errors.Wrap(e.context.Err(), err.Error())
+		}
+		delay *= 2
+		err = fn()
+	}
+	return err
+}
+
+// setStatus records the status of a subscription, which is only active while its status is "active"
+func (e *Engine) setStatus(id string, status models.SubscriptionStatus, errorText string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	log := e.log.WithField("subscription", id)
+	rec := &Record{}
+	if err := e.db.Where(&Record{UUID: id}).First(rec).Error; err != nil {
+		log.WithError(err).Error("failed to read subscription")
+		return
+	}
+	sub := &models.Subscription{}
+	if err := json.Unmarshal(rec.Data, sub); err != nil {
+		log.WithError(err).Error("failed to unmarshal subscription")
+		return
+	}
+	now := time.Now().UTC()
+	sub.Status = status
+	sub.Error = errorText
+	if sub.Meta == nil {
+		sub.Meta = &models.Meta{}
+	}
+	sub.Meta.LastUpdated = now.Format(time.RFC3339)
+	data, err := json.Marshal(sub)
+	if err != nil {
+		log.WithError(err).Error("failed to marshal subscription")
+		return
+	}
+	rec.Data = data
+	rec.Active = status == models.SubscriptionStatusActive
+	rec.UpdatedAt = now
+	if err := e.db.Save(rec).Error; err != nil {
+		log.WithError(err).Error("failed to save subscription")
+	}
+}
+
+// NewEngine ...
+func NewEngine(lc fx.Lifecycle, log *logging.Logger, db *database.DB, config *config.Config) *Engine {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	e := &Engine{
+		activating:    map[string]bool{},
+		channels:      map[models.SubscriptionChannelType]Channel{},
+		context:       ctx,
+		contextCancel: cancel,
+		db:            db,
+		deliveries:    make(chan *delivery, eventsBuffer),
+		events:        make(chan *Event, eventsBuffer),
+		log:           log.WithField("component", "subscriptions"),
+		matchers:      map[matcherKey]Matcher{},
+		pollInterval:  config.SubscriptionPollInterval,
+		retries:       config.SubscriptionRetries,
+		retryDelay:    config.SubscriptionRetryDelay,
+		wake:          make(chan struct{}, 1),
+		workers:       config.SubscriptionWorkers,
+	}
+	if e.pollInterval <= 0 {
+		e.pollInterval = time.Minute
+	}
+	if e.retryDelay <= 0 {
+		e.retryDelay = time.Second
+	}
+	if e.workers <= 0 {
+		e.workers = defaultDeliveryWorkers
+	}
+	e.RegisterChannel(models.SubscriptionChannelTypeRestHook, NewRestHook(&http.Client{Timeout: config.SubscriptionTimeout}))
+
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			cancel()
+			return nil
+		},
+	})
+
+	return e
+}
+
+// StartEngine ...
+func StartEngine(engine *Engine) {
+	engine.Start()
+}
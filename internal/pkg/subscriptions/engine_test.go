@@ -0,0 +1,144 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"go.uber.org/fx/fxtest"
+)
+
+// blockingChannel records the notifications delivered to it, holding each delivery until it is released
+type blockingChannel struct {
+	mutex     sync.Mutex
+	active    int
+	maxActive int
+	delivered map[string][]string
+	release   chan struct{}
+}
+
+func (c *blockingChannel) Handshake(ctx context.Context, id string, sub *models.Subscription) error {
+	return nil
+}
+
+func (c *blockingChannel) Deliver(ctx context.Context, id string, sub *models.Subscription, event *Event) error {
+	c.mutex.Lock()
+	c.active++
+	if c.active > c.maxActive {
+		c.maxActive = c.active
+	}
+	c.mutex.Unlock()
+	<-c.release
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.active--
+	c.delivered[id] = append(c.delivered[id], event.ResourceID)
+	return nil
+}
+
+func (c *blockingChannel) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := 0
+	for _, ids := range c.delivered {
+		n += len(ids)
+	}
+	return n
+}
+
+func TestEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-subscriptions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := logging.NewLogger()
+	appConfig := &config.Config{
+		DatabaseType:             "sqlite3",
+		DatabaseConnectionString: filepath.Join(dir, "test.db"),
+		SubscriptionPollInterval: time.Hour,
+		SubscriptionWorkers:      2,
+	}
+	db, err := database.NewConnection(log, appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+	if err := db.AutoMigrate(&Record{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	subscribe := func(id string, criteria string, tenant string, active bool) {
+		data, err := json.Marshal(&models.Subscription{
+			Criteria: criteria,
+			Status:   models.SubscriptionStatusActive,
+			Channel:  &models.SubscriptionChannel{Type: models.SubscriptionChannelTypeRestHook},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Create(&Record{UUID: id, Data: data, Active: active, Tenant: tenant}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	subscribe("active", "Practitioner?active=true", "", true)
+	subscribe("inactive", "Practitioner?active=false", "", true)
+	subscribe("location", "Location", "", true)
+	subscribe("tenant", "Practitioner", "clinic", true)
+	subscribe("off", "Practitioner", "", false)
+
+	lc := fxtest.NewLifecycle(t)
+	engine := NewEngine(lc, log, db, appConfig)
+	channel := &blockingChannel{delivered: map[string][]string{}, release: make(chan struct{})}
+	engine.RegisterChannel(models.SubscriptionChannelTypeRestHook, channel)
+	engine.RegisterMatcher("", "Practitioner", activeMatcher{})
+	lc.RequireStart()
+	defer lc.RequireStop()
+	engine.Start()
+
+	for _, id := range []string{"p1", "p2", "p3", "p4", "p5"} {
+		engine.Notify(&Event{Action: ActionCreate, ResourceType: "Practitioner", ResourceID: id, Resource: []byte(`{"resourceType": "Practitioner", "active": true}`)})
+	}
+	engine.Notify(&Event{Action: ActionCreate, ResourceType: "Practitioner", ResourceID: "c1", Resource: []byte(`{"resourceType": "Practitioner"}`), Tenant: "clinic"})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for delivered := 0; delivered < 6; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 6 notifications, got %d", delivered)
+		}
+		select {
+		case channel.release <- struct{}{}:
+			delivered++
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	for channel.count() < 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	channel.mutex.Lock()
+	defer channel.mutex.Unlock()
+	if channel.maxActive > appConfig.SubscriptionWorkers {
+		t.Fatalf("expected at most %d concurrent deliveries, got %d", appConfig.SubscriptionWorkers, channel.maxActive)
+	}
+	if len(channel.delivered["active"]) != 5 {
+		t.Fatalf("expected 5 notifications of the matching subscription, got %v", channel.delivered["active"])
+	}
+	if ids := channel.delivered["tenant"]; len(ids) != 1 || ids[0] != "c1" {
+		t.Fatalf("expected the tenant subscription to be notified of its tenant only, got %v", ids)
+	}
+	for _, id := range []string{"inactive", "location", "off"} {
+		if len(channel.delivered[id]) != 0 {
+			t.Fatalf("expected subscription %q not to be notified, got %v", id, channel.delivered[id])
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package subscriptions
+
+import "time"
+
+// Record is a Subscription resource as stored in the database
+type Record struct {
+	UUID      string `gorm:"primary_key"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	DeletedAt *time.Time `sql:"index"`
+	Data      []byte
+	Active    bool
+	// Owner is the client that created the subscription, whose token is required to bind to it when authorization is enabled
+	Owner string
+	// Tenant is the organization the subscription was created for, empty for the top level organization
+	Tenant string `gorm:"not null;default:''"`
+}
+
+// TableName keeps the table name used before the model was shared with the subscription engine
+func (Record) TableName() string {
+	return "subscription_dbs"
+}
@@ -0,0 +1,69 @@
+package subscriptions
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/pkg/errors"
+)
+
+// RestHook delivers notifications by POSTing to the subscription endpoint
+type RestHook struct {
+	client *http.Client
+}
+
+// NewRestHook ...
+func NewRestHook(client *http.Client) *RestHook {
+	return &RestHook{client: client}
+}
+
+// Handshake sends an empty notification, which the endpoint must accept for the subscription to be activated
+func (c *RestHook) Handshake(ctx context.Context, id string, sub *models.Subscription) error {
+	return c.post(ctx, sub, nil)
+}
+
+// Deliver sends the changed resource as the body when the subscription requests a payload, otherwise an empty notification
+func (c *RestHook) Deliver(ctx context.Context, id string, sub *models.Subscription, event *Event) error {
+	var body []byte
+	if sub.Channel.Payload != "" && event.Action != ActionDelete {
+		body = event.Resource
+	}
+	return c.post(ctx, sub, body)
+}
+
+func (c *RestHook) post(ctx context.Context, sub *models.Subscription, body []byte) error {
+	if sub.Channel.Endpoint == "" {
+		return errors.New("subscription has no endpoint")
+	}
+	req, err := http.NewRequest(http.MethodPost, sub.Channel.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "invalid endpoint")
+	}
+	req = req.WithContext(ctx)
+	for _, h := range sub.Channel.Header {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 {
+			return errors.Errorf("invalid header %q", h)
+		}
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	if len(body) > 0 {
+		req.Header.Set("Content-Type", sub.Channel.Payload)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to reach endpoint")
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("endpoint responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
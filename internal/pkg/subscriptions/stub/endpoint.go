@@ -0,0 +1,83 @@
+// Package stub provides a local rest-hook endpoint for testing subscription notifications
+package stub
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Notification is a request received by the endpoint
+type Notification struct {
+	Header http.Header
+	Body   []byte
+}
+
+// Endpoint is a local HTTP server that records the notifications it receives
+type Endpoint struct {
+	*httptest.Server
+
+	failures      int
+	mutex         sync.Mutex
+	notifications []*Notification
+	received      chan *Notification
+}
+
+// NewEndpoint starts an endpoint, which must be closed by the caller
+func NewEndpoint() *Endpoint {
+	e := &Endpoint{received: make(chan *Notification, 100)}
+	e.Server = httptest.NewServer(http.HandlerFunc(e.serveHTTP))
+	return e
+}
+
+func (e *Endpoint) serveHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	n := &Notification{Header: req.Header, Body: body}
+
+	e.mutex.Lock()
+	fail := e.failures > 0
+	if fail {
+		e.failures--
+	} else {
+		e.notifications = append(e.notifications, n)
+	}
+	e.mutex.Unlock()
+
+	if fail {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	select {
+	case e.received <- n:
+	default:
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// FailNext makes the endpoint respond with an error to the next n requests
+func (e *Endpoint) FailNext(n int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.failures = n
+}
+
+// Notifications returns all successfully received notifications, including handshakes
+func (e *Endpoint) Notifications() []*Notification {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]*Notification{}, e.notifications...)
+}
+
+// Wait returns the next received notification
+func (e *Endpoint) Wait(timeout time.Duration) (*Notification, error) {
+	select {
+	case n := <-e.received:
+		return n, nil
+	case <-time.After(timeout):
+		return nil, errors.New("timed out waiting for notification")
+	}
+}
@@ -0,0 +1,273 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"go.uber.org/fx"
+)
+
+const (
+	websocketWriteTimeout = 10 * time.Second
+	websocketPingInterval = 30 * time.Second
+	websocketSendBuffer   = 16
+)
+
+// websocketClient is a single websocket connection, which may be bound to several subscriptions
+type websocketClient struct {
+	conn *websocket.Conn
+	send chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *websocketClient) close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// writeLoop serializes all writes to the connection
+func (c *websocketClient) writeLoop() {
+	ticker := time.NewTicker(websocketPingInterval)
+	defer ticker.Stop()
+	defer c.conn.Close()
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(websocketWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				c.close()
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(websocketWriteTimeout)); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+			c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(websocketWriteTimeout))
+			return
+		}
+	}
+}
+
+// queue sends a message without blocking, dropping the client if it cannot keep up
+func (c *websocketClient) queue(msg string) bool {
+	select {
+	case c.send <- []byte(msg):
+		return true
+	case <-c.done:
+		return false
+	default:
+		c.close()
+		return false
+	}
+}
+
+// WebsocketChannel delivers notifications to websocket clients that have bound to a subscription
+// clients send "bind <id>" and receive "bound <id>", then "ping <id>" whenever a matching resource changes
+type WebsocketChannel struct {
+	clients     map[string]map[*websocketClient]bool
+	connections map[*websocketClient]bool
+	db          *database.DB
+	log         logging.FieldLogger
+	mutex       sync.Mutex
+	upgrader    websocket.Upgrader
+}
+
+// Handshake accepts every websocket subscription, since clients connect after activation
+func (c *WebsocketChannel) Handshake(ctx context.Context, id string, sub *models.Subscription) error {
+	return nil
+}
+
+// Deliver pings every client bound to the subscription, followed by the resource when a payload is requested
+func (c *WebsocketChannel) Deliver(ctx context.Context, id string, sub *models.Subscription, event *Event) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for client := range c.clients[id] {
+		if !client.queue("ping " + id) {
+			continue
+		}
+		if sub.Channel.Payload != "" && event.Action != ActionDelete {
+			client.queue(string(event.Resource))
+		}
+	}
+	return nil
+}
+
+// Handler returns the endpoint of the clients of the subscriptions of an organization, empty for the top level one
+// when authorization is enabled, clients may only bind to the subscriptions they created, for resources their token
+// grants read access to
+func (c *WebsocketChannel) Handler(tenant string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		c.serve(rw, req, tenant)
+	})
+}
+
+// serve upgrades the connection and processes bind requests until the client disconnects
+func (c *WebsocketChannel) serve(rw http.ResponseWriter, req *http.Request, tenant string) {
+	token := auth.FromContext(req.Context())
+	conn, err := c.upgrader.Upgrade(rw, req, nil)
+	if err != nil {
+		c.log.WithError(err).Info("websocket upgrade failed")
+		return
+	}
+	client := &websocketClient{
+		conn: conn,
+		send: make(chan []byte, websocketSendBuffer),
+		done: make(chan struct{}),
+	}
+	go client.writeLoop()
+	c.mutex.Lock()
+	c.connections[client] = true
+	c.mutex.Unlock()
+	defer c.disconnect(client)
+
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			client.close()
+			return
+		}
+		fields := strings.Fields(string(msg))
+		if len(fields) != 2 || fields[0] != "bind" {
+			client.queue(fmt.Sprintf("error unsupported command %q", string(msg)))
+			continue
+		}
+		id := fields[1]
+		if err := c.checkSubscription(id, tenant, token); err != nil {
+			client.queue(fmt.Sprintf("error %s %s", id, err.Error()))
+			continue
+		}
+		c.bind(id, client)
+		client.queue("bound " + id)
+	}
+}
+
+// checkSubscription verifies that a subscription of an organization is an active websocket subscription, which the
+// client of token, when there is one, created and may read the resources of
+func (c *WebsocketChannel) checkSubscription(id string, tenant string, token *auth.Token) error {
+	rec := &Record{}
+	query := c.db.Where("tenant = ?", tenant).Where(&Record{UUID: id})
+	if token != nil {
+		query = query.Where("owner = ?", token.ClientID)
+	}
+	if err := query.First(rec).Error; err != nil {
+		return errors.New("subscription not found")
+	}
+	if !rec.Active {
+		return errors.New("subscription is not active")
+	}
+	sub := &models.Subscription{}
+	if err := json.Unmarshal(rec.Data, sub); err != nil || sub.Channel == nil || sub.Channel.Type != models.SubscriptionChannelTypeWebsocket {
+		return errors.New("subscription does not use a websocket channel")
+	}
+	if token != nil {
+		criteria, err := ParseCriteria(sub.Criteria)
+		if err != nil {
+			return errors.New("subscription has invalid criteria")
+		}
+		if !token.Scopes.Allows(criteria.ResourceType, auth.Read) {
+			return errors.Errorf("the token does not grant read access to %s resources", criteria.ResourceType)
+		}
+	}
+	return nil
+}
+
+func (c *WebsocketChannel) bind(id string, client *websocketClient) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.clients[id] == nil {
+		c.clients[id] = map[*websocketClient]bool{}
+	}
+	c.clients[id][client] = true
+}
+
+func (c *WebsocketChannel) disconnect(client *websocketClient) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.connections, client)
+	for id, clients := range c.clients {
+		delete(clients, client)
+		if len(clients) == 0 {
+			delete(c.clients, id)
+		}
+	}
+}
+
+// closeAll disconnects every client
+func (c *WebsocketChannel) closeAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for client := range c.connections {
+		client.close()
+	}
+}
+
+// originChecker accepts the websocket connections of browsers on the origins allowed to make CORS requests, and of
+// clients that send no origin
+type originChecker struct {
+	allowed []string
+}
+
+func (o *originChecker) check(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, allowed := range o.allowed {
+		allowed = strings.ToLower(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// a single wildcard matches any part of an origin, as in the CORS configuration
+		if i := strings.Index(allowed, "*"); i >= 0 {
+			prefix, suffix := allowed[:i], allowed[i+1:]
+			if len(origin) >= len(prefix)+len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NewWebsocketChannel creates the websocket channel and registers it with the engine
+func NewWebsocketChannel(lc fx.Lifecycle, log *logging.Logger, db *database.DB, engine *Engine, config *config.Config) *WebsocketChannel {
+	origins := &originChecker{allowed: config.CORSAllowedOrigins}
+	c := &WebsocketChannel{
+		clients:     map[string]map[*websocketClient]bool{},
+		connections: map[*websocketClient]bool{},
+		db:          db,
+		log:         log.WithField("component", "subscriptions-ws"),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: origins.check,
+		},
+	}
+	engine.RegisterChannel(models.SubscriptionChannelTypeWebsocket, c)
+
+	lc.Append(fx.Hook{
+		OnStop: func(ctx context.Context) error {
+			c.closeAll()
+			return nil
+		},
+	})
+
+	return c
+}
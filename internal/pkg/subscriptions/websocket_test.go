@@ -0,0 +1,183 @@
+package subscriptions
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/format"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/storage/database"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+	"github.com/gorilla/websocket"
+	"github.com/urfave/negroni"
+	"go.uber.org/fx/fxtest"
+)
+
+func TestOriginChecker(t *testing.T) {
+	checker := &originChecker{allowed: []string{"https://app.example.org", "https://*.clinic.example.org"}}
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://fhir.example.org", true},
+		{"https://app.example.org", true},
+		{"https://APP.example.org", true},
+		{"https://ward.clinic.example.org", true},
+		{"https://clinic.example.org.evil.com", false},
+		{"https://evil.example.com", false},
+		{"http://app.example.org", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "https://fhir.example.org/fhir/$subscription-ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := checker.check(req); got != tt.allowed {
+			t.Errorf("origin %q: expected %v, got %v", tt.origin, tt.allowed, got)
+		}
+	}
+	anyOrigin := &originChecker{allowed: []string{"*"}}
+	req := httptest.NewRequest(http.MethodGet, "https://fhir.example.org/fhir/$subscription-ws", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	if !anyOrigin.check(req) {
+		t.Error("expected every origin to be allowed by a wildcard")
+	}
+}
+
+func TestWebsocketChannel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-websocket-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log := logging.NewLogger()
+	appConfig := &config.Config{
+		CORSAllowedOrigins:       []string{"https://app.example.org"},
+		DatabaseType:             "sqlite3",
+		DatabaseConnectionString: filepath.Join(dir, "test.db"),
+	}
+	db, err := database.NewConnection(log, appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.LogMode(false)
+	if err := db.AutoMigrate(&Record{}).Error; err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(&models.Subscription{
+		Criteria: "Practitioner",
+		Status:   models.SubscriptionStatusActive,
+		Channel:  &models.SubscriptionChannel{Type: models.SubscriptionChannelTypeWebsocket},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []*Record{
+		{UUID: "ws1", Data: data, Active: true},
+		{UUID: "ws2", Data: data, Active: true, Owner: "payer"},
+		{UUID: "ws3", Data: data, Active: true, Owner: "payer", Tenant: "beta"},
+	}
+	for _, rec := range records {
+		if err := db.Create(rec).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lc := fxtest.NewLifecycle(t)
+	channel := NewWebsocketChannel(lc, log, db, NewEngine(lc, log, db, appConfig), appConfig)
+	lc.RequireStart()
+	defer lc.RequireStop()
+
+	// the format negotiator must not wrap the response writer of the upgrade, which would not support hijacking
+	negotiator, err := format.NewNegotiator(log, static.NewStaticFilesBox())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := negroni.New(negotiator)
+	// requests with a client header carry a token, as if the authorizer had validated one
+	handler := channel.Handler("")
+	n.UseHandler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if client := req.Header.Get("X-Test-Client"); client != "" {
+			token := &auth.Token{ClientID: client, Scopes: auth.ParseScopes(req.Header.Get("X-Test-Scopes"))}
+			req = req.WithContext(auth.WithToken(req.Context(), token))
+		}
+		handler.ServeHTTP(rw, req)
+	}))
+	server := httptest.NewServer(n)
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/fhir/$subscription-ws"
+
+	_, res, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": []string{"https://evil.example.com"}})
+	if err == nil || res == nil || res.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a connection from another origin to be rejected, got %v", err)
+	}
+
+	dial := func(header http.Header) *websocket.Conn {
+		header.Set("Origin", "https://app.example.org")
+		conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	exchangeOn := func(conn *websocket.Conn, msg string) string {
+		if msg != "" {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, reply, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(reply)
+	}
+
+	// the subscriptions of other clients, of other organizations, or for resources the token cannot read are not bound
+	payer := dial(http.Header{"X-Test-Client": []string{"payer"}, "X-Test-Scopes": []string{"system/Location.read"}})
+	defer payer.Close()
+	for _, id := range []string{"ws1", "ws2", "ws3"} {
+		if reply := exchangeOn(payer, "bind "+id); !strings.HasPrefix(reply, "error "+id) {
+			t.Fatalf("expected binding to %s to fail, got %q", id, reply)
+		}
+	}
+	reader := dial(http.Header{"X-Test-Client": []string{"payer"}, "X-Test-Scopes": []string{"system/Practitioner.read"}})
+	defer reader.Close()
+	if reply := exchangeOn(reader, "bind ws2"); reply != "bound ws2" {
+		t.Fatalf("expected the subscription of the client to be bound, got %q", reply)
+	}
+
+	conn := dial(http.Header{"Accept": []string{"application/fhir+xml"}})
+	defer conn.Close()
+	exchange := func(msg string) string {
+		return exchangeOn(conn, msg)
+	}
+	if reply := exchange("bind missing"); !strings.HasPrefix(reply, "error missing") {
+		t.Fatalf("expected binding to a missing subscription to fail, got %q", reply)
+	}
+	if reply := exchange("bind ws1"); reply != "bound ws1" {
+		t.Fatalf("expected the subscription to be bound, got %q", reply)
+	}
+	sub := &models.Subscription{}
+	json.Unmarshal(data, sub)
+	if err := channel.Deliver(context.Background(), "ws1", sub, &Event{Action: ActionCreate, ResourceType: "Practitioner"}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := exchange(""); reply != "ping ws1" {
+		t.Fatalf("expected a notification, got %q", reply)
+	}
+}
@@ -0,0 +1,129 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// reloadCheckInterval is the shortest interval between checks of the certificate files for changes
+var reloadCheckInterval = 10 * time.Second
+
+// keyPair serves the certificate of the server, which is reloaded when its files change
+// a certificate that cannot be loaded, e.g. while only one of the files has been replaced, is retried at the next check
+type keyPair struct {
+	certFile      string
+	checkInterval time.Duration
+	checked       time.Time
+	cert          *tls.Certificate
+	keyFile       string
+	log           logging.FieldLogger
+	modTime       time.Time
+	mutex         sync.Mutex
+}
+
+// GetCertificate returns the current certificate, reloading it first when its files have changed since the last check
+func (k *keyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	if time.Since(k.checked) >= k.checkInterval {
+		if err := k.reload(); err != nil {
+			k.log.WithError(err).Warn("failed to reload certificate, the previous certificate is served")
+		}
+	}
+	return k.cert, nil
+}
+
+func (k *keyPair) reload() error {
+	k.checked = time.Now()
+	modTime := time.Time{}
+	for _, name := range []string{k.certFile, k.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return errors.Wrap(err, "failed to read certificate file")
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if k.cert != nil && modTime.Equal(k.modTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(k.certFile, k.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load certificate")
+	}
+	k.cert = &cert
+	k.modTime = modTime
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		k.log.WithFields(logging.Fields{
+			"subject":   leaf.Subject.String(),
+			"not_after": leaf.NotAfter,
+		}).Info("loaded certificate")
+	}
+	return nil
+}
+
+// NewTLSConfig creates the TLS configuration of the server, which is nil when it serves plain HTTP
+// clients are asked for a certificate when a CA bundle is configured, and must present one when it is required
+func NewTLSConfig(log *logging.Logger, config *config.Config) (*tls.Config, error) {
+	tLog := log.WithField("component", "tls")
+	if config.TLSCertFile == "" {
+		if config.TLSKeyFile != "" || config.TLSClientCAFile != "" || config.TLSClientCertRequired {
+			return nil, errors.New("TLS settings require tls_cert_file")
+		}
+		return nil, nil
+	}
+	if config.TLSKeyFile == "" {
+		return nil, errors.New("tls_cert_file requires tls_key_file")
+	}
+
+	pair := &keyPair{
+		certFile:      config.TLSCertFile,
+		checkInterval: reloadCheckInterval,
+		keyFile:       config.TLSKeyFile,
+		log:           tLog,
+	}
+	if err := pair.reload(); err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: pair.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	switch {
+	case config.TLSClientCAFile != "":
+		data, err := ioutil.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read client CA bundle")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("no certificates found in %s", config.TLSClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.TLSClientCertRequired {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	case config.TLSClientCertRequired:
+		return nil, errors.New("tls_client_cert_required requires tls_client_ca_file")
+	}
+	return tlsConfig, nil
+}
+
+// ConfigureServer serves HTTPS with a TLS configuration, negotiating HTTP/2 with the clients that support it
+func ConfigureServer(server *http.Server, tlsConfig *tls.Config) error {
+	server.TLSConfig = tlsConfig
+	return errors.Wrap(http2.ConfigureServer(server, &http2.Server{}), "failed to configure HTTP/2")
+}
@@ -0,0 +1,182 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/auth"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/config"
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/logging"
+	"golang.org/x/net/http2"
+)
+
+// issue creates a certificate signed by parent, or a self-signed CA certificate when parent is nil
+func issue(t *testing.T, commonName string, serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, path string, cert *x509.Certificate, key *ecdsa.PrivateKey) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if key == nil {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fhir-api-tls-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(interval time.Duration) { reloadCheckInterval = interval }(reloadCheckInterval)
+	reloadCheckInterval = 0
+
+	ca, caKey, _ := issue(t, "Test CA", 1, nil, nil)
+	serverCert, serverKey, _ := issue(t, "server", 2, ca, caKey)
+	_, _, clientCert := issue(t, "payer", 3, ca, caKey)
+	certFile := filepath.Join(dir, "server.pem")
+	writePEM(t, certFile, serverCert, serverKey)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, ca, nil)
+
+	appConfig := &config.Config{
+		TLSCertFile:           certFile,
+		TLSClientCAFile:       caFile,
+		TLSClientCertRequired: true,
+		TLSKeyFile:            certFile + ".key",
+	}
+	tlsConfig, err := NewTLSConfig(logging.NewLogger(), appConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintf(rw, "%s %s", req.Proto, auth.CertificateIdentity(auth.ClientCertificate(req)))
+	})}
+	if err := ConfigureServer(server, tlsConfig); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	defer server.Close()
+	url := "https://" + ln.Addr().String() + "/fhir/metadata"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	client := func(certs ...tls.Certificate) *http.Client {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}
+		if err := http2.ConfigureTransport(transport); err != nil {
+			t.Fatal(err)
+		}
+		return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	}
+	get := func(c *http.Client) (*http.Response, string) {
+		res, err := c.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, string(body)
+	}
+
+	res, body := get(client(clientCert))
+	if body != "HTTP/2.0 payer" {
+		t.Fatalf("expected an HTTP/2 request from payer, got %q", body)
+	}
+	if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 2 {
+		t.Fatalf("expected the server certificate, got serial %d", serial)
+	}
+	if _, err := client().Get(url); err == nil {
+		t.Fatal("expected a client without a certificate to be rejected")
+	}
+
+	renewed, renewedKey, _ := issue(t, "server", 4, ca, caKey)
+	writePEM(t, certFile, renewed, renewedKey)
+	later := time.Now().Add(time.Minute)
+	for _, name := range []string{certFile, certFile + ".key"} {
+		if err := os.Chtimes(name, later, later); err != nil {
+			t.Fatal(err)
+		}
+	}
+	res, _ = get(client(clientCert))
+	if serial := res.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != 4 {
+		t.Fatalf("expected the renewed server certificate, got serial %d", serial)
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.Config
+		err    bool
+	}{
+		{"plain HTTP", config.Config{}, false},
+		{"key without certificate", config.Config{TLSKeyFile: "server.key"}, true},
+		{"certificate without key", config.Config{TLSCertFile: "server.pem"}, true},
+		{"required client certificate without CA", config.Config{TLSCertFile: "server.pem", TLSKeyFile: "server.key", TLSClientCertRequired: true}, true},
+	}
+	for _, test := range tests {
+		tlsConfig, err := NewTLSConfig(logging.NewLogger(), &test.config)
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %t, got %v", test.name, test.err, err)
+		}
+		if err == nil && tlsConfig != nil {
+			t.Errorf("%s: expected plain HTTP", test.name)
+		}
+	}
+}
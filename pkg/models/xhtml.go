@@ -0,0 +1,219 @@
+package models
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// xmlNamespace is the namespace bound to the reserved xml prefix, e.g. of xml:lang attributes
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+var xhtmlTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// parseXHTML checks that the narrative of a JSON resource is a single well-formed XHTML div and writes it out again
+func parseXHTML(div string) (string, error) {
+	dec := xml.NewDecoder(strings.NewReader(div))
+	// the namespace of the div may be left out in JSON
+	dec.DefaultSpace = XHTMLNamespace
+	r := &xmlReader{dec: dec}
+	out := ""
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			if out == "" {
+				return "", errors.New("no div element found")
+			}
+			return out, nil
+		} else if err != nil {
+			return "", errors.Wrap(err, "unable to parse narrative")
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if out != "" {
+				return "", errors.New("more than one element found")
+			}
+			r.push(t)
+			if out, err = readXHTML(r, t); err != nil {
+				return "", err
+			}
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return "", errors.Errorf("unexpected text %q outside of the div", string(bytes.TrimSpace(t)))
+			}
+		default:
+			return "", errors.New("unexpected markup outside of the div")
+		}
+	}
+}
+
+// readXHTML writes out the div element started by start, declaring the namespaces it uses on its own elements since
+// the ones declared on its ancestors are not copied with it
+func readXHTML(r *xmlReader, start xml.StartElement) (string, error) {
+	if start.Name.Space != XHTMLNamespace || start.Name.Local != "div" {
+		return "", errors.Errorf("element %q is not an XHTML div", start.Name.Local)
+	}
+	w := &xhtmlWriter{}
+	if err := w.start(r, start); err != nil {
+		return "", err
+	}
+	for len(w.names) > 0 {
+		tok, err := r.token()
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			err = w.start(r, t)
+		case xml.EndElement:
+			w.end()
+		case xml.CharData:
+			w.close()
+			xhtmlTextEscaper.WriteString(&w.buf, string(t))
+		case xml.Comment:
+			w.close()
+			w.buf.WriteString("<!--" + string(t) + "-->")
+		default:
+			err = errors.New("unexpected processing instruction or directive")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return w.buf.String(), nil
+}
+
+// xhtmlWriter writes the elements of a narrative, with XHTML as the default namespace
+type xhtmlWriter struct {
+	buf bytes.Buffer
+	// names holds the qualified names of the open elements
+	names []string
+	// scopes holds the namespaces bound on each open element, by prefix, with "" for the default namespace
+	scopes []map[string]string
+	// open is set while the start tag of the last element is not yet closed
+	open bool
+}
+
+// bound returns the namespace of a prefix, looking up the element being started before the open ones
+func (w *xhtmlWriter) bound(scope map[string]string, prefix string) (string, bool) {
+	if space, ok := scope[prefix]; ok {
+		return space, true
+	}
+	for i := len(w.scopes) - 1; i >= 0; i-- {
+		if space, ok := w.scopes[i][prefix]; ok {
+			return space, true
+		}
+	}
+	// elements without a prefix are in no namespace until a default one is declared
+	return "", prefix == ""
+}
+
+// qualify returns the name to write for an element or attribute, binding its namespace in scope when it is not yet
+func (w *xhtmlWriter) qualify(r *xmlReader, scope map[string]string, name xml.Name, element bool) (string, error) {
+	space := name.Space
+	switch {
+	case space == "" && !element:
+		return name.Local, nil
+	case space == xmlNamespace:
+		return "xml:" + name.Local, nil
+	}
+	prefix, declared := r.prefix(space)
+	switch {
+	case space == XHTMLNamespace && element:
+		prefix = ""
+	case !declared && space != "":
+		return "", errors.Errorf("undeclared namespace %q", space)
+	case !element && prefix == "":
+		// attributes are only in a namespace through a prefix
+		prefix = "ns"
+	}
+	if element {
+		if bound, _ := w.bound(scope, ""); bound == space {
+			return name.Local, nil
+		}
+	}
+	for i := 1; ; i++ {
+		if bound, ok := w.bound(scope, prefix); ok && bound == space {
+			break
+		}
+		if _, taken := scope[prefix]; !taken {
+			scope[prefix] = space
+			break
+		}
+		prefix = "ns" + strconv.Itoa(i)
+	}
+	if prefix == "" {
+		return name.Local, nil
+	}
+	return prefix + ":" + name.Local, nil
+}
+
+func (w *xhtmlWriter) start(r *xmlReader, start xml.StartElement) error {
+	scope := map[string]string{}
+	name, err := w.qualify(r, scope, start.Name, true)
+	if err != nil {
+		return err
+	}
+	var attrs bytes.Buffer
+	for _, a := range start.Attr {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			// the namespaces are declared where the written elements need them
+			continue
+		}
+		attrName, err := w.qualify(r, scope, a.Name, false)
+		if err != nil {
+			return err
+		}
+		attrs.WriteString(" " + attrName + `="`)
+		xml.EscapeText(&attrs, []byte(a.Value))
+		attrs.WriteByte('"')
+	}
+
+	w.close()
+	w.buf.WriteString("<" + name)
+	prefixes := []string{}
+	for prefix := range scope {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		if prefix == "" {
+			w.buf.WriteString(` xmlns="`)
+		} else {
+			w.buf.WriteString(" xmlns:" + prefix + `="`)
+		}
+		xml.EscapeText(&w.buf, []byte(scope[prefix]))
+		w.buf.WriteByte('"')
+	}
+	w.buf.Write(attrs.Bytes())
+	w.names = append(w.names, name)
+	w.scopes = append(w.scopes, scope)
+	w.open = true
+	return nil
+}
+
+func (w *xhtmlWriter) end() {
+	name := w.names[len(w.names)-1]
+	w.names = w.names[:len(w.names)-1]
+	w.scopes = w.scopes[:len(w.scopes)-1]
+	if w.open {
+		// the element has no content
+		w.buf.WriteString("/>")
+		w.open = false
+		return
+	}
+	w.buf.WriteString("</" + name + ">")
+}
+
+// close ends the start tag of the last element before its content
+func (w *xhtmlWriter) close() {
+	if w.open {
+		w.buf.WriteByte('>')
+		w.open = false
+	}
+}
@@ -0,0 +1,694 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gobuffalo/packr/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// FHIRNamespace is the namespace of the elements of FHIR XML documents
+	FHIRNamespace = "http://hl7.org/fhir"
+	// XHTMLNamespace is the namespace of narratives
+	XHTMLNamespace = "http://www.w3.org/1999/xhtml"
+)
+
+// xmlKind is how the value of a property is represented in XML
+type xmlKind int
+
+const (
+	// primitives are elements with a value attribute, e.g. <active value="true"/>
+	xmlPrimitive xmlKind = iota
+	// complex types are elements whose properties are child elements
+	xmlComplex
+	// resources are wrapped in an element named after the property, e.g. <resource><Patient>...</Patient></resource>
+	xmlResource
+	// narratives are XHTML div elements, held as strings in JSON
+	xmlXHTML
+)
+
+// xmlProperty is a property of a FHIR type, as declared in the JSON schema
+type xmlProperty struct {
+	array bool
+	// definition is the type of complex values
+	definition string
+	// jsonType is the JSON type of primitive values: string, number or boolean
+	jsonType string
+	kind     xmlKind
+	name     string
+}
+
+// xmlDefinition lists the properties of a FHIR type in the order of their XML elements
+type xmlDefinition struct {
+	name       string
+	properties []*xmlProperty
+	byName     map[string]*xmlProperty
+}
+
+// schemaProperty is the part of a property of the JSON schema that describes its type
+type schemaProperty struct {
+	Const string          `json:"const"`
+	Items *schemaProperty `json:"items"`
+	Ref   string          `json:"$ref"`
+	Type  string          `json:"type"`
+}
+
+type schemaDefinition struct {
+	OneOf      []*schemaProperty `json:"oneOf"`
+	Properties json.RawMessage   `json:"properties"`
+	Type       string            `json:"type"`
+}
+
+// XMLCodec converts FHIR resources between their JSON and XML forms, following the element order of the FHIR JSON schema
+type XMLCodec struct {
+	definitions map[string]*xmlDefinition
+	resources   map[string]bool
+}
+
+// ToXML converts a JSON resource to FHIR XML
+func (c *XMLCodec) ToXML(doc []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	resource := map[string]interface{}{}
+	if err := dec.Decode(&resource); err != nil {
+		return nil, errors.Wrap(err, "unable to parse JSON resource")
+	}
+	w := &xmlWriter{}
+	if err := c.writeResource(w, resource, true); err != nil {
+		return nil, err
+	}
+	w.buf.WriteByte('\n')
+	return append([]byte(xml.Header), w.buf.Bytes()...), nil
+}
+
+// ToJSON converts a FHIR XML resource to JSON, e.g. to validate it against the JSON schema
+func (c *XMLCodec) ToJSON(doc []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(doc))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil, errors.New("no resource found in XML document")
+		} else if err != nil {
+			return nil, errors.Wrap(err, "unable to parse XML resource")
+		}
+		if start, ok := tok.(xml.StartElement); ok {
+			r := &xmlReader{dec: dec}
+			r.push(start)
+			resource, err := c.readResource(r, start)
+			if err != nil {
+				return nil, err
+			}
+			return json.Marshal(resource)
+		}
+	}
+}
+
+// Marshal encodes a resource of this package as FHIR XML
+func (c *XMLCodec) Marshal(resource interface{}) ([]byte, error) {
+	doc, err := json.Marshal(resource)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal resource")
+	}
+	return c.ToXML(doc)
+}
+
+// Unmarshal decodes a FHIR XML resource into a resource of this package
+func (c *XMLCodec) Unmarshal(doc []byte, resource interface{}) error {
+	jsonDoc, err := c.ToJSON(doc)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(json.Unmarshal(jsonDoc, resource), "unable to unmarshal resource")
+}
+
+func (c *XMLCodec) writeResource(w *xmlWriter, resource map[string]interface{}, root bool) error {
+	resourceType, _ := resource["resourceType"].(string)
+	def := c.definitions[resourceType]
+	if def == nil || !c.resources[resourceType] {
+		return errors.Errorf("unknown resource type %q", resourceType)
+	}
+	attrs := []xml.Attr{{Name: xml.Name{Local: "xmlns"}, Value: FHIRNamespace}}
+	if !root {
+		// contained resources inherit the namespace of the document
+		attrs = nil
+	}
+	return c.writeObject(w, resourceType, def, resource, attrs, true)
+}
+
+// writeObject writes a complex value as an element named name
+// the IDs of elements, unlike those of resources, and the URLs of extensions are attributes
+func (c *XMLCodec) writeObject(w *xmlWriter, name string, def *xmlDefinition, obj map[string]interface{}, attrs []xml.Attr, resource bool) error {
+	attributes := map[string]bool{}
+	if !resource {
+		attributes["id"] = true
+	}
+	if def.name == "Extension" {
+		attributes["url"] = true
+	}
+	for _, p := range def.properties {
+		if !attributes[p.name] {
+			continue
+		}
+		if v, ok := obj[p.name]; ok {
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: p.name}, Value: primitiveString(v)})
+		}
+	}
+	for key := range obj {
+		if key == "resourceType" || attributes[key] {
+			continue
+		}
+		if def.byName[strings.TrimPrefix(key, "_")] == nil {
+			return errors.Errorf("unknown element %q in %s", key, def.name)
+		}
+	}
+
+	w.start(name, attrs)
+	for _, p := range def.properties {
+		if attributes[p.name] {
+			continue
+		}
+		value, hasValue := obj[p.name]
+		ext, hasExt := obj["_"+p.name]
+		if !hasValue && !hasExt {
+			continue
+		}
+		values, exts := []interface{}{value}, []interface{}{ext}
+		if p.array {
+			values, _ = value.([]interface{})
+			exts, _ = ext.([]interface{})
+		}
+		for i := 0; i < len(values) || i < len(exts); i++ {
+			var v, e interface{}
+			if i < len(values) {
+				v = values[i]
+			}
+			if i < len(exts) {
+				e = exts[i]
+			}
+			if err := c.writeValue(w, p, v, e); err != nil {
+				return err
+			}
+		}
+	}
+	w.end(name)
+	return nil
+}
+
+func (c *XMLCodec) writeValue(w *xmlWriter, p *xmlProperty, value interface{}, ext interface{}) error {
+	switch p.kind {
+	case xmlPrimitive:
+		if value == nil && ext == nil {
+			return nil
+		}
+		attrs := []xml.Attr{}
+		extObj, _ := ext.(map[string]interface{})
+		if id, ok := extObj["id"]; ok {
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "id"}, Value: primitiveString(id)})
+		}
+		if value != nil {
+			attrs = append(attrs, xml.Attr{Name: xml.Name{Local: "value"}, Value: primitiveString(value)})
+		}
+		extensions, _ := extObj["extension"].([]interface{})
+		if len(extensions) == 0 {
+			w.empty(p.name, attrs)
+			return nil
+		}
+		w.start(p.name, attrs)
+		for _, e := range extensions {
+			obj, ok := e.(map[string]interface{})
+			if !ok {
+				return errors.Errorf("invalid extension of %q", p.name)
+			}
+			if err := c.writeObject(w, "extension", c.definitions["Extension"], obj, nil, false); err != nil {
+				return err
+			}
+		}
+		w.end(p.name)
+	case xmlXHTML:
+		div, ok := value.(string)
+		if !ok {
+			return errors.Errorf("invalid narrative in %q", p.name)
+		}
+		div, err := parseXHTML(div)
+		if err != nil {
+			return errors.Wrapf(err, "invalid narrative in %q", p.name)
+		}
+		w.raw(div)
+	case xmlResource:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("invalid resource in %q", p.name)
+		}
+		w.start(p.name, nil)
+		if err := c.writeResource(w, obj, false); err != nil {
+			return err
+		}
+		w.end(p.name)
+	case xmlComplex:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.Errorf("invalid value of %q", p.name)
+		}
+		return c.writeObject(w, p.name, c.definitions[p.definition], obj, nil, false)
+	}
+	return nil
+}
+
+// primitiveString formats a JSON primitive as the value attribute of an element
+func primitiveString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case bool:
+		return strconv.FormatBool(t)
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	}
+	return ""
+}
+
+// xmlWriter writes indented XML
+type xmlWriter struct {
+	buf   bytes.Buffer
+	depth int
+	// open is set while the start tag of the last element is not yet closed
+	open bool
+}
+
+func (w *xmlWriter) tag(name string, attrs []xml.Attr) {
+	if w.open {
+		w.buf.WriteByte('>')
+		w.open = false
+	}
+	if w.buf.Len() > 0 {
+		w.buf.WriteByte('\n')
+	}
+	w.buf.WriteString(strings.Repeat("  ", w.depth))
+	w.buf.WriteByte('<')
+	w.buf.WriteString(name)
+	for _, a := range attrs {
+		w.buf.WriteByte(' ')
+		w.buf.WriteString(a.Name.Local)
+		w.buf.WriteString(`="`)
+		xml.EscapeText(&w.buf, []byte(a.Value))
+		w.buf.WriteByte('"')
+	}
+}
+
+func (w *xmlWriter) start(name string, attrs []xml.Attr) {
+	w.tag(name, attrs)
+	w.open = true
+	w.depth++
+}
+
+func (w *xmlWriter) empty(name string, attrs []xml.Attr) {
+	w.tag(name, attrs)
+	w.buf.WriteString("/>")
+}
+
+func (w *xmlWriter) end(name string) {
+	w.depth--
+	if w.open {
+		// the element has no children
+		w.buf.WriteString("/>")
+		w.open = false
+		return
+	}
+	w.buf.WriteByte('\n')
+	w.buf.WriteString(strings.Repeat("  ", w.depth))
+	w.buf.WriteString("</" + name + ">")
+}
+
+func (w *xmlWriter) raw(s string) {
+	if w.open {
+		w.buf.WriteByte('>')
+		w.open = false
+	}
+	w.buf.WriteByte('\n')
+	w.buf.WriteString(strings.Repeat("  ", w.depth))
+	w.buf.WriteString(s)
+}
+
+// xmlReader reads the tokens of a document, tracking the namespace prefixes declared by the open elements, which the
+// decoder resolves but does not report, so that narratives can be written out with the prefixes they use
+type xmlReader struct {
+	dec *xml.Decoder
+	// scopes holds the prefixes declared on each open element, by namespace
+	scopes []map[string]string
+}
+
+func (r *xmlReader) token() (xml.Token, error) {
+	tok, err := r.dec.Token()
+	if err == io.EOF {
+		return nil, errors.New("unexpected end of XML document")
+	} else if err != nil {
+		return nil, errors.Wrap(err, "unable to parse XML resource")
+	}
+	switch t := tok.(type) {
+	case xml.StartElement:
+		r.push(t)
+	case xml.EndElement:
+		r.scopes = r.scopes[:len(r.scopes)-1]
+	}
+	return tok, nil
+}
+
+// push opens the scope of an element read from the decoder
+func (r *xmlReader) push(start xml.StartElement) {
+	scope := map[string]string{}
+	for _, a := range start.Attr {
+		switch {
+		case a.Name.Space == "xmlns":
+			scope[a.Value] = a.Name.Local
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			scope[a.Value] = ""
+		}
+	}
+	r.scopes = append(r.scopes, scope)
+}
+
+// prefix returns the prefix of a namespace in the innermost scope declaring it, "" for the default namespace
+func (r *xmlReader) prefix(space string) (string, bool) {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if prefix, ok := r.scopes[i][space]; ok {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// next returns the next child element, or nil at the end of the current element
+// only whitespace and comments may appear between the elements of FHIR resources
+func (r *xmlReader) next() (*xml.StartElement, error) {
+	for {
+		tok, err := r.token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			return &t, nil
+		case xml.EndElement:
+			return nil, nil
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.Errorf("unexpected text %q", string(bytes.TrimSpace(t)))
+			}
+		}
+	}
+}
+
+func (c *XMLCodec) readResource(r *xmlReader, start xml.StartElement) (map[string]interface{}, error) {
+	if start.Name.Space != FHIRNamespace {
+		return nil, errors.Errorf("element %q is not in the FHIR namespace", start.Name.Local)
+	}
+	def := c.definitions[start.Name.Local]
+	if def == nil || !c.resources[start.Name.Local] {
+		return nil, errors.Errorf("unknown resource type %q", start.Name.Local)
+	}
+	obj, err := c.readObject(r, start, def, true)
+	if err != nil {
+		return nil, err
+	}
+	obj["resourceType"] = start.Name.Local
+	return obj, nil
+}
+
+func (c *XMLCodec) readObject(r *xmlReader, start xml.StartElement, def *xmlDefinition, resource bool) (map[string]interface{}, error) {
+	obj := map[string]interface{}{}
+	for _, a := range start.Attr {
+		switch {
+		case a.Name.Space == "xmlns" || a.Name.Local == "xmlns":
+		case a.Name.Local == "id" && !resource, a.Name.Local == "url" && def.name == "Extension":
+			obj[a.Name.Local] = a.Value
+		default:
+			return nil, errors.Errorf("unexpected attribute %q of %s", a.Name.Local, start.Name.Local)
+		}
+	}
+
+	for {
+		child, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if child == nil {
+			break
+		}
+		p := def.byName[child.Name.Local]
+		if p == nil || (p.kind != xmlXHTML && child.Name.Space != FHIRNamespace) {
+			return nil, errors.Errorf("unknown element %q in %s", child.Name.Local, def.name)
+		}
+		if err := c.readValue(r, *child, p, obj); err != nil {
+			return nil, err
+		}
+	}
+
+	// the values and extensions of primitive arrays are aligned with nulls, which are dropped when there are none of one kind
+	for _, p := range def.properties {
+		if p.kind != xmlPrimitive || !p.array {
+			continue
+		}
+		for _, key := range []string{p.name, "_" + p.name} {
+			if list, ok := obj[key].([]interface{}); ok && allNil(list) {
+				delete(obj, key)
+			}
+		}
+	}
+	return obj, nil
+}
+
+func (c *XMLCodec) readValue(r *xmlReader, start xml.StartElement, p *xmlProperty, obj map[string]interface{}) error {
+	var value interface{}
+	switch p.kind {
+	case xmlPrimitive:
+		var ext map[string]interface{}
+		for _, a := range start.Attr {
+			switch a.Name.Local {
+			case "value":
+				v, err := parsePrimitive(p, a.Value)
+				if err != nil {
+					return err
+				}
+				value = v
+			case "id":
+				ext = map[string]interface{}{"id": a.Value}
+			}
+		}
+		extensions := []interface{}{}
+		for {
+			child, err := r.next()
+			if err != nil {
+				return err
+			}
+			if child == nil {
+				break
+			}
+			if child.Name.Local != "extension" {
+				return errors.Errorf("unexpected element %q in %s", child.Name.Local, p.name)
+			}
+			e, err := c.readObject(r, *child, c.definitions["Extension"], false)
+			if err != nil {
+				return err
+			}
+			extensions = append(extensions, e)
+		}
+		if len(extensions) > 0 {
+			if ext == nil {
+				ext = map[string]interface{}{}
+			}
+			ext["extension"] = extensions
+		}
+		if p.array {
+			values, _ := obj[p.name].([]interface{})
+			exts, _ := obj["_"+p.name].([]interface{})
+			var e interface{}
+			if ext != nil {
+				e = ext
+			}
+			obj[p.name] = append(values, value)
+			obj["_"+p.name] = append(exts, e)
+			return nil
+		}
+		if value != nil {
+			obj[p.name] = value
+		}
+		if ext != nil {
+			obj["_"+p.name] = ext
+		}
+		return nil
+	case xmlXHTML:
+		div, err := readXHTML(r, start)
+		if err != nil {
+			return errors.Wrapf(err, "invalid narrative in %s", p.name)
+		}
+		value = div
+	case xmlResource:
+		child, err := r.next()
+		if err != nil {
+			return err
+		}
+		if child == nil {
+			return errors.Errorf("no resource found in %s", p.name)
+		}
+		resource, err := c.readResource(r, *child)
+		if err != nil {
+			return err
+		}
+		if extra, err := r.next(); err != nil {
+			return err
+		} else if extra != nil {
+			return errors.Errorf("%s holds more than one resource", p.name)
+		}
+		value = resource
+	case xmlComplex:
+		v, err := c.readObject(r, start, c.definitions[p.definition], false)
+		if err != nil {
+			return err
+		}
+		value = v
+	}
+
+	if p.array {
+		values, _ := obj[p.name].([]interface{})
+		obj[p.name] = append(values, value)
+		return nil
+	}
+	if _, ok := obj[p.name]; ok {
+		return errors.Errorf("%s appears more than once", p.name)
+	}
+	obj[p.name] = value
+	return nil
+}
+
+// parsePrimitive converts the value attribute of an element to the JSON type of its property
+func parsePrimitive(p *xmlProperty, value string) (interface{}, error) {
+	switch p.jsonType {
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil || (value != "true" && value != "false") {
+			return nil, errors.Errorf("invalid boolean %q of %s", value, p.name)
+		}
+		return b, nil
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return nil, errors.Errorf("invalid number %q of %s", value, p.name)
+		}
+		// the decimal is kept as written, to preserve its precision
+		return json.Number(value), nil
+	}
+	return value, nil
+}
+
+func allNil(list []interface{}) bool {
+	for _, v := range list {
+		if v != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// NewXMLCodec reads the FHIR types from the JSON schema
+func NewXMLCodec(box *packr.Box) (*XMLCodec, error) {
+	data, err := box.Find("fhir.schema.json")
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read schema")
+	}
+	schema := struct {
+		Definitions map[string]*schemaDefinition `json:"definitions"`
+	}{}
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, errors.Wrap(err, "could not parse schema")
+	}
+
+	c := &XMLCodec{
+		definitions: map[string]*xmlDefinition{},
+		resources:   map[string]bool{},
+	}
+	if list := schema.Definitions["ResourceList"]; list != nil {
+		for _, ref := range list.OneOf {
+			c.resources[refName(ref.Ref)] = true
+		}
+	}
+	names := []string{}
+	for name := range schema.Definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		d := schema.Definitions[name]
+		if len(d.Properties) == 0 {
+			continue
+		}
+		def := &xmlDefinition{name: name, byName: map[string]*xmlProperty{}}
+		// the properties are decoded one by one, since the order of the elements matters in XML
+		dec := json.NewDecoder(bytes.NewReader(d.Properties))
+		if _, err := dec.Token(); err != nil {
+			return nil, errors.Wrapf(err, "could not parse properties of %s", name)
+		}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not parse properties of %s", name)
+			}
+			propName, _ := tok.(string)
+			sp := &schemaProperty{}
+			if err := dec.Decode(sp); err != nil {
+				return nil, errors.Wrapf(err, "could not parse property %s of %s", propName, name)
+			}
+			if strings.HasPrefix(propName, "_") || sp.Const != "" {
+				// extensions of primitives are written with their values, and the resource type is the name of the element
+				continue
+			}
+			p := newXMLProperty(propName, sp, schema.Definitions)
+			def.properties = append(def.properties, p)
+			def.byName[propName] = p
+		}
+		c.definitions[name] = def
+	}
+	if c.definitions["Extension"] == nil {
+		return nil, errors.New("no Extension type found in schema")
+	}
+	return c, nil
+}
+
+func newXMLProperty(name string, sp *schemaProperty, definitions map[string]*schemaDefinition) *xmlProperty {
+	p := &xmlProperty{name: name, kind: xmlPrimitive, jsonType: "string"}
+	if sp.Items != nil {
+		p.array = true
+		sp = sp.Items
+	}
+	if sp.Ref == "" {
+		if sp.Type != "" {
+			p.jsonType = sp.Type
+		}
+		return p
+	}
+	ref := refName(sp.Ref)
+	d := definitions[ref]
+	switch {
+	case ref == "xhtml":
+		p.kind = xmlXHTML
+	case ref == "ResourceList":
+		p.kind = xmlResource
+	case d != nil && len(d.Properties) > 0:
+		p.kind = xmlComplex
+		p.definition = ref
+	case d != nil && d.Type != "":
+		p.jsonType = d.Type
+	}
+	return p
+}
+
+func refName(ref string) string {
+	return strings.TrimPrefix(ref, "#/definitions/")
+}
@@ -0,0 +1,224 @@
+package models_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SynapticHealthAlliance/fhir-api/internal/pkg/static"
+	"github.com/SynapticHealthAlliance/fhir-api/pkg/models"
+)
+
+const locationXML = `<?xml version="1.0" encoding="UTF-8"?>
+<Location xmlns="http://hl7.org/fhir">
+  <id value="1"/>
+  <text>
+    <status value="generated"/>
+    <div xmlns="http://www.w3.org/1999/xhtml"><p>Burgers <b>University</b> &amp; Medical Center</p></div>
+  </text>
+  <contained>
+    <Organization>
+      <id value="org"/>
+      <name value="Burgers"/>
+    </Organization>
+  </contained>
+  <extension url="http://example.org/fhir/StructureDefinition/accessible">
+    <valueBoolean value="true"/>
+  </extension>
+  <!-- comments are ignored -->
+  <identifier>
+    <value value="B1-S.F2"/>
+  </identifier>
+  <status value="active"/>
+  <name id="n1" value="South Wing">
+    <extension url="http://example.org/fhir/StructureDefinition/translation">
+      <valueString value="Südflügel"/>
+    </extension>
+  </name>
+  <alias value="SW"/>
+  <position>
+    <longitude value="-83.6945691"/>
+    <latitude value="42.25475478"/>
+  </position>
+  <managingOrganization>
+    <reference value="#org"/>
+  </managingOrganization>
+</Location>
+`
+
+func newXMLCodec(t *testing.T) *models.XMLCodec {
+	c, err := models.NewXMLCodec(static.NewStaticFilesBox())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func decodeJSON(t *testing.T, doc []byte) map[string]interface{} {
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	m := map[string]interface{}{}
+	if err := dec.Decode(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+	c := newXMLCodec(t)
+	doc, err := ioutil.ReadFile("../../fixures/practitioner.example.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := c.ToXML(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(x)
+	if !strings.Contains(s, `<Practitioner xmlns="http://hl7.org/fhir">`) || !strings.Contains(s, `<active value="true"/>`) {
+		t.Fatalf("expected a FHIR XML Practitioner, got %s", s)
+	}
+	if strings.Index(s, "<identifier>") > strings.Index(s, "<active") || strings.Index(s, "<active") > strings.Index(s, "<name>") {
+		t.Errorf("expected the elements in the order of the FHIR definition, got %s", s)
+	}
+	back, err := c.ToJSON(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, got := decodeJSON(t, doc), decodeJSON(t, back); !reflect.DeepEqual(expected, got) {
+		t.Errorf("expected %v after a round trip, got %v", expected, got)
+	}
+}
+
+func TestXMLToJSON(t *testing.T) {
+	c := newXMLCodec(t)
+	doc, err := c.ToJSON([]byte(locationXML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := models.NewJSONValidator(static.NewStaticFilesBox(), "Location")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, vErrs, err := v.Validate(doc); err != nil || !valid {
+		t.Fatalf("expected the converted resource to be valid, got %v %v: %s", vErrs, err, doc)
+	}
+
+	location := &models.Location{}
+	if err := c.Unmarshal([]byte(locationXML), location); err != nil {
+		t.Fatal(err)
+	}
+	if location.Name != "South Wing" || location.Position.Latitude != 42.25475478 || len(location.Contained) != 1 {
+		t.Errorf("unexpected location %+v", location)
+	}
+	m := decodeJSON(t, doc)
+	if div := m["text"].(map[string]interface{})["div"]; div != `<div xmlns="http://www.w3.org/1999/xhtml"><p>Burgers <b>University</b> &amp; Medical Center</p></div>` {
+		t.Errorf("expected the narrative to be kept as is, got %v", div)
+	}
+	if ext := m["_name"].(map[string]interface{}); ext["id"] != "n1" || len(ext["extension"].([]interface{})) != 1 {
+		t.Errorf("expected the extension of name, got %v", ext)
+	}
+	if lat := m["position"].(map[string]interface{})["latitude"]; lat != json.Number("42.25475478") {
+		t.Errorf("expected the latitude as written, got %v", lat)
+	}
+
+	x, err := c.ToXML(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := c.ToJSON(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, decodeJSON(t, back)) {
+		t.Errorf("expected the same resource after a round trip, got %s", x)
+	}
+
+	// the values of repeated primitives are aligned with their extensions
+	doc, err = c.ToJSON([]byte(`<Location xmlns="http://hl7.org/fhir"><alias value="SW"/><alias id="a2"/></Location>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m = decodeJSON(t, doc)
+	if aliases, exts := m["alias"].([]interface{}), m["_alias"].([]interface{}); len(aliases) != 2 || aliases[1] != nil || exts[0] != nil {
+		t.Errorf("expected the aliases to be aligned with their extensions, got %v and %v", aliases, exts)
+	}
+}
+
+func TestXMLErrors(t *testing.T) {
+	c := newXMLCodec(t)
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"unknown resource", `<Unknown xmlns="http://hl7.org/fhir"/>`},
+		{"missing namespace", `<Location><status value="active"/></Location>`},
+		{"unknown element", `<Location xmlns="http://hl7.org/fhir"><colour value="red"/></Location>`},
+		{"invalid boolean", `<Practitioner xmlns="http://hl7.org/fhir"><active value="yes"/></Practitioner>`},
+		{"text content", `<Location xmlns="http://hl7.org/fhir"><status>active</status></Location>`},
+		{"malformed", `<Location xmlns="http://hl7.org/fhir"><status value="active"></Location>`},
+	}
+	for _, test := range tests {
+		if _, err := c.ToJSON([]byte(test.doc)); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+	if _, err := c.ToXML([]byte(`{"resourceType":"Location","colour":"red"}`)); err == nil {
+		t.Error("expected an error for an unknown property")
+	}
+}
+
+func TestXMLNarrative(t *testing.T) {
+	c := newXMLCodec(t)
+	narrative := func(doc []byte) string {
+		return decodeJSON(t, doc)["text"].(map[string]interface{})["div"].(string)
+	}
+
+	// the prefixes declared on the ancestors of the div are declared on the elements using them
+	doc, err := c.ToJSON([]byte(`<Location xmlns="http://hl7.org/fhir" xmlns:h="http://www.w3.org/1999/xhtml" xmlns:xl="http://www.w3.org/1999/xlink">
+  <text><status value="generated"/><h:div><h:p>South <h:a xl:href="#wing">Wing</h:a><h:br/></h:p></h:div></text>
+</Location>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<div xmlns="http://www.w3.org/1999/xhtml"><p>South <a xmlns:xl="http://www.w3.org/1999/xlink" xl:href="#wing">Wing</a><br/></p></div>`
+	if div := narrative(doc); div != expected {
+		t.Errorf("expected the narrative %s, got %s", expected, div)
+	}
+
+	// the namespace may be left out of JSON narratives
+	x, err := c.ToXML([]byte(`{"resourceType":"Location","text":{"status":"generated","div":"<div>South &amp; <b>North</b></div>"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(x), `<div xmlns="http://www.w3.org/1999/xhtml">South &amp; <b>North</b></div>`) {
+		t.Errorf("expected the narrative in the XHTML namespace, got %s", x)
+	}
+
+	tests := []struct {
+		name string
+		div  string
+	}{
+		{"malformed", `<div xmlns="http://www.w3.org/1999/xhtml"><p>South</div>`},
+		{"not a div", `<p xmlns="http://www.w3.org/1999/xhtml">South</p>`},
+		{"not XHTML", `<div xmlns="http://example.org">South</div>`},
+		{"two divs", `<div xmlns="http://www.w3.org/1999/xhtml">South</div><div xmlns="http://www.w3.org/1999/xhtml">North</div>`},
+		{"text outside", `<div xmlns="http://www.w3.org/1999/xhtml">South</div> Wing`},
+		{"undeclared prefix", `<div xmlns="http://www.w3.org/1999/xhtml"><a xl:href="#wing">Wing</a></div>`},
+	}
+	for _, test := range tests {
+		resource, _ := json.Marshal(map[string]interface{}{
+			"resourceType": "Location",
+			"text":         map[string]interface{}{"status": "generated", "div": test.div},
+		})
+		if _, err := c.ToXML(resource); err == nil {
+			t.Errorf("%s: expected an error converting to XML", test.name)
+		}
+		if _, err := c.ToJSON([]byte(`<Location xmlns="http://hl7.org/fhir"><text><status value="generated"/>` + test.div + `</text></Location>`)); err == nil {
+			t.Errorf("%s: expected an error converting to JSON", test.name)
+		}
+	}
+}